@@ -0,0 +1,251 @@
+// Package main has a command-line tool that measures how many of the correlated pairs
+// an approximate algorithm finds. It runs the approximate algorithm and ALGO_FULL_PEARSON
+// on the same input and writes one json object per stride, followed by a summary.
+// The input format is the same as for main/process_data_from_file.go.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib"
+	"github.com/kpaschen/corrjoin/lib/comparisons"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"time"
+)
+
+// A run is a window with its own comparer for one of the algorithms.
+type run struct {
+	window  *lib.TimeseriesWindow
+	engine  *comparisons.CountingEngine
+	results chan *datatypes.CorrjoinResult
+}
+
+func newRun(config settings.CorrjoinSettings) *run {
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	comparer := &comparisons.InProcessComparer{}
+	comparer.Initialize(config, results)
+	engine := &comparisons.CountingEngine{Engine: comparer}
+	return &run{
+		window:  lib.NewTimeseriesWindow(config, engine),
+		engine:  engine,
+		results: results,
+	}
+}
+
+type strideResult struct {
+	pairs       map[datatypes.RowPair]float64
+	comparisons int
+	duration    time.Duration
+}
+
+// shift shifts data into the window and waits for the results of the stride.
+// It returns nil if the window is not full yet.
+func (r *run) shift(data [][]float64, timeout time.Duration) (*strideResult, error) {
+	start := time.Now()
+	err, computing := r.window.ShiftBuffer(data)
+	if err != nil {
+		return nil, err
+	}
+	if !computing {
+		return nil, nil
+	}
+	ret := &strideResult{pairs: make(map[datatypes.RowPair]float64)}
+	deadline := time.After(timeout)
+	for {
+		select {
+		case result := <-r.results:
+			if result.StrideCounter != r.window.StrideCounter {
+				continue
+			}
+			// An empty result is the last one for a stride.
+			if len(result.CorrelatedPairs) == 0 {
+				ret.duration = time.Since(start)
+				ret.comparisons = r.engine.Compared
+				return ret, nil
+			}
+			for pair, pearson := range result.CorrelatedPairs {
+				ret.pairs[pair] = pearson
+			}
+		case <-deadline:
+			return nil, fmt.Errorf("stride %d did not finish within %v", r.window.StrideCounter, timeout)
+		}
+	}
+}
+
+// An Evaluation is written as one line of json per stride.
+type Evaluation struct {
+	Stride    int    `json:"stride"`
+	Summary   bool   `json:"summary,omitempty"`
+	Algorithm string `json:"algorithm"`
+	Rows      int    `json:"rows"`
+
+	// The pairs found by full pearson.
+	CorrelatedPairs int `json:"correlatedPairs"`
+	// The pairs found by the approximate algorithm.
+	FoundPairs int `json:"foundPairs"`
+	// The pairs found by both.
+	TruePositives int `json:"truePositives"`
+
+	Recall float64 `json:"recall"`
+	// The approximate algorithms compute the pearson correlation of their candidates,
+	// so this is only below 1 when they report pairs that full pearson does not.
+	// Comparisons says how many candidates they needed.
+	Precision float64 `json:"precision"`
+
+	Comparisons     int     `json:"comparisons"`
+	FullComparisons int     `json:"fullComparisons"`
+	Seconds         float64 `json:"seconds"`
+	FullSeconds     float64 `json:"fullSeconds"`
+}
+
+func (e *Evaluation) computeRates() {
+	e.Recall = 1.0
+	if e.CorrelatedPairs > 0 {
+		e.Recall = float64(e.TruePositives) / float64(e.CorrelatedPairs)
+	}
+	e.Precision = 1.0
+	if e.FoundPairs > 0 {
+		e.Precision = float64(e.TruePositives) / float64(e.FoundPairs)
+	}
+}
+
+func (e *Evaluation) add(other *Evaluation) {
+	e.CorrelatedPairs += other.CorrelatedPairs
+	e.FoundPairs += other.FoundPairs
+	e.TruePositives += other.TruePositives
+	e.Comparisons += other.Comparisons
+	e.FullComparisons += other.FullComparisons
+	e.Seconds += other.Seconds
+	e.FullSeconds += other.FullSeconds
+}
+
+func evaluate(stride int, rows int, algorithm string, approximate *strideResult, full *strideResult) *Evaluation {
+	ret := &Evaluation{
+		Stride:          stride,
+		Algorithm:       algorithm,
+		Rows:            rows,
+		CorrelatedPairs: len(full.pairs),
+		FoundPairs:      len(approximate.pairs),
+		Comparisons:     approximate.comparisons,
+		FullComparisons: full.comparisons,
+		Seconds:         approximate.duration.Seconds(),
+		FullSeconds:     full.duration.Seconds(),
+	}
+	for pair := range approximate.pairs {
+		if _, found := full.pairs[pair]; found {
+			ret.TruePositives++
+		}
+	}
+	ret.computeRates()
+	return ret
+}
+
+// evaluateInput runs the approximate algorithm of config and full pearson on the strides
+// read from input. It encodes the evaluation of every stride and then the summary, and
+// returns the summary.
+func evaluateInput(input io.Reader, config settings.CorrjoinSettings, strideTimeout time.Duration,
+	encoder *json.Encoder) (*Evaluation, error) {
+	fullConfig := config
+	fullConfig.Algorithm = settings.ALGO_FULL_PEARSON
+	approximate := newRun(config)
+	full := newRun(fullConfig)
+	summary := &Evaluation{Summary: true, Algorithm: config.Algorithm}
+
+	err := lib.ReadStrides(input, config.StrideLength, func(data [][]float64) error {
+		approximateResult, err := approximate.shift(data, strideTimeout)
+		if err != nil {
+			return err
+		}
+		// The windows keep the rows they are given, so they must not share them.
+		fullData := make([][]float64, len(data))
+		for i, row := range data {
+			fullData[i] = slices.Clone(row)
+		}
+		fullResult, err := full.shift(fullData, strideTimeout)
+		if err != nil {
+			return err
+		}
+		if approximateResult == nil || fullResult == nil {
+			return nil
+		}
+		evaluation := evaluate(approximate.window.StrideCounter, len(data), config.Algorithm,
+			approximateResult, fullResult)
+		summary.Stride = evaluation.Stride
+		summary.Rows = evaluation.Rows
+		summary.add(evaluation)
+		return encoder.Encode(evaluation)
+	})
+	if err != nil {
+		return nil, err
+	}
+	summary.computeRates()
+	return summary, encoder.Encode(summary)
+}
+
+func main() {
+	filename := flag.String("filename", "", "Name of the file to read")
+	output := flag.String("output", "", "Name of the file to write the json results to. Defaults to stdout")
+	windowSize := flag.Int("windowSize", 1020, "column count of a time series window")
+	stride := flag.Int("stride", 102, "how much to slide the time series window by")
+	correlationThreshold := flag.Int("correlationThreshold", 90, "correlation threshold in percent")
+	algorithm := flag.String("algorithm", settings.ALGO_PAA_SVD, "The algorithm to evaluate. Possible values: paa_only, paa_svd, lsh")
+	ks := flag.Int("ks", 15, "How many columns to reduce the input to in the first paa step")
+	ke := flag.Int("ke", 30, "How many columns to reduce the input to in the second paa step")
+	svdDimensions := flag.Int("svdOutput", 3, "How many columns to choose after svd") // aka kb
+	maxRowsForSvd := flag.Int("maxRowsForSvd", 10000, "The maximum number of rows to use for the full svd")
+	svdStrategy := flag.String("svdStrategy", settings.SVD_FULL, "How to compute the SVD. Possible values: full, randomized, incremental")
+	lshTables := flag.Int("lshTables", 16, "The number of hash tables for the lsh algorithm")
+	lshBits := flag.Int("lshBits", 10, "The number of bits per hash for the lsh algorithm")
+	correlationMeasure := flag.String("correlationMeasure", settings.MEASURE_PEARSON, "The correlation measure. Possible values: pearson, spearman")
+	preprocessing := flag.String("preprocessing", settings.PREPROCESS_NONE, "How to transform timeseries before correlating them. Possible values: none, difference, detrend, moving_average")
+	movingAverageWindow := flag.Int("movingAverageWindow", 30, "The number of samples in the moving average for the moving_average preprocessing")
+	seasonalPeriod := flag.Int("seasonalPeriod", 0, "The length of the cycle to remove from the timeseries, in samples. 0 disables this")
+	negativeCorrelations := flag.Bool("negativeCorrelations", false, "Whether to also look for negative correlations")
+	strideTimeout := flag.Duration("strideTimeout", 30*time.Minute, "How long to wait for the results of a stride")
+	flag.Parse()
+
+	input, err := os.Open(*filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer input.Close()
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+	encoder := json.NewEncoder(out)
+
+	config := settings.CorrjoinSettings{
+		SvdOutputDimensions:  *svdDimensions,
+		SvdDimensions:        *ks,
+		EuclidDimensions:     *ke,
+		CorrelationThreshold: float64(*correlationThreshold) / 100.0,
+		WindowSize:           *windowSize,
+		StrideLength:         *stride,
+		MaxRowsForSvd:        *maxRowsForSvd,
+		SvdStrategy:          *svdStrategy,
+		LshTables:            *lshTables,
+		LshBits:              *lshBits,
+		NegativeCorrelations: *negativeCorrelations,
+		CorrelationMeasure:   *correlationMeasure,
+		Preprocessing:        *preprocessing,
+		MovingAverageWindow:  *movingAverageWindow,
+		SeasonalPeriod:       *seasonalPeriod,
+		Algorithm:            *algorithm,
+	}.ComputeSettingsFields()
+	log.Printf("config is %+v\n", config)
+
+	if _, err = evaluateInput(input, config, *strideTimeout, encoder); err != nil {
+		log.Fatal(err)
+	}
+}
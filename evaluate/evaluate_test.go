@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"github.com/kpaschen/corrjoin/lib/utils"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// randomWalks returns lines of space-separated values for groups of noisy copies of
+// random walks, one line per point in time.
+func randomWalks(groups int, copies int, length int) string {
+	rows := utils.RandomWalks(rand.New(rand.NewSource(3)), groups, copies, length)
+	var b strings.Builder
+	for j := 0; j < length; j++ {
+		values := make([]string, len(rows))
+		for i, row := range rows {
+			values[i] = fmt.Sprintf("%f", row[j])
+		}
+		b.WriteString(strings.Join(values, " ") + "\n")
+	}
+	return b.String()
+}
+
+func TestEvaluateFullPearson(t *testing.T) {
+	config := settings.CorrjoinSettings{
+		Algorithm:            settings.ALGO_FULL_PEARSON,
+		WindowSize:           60,
+		StrideLength:         20,
+		SvdDimensions:        10,
+		EuclidDimensions:     20,
+		SvdOutputDimensions:  3,
+		CorrelationThreshold: 0.9,
+	}.ComputeSettingsFields()
+	var out bytes.Buffer
+	summary, err := evaluateInput(strings.NewReader(randomWalks(5, 4, 100)), config, time.Minute,
+		json.NewEncoder(&out))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// The window is full after three strides, so there are evaluations for three strides.
+	decoder := json.NewDecoder(&out)
+	strides := 0
+	for decoder.More() {
+		var e Evaluation
+		if err = decoder.Decode(&e); err != nil {
+			t.Fatalf("failed to decode evaluation: %v", err)
+		}
+		if e.Recall != 1.0 || e.Precision != 1.0 || e.Rows != 20 {
+			t.Errorf("expected full pearson to find all pairs of 20 rows but got %+v", e)
+		}
+		if !e.Summary {
+			strides++
+		}
+	}
+	if strides != 3 {
+		t.Errorf("expected three evaluated strides but got %d", strides)
+	}
+	if !summary.Summary || summary.Recall != 1.0 || summary.CorrelatedPairs == 0 ||
+		summary.TruePositives != summary.CorrelatedPairs {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	// Four copies of five walks have 5*6 correlated pairs per stride.
+	if summary.CorrelatedPairs < 3*30 {
+		t.Errorf("expected at least the pairs within the groups to be correlated but got %d",
+			summary.CorrelatedPairs)
+	}
+}
@@ -2,8 +2,10 @@ package explorer
 
 import (
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	explorerlib "github.com/kpaschen/corrjoin/lib/explorer"
+	"github.com/kpaschen/corrjoin/lib/reporter"
 	"io"
 	"log"
 	"os"
@@ -66,6 +68,7 @@ func (c *CorrelationExplorer) scanResultFiles() error {
 			strideParsedFromFilename, err = parseStrideFromFilename(e.Name())
 			if err != nil {
 				// This is not a stride file.
+				c.expireChangeFile(e)
 				continue
 			}
 		} else {
@@ -247,6 +250,49 @@ func directoryNameForStride(stride Stride) string {
 	return fmt.Sprintf("stride_%d_%d", stride.ID, stride.StartTime)
 }
 
+func changeFilenameForStride(stride Stride) string {
+	return reporter.ChangeFilename(stride.ID, time.Unix(stride.StartTime, 0), time.Unix(stride.EndTime, 0))
+}
+
+// expireChangeFile removes e if it is a change file that is older than maxAgeSeconds.
+// Change files are not strides, so they have to be aged out separately.
+func (c *CorrelationExplorer) expireChangeFile(e os.DirEntry) {
+	if c.maxAgeSeconds <= 0 || !strings.HasPrefix(e.Name(), "changes_") {
+		return
+	}
+	t, err := e.Info()
+	if err != nil {
+		return
+	}
+	age := int(time.Now().UTC().Unix() - t.ModTime().UTC().Unix())
+	if age <= c.maxAgeSeconds {
+		return
+	}
+	fullPath := filepath.Join(c.FilenameBase, e.Name())
+	log.Printf("change file %s should be deleted\n", fullPath)
+	if err = os.Remove(fullPath); err != nil {
+		log.Printf("failed to remove %s: %v\n", fullPath, err)
+	}
+}
+
+// readChanges reads the correlation changes between the previous stride and stride.
+// It returns nil if the receiver did not write a change file for stride.
+func (c *CorrelationExplorer) readChanges(stride *Stride) (*reporter.ChangeReport, error) {
+	file, err := os.Open(filepath.Join(c.FilenameBase, changeFilenameForStride(*stride)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var report reporter.ChangeReport
+	if err = json.NewDecoder(file).Decode(&report); err != nil {
+		return nil, fmt.Errorf("failed to parse change file for stride %d: %v", stride.ID, err)
+	}
+	return &report, nil
+}
+
 func parseStrideFromDirname(dirname string) (*Stride, error) {
 	var strideCounter int
 	var startTime int
@@ -290,12 +336,27 @@ func parseStrideFromFilename(filename string) (*Stride, error) {
 
 func (c *CorrelationExplorer) retrieveCorrelatedTimeseries(stride *Stride, tsRowId uint64,
 	onlyConsider []uint64, maxResults int) (map[uint64]float32, error) {
+	edges, err := c.retrieveCorrelatedEdges(stride, tsRowId, onlyConsider, maxResults)
+	if edges == nil {
+		return nil, err
+	}
+	ret := make(map[uint64]float32)
+	for otherRowId, e := range edges {
+		ret[otherRowId] = e.Pearson
+	}
+	return ret, err
+}
+
+// retrieveCorrelatedEdges returns the edges between tsRowId and its correlates, keyed by
+// the id of the correlated timeseries. The edges are oriented so that tsRowId is the Source.
+func (c *CorrelationExplorer) retrieveCorrelatedEdges(stride *Stride, tsRowId uint64,
+	onlyConsider []uint64, maxResults int) (map[uint64]explorerlib.Edge, error) {
 
 	if stride == nil || stride.subgraphs == nil {
 		return nil, fmt.Errorf("stride has no subgraphs")
 	}
 
-	ret := make(map[uint64]float32)
+	ret := make(map[uint64]explorerlib.Edge)
 
 	metric, exists := stride.metricsCache[tsRowId]
 	if !exists {
@@ -319,12 +380,14 @@ func (c *CorrelationExplorer) retrieveCorrelatedTimeseries(stride *Stride, tsRow
 
 	ctr := 0
 	for _, e := range edges {
-		if e.Pearson > 0 && (e.Source == tsRowId || e.Target == tsRowId) {
+		if e.Pearson != 0 && (e.Source == tsRowId || e.Target == tsRowId) {
 			var otherRowId uint64
 			if e.Source == tsRowId {
 				otherRowId = e.Target
 			} else {
 				otherRowId = e.Source
+				e.Source, e.Target = e.Target, e.Source
+				e.Lag = -e.Lag
 			}
 			if len(onlyConsider) > 0 {
 				found := false
@@ -338,7 +401,7 @@ func (c *CorrelationExplorer) retrieveCorrelatedTimeseries(stride *Stride, tsRow
 					continue
 				}
 			}
-			ret[otherRowId] = e.Pearson
+			ret[otherRowId] = e
 			ctr++
 			if maxResults > 0 && ctr >= maxResults {
 				break
@@ -361,6 +424,7 @@ func (c *CorrelationExplorer) retrieveEdges(stride *Stride, graphId int, maxNode
 
 	reader := csv.NewReader(edgeFile)
 	reader.ReuseRecord = true
+	reader.FieldsPerRecord = -1
 	var results []explorerlib.Edge
 	// Read the header line
 	_, err = reader.Read()
@@ -395,12 +459,43 @@ func (c *CorrelationExplorer) retrieveEdges(stride *Stride, graphId int, maxNode
 		if err != nil {
 			return nil, err
 		}
+		// Edge files written before lags were supported only have three columns.
+		var lag int64
+		if len(row) > 3 {
+			lag, err = strconv.ParseInt(row[3], 10, 32)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-		results = append(results, explorerlib.Edge{
+		// The measure column was added after the lag column.
+		var measure string
+		if len(row) > 4 {
+			measure = row[4]
+		}
+
+		edge := explorerlib.Edge{
 			Source:  uint64(source),
 			Target:  uint64(target),
 			Pearson: float32(pearson),
-		})
+			Lag:     int32(lag),
+			Measure: measure,
+		}
+		// So were the significance columns.
+		if len(row) > 8 {
+			significance := make([]float32, 4)
+			for i := range significance {
+				value, err := strconv.ParseFloat(row[5+i], 32)
+				if err != nil {
+					return nil, err
+				}
+				significance[i] = float32(value)
+			}
+			edge.PValue, edge.ConfidenceLow = significance[0], significance[1]
+			edge.ConfidenceHigh, edge.EffectiveSampleSize = significance[2], significance[3]
+		}
+
+		results = append(results, edge)
 		ctr++
 		if maxNodes > 0 && ctr > maxNodes {
 			// Returning an empty edges list will make the graph render without edges.
@@ -454,12 +549,15 @@ func (c *CorrelationExplorer) extractEdges(stride *Stride) error {
 				edgeWriter := csv.NewWriter(edgeFile)
 				edgeFiles[graphId] = edgeFile
 				edgeWriters[graphId] = edgeWriter
-				err = edgeWriter.Write([]string{"ID", "Correlated", "Pearson"})
+				err = edgeWriter.Write([]string{"ID", "Correlated", "Pearson", "Lag", "Measure",
+					"PValue", "ConfidenceLow", "ConfidenceHigh", "EffectiveSampleSize"})
 				if err != nil {
 					return fmt.Errorf("failed to write header to edge csv file: %v\n", err)
 				}
 			}
-			err = edgeWriters[graphId].Write([]string{fmt.Sprintf("%d", e.Source), fmt.Sprintf("%d", e.Target), fmt.Sprintf("%f", e.Pearson)})
+			err = edgeWriters[graphId].Write([]string{fmt.Sprintf("%d", e.Source), fmt.Sprintf("%d", e.Target), fmt.Sprintf("%f", e.Pearson),
+				fmt.Sprintf("%d", e.Lag), e.Measure, fmt.Sprintf("%g", e.PValue), fmt.Sprintf("%f", e.ConfidenceLow),
+				fmt.Sprintf("%f", e.ConfidenceHigh), fmt.Sprintf("%f", e.EffectiveSampleSize)})
 			if err != nil {
 				return fmt.Errorf("failed to write %v to edge file: %v", e, err)
 			}
@@ -533,6 +631,11 @@ func (c *CorrelationExplorer) addStrideCacheEntry(stride *Stride) {
 		if err != nil {
 			log.Printf("failed to remove %s: %v\n", fullPath, err)
 		}
+		fullPath = filepath.Join(c.FilenameBase, changeFilenameForStride(*s))
+		err = os.RemoveAll(fullPath)
+		if err != nil {
+			log.Printf("failed to remove %s: %v\n", fullPath, err)
+		}
 		s.Status = StrideDeleted
 		c.strideCache[oldestEntry] = nil
 	}
@@ -546,6 +649,7 @@ func (c *CorrelationExplorer) readResultFile(filename string, stride *Stride) er
 		return err
 	}
 	defer parquetExplorer.Delete()
+	stride.Preprocessing, _ = parquetExplorer.Metadata(reporter.METADATA_PREPROCESSING)
 	log.Printf("reading metrics from %s\n", filename)
 	err = parquetExplorer.GetMetrics(&stride.metricsCache)
 	if err != nil {
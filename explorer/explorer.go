@@ -16,6 +16,12 @@ import (
 
 const (
 	MAX_GRAPH_SIZE = 1500
+
+	// The default number of events that GetCorrelationChanges returns.
+	MAX_CHANGES = 200
+
+	// Edges between anti-correlated timeseries get this color in the node graph.
+	NEGATIVE_CORRELATION_COLOR = "red"
 )
 
 // Types for the REST API
@@ -29,6 +35,21 @@ type CorrelatedResponse struct {
 	Labels      map[model.LabelName]model.LabelValue `json:"labels"`
 	LabelString string                               `json:"labelString"`
 	Pearson     float32                              `json:"pearson"`
+	// A positive lag means the requested timeseries leads this one by Lag samples.
+	Lag int32 `json:"lag"`
+	// The correlation measure that produced Pearson, empty for files written before
+	// the measure was recorded.
+	Measure string `json:"measure,omitempty"`
+	// Only set when the significance of the correlation is known.
+	Significance *significanceResponse `json:"significance,omitempty"`
+}
+
+type significanceResponse struct {
+	PValue float32 `json:"pValue"`
+	// The 95% confidence interval of Pearson.
+	ConfidenceLow       float32 `json:"confidenceLow"`
+	ConfidenceHigh      float32 `json:"confidenceHigh"`
+	EffectiveSampleSize float32 `json:"effectiveSampleSize"`
 }
 
 type metricInfoResponse struct {
@@ -38,6 +59,7 @@ type metricInfoResponse struct {
 	LabelString string                               `json:"labelString"`
 	Constant    bool                                 `json:"constant"`
 	SubgraphId  int                                  `json:"subgraphId"`
+	Rate        bool                                 `json:"rate"`
 }
 
 type correlatedTimeseriesResponse struct {
@@ -45,6 +67,25 @@ type correlatedTimeseriesResponse struct {
 	Constant   bool                 `json:"constant"`
 }
 
+type correlationChangeResponse struct {
+	// One of reporter.CHANGE_NEW, CHANGE_LOST or CHANGE_STRENGTH.
+	Kind         string `json:"kind"`
+	Source       string `json:"source"`
+	SourceLabels string `json:"sourceLabels"`
+	Target       string `json:"target"`
+	TargetLabels string `json:"targetLabels"`
+	// The coefficients in the previous and in the requested stride, 0 if the
+	// timeseries were not correlated.
+	Previous float32 `json:"previous"`
+	Current  float32 `json:"current"`
+}
+
+type correlationChangesResponse struct {
+	Stride         int                         `json:"stride"`
+	PreviousStride int                         `json:"previousStride"`
+	Changes        []correlationChangeResponse `json:"changes"`
+}
+
 type subgraphNodeResponse struct {
 	Id       string `json:"id"`
 	Title    string `json:"title"`
@@ -58,6 +99,10 @@ type subgraphEdgeResponse struct {
 	Target    string `json:"target"`
 	Thickness int    `json:"thickness"`
 	Mainstat  string `json:"mainstat,optional"`
+	// Secondarystat is the lag, if there is one.
+	Secondarystat string `json:"secondarystat,omitempty"`
+	// Color is set for negative correlations.
+	Color string `json:"color,omitempty"`
 }
 
 type TimeseriesResponse struct {
@@ -231,6 +276,12 @@ func (c *CorrelationExplorer) GetSubgraphEdges(w http.ResponseWriter, r *http.Re
 			Target:   fmt.Sprintf("fp-%d", e.Target),
 			Mainstat: fmt.Sprintf("%f", e.Pearson),
 		}
+		if e.Lag != 0 {
+			resp[i].Secondarystat = fmt.Sprintf("lag %d", e.Lag)
+		}
+		if e.Pearson < 0 {
+			resp[i].Color = NEGATIVE_CORRELATION_COLOR
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -843,6 +894,7 @@ func (c *CorrelationExplorer) GetMetricInfo(w http.ResponseWriter, r *http.Reque
 			LabelString: m.MetricString(),
 			Constant:    m.Constant,
 			SubgraphId:  subgraphId,
+			Rate:        m.Rate,
 		})
 	}
 
@@ -882,7 +934,7 @@ func (c *CorrelationExplorer) GetCorrelatedSeries(w http.ResponseWriter, r *http
 		otherRowIds = metricRowIds[1 : len(metricRowIds)-1]
 	}
 
-	correlatesMap, err := c.retrieveCorrelatedTimeseries(stride, metricRowIds[0], otherRowIds, 20)
+	correlatesMap, err := c.retrieveCorrelatedEdges(stride, metricRowIds[0], otherRowIds, 20)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -902,19 +954,127 @@ func (c *CorrelationExplorer) GetCorrelatedSeries(w http.ResponseWriter, r *http
 		Constant:   false,
 	}
 
-	for otherRowId, pearson := range correlatesMap {
+	for otherRowId, edge := range correlatesMap {
 		otherMetric, exists := stride.metricsCache[otherRowId]
 		if !exists {
 			err = fmt.Errorf("ts %d is allegedly correlated with %d but that does not exist", metricRowIds[0], otherRowId)
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		resp.Correlates = append(resp.Correlates, CorrelatedResponse{
+		correlated := CorrelatedResponse{
 			Rowid:       fmt.Sprintf("fp-%d", otherRowId),
 			Labels:      map[model.LabelName]model.LabelValue(otherMetric.LabelSet),
 			LabelString: otherMetric.MetricString(),
-			Pearson:     pearson,
-		})
+			Pearson:     edge.Pearson,
+			Lag:         edge.Lag,
+			Measure:     edge.Measure,
+		}
+		if edge.EffectiveSampleSize > 0 {
+			correlated.Significance = &significanceResponse{
+				PValue:              edge.PValue,
+				ConfidenceLow:       edge.ConfidenceLow,
+				ConfidenceHigh:      edge.ConfidenceHigh,
+				EffectiveSampleSize: edge.EffectiveSampleSize,
+			}
+		}
+		resp.Correlates = append(resp.Correlates, correlated)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// GetCorrelationChanges returns the correlations that appeared, disappeared or changed in
+// strength between the previous stride and the requested one, largest changes first.
+// The kind parameter selects one kind of change, ts or tsid select the changes of one
+// timeseries, and limit caps the number of changes.
+func (c *CorrelationExplorer) GetCorrelationChanges(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	stride, err := c.getStride(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if stride == nil {
+		http.Error(w, fmt.Sprintf("no stride found for time"), http.StatusNotFound)
+		return
+	}
+
+	limit := MAX_CHANGES
+	if l, ok := params["limit"]; ok {
+		value, err := strconv.ParseInt(strings.TrimSpace(l[0]), 10, 32)
+		if err != nil || value <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %s", l[0]), http.StatusBadRequest)
+			return
+		}
+		limit = int(value)
+	}
+	kind := ""
+	if k, ok := params["kind"]; ok {
+		kind = k[0]
+	}
+	var metricRowId uint64
+	_, hasTs := params["ts"]
+	_, hasTsid := params["tsid"]
+	if hasTs || hasTsid {
+		metricRowIds, err := c.getMetrics(params, stride)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(metricRowIds) == 0 {
+			http.Error(w, fmt.Sprintf("no metric found for params %v", params), http.StatusNotFound)
+			return
+		}
+		metricRowId = metricRowIds[0]
+	}
+
+	report, err := c.readChanges(stride)
+	if err != nil {
+		log.Printf("failed to read correlation changes for stride %d: %v\n", stride.ID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if report == nil {
+		http.Error(w, fmt.Sprintf("no correlation changes recorded for stride %d", stride.ID), http.StatusNotFound)
+		return
+	}
+
+	resp := correlationChangesResponse{
+		Stride:         report.Stride,
+		PreviousStride: report.PreviousStride,
+		Changes:        make([]correlationChangeResponse, 0, min(limit, len(report.Events))),
+	}
+	for _, e := range report.Events {
+		if len(resp.Changes) >= limit {
+			break
+		}
+		if kind != "" && e.Kind != kind {
+			continue
+		}
+		source, target := e.Timeseries1, e.Timeseries2
+		if metricRowId != 0 {
+			if target == metricRowId {
+				source, target = target, source
+			} else if source != metricRowId {
+				continue
+			}
+		}
+		change := correlationChangeResponse{
+			Kind:     e.Kind,
+			Source:   fmt.Sprintf("fp-%d", source),
+			Target:   fmt.Sprintf("fp-%d", target),
+			Previous: e.Previous,
+			Current:  e.Current,
+		}
+		if m, exists := stride.metricsCache[source]; exists {
+			change.SourceLabels = m.MetricString()
+		}
+		if m, exists := stride.metricsCache[target]; exists {
+			change.TargetLabels = m.MetricString()
+		}
+		resp.Changes = append(resp.Changes, change)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
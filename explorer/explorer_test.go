@@ -1,8 +1,15 @@
 package explorer
 
 import (
+	"encoding/json"
 	"fmt"
 	explorerlib "github.com/kpaschen/corrjoin/lib/explorer"
+	"github.com/kpaschen/corrjoin/lib/reporter"
+	"github.com/prometheus/common/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -193,3 +200,78 @@ func TestExtendTimeline(t *testing.T) {
 		t.Errorf("only 1, 2 and 3 should have been added to knownTimeseries but i have %v", knownTimeseries)
 	}
 }
+
+func TestGetCorrelationChanges(t *testing.T) {
+	tempdir, err := os.MkdirTemp("", "corrjoinTest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	explorer := CorrelationExplorer{
+		FilenameBase: tempdir,
+		strideCache:  make([]*Stride, STRIDE_CACHE_SIZE, STRIDE_CACHE_SIZE),
+	}
+	start := time.Date(2025, 3, 28, 10, 0, 0, 0, time.UTC)
+	explorer.strideCache[0] = &Stride{
+		ID:        2,
+		StartTime: start.Unix(),
+		EndTime:   start.Add(time.Hour).Unix(),
+		Status:    StrideProcessed,
+		metricsCache: map[uint64]*explorerlib.Metric{
+			10: {Fingerprint: 10, LabelSet: model.LabelSet{"__name__": "a"}},
+			20: {Fingerprint: 20, LabelSet: model.LabelSet{"__name__": "b"}},
+			30: {Fingerprint: 30, LabelSet: model.LabelSet{"__name__": "c"}},
+		},
+	}
+
+	request := httptest.NewRequest("GET", "/getCorrelationChanges?strideId=2", nil)
+	recorder := httptest.NewRecorder()
+	explorer.GetCorrelationChanges(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected not found without a change file but got %d", recorder.Code)
+	}
+
+	report := reporter.ChangeReport{
+		Stride:         2,
+		PreviousStride: 1,
+		Events: []reporter.ChangeEvent{
+			{Kind: reporter.CHANGE_LOST, Timeseries1: 10, Timeseries2: 20, Previous: 0.95},
+			{Kind: reporter.CHANGE_NEW, Timeseries1: 20, Timeseries2: 30, Current: 0.9},
+			{Kind: reporter.CHANGE_STRENGTH, Timeseries1: 10, Timeseries2: 30, Previous: 0.95, Current: 0.8},
+		},
+	}
+	file, err := os.Create(filepath.Join(tempdir, changeFilenameForStride(*explorer.strideCache[0])))
+	if err != nil {
+		t.Fatalf("failed to create change file: %v", err)
+	}
+	json.NewEncoder(file).Encode(report)
+	file.Close()
+
+	request = httptest.NewRequest("GET", "/getCorrelationChanges?strideId=2&tsid=30", nil)
+	recorder = httptest.NewRecorder()
+	explorer.GetCorrelationChanges(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var resp correlationChangesResponse
+	if err = json.NewDecoder(recorder.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.PreviousStride != 1 || len(resp.Changes) != 2 {
+		t.Fatalf("expected the two changes of timeseries 30 but got %+v", resp)
+	}
+	for _, c := range resp.Changes {
+		if c.Source != "fp-30" || c.SourceLabels != explorer.strideCache[0].metricsCache[30].MetricString() {
+			t.Errorf("expected timeseries 30 to be the source of %+v", c)
+		}
+	}
+
+	request = httptest.NewRequest("GET", "/getCorrelationChanges?strideId=2&kind=lost", nil)
+	recorder = httptest.NewRecorder()
+	explorer.GetCorrelationChanges(recorder, request)
+	resp = correlationChangesResponse{}
+	json.NewDecoder(recorder.Body).Decode(&resp)
+	if len(resp.Changes) != 1 || resp.Changes[0].Target != "fp-20" || resp.Changes[0].Previous != 0.95 {
+		t.Errorf("expected the lost correlation but got %+v", resp.Changes)
+	}
+}
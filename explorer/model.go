@@ -38,7 +38,10 @@ type Stride struct {
 	EndTimeString   string
 	Status          StrideState
 	Filename        string
-	subgraphs       *explorerlib.SubgraphMemberships
+	// The preprocessing that was applied to the timeseries before they were correlated.
+	// This is empty for files that do not record it.
+	Preprocessing string
+	subgraphs     *explorerlib.SubgraphMemberships
 
 	// Maps metric fingerprints to Metrics.
 	metricsCache map[uint64](*explorerlib.Metric)
@@ -5,6 +5,9 @@ import (
 	"flag"
 	"github.com/gorilla/mux"
 	"github.com/kpaschen/corrjoin/explorer"
+	"github.com/kpaschen/corrjoin/lib/comparisons"
+	"github.com/kpaschen/corrjoin/lib/correlation"
+	"github.com/kpaschen/corrjoin/lib/preprocess"
 	"github.com/kpaschen/corrjoin/lib/settings"
 	"github.com/kpaschen/corrjoin/receiver"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -14,6 +17,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"time"
 )
 
 type config struct {
@@ -32,9 +36,40 @@ func main() {
 	var ks int
 	var ke int
 	var svdDimensions int
+	var svdStrategy string
+	var autoTune bool
+	var autoTuneInterval int
+	var autoTuneTargetRecall int
+	var autoTuneSampleRows int
+	var autoTuneBudget int
 	var algorithm string
+	var correlationMeasure string
+	var preprocessing string
+	var movingAverageWindow int
+	var seasonalPeriod time.Duration
+	var seasonalBuckets int
+	var seasonalHistory int
+	var maxLag int
+	var lshTables int
+	var lshBits int
+	var negativeCorrelations bool
+	var maxPValue float64
+	var detectChanges bool
+	var changeThreshold float64
+	var notifierURL string
+	var notifierRules string
+	var rateCounters bool
+	var histogramSeries string
+	var relabelConfig string
+	var maxSeriesPerJob int
+	var backfillURL string
+	var backfillMatchers string
+	var backfillSeriesPerQuery int
 	var skipConstantTs bool
 	var compareEngine string
+	var comparerWorkers int
+	var comparerWorkerURLs string
+	var comparisonWorkerAddress string
 	var parquetMaxRowsPerRowGroup int
 	var sampleInterval int
 	var resultsDirectory string
@@ -42,6 +77,7 @@ func main() {
 	var noExplore bool
 	var prometheusURL string
 	var strideMaxAgeSeconds int
+	var checkpointInterval int
 	var maxRows int
 	var labeldrop string
 
@@ -56,15 +92,47 @@ func main() {
 	flag.IntVar(&ks, "ks", 15, "how many columns to reduce the input to in the first PAA step")
 	flag.IntVar(&ke, "ke", 30, "how many columns to reduce the input to in the second PAA step (during bucketing)")
 	flag.IntVar(&svdDimensions, "svdDimensions", 3, "How many columns to choose after SVD")
-	flag.StringVar(&algorithm, "algorithm", "paa_svd", "Algorithm to use. Possible values: full_pearson, paa_only, paa_svd")
+	flag.BoolVar(&autoTune, "autoTune", false, "Whether to choose ks, ke and svdDimensions automatically for the paa_svd algorithm")
+	flag.IntVar(&autoTuneInterval, "autoTuneInterval", 0, "How many strides to wait before tuning again. 0 means tune only on the first full window")
+	flag.IntVar(&autoTuneTargetRecall, "autoTuneTargetRecall", 95, "The percentage of correlated pairs that the tuned settings should find")
+	flag.IntVar(&autoTuneSampleRows, "autoTuneSampleRows", 2000, "How many timeseries to sample for tuning")
+	flag.IntVar(&autoTuneBudget, "autoTuneBudget", 60, "How long tuning may take, in seconds")
+	flag.StringVar(&svdStrategy, "svdStrategy", "full", "How to compute the SVD. Possible values: full (on a sample of the rows), randomized, incremental")
+	flag.StringVar(&algorithm, "algorithm", "paa_svd", "Algorithm to use. Possible values: full_pearson, paa_only, paa_svd, lagged_pearson, lsh")
+	flag.StringVar(&preprocessing, "preprocessing", "none", "How to transform timeseries before correlating them. Possible values: none, difference, detrend, moving_average")
+	flag.IntVar(&movingAverageWindow, "movingAverageWindow", 30, "The number of samples in the moving average that the moving_average preprocessing subtracts")
+	flag.DurationVar(&seasonalPeriod, "seasonalPeriod", 0, "The length of the cycle to remove from timeseries before correlating them, for example 24h. 0 disables this")
+	flag.IntVar(&seasonalBuckets, "seasonalBuckets", 144, "The number of values in the seasonal profile of a timeseries. This bounds the memory per timeseries")
+	flag.IntVar(&seasonalHistory, "seasonalHistory", 7, "The number of periods the seasonal profile averages over")
+	flag.StringVar(&correlationMeasure, "correlationMeasure", "pearson", "The correlation measure. Possible values: pearson, spearman (rank correlation)")
+	flag.BoolVar(&negativeCorrelations, "negativeCorrelations", false, "Whether to also look for timeseries with a correlation of at most -correlationThreshold")
+	flag.Float64Var(&maxPValue, "maxPValue", 0, "Drop correlated pairs whose p-value, corrected for autocorrelation, is above this. 0 keeps all pairs")
+	flag.BoolVar(&detectChanges, "detectChanges", true, "Whether to write the correlations that appeared, disappeared or changed in strength since the previous stride to a file per stride")
+	flag.Float64Var(&changeThreshold, "changeThreshold", 0.1, "How much the correlation coefficient of two timeseries has to change between strides to be reported. 0 reports every change")
+	flag.StringVar(&notifierURL, "notifierURL", "", "An Alertmanager URL (ending in /api/v2/alerts) to send alerts about the correlations of watched timeseries to")
+	flag.StringVar(&notifierRules, "notifierRules", "", "A json file with the rules for the alerts, see lib/notifier")
+	flag.BoolVar(&rateCounters, "rateCounters", true, "Whether to convert counters (recognized by metadata or by a _total, _count or _sum suffix) to per-second rates before correlating them")
+	flag.StringVar(&histogramSeries, "histogramSeries", "", "The series to derive from every classic or native histogram in place of its buckets, separated by commas: quantiles like p90 or p99.9, mean, count and sum, for example p50,p99,mean. Empty keeps the bucket, count and sum series")
+	flag.StringVar(&relabelConfig, "relabelConfig", "", "A yaml file with Prometheus relabel configs (keep, drop, labeldrop, replace, ...) to apply to every received timeseries")
+	flag.IntVar(&maxSeriesPerJob, "maxSeriesPerJob", 0, "The maximum number of timeseries to take per job after relabeling. 0 means no limit")
+	flag.StringVar(&backfillURL, "backfillURL", "", "The base URL of a Prometheus compatible query API to read the last window of samples from at startup")
+	flag.StringVar(&backfillMatchers, "backfillMatchers", "", "Series selectors for the timeseries to backfill, separated by semicolons. Empty selects all timeseries")
+	flag.IntVar(&backfillSeriesPerQuery, "backfillSeriesPerQuery", 100, "The number of timeseries to read per query_range request when backfilling")
+	flag.IntVar(&lshTables, "lshTables", 16, "The number of hash tables for the lsh algorithm. More tables find more correlated pairs but cost more comparisons")
+	flag.IntVar(&lshBits, "lshBits", 10, "The number of bits per hash for the lsh algorithm. More bits mean fewer comparisons but find fewer correlated pairs")
+	flag.IntVar(&maxLag, "maxLag", 5, "The maximum lag in samples for the lagged_pearson algorithm")
 	flag.BoolVar(&skipConstantTs, "skipConstantTs", true, "Whether to ignore timeseries whose value is constant in the current window")
-	flag.StringVar(&compareEngine, "comparer", "inprocess", "The comparison engine.")
+	flag.StringVar(&compareEngine, "comparer", "inprocess", "The comparison engine. Possible values: inprocess, parallel, distributed")
+	flag.StringVar(&comparerWorkerURLs, "comparerWorkerURLs", "", "The base URLs of the comparison workers for the distributed comparer, separated by commas")
+	flag.StringVar(&comparisonWorkerAddress, "comparisonWorkerAddress", "", "If set, run only a comparison worker for the distributed comparer on this address")
+	flag.IntVar(&comparerWorkers, "comparerWorkers", 0, "The number of worker goroutines for the parallel comparer. 0 means one per CPU.")
 	flag.IntVar(&parquetMaxRowsPerRowGroup, "parquetMaxRowsPerRowGroup", 100000, "Number of rows per row group in Parquet. Small numbers reduce memory usage but cost more disk space; large numbers cost more memory but improve compression.")
 	flag.StringVar(&resultsDirectory, "resultsDirectory", "/tmp/corrjoinResults", "The directory with the result files.")
 	flag.BoolVar(&justExplore, "justExplore", false, "If true, launch only the explorer endpoint")
 	flag.BoolVar(&noExplore, "noExplore", false, "If true, do not launch the explorer endpoint")
 	flag.StringVar(&prometheusURL, "prometheusURL", "", "A URL for the prometheus service")
 	flag.IntVar(&strideMaxAgeSeconds, "strideMaxAgeSeconds", 21600, "The maximum time to keep stride data around for.")
+	flag.IntVar(&checkpointInterval, "checkpointInterval", 600, "How often to write a checkpoint of the receiver state, in seconds. 0 disables checkpoints.")
 	flag.IntVar(&maxRows, "maxRows", 0, "The maximum number of timeseries to process. 0 means no limit.")
 	flag.StringVar(&labeldrop, "labeldrop", "", "The labels to drop from timeseries, separated by |")
 
@@ -76,20 +144,72 @@ func main() {
 		explorerAddress:   explorerAddr,
 	}
 
+	// The seasonal period is counted in samples.
+	seasonalSamples := 0
+	if sampleInterval > 0 {
+		seasonalSamples = int(seasonalPeriod / (time.Duration(sampleInterval) * time.Second))
+	}
+
 	corrjoinConfig := settings.CorrjoinSettings{
-		SvdDimensions:        ks,
-		SvdOutputDimensions:  svdDimensions,
-		EuclidDimensions:     ke,
-		CorrelationThreshold: float64(float64(correlationThreshold) / 100.0),
-		WindowSize:           windowSize,
-		StrideLength:         stride,
-		SampleInterval:       sampleInterval,
-		Algorithm:            algorithm,
-		MaxRowsPerRowGroup:   int64(parquetMaxRowsPerRowGroup),
-		ResultsDirectory:     resultsDirectory,
-		MaxRows:              maxRows,
+		SvdDimensions:          ks,
+		SvdOutputDimensions:    svdDimensions,
+		SvdStrategy:            svdStrategy,
+		AutoTune:               autoTune,
+		AutoTuneInterval:       autoTuneInterval,
+		AutoTuneTargetRecall:   float64(autoTuneTargetRecall) / 100.0,
+		AutoTuneSampleRows:     autoTuneSampleRows,
+		AutoTuneBudget:         autoTuneBudget,
+		EuclidDimensions:       ke,
+		CorrelationThreshold:   float64(float64(correlationThreshold) / 100.0),
+		WindowSize:             windowSize,
+		StrideLength:           stride,
+		SampleInterval:         sampleInterval,
+		Algorithm:              algorithm,
+		CorrelationMeasure:     correlationMeasure,
+		Preprocessing:          preprocessing,
+		MovingAverageWindow:    movingAverageWindow,
+		SeasonalPeriod:         seasonalSamples,
+		SeasonalBuckets:        seasonalBuckets,
+		SeasonalHistory:        seasonalHistory,
+		Comparer:               compareEngine,
+		ComparerWorkers:        comparerWorkers,
+		ComparerWorkerURLs:     splitNonEmpty(comparerWorkerURLs, ","),
+		MaxLag:                 maxLag,
+		LshTables:              lshTables,
+		LshBits:                lshBits,
+		NegativeCorrelations:   negativeCorrelations,
+		MaxPValue:              maxPValue,
+		DetectChanges:          detectChanges,
+		ChangeThreshold:        changeThreshold,
+		NotifierURL:            notifierURL,
+		NotifierRulesFile:      notifierRules,
+		RateCounters:           rateCounters,
+		HistogramSeries:        splitNonEmpty(histogramSeries, ","),
+		RelabelConfigFile:      relabelConfig,
+		MaxSeriesPerJob:        maxSeriesPerJob,
+		BackfillURL:            backfillURL,
+		BackfillMatchers:       splitNonEmpty(backfillMatchers, ";"),
+		BackfillSeriesPerQuery: backfillSeriesPerQuery,
+		MaxRowsPerRowGroup:     int64(parquetMaxRowsPerRowGroup),
+		ResultsDirectory:       resultsDirectory,
+		MaxRows:                maxRows,
+		CheckpointInterval:     checkpointInterval,
 	}
 	corrjoinConfig = corrjoinConfig.ComputeSettingsFields()
+	if _, err := correlation.NewRowTransform(corrjoinConfig.CorrelationMeasure); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := preprocess.NewRowTransform(corrjoinConfig); err != nil {
+		log.Fatal(err)
+	}
+	if corrjoinConfig.AutoTune && corrjoinConfig.Algorithm != settings.ALGO_PAA_SVD {
+		log.Fatalf("-autoTune is only supported for the %s algorithm, not %s\n", settings.ALGO_PAA_SVD, corrjoinConfig.Algorithm)
+	}
+
+	if comparisonWorkerAddress != "" {
+		runComparisonWorker(comparisonWorkerAddress, cfg.metricsAddress)
+		return
+	}
 
 	var expl *explorer.CorrelationExplorer
 	var explorerRouter *mux.Router
@@ -114,6 +234,7 @@ func main() {
 		explorerRouter.HandleFunc("/getMetricInfo", expl.GetMetricInfo).Methods("GET")
 		explorerRouter.HandleFunc("/dumpMetricCache", expl.DumpMetricCache).Methods("GET")
 		explorerRouter.HandleFunc("/getMetricHistory", expl.GetMetricHistory).Methods("GET")
+		explorerRouter.HandleFunc("/getCorrelationChanges", expl.GetCorrelationChanges).Methods("GET")
 	}
 
 	http.Handle("/metrics", promhttp.Handler())
@@ -123,11 +244,17 @@ func main() {
 	signal.Notify(stop, os.Interrupt)
 
 	var prometheusServer *http.Server
+	var shutdownProcessor func() error
 
 	if !justExplore {
-		processor := receiver.NewTsProcessor(corrjoinConfig)
+		processor, err := receiver.NewTsProcessor(corrjoinConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		shutdownProcessor = processor.Shutdown
 		prometheusRouter := mux.NewRouter().StrictSlash(true)
 		prometheusRouter.HandleFunc("/api/v1/write", processor.ReceivePrometheusData)
+		prometheusRouter.HandleFunc("/v1/metrics", processor.ReceiveOTLPData).Methods("POST")
 		prometheusServer = &http.Server{
 			Addr:    cfg.prometheusAddress,
 			Handler: prometheusRouter,
@@ -166,6 +293,13 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10)
 	defer cancel()
 
+	// This writes a checkpoint and flushes the results files.
+	if shutdownProcessor != nil {
+		if err := shutdownProcessor(); err != nil {
+			log.Printf("failed to shut down correlation service: %v\n", err)
+		}
+	}
+
 	// This is where the correlation service gets a chance to dump results to disk.
 	if !justExplore && prometheusServer != nil {
 		if err := prometheusServer.Shutdown(ctx); err != nil {
@@ -179,3 +313,37 @@ func main() {
 		}
 	}
 }
+
+func splitNonEmpty(s string, sep string) []string {
+	ret := []string{}
+	for _, part := range strings.Split(s, sep) {
+		if part != "" {
+			ret = append(ret, part)
+		}
+	}
+	return ret
+}
+
+// runComparisonWorker serves comparison requests from a distributed comparer until interrupted.
+func runComparisonWorker(address string, metricsAddress string) {
+	http.Handle("/metrics", promhttp.Handler())
+	go http.ListenAndServe(metricsAddress, nil)
+
+	worker := comparisons.NewComparisonWorker()
+	server := &http.Server{
+		Addr:    address,
+		Handler: worker.Handler(),
+	}
+	go func() {
+		log.Printf("comparison worker listening on port %s\n", address)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	<-stop
+	log.Println("comparison worker shutting down")
+	server.Close()
+}
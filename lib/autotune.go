@@ -0,0 +1,259 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib/comparisons"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"time"
+)
+
+var (
+	tunedKs = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "corrjoin_tuned_ks",
+			Help: "The number of columns for the first PAA step chosen by auto-tuning.",
+		},
+	)
+	tunedKe = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "corrjoin_tuned_ke",
+			Help: "The number of columns for the second PAA step chosen by auto-tuning.",
+		},
+	)
+	tunedSvdDimensions = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "corrjoin_tuned_svd_dimensions",
+			Help: "The number of svd output dimensions chosen by auto-tuning.",
+		},
+	)
+	tunedRecall = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "corrjoin_tuned_recall",
+			Help: "The recall of the settings chosen by auto-tuning, estimated on a sample of the window.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tunedKs)
+	prometheus.MustRegister(tunedKe)
+	prometheus.MustRegister(tunedSvdDimensions)
+	prometheus.MustRegister(tunedRecall)
+}
+
+// tuningResult is the outcome of running the algorithm with one parameter set on a sample.
+type tuningResult struct {
+	ks          int
+	ke          int
+	kb          int
+	recall      float64
+	comparisons int
+	duration    time.Duration
+}
+
+// tuningCandidates returns the parameter sets to try. The current settings come first
+// so there is always a result for them, even when the budget runs out.
+func tuningCandidates(config settings.CorrjoinSettings) [][3]int {
+	ret := [][3]int{{config.SvdDimensions, config.EuclidDimensions, config.SvdOutputDimensions}}
+	for _, ks := range []int{10, 15, 20, 30, 40} {
+		if ks > config.WindowSize {
+			continue
+		}
+		for _, ke := range []int{ks, 2 * ks} {
+			if ke > config.WindowSize {
+				continue
+			}
+			for kb := 2; kb <= 6 && kb <= ks; kb++ {
+				if ks == ret[0][0] && ke == ret[0][1] && kb == ret[0][2] {
+					continue
+				}
+				ret = append(ret, [3]int{ks, ke, kb})
+			}
+		}
+	}
+	return ret
+}
+
+// tuningSample returns up to AutoTuneSampleRows rows of the window that are not skipped,
+// spread evenly over the window.
+func (w *TimeseriesWindow) tuningSample() [][]float64 {
+	rows := make([]int, 0, len(w.normalized))
+	for i := range w.normalized {
+		if i < len(w.skipRows) && w.skipRows[i] {
+			continue
+		}
+		rows = append(rows, i)
+	}
+	sampleSize := min(len(rows), w.settings.AutoTuneSampleRows)
+	sample := make([][]float64, 0, sampleSize)
+	for i := 0; i < sampleSize; i++ {
+		sample = append(sample, w.normalized[rows[i*len(rows)/sampleSize]])
+	}
+	return sample
+}
+
+// correlatedPairs returns the pairs of rows in sample whose pearson correlation is at
+// least the threshold. The rows are normalized, so this is their dot product.
+func correlatedPairs(sample [][]float64, config settings.CorrjoinSettings) map[datatypes.RowPair]bool {
+	ret := make(map[datatypes.RowPair]bool)
+	for i := 0; i < len(sample); i++ {
+		for j := i + 1; j < len(sample); j++ {
+			pearson := 0.0
+			for k, v := range sample[i] {
+				pearson += v * sample[j][k]
+			}
+			if pearson >= config.CorrelationThreshold ||
+				(config.NegativeCorrelations && pearson <= -config.CorrelationThreshold) {
+				ret[*datatypes.NewRowPair(i, j)] = true
+			}
+		}
+	}
+	return ret
+}
+
+// tryParameters runs ALGO_PAA_SVD on the sample with the given settings.
+func tryParameters(sample [][]float64, config settings.CorrjoinSettings, truth map[datatypes.RowPair]bool) (*tuningResult, error) {
+	start := time.Now()
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	comparer := &comparisons.InProcessComparer{Trial: true}
+	comparer.Initialize(config, results)
+	engine := &comparisons.CountingEngine{Engine: comparer}
+
+	found := make(chan int)
+	go func() {
+		truePositives := 0
+		// The comparer sends an empty result at the end of the stride.
+		for result := range results {
+			if len(result.CorrelatedPairs) == 0 {
+				break
+			}
+			for pair := range result.CorrelatedPairs {
+				if truth[pair] {
+					truePositives++
+				}
+			}
+		}
+		found <- truePositives
+	}()
+
+	window := NewTimeseriesWindow(config, engine)
+	window.trial = true
+	window.buffers = sample
+	window.normalized = sample
+	window.ConstantRows = make([]bool, len(sample))
+	window.skipRows = make([]bool, len(sample))
+	window.StrideCounter = 1
+	if err := engine.StartStride(sample, window.skipRows, window.StrideCounter); err != nil {
+		return nil, err
+	}
+	if err := window.processBuffer(); err != nil {
+		// Make sure the collector goroutine finishes.
+		comparer.StopStride(window.StrideCounter)
+		<-found
+		return nil, err
+	}
+	ret := &tuningResult{
+		ks:          config.SvdDimensions,
+		ke:          config.EuclidDimensions,
+		kb:          config.SvdOutputDimensions,
+		recall:      1.0,
+		comparisons: engine.Compared,
+	}
+	truePositives := <-found
+	if len(truth) > 0 {
+		ret.recall = float64(truePositives) / float64(len(truth))
+	}
+	ret.duration = time.Since(start)
+	return ret, nil
+}
+
+// better returns true if a is a better choice than b: among the results that meet the
+// target recall, the one with the fewest comparisons wins. Otherwise, higher recall wins.
+func better(a *tuningResult, b *tuningResult, targetRecall float64) bool {
+	if b == nil {
+		return true
+	}
+	aMeets, bMeets := a.recall >= targetRecall, b.recall >= targetRecall
+	if aMeets != bMeets {
+		return aMeets
+	}
+	if aMeets {
+		return a.comparisons < b.comparisons
+	}
+	return a.recall > b.recall
+}
+
+// autoTune estimates recall and cost of several parameter sets for the first PAA step,
+// the second PAA step and the SVD on a sample of the window, and switches to the cheapest
+// one that meets the target recall.
+// This must only be called after normalizeWindow and computeSkipRows.
+func (w *TimeseriesWindow) autoTune() (*tuningResult, error) {
+	// Do not retry on every stride if tuning fails.
+	w.lastTuned = w.StrideCounter
+	if w.settings.Algorithm != settings.ALGO_PAA_SVD {
+		return nil, fmt.Errorf("auto-tuning is only supported for %s", settings.ALGO_PAA_SVD)
+	}
+	start := time.Now()
+	budget := time.Duration(w.settings.AutoTuneBudget) * time.Second
+	sample := w.tuningSample()
+	if len(sample) < 2 {
+		return nil, fmt.Errorf("not enough rows to tune on")
+	}
+	truth := correlatedPairs(sample, w.settings)
+	log.Printf("tuning on %d rows with %d correlated pairs\n", len(sample), len(truth))
+
+	var best *tuningResult
+	for _, candidate := range tuningCandidates(w.settings) {
+		if best != nil && time.Since(start) > budget {
+			log.Printf("auto-tuning ran out of time after %v\n", time.Since(start))
+			break
+		}
+		config := w.settings
+		config.SvdDimensions, config.EuclidDimensions, config.SvdOutputDimensions = candidate[0], candidate[1], candidate[2]
+		config = config.ComputeSettingsFields()
+		result, err := tryParameters(sample, config, truth)
+		if err != nil {
+			log.Printf("failed to try ks %d, ke %d, kb %d: %v\n", candidate[0], candidate[1], candidate[2], err)
+			continue
+		}
+		log.Printf("ks %d, ke %d, kb %d: recall %f with %d comparisons in %v\n",
+			result.ks, result.ke, result.kb, result.recall, result.comparisons, result.duration)
+		if better(result, best, w.settings.AutoTuneTargetRecall) {
+			best = result
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no parameter set could be evaluated")
+	}
+
+	w.settings.SvdDimensions = best.ks
+	w.settings.EuclidDimensions = best.ke
+	w.settings.SvdOutputDimensions = best.kb
+	w.settings = w.settings.ComputeSettingsFields()
+	w.comparer.Reconfigure(w.settings)
+	// The block size for the running sums and the svd output size may have changed.
+	w.stats = newWindowStats(w.settings)
+	w.svd = nil
+
+	log.Printf("auto-tuning chose ks %d, ke %d, kb %d with estimated recall %f and %d comparisons on the sample\n",
+		best.ks, best.ke, best.kb, best.recall, best.comparisons)
+	tunedKs.Set(float64(best.ks))
+	tunedKe.Set(float64(best.ke))
+	tunedSvdDimensions.Set(float64(best.kb))
+	tunedRecall.Set(best.recall)
+	return best, nil
+}
+
+// tuningDue returns true if autoTune should run for the current stride.
+func (w *TimeseriesWindow) tuningDue() bool {
+	if !w.settings.AutoTune {
+		return false
+	}
+	if w.lastTuned == 0 {
+		return true
+	}
+	return w.settings.AutoTuneInterval > 0 && w.StrideCounter-w.lastTuned >= w.settings.AutoTuneInterval
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"github.com/kpaschen/corrjoin/lib/comparisons"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"github.com/kpaschen/corrjoin/lib/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// reconfigureRecorder remembers the settings it was reconfigured with.
+type reconfigureRecorder struct {
+	comparisons.Engine
+	config *settings.CorrjoinSettings
+}
+
+func (r *reconfigureRecorder) Reconfigure(config settings.CorrjoinSettings) {
+	r.config = &config
+	r.Engine.Reconfigure(config)
+}
+
+func TestAutoTune(t *testing.T) {
+	config := settings.CorrjoinSettings{
+		Algorithm:            settings.ALGO_PAA_SVD,
+		WindowSize:           120,
+		StrideLength:         40,
+		SvdDimensions:        10,
+		EuclidDimensions:     20,
+		SvdOutputDimensions:  3,
+		CorrelationThreshold: 0.9,
+		AutoTune:             true,
+		AutoTuneTargetRecall: 0.9,
+	}.ComputeSettingsFields()
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	defer close(results)
+	comparer := &comparisons.InProcessComparer{}
+	comparer.Initialize(config, results)
+	engine := &reconfigureRecorder{Engine: comparer}
+	tswindow := NewTimeseriesWindow(config, engine)
+
+	// Groups of random walks with noisy copies.
+	tswindow.buffers = utils.RandomWalks(rand.New(rand.NewSource(9)), 30, 8, config.WindowSize)
+	tswindow.StrideCounter = 3
+
+	if !tswindow.tuningDue() {
+		t.Errorf("expected tuning to be due before the first tuning run")
+	}
+	tswindow.normalizeWindow()
+	tswindow.computeSkipRows()
+	svdRetainedVariance.Set(-1.0)
+	result, err := tswindow.autoTune()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if v := testutil.ToFloat64(svdRetainedVariance); v != -1.0 {
+		t.Errorf("expected the trial runs to leave the retained variance metric alone but it is %f", v)
+	}
+	if result.recall < config.AutoTuneTargetRecall {
+		t.Errorf("expected the chosen settings to meet the target recall but got %f", result.recall)
+	}
+	if tswindow.settings.SvdDimensions != result.ks || tswindow.settings.EuclidDimensions != result.ke ||
+		tswindow.settings.SvdOutputDimensions != result.kb {
+		t.Errorf("window settings %+v do not match the tuning result %+v", tswindow.settings, result)
+	}
+	expectedEpsilon1 := math.Sqrt(float64(2*result.ks) * (1.0 - config.CorrelationThreshold) / float64(config.WindowSize))
+	if math.Abs(tswindow.settings.Epsilon1-expectedEpsilon1) > 1e-9 {
+		t.Errorf("expected epsilon1 to be recomputed as %f but it is %f", expectedEpsilon1, tswindow.settings.Epsilon1)
+	}
+	if engine.config == nil || engine.config.EuclidDimensions != result.ke {
+		t.Errorf("expected the comparer to be reconfigured with ke %d but got %+v", result.ke, engine.config)
+	}
+	if tswindow.tuningDue() {
+		t.Errorf("did not expect tuning to be due again without an interval")
+	}
+	tswindow.settings.AutoTuneInterval = 2
+	tswindow.StrideCounter += 2
+	if !tswindow.tuningDue() {
+		t.Errorf("expected tuning to be due after the interval")
+	}
+
+	// The tuned settings work for a real stride.
+	if err = engine.StartStride(tswindow.normalized, tswindow.skipRows, tswindow.StrideCounter); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	go func() {
+		for range results {
+		}
+	}()
+	if err = tswindow.processBuffer(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestAutoTuneOtherAlgorithm(t *testing.T) {
+	config := settings.CorrjoinSettings{
+		Algorithm:            settings.ALGO_FULL_PEARSON,
+		WindowSize:           20,
+		StrideLength:         10,
+		CorrelationThreshold: 0.9,
+		AutoTune:             true,
+	}.ComputeSettingsFields()
+	tswindow := NewTimeseriesWindow(config, &comparisons.InProcessComparer{})
+	tswindow.StrideCounter = 2
+	if _, err := tswindow.autoTune(); err == nil {
+		t.Errorf("expected an error for auto-tuning %s", config.Algorithm)
+	}
+	if tswindow.tuningDue() {
+		t.Errorf("did not expect tuning to be due again after it failed")
+	}
+}
+
+func TestTuningCandidates(t *testing.T) {
+	config := settings.CorrjoinSettings{
+		WindowSize:          25,
+		SvdDimensions:       15,
+		EuclidDimensions:    30,
+		SvdOutputDimensions: 3,
+	}
+	candidates := tuningCandidates(config)
+	if candidates[0] != [3]int{15, 30, 3} {
+		t.Errorf("expected the current settings first but got %v", candidates[0])
+	}
+	seen := make(map[[3]int]bool)
+	for _, c := range candidates[1:] {
+		if c[0] > config.WindowSize || c[1] > config.WindowSize || c[2] > c[0] {
+			t.Errorf("invalid candidate %v", c)
+		}
+		if seen[c] || c == candidates[0] {
+			t.Errorf("duplicate candidate %v", c)
+		}
+		seen[c] = true
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"log"
 	"math"
+	"runtime"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -33,9 +36,13 @@ func init() {
 // the n-dimensional bucketing scheme.
 // members is a list of the row indices of the data rows that ended
 // up in this bucket.
+// negatedMembers is a list of the row indices of the data rows whose
+// negation ended up in this bucket. It is only filled when looking for
+// negative correlations.
 type Bucket struct {
-	coordinates []int
-	members     []int
+	coordinates    []int
+	members        []int
+	negatedMembers []int
 }
 
 // k-dimensional items are assigned into a k-dimensional bucketing scheme.
@@ -110,16 +117,18 @@ func (s *BucketingScheme) Initialize() error {
 		for j, v := range vec {
 			coordinates[j] = s.BucketIndex(v)
 		}
-		name := BucketName(coordinates)
-		bucket, exists := s.buckets[name]
-		if exists {
-			bucket.members = append(bucket.members, i)
-		} else {
-			s.buckets[name] = &Bucket{
-				coordinates: coordinates,
-				members:     make([]int, 1, 1000),
+		bucket := s.bucket(coordinates)
+		bucket.members = append(bucket.members, i)
+
+		if s.settings.NegativeCorrelations {
+			// SVD is linear, so the projection of a negated row is the negated projection.
+			// A row that is anti-correlated with row i ends up close to i's negation.
+			negatedCoordinates := make([]int, columnCount, columnCount)
+			for j, v := range vec {
+				negatedCoordinates[j] = s.BucketIndex(-v)
 			}
-			s.buckets[name].members[0] = i
+			bucket = s.bucket(negatedCoordinates)
+			bucket.negatedMembers = append(bucket.negatedMembers, i)
 		}
 	}
 
@@ -128,27 +137,163 @@ func (s *BucketingScheme) Initialize() error {
 	return nil
 }
 
+// bucket returns the bucket with the given coordinates, creating it if necessary.
+func (s *BucketingScheme) bucket(coordinates []int) *Bucket {
+	name := BucketName(coordinates)
+	bucket, exists := s.buckets[name]
+	if !exists {
+		bucket = &Bucket{
+			coordinates: coordinates,
+			members:     make([]int, 0, 1000),
+		}
+		s.buckets[name] = bucket
+	}
+	return bucket
+}
+
+// BucketName returns the coordinates formatted like fmt's %v verb. This is on the
+// hot path of the neighbour lookup, so it avoids fmt.
 func BucketName(coordinates []int) string {
-	return fmt.Sprintf("%v", coordinates)
+	name := make([]byte, 0, 4*len(coordinates)+2)
+	name = append(name, '[')
+	for i, c := range coordinates {
+		if i > 0 {
+			name = append(name, ' ')
+		}
+		name = strconv.AppendInt(name, int64(c), 10)
+	}
+	name = append(name, ']')
+	return string(name)
 }
 
+// CorrelationCandidates asks the comparer to compare all pairs of rows that are in
+// the same bucket or in neighbouring buckets.
+// The buckets are processed by a pool of goroutines, but the comparer is only
+// called from this goroutine.
 func (s *BucketingScheme) CorrelationCandidates() error {
 	fmt.Printf("Correlation candidates: looking at %d buckets\n", len(s.buckets))
-	for _, bucket := range s.buckets {
-		err := s.candidatesForBucket(bucket)
+	return s.correlationCandidates(s.neighbourOffsets(), runtime.NumCPU())
+}
+
+// neighbourOffsets returns the offsets from a bucket's coordinates to its neighbours'
+// coordinates. It returns nil if it is cheaper to look at all buckets than to
+// look up every possible neighbour.
+func (s *BucketingScheme) neighbourOffsets() [][]int {
+	dimensions := s.settings.SvdOutputDimensions
+	if math.Pow(3, float64(dimensions))-1 >= float64(len(s.buckets)) {
+		return nil
+	}
+	return neighbourCoordinates(make([]int, dimensions))
+}
+
+func (s *BucketingScheme) correlationCandidates(offsets [][]int, workerCount int) error {
+	bucketQueue := make(chan *Bucket, workerCount)
+	pairs := make(chan [][2]int, workerCount)
+	var errLock sync.Mutex
+	var firstErr error
+	var workers sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			batch := make([][2]int, 0, comparisons.PAIR_BATCH_SIZE)
+			emit := func(r1 int, r2 int) {
+				batch = append(batch, [2]int{r1, r2})
+				if len(batch) >= comparisons.PAIR_BATCH_SIZE {
+					pairs <- batch
+					batch = make([][2]int, 0, comparisons.PAIR_BATCH_SIZE)
+				}
+			}
+			for bucket := range bucketQueue {
+				errLock.Lock()
+				failed := firstErr != nil
+				errLock.Unlock()
+				if failed {
+					continue
+				}
+				if err := s.candidatesForBucket(bucket, offsets, emit); err != nil {
+					errLock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errLock.Unlock()
+				}
+			}
+			if len(batch) > 0 {
+				pairs <- batch
+			}
+		}()
+	}
+	go func() {
+		for _, bucket := range s.buckets {
+			bucketQueue <- bucket
+		}
+		close(bucketQueue)
+		workers.Wait()
+		close(pairs)
+	}()
+
+	var err error
+	for batch := range pairs {
+		// Keep reading after an error so the workers can finish.
 		if err != nil {
-			return err
+			continue
 		}
+		for _, p := range batch {
+			if err = s.comparer.Compare(p[0], p[1]); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = firstErr
+	}
+	if err != nil {
+		return err
 	}
 	// Let the comparer know there will be no further requests for this stride.
 	return s.comparer.StopStride(s.strideCounter)
 }
 
-// candidatesForBucket processes rowPairs for a Bucket and its neighbours.
-func (s *BucketingScheme) candidatesForBucket(bucket *Bucket) error {
+// neighbours returns the buckets whose coordinates match the coordinates of bucket.
+// match must only accept coordinates that are at most one away from bucket's
+// coordinates along every dimension. If offsets is nil, all buckets are checked,
+// otherwise only the bucket itself and the buckets at the given offsets.
+func (s *BucketingScheme) neighbours(bucket *Bucket, offsets [][]int, match func([]int, []int) bool) []*Bucket {
+	var ret []*Bucket
+	if offsets == nil {
+		for _, otherBucket := range s.buckets {
+			if match(bucket.coordinates, otherBucket.coordinates) {
+				ret = append(ret, otherBucket)
+			}
+		}
+		return ret
+	}
+	if match(bucket.coordinates, bucket.coordinates) {
+		ret = append(ret, bucket)
+	}
+	coordinates := make([]int, len(bucket.coordinates))
+	for _, offset := range offsets {
+		for i, c := range bucket.coordinates {
+			coordinates[i] = c + offset[i]
+		}
+		if !match(bucket.coordinates, coordinates) {
+			continue
+		}
+		if otherBucket, exists := s.buckets[BucketName(coordinates)]; exists {
+			ret = append(ret, otherBucket)
+		}
+	}
+	return ret
+}
+
+// candidatesForBucket emits the rowPairs for a Bucket and its neighbours.
+func (s *BucketingScheme) candidatesForBucket(bucket *Bucket, offsets [][]int, emit func(int, int)) error {
 	//utils.ReportMemory(fmt.Sprintf("starting on bucket %s with %d members\n",
 	//		BucketName(bucket.coordinates), len(bucket.members)))
-	bucketSizeHist.Observe(float64(len(bucket.members)))
+	if len(bucket.members) > 0 {
+		bucketSizeHist.Observe(float64(len(bucket.members)))
+	}
 	for i := 0; i < len(bucket.members); i++ {
 		r1 := bucket.members[i]
 		for j := i + 1; j < len(bucket.members); j++ {
@@ -157,36 +302,48 @@ func (s *BucketingScheme) candidatesForBucket(bucket *Bucket) error {
 				return fmt.Errorf("duplicate entry %d in bucket %s", r1,
 					BucketName(bucket.coordinates))
 			}
-			err := s.comparer.Compare(r1, r2)
-			if err != nil {
-				return err
-			}
+			emit(r1, r2)
 		}
 	}
 
-	neighbourCount := 0
-	for otherName, otherBucket := range s.buckets {
-		if isLeftNeighbour(bucket.coordinates, otherBucket.coordinates) {
-			neighbourCount++
+	if len(bucket.members) > 0 {
+		for _, otherBucket := range s.neighbours(bucket, offsets, isLeftNeighbour) {
 			for _, r1 := range bucket.members {
 				for _, r2 := range otherBucket.members {
 					if r1 == r2 {
 						return fmt.Errorf("element %d is in buckets %s and %s", r1,
-							BucketName(bucket.coordinates), otherName)
-					}
-					err := s.comparer.Compare(r1, r2)
-					if err != nil {
-						return err
+							BucketName(bucket.coordinates), BucketName(otherBucket.coordinates))
 					}
+					emit(r1, r2)
 				}
 			}
 		}
 	}
-	//log.Printf("bucket %s of size %d has been compared to %d neighbours\n",
-	//		BucketName(bucket.coordinates), len(bucket.members), neighbourCount)
+	if s.settings.NegativeCorrelations {
+		s.negativeCandidatesForBucket(bucket, offsets, emit)
+	}
 	return nil
 }
 
+// negativeCandidatesForBucket emits the pairs of the members of a bucket with the negated
+// members of the bucket itself and of all its neighbours.
+// If row r1 is close to the negation of row r2, then r2 is also close to the negation
+// of r1, so every pair is found twice. Only the one with r1 < r2 is emitted.
+func (s *BucketingScheme) negativeCandidatesForBucket(bucket *Bucket, offsets [][]int, emit func(int, int)) {
+	if len(bucket.members) == 0 {
+		return
+	}
+	for _, otherBucket := range s.neighbours(bucket, offsets, isNeighbourOrSelf) {
+		for _, r1 := range bucket.members {
+			for _, r2 := range otherBucket.negatedMembers {
+				if r1 < r2 {
+					emit(r1, r2)
+				}
+			}
+		}
+	}
+}
+
 // A bucket is a "left" neighbour of another bucket if it is a neighbour along any dimension,
 // and if its string representation is alphabetically smaller than the other bucket's.
 // So for instance [0,0,1] is a left neighbour of [0,1,1] but not a left neighbour of [0,0,0].
@@ -212,6 +369,20 @@ func isLeftNeighbour(input []int, maybeNeighbour []int) bool {
 	return oneDiffFound
 }
 
+// isNeighbourOrSelf returns true if the coordinates differ by at most one along every dimension.
+func isNeighbourOrSelf(input []int, maybeNeighbour []int) bool {
+	if len(input) != len(maybeNeighbour) {
+		return false
+	}
+	for i, inputCoordinate := range input {
+		diff := inputCoordinate - maybeNeighbour[i]
+		if diff > 1 || diff < -1 {
+			return false
+		}
+	}
+	return true
+}
+
 func neighbourCoordinates(input []int) [][]int {
 	// In every direction (~ dimension of input), we can either
 	// leave the value as it is, or add one, or subtract 1.
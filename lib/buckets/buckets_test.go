@@ -1,9 +1,14 @@
 package buckets
 
 import (
+	"fmt"
 	"github.com/kpaschen/corrjoin/lib/comparisons"
 	"github.com/kpaschen/corrjoin/lib/datatypes"
 	"github.com/kpaschen/corrjoin/lib/settings"
+	"math"
+	"math/rand"
+	"runtime"
+	"slices"
 	"testing"
 )
 
@@ -70,6 +75,14 @@ func TestNeighbourCoordinates(t *testing.T) {
 	}
 }
 
+func TestBucketName(t *testing.T) {
+	for _, coordinates := range [][]int{{}, {1}, {-1, 0, 12}} {
+		if BucketName(coordinates) != fmt.Sprintf("%v", coordinates) {
+			t.Errorf("unexpected bucket name %s for %v", BucketName(coordinates), coordinates)
+		}
+	}
+}
+
 func TestIsLeftNeighbour(t *testing.T) {
 	n := isLeftNeighbour([]int{1, 2, 3}, []int{1, 2, 3})
 	if n {
@@ -130,3 +143,178 @@ func TestCorrelationCandidates(t *testing.T) {
 		t.Errorf("unexpected error in CorrelationCandidates: %v", err)
 	}
 }
+
+func TestNegativeCorrelationCandidates(t *testing.T) {
+	originalMatrix := [][]float64{
+		[]float64{-1.0, 0.0, 1.0},
+		[]float64{1.0, 0.0, -1.0},
+		[]float64{-1.0, 0.0, 1.0},
+	}
+	svdOutputMatrix := [][]float64{
+		[]float64{1.1, 0.2},
+		[]float64{-1.1, -0.2},
+		[]float64{1.1, 0.2},
+	}
+	settings := settings.CorrjoinSettings{
+		SvdDimensions:        3,
+		EuclidDimensions:     3,
+		CorrelationThreshold: 0.9,
+		WindowSize:           3,
+		SvdOutputDimensions:  2,
+		NegativeCorrelations: true,
+	}.ComputeSettingsFields()
+	comparer := &comparisons.InProcessComparer{}
+	results := make(chan *datatypes.CorrjoinResult, 2)
+	comparer.Initialize(settings, results)
+	if err := comparer.StartStride(originalMatrix, []bool{}, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	scheme := NewBucketingScheme(originalMatrix, svdOutputMatrix, []bool{}, settings, 0, comparer)
+	if err := scheme.Initialize(); err != nil {
+		t.Fatalf("unexpected error in bucket scheme initialization: %v", err)
+	}
+	if err := scheme.CorrelationCandidates(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result := <-results
+	expected := map[datatypes.RowPair]float64{
+		*datatypes.NewRowPair(0, 1): -1.0,
+		*datatypes.NewRowPair(0, 2): 1.0,
+		*datatypes.NewRowPair(1, 2): -1.0,
+	}
+	if len(result.CorrelatedPairs) != len(expected) {
+		t.Fatalf("expected %d pairs but got %v", len(expected), result.CorrelatedPairs)
+	}
+	for pair, pearson := range expected {
+		if math.Abs(result.CorrelatedPairs[pair]-pearson) > 0.0001 {
+			t.Errorf("expected correlation %f for %v but got %f", pearson, pair, result.CorrelatedPairs[pair])
+		}
+	}
+}
+
+func TestIsNeighbourOrSelf(t *testing.T) {
+	if !isNeighbourOrSelf([]int{1, 2, 3}, []int{1, 2, 3}) {
+		t.Errorf("a bucket should match itself")
+	}
+	if !isNeighbourOrSelf([]int{1, 2, 3}, []int{2, 1, 3}) {
+		t.Errorf("expected [2 1 3] to be a neighbour of [1 2 3]")
+	}
+	if isNeighbourOrSelf([]int{1, 2, 3}, []int{1, 2, 5}) {
+		t.Errorf("did not expect [1 2 5] to be a neighbour of [1 2 3]")
+	}
+}
+
+// recordingComparer is an Engine that only records the pairs it is asked to compare.
+type recordingComparer struct {
+	pairs [][2]int
+}
+
+func (r *recordingComparer) Initialize(config settings.CorrjoinSettings, results chan<- *datatypes.CorrjoinResult) {
+}
+
+func (r *recordingComparer) Reconfigure(config settings.CorrjoinSettings) {
+}
+
+func (r *recordingComparer) StartStride(normalizedMatrix [][]float64, constantRows []bool, strideCounter int) error {
+	r.pairs = nil
+	return nil
+}
+
+func (r *recordingComparer) Compare(index1 int, index2 int) error {
+	r.pairs = append(r.pairs, [2]int{min(index1, index2), max(index1, index2)})
+	return nil
+}
+
+func (r *recordingComparer) StopStride(strideCounter int) error {
+	return nil
+}
+
+func (r *recordingComparer) Shutdown() error {
+	return nil
+}
+
+func (r *recordingComparer) sortedPairs() [][2]int {
+	ret := slices.Clone(r.pairs)
+	slices.SortFunc(ret, func(a, b [2]int) int {
+		if a[0] != b[0] {
+			return a[0] - b[0]
+		}
+		return a[1] - b[1]
+	})
+	return ret
+}
+
+func randomBucketingScheme(rowCount int, dimensions int, epsilon float64, negative bool) (*BucketingScheme, *recordingComparer) {
+	rng := rand.New(rand.NewSource(3))
+	svdOutputMatrix := make([][]float64, rowCount)
+	for i := range svdOutputMatrix {
+		svdOutputMatrix[i] = make([]float64, dimensions)
+		for j := range svdOutputMatrix[i] {
+			svdOutputMatrix[i][j] = rng.NormFloat64() * 0.3
+		}
+	}
+	config := settings.CorrjoinSettings{
+		SvdOutputDimensions:  dimensions,
+		Epsilon1:             epsilon,
+		NegativeCorrelations: negative,
+	}
+	comparer := &recordingComparer{}
+	scheme := NewBucketingScheme(svdOutputMatrix, svdOutputMatrix, []bool{}, config, 0, comparer)
+	if err := scheme.Initialize(); err != nil {
+		panic(err)
+	}
+	return scheme, comparer
+}
+
+func TestNeighbourIndexCandidates(t *testing.T) {
+	for _, negative := range []bool{false, true} {
+		for _, dimensions := range []int{2, 3, 4} {
+			scheme, comparer := randomBucketingScheme(1000, dimensions, 0.1, negative)
+			offsets := neighbourCoordinates(make([]int, dimensions))
+
+			if err := scheme.correlationCandidates(nil, 1); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			scanned := comparer.sortedPairs()
+			comparer.pairs = nil
+			if err := scheme.correlationCandidates(offsets, 4); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			indexed := comparer.sortedPairs()
+
+			if len(scanned) == 0 {
+				t.Errorf("expected some candidates for %d dimensions", dimensions)
+			}
+			if !slices.Equal(scanned, indexed) {
+				t.Errorf("%d dimensions, negative %t: neighbour index found %d candidates but the scan found %d",
+					dimensions, negative, len(indexed), len(scanned))
+			}
+		}
+	}
+}
+
+func BenchmarkCorrelationCandidates(b *testing.B) {
+	dimensions := 4
+	scheme, comparer := randomBucketingScheme(10000, dimensions, 0.05, false)
+	b.Logf("%d rows in %d buckets", 10000, len(scheme.buckets))
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			comparer.pairs = nil
+			scheme.correlationCandidates(nil, 1)
+		}
+	})
+	b.Run("index", func(b *testing.B) {
+		offsets := neighbourCoordinates(make([]int, dimensions))
+		for i := 0; i < b.N; i++ {
+			comparer.pairs = nil
+			scheme.correlationCandidates(offsets, 1)
+		}
+	})
+	b.Run("parallel index", func(b *testing.B) {
+		offsets := neighbourCoordinates(make([]int, dimensions))
+		for i := 0; i < b.N; i++ {
+			comparer.pairs = nil
+			scheme.correlationCandidates(offsets, runtime.NumCPU())
+		}
+	})
+}
@@ -0,0 +1,397 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// CHECKPOINT_VERSION has to change whenever the layout of Checkpoint changes.
+	CHECKPOINT_VERSION = 3
+
+	checkpointMagic  = "CJCKPT\x00\x00"
+	checkpointPrefix = "checkpoint_"
+	checkpointSuffix = ".ckpt"
+
+	// How many checkpoint files to keep around.
+	checkpointsToKeep = 2
+)
+
+// A Checkpoint is a snapshot of the state of a receiver: the sliding window,
+// the partial stride in the accumulator, the stride start times and the latest
+// samples of the counters that are converted to rates.
+//
+// On disk, a checkpoint is an 8 byte magic string, a 4 byte version, the gob-encoded
+// Checkpoint and a crc32 checksum of the gob-encoded data.
+type Checkpoint struct {
+	CreatedAt time.Time
+
+	// These have to match the settings of the receiver that restores the checkpoint.
+	WindowSize     int
+	StrideLength   int
+	SampleInterval int
+
+	StrideCounter    int
+	WindowBuffers    [][]float64
+	MaskedUntil      []int
+	StrideStartTimes map[int]time.Time
+	// Only set when the receiver removes seasonality.
+	Seasonality *SeasonalState
+
+	Accumulator AccumulatorState
+	// The latest sample of every counter, keyed by fingerprint.
+	Rates map[uint64]CounterSample
+}
+
+// AccumulatorState is the part of a TimeseriesAccumulator that is saved in a checkpoint.
+type AccumulatorState struct {
+	Tsids                []TsId
+	Buffers              map[int][]float64
+	CurrentStrideStartTs time.Time
+	CurrentStrideMaxTs   time.Time
+	SampledRows          map[int]bool
+	EndedRows            map[int]bool
+	IdleStrides          map[int]int
+}
+
+// Snapshot returns the state of the accumulator. The result shares memory with the
+// accumulator, so it must not be used after the next call to AddObservation.
+func (a *TimeseriesAccumulator) Snapshot() AccumulatorState {
+	return AccumulatorState{
+		Tsids:                a.Tsids,
+		Buffers:              a.buffers,
+		CurrentStrideStartTs: a.currentStrideStartTs,
+		CurrentStrideMaxTs:   a.currentStrideMaxTs,
+		SampledRows:          a.sampledRows,
+		EndedRows:            a.endedRows,
+		IdleStrides:          a.idleStrides,
+	}
+}
+
+// validate checks that state fits an accumulator for strides of stride samples.
+func (state AccumulatorState) validate(stride int) error {
+	if len(state.Buffers) != len(state.Tsids) {
+		return fmt.Errorf("accumulator state has %d buffers but %d tsids",
+			len(state.Buffers), len(state.Tsids))
+	}
+	rowmap := make(map[uint64]int)
+	for i, tsid := range state.Tsids {
+		if _, exists := rowmap[tsid.MetricFingerprint]; exists {
+			return fmt.Errorf("duplicate fingerprint %d in accumulator state", tsid.MetricFingerprint)
+		}
+		rowmap[tsid.MetricFingerprint] = i
+		if b, ok := state.Buffers[i]; !ok || len(b) > stride {
+			return fmt.Errorf("bad buffer for row %d in accumulator state", i)
+		}
+	}
+	return nil
+}
+
+// Restore replaces the state of the accumulator with state.
+func (a *TimeseriesAccumulator) Restore(state AccumulatorState) error {
+	if err := state.validate(a.stride); err != nil {
+		return err
+	}
+	rowmap := make(map[uint64]int, len(state.Tsids))
+	for i, tsid := range state.Tsids {
+		rowmap[tsid.MetricFingerprint] = i
+	}
+	a.rowmap = rowmap
+	a.Tsids = state.Tsids
+	a.maxRow = len(state.Tsids)
+	a.buffers = state.Buffers
+	for i, b := range a.buffers {
+		// gob does not preserve capacity.
+		a.buffers[i] = append(make([]float64, 0, a.stride), b...)
+	}
+	a.currentStrideStartTs = state.CurrentStrideStartTs
+	a.currentStrideMaxTs = state.CurrentStrideMaxTs
+	a.sampledRows = nonNilMap(state.SampledRows)
+	a.endedRows = nonNilMap(state.EndedRows)
+	a.idleStrides = nonNilMap(state.IdleStrides)
+	a.retiredRows = make(map[int]bool)
+	log.Printf("restored accumulator with %d rows and stride start time %v\n",
+		a.maxRow, a.currentStrideStartTs.UTC().Format("20060102150405"))
+	return nil
+}
+
+// gob decodes empty maps as nil.
+func nonNilMap[V any](m map[int]V) map[int]V {
+	if m == nil {
+		return make(map[int]V)
+	}
+	return m
+}
+
+// Snapshot returns the stride counter, the buffers and the row masks of the window.
+// The result shares memory with the window, so it must not be used after the next
+// call to ShiftObservations.
+func (w *TimeseriesWindow) Snapshot() (int, [][]float64, []int) {
+	return w.StrideCounter, w.buffers, w.maskedUntil
+}
+
+// validateWindow checks that buffers and maskedUntil fit a window of windowSize columns.
+func validateWindow(buffers [][]float64, maskedUntil []int, windowSize int) error {
+	if len(buffers) > 0 {
+		columnCount := len(buffers[0])
+		if columnCount > windowSize {
+			return fmt.Errorf("window buffers have %d columns but the window size is %d",
+				columnCount, windowSize)
+		}
+		for i, b := range buffers {
+			if len(b) != columnCount {
+				return fmt.Errorf("bad column count %d in row %d (expected %d)", len(b), i, columnCount)
+			}
+		}
+	}
+	if len(maskedUntil) > len(buffers) {
+		return fmt.Errorf("window has masks for %d rows but only %d rows", len(maskedUntil), len(buffers))
+	}
+	return nil
+}
+
+// Restore replaces the contents of the window. This must be called before the
+// first call to ShiftObservations.
+func (w *TimeseriesWindow) Restore(strideCounter int, buffers [][]float64, maskedUntil []int) error {
+	if err := validateWindow(buffers, maskedUntil, w.settings.WindowSize); err != nil {
+		return err
+	}
+	w.StrideCounter = strideCounter
+	w.buffers = buffers
+	w.maskedUntil = maskedUntil
+	w.stats.invalidate()
+	log.Printf("restored window with %d rows at stride %d\n", len(buffers), strideCounter)
+	return nil
+}
+
+func (c *Checkpoint) validate(config settings.CorrjoinSettings) error {
+	if c.WindowSize != config.WindowSize || c.StrideLength != config.StrideLength ||
+		c.SampleInterval != config.SampleInterval {
+		return fmt.Errorf("checkpoint was written with window size %d, stride length %d and sample interval %d",
+			c.WindowSize, c.StrideLength, c.SampleInterval)
+	}
+	// The accumulator resumes at the stride it was in when the checkpoint was written, so
+	// the samples after a longer downtime would be joined onto the old ones as if nothing
+	// had been missed.
+	maxAge := time.Duration(config.StrideLength*config.SampleInterval) * time.Second
+	if time.Since(c.CreatedAt) > maxAge {
+		return fmt.Errorf("checkpoint from %v is older than the stride duration %v", c.CreatedAt, maxAge)
+	}
+	if len(c.Accumulator.Tsids) < len(c.WindowBuffers) {
+		return fmt.Errorf("checkpoint has %d window rows but only %d tsids",
+			len(c.WindowBuffers), len(c.Accumulator.Tsids))
+	}
+	// Check the parts here rather than only when they are restored, so a bad checkpoint
+	// is skipped before any of the receiver state is replaced.
+	if err := validateWindow(c.WindowBuffers, c.MaskedUntil, config.WindowSize); err != nil {
+		return err
+	}
+	return c.Accumulator.validate(config.StrideLength)
+}
+
+// WriteCheckpoint writes c to a new file in directory and removes older checkpoints.
+func WriteCheckpoint(directory string, c *Checkpoint) error {
+	filename := fmt.Sprintf("%s%d%s", checkpointPrefix, c.CreatedAt.UTC().Unix(), checkpointSuffix)
+	path := filepath.Join(directory, filename)
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	err = writeCheckpoint(file, c)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// Renaming makes sure there is never a partially written checkpoint with the final name.
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	log.Printf("wrote checkpoint %s\n", path)
+	removeOldCheckpoints(directory)
+	return nil
+}
+
+func writeCheckpoint(writer io.Writer, c *Checkpoint) error {
+	buffered := bufio.NewWriter(writer)
+	if _, err := buffered.WriteString(checkpointMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(buffered, binary.LittleEndian, uint32(CHECKPOINT_VERSION)); err != nil {
+		return err
+	}
+	checksum := crc32.NewIEEE()
+	if err := gob.NewEncoder(io.MultiWriter(buffered, checksum)).Encode(c); err != nil {
+		return err
+	}
+	if err := binary.Write(buffered, binary.LittleEndian, checksum.Sum32()); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// ReadCheckpoint reads a checkpoint file and verifies its version and checksum.
+func ReadCheckpoint(path string) (*Checkpoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return readCheckpoint(file, stat.Size())
+}
+
+func readCheckpoint(reader io.ReaderAt, size int64) (*Checkpoint, error) {
+	headerSize := int64(len(checkpointMagic) + 4)
+	payloadSize := size - headerSize - 4
+	if payloadSize <= 0 {
+		return nil, fmt.Errorf("checkpoint is too short (%d bytes)", size)
+	}
+	header := make([]byte, headerSize)
+	if _, err := reader.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:len(checkpointMagic)]) != checkpointMagic {
+		return nil, fmt.Errorf("not a checkpoint file")
+	}
+	version := binary.LittleEndian.Uint32(header[len(checkpointMagic):])
+	if version != CHECKPOINT_VERSION {
+		return nil, fmt.Errorf("checkpoint has version %d but only version %d is supported",
+			version, CHECKPOINT_VERSION)
+	}
+	trailer := make([]byte, 4)
+	if _, err := reader.ReadAt(trailer, headerSize+payloadSize); err != nil {
+		return nil, err
+	}
+	expectedChecksum := binary.LittleEndian.Uint32(trailer)
+
+	checksum := crc32.NewIEEE()
+	payload := io.TeeReader(io.NewSectionReader(reader, headerSize, payloadSize), checksum)
+	var c Checkpoint
+	decodeErr := gob.NewDecoder(payload).Decode(&c)
+	// Make sure the checksum covers the whole payload even if decoding stopped early.
+	if _, err := io.Copy(io.Discard, payload); err != nil {
+		return nil, err
+	}
+	if checksum.Sum32() != expectedChecksum {
+		return nil, fmt.Errorf("checkpoint checksum mismatch")
+	}
+	if decodeErr != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint: %v", decodeErr)
+	}
+	return &c, nil
+}
+
+// listCheckpoints returns the checkpoint files in directory, newest first.
+func listCheckpoints(directory string) ([]string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		name    string
+		created int64
+	}
+	candidates := make([]candidate, 0)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		var created int64
+		n, err := fmt.Sscanf(e.Name(), checkpointPrefix+"%d"+checkpointSuffix, &created)
+		if n != 1 || err != nil || filepath.Ext(e.Name()) != checkpointSuffix {
+			continue
+		}
+		candidates = append(candidates, candidate{name: e.Name(), created: created})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].created > candidates[j].created
+	})
+	ret := make([]string, len(candidates))
+	for i, c := range candidates {
+		ret[i] = filepath.Join(directory, c.name)
+	}
+	return ret, nil
+}
+
+func removeOldCheckpoints(directory string) {
+	checkpoints, err := listCheckpoints(directory)
+	if err != nil {
+		log.Printf("failed to list checkpoints: %v\n", err)
+		return
+	}
+	for i, path := range checkpoints {
+		if i < checkpointsToKeep {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			log.Printf("failed to remove old checkpoint %s: %v\n", path, err)
+		}
+	}
+}
+
+// LoadLatestCheckpoint returns the newest checkpoint in directory that can be read
+// and that is compatible with config. It returns nil if there is no such checkpoint.
+func LoadLatestCheckpoint(directory string, config settings.CorrjoinSettings) (*Checkpoint, error) {
+	checkpoints, err := listCheckpoints(directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range checkpoints {
+		c, err := ReadCheckpoint(path)
+		if err != nil {
+			log.Printf("rejecting checkpoint %s: %v\n", path, err)
+			continue
+		}
+		if err = c.validate(config); err != nil {
+			log.Printf("rejecting checkpoint %s: %v\n", path, err)
+			continue
+		}
+		log.Printf("using checkpoint %s\n", path)
+		return c, nil
+	}
+	return nil, nil
+}
+
+// SeasonalSnapshot returns the periodic profiles of the rows, or nil if the window
+// does not remove seasonality. The result shares memory with the window.
+func (w *TimeseriesWindow) SeasonalSnapshot() *SeasonalState {
+	if w.seasonality == nil {
+		return nil
+	}
+	return &w.seasonality.SeasonalState
+}
+
+// RestoreSeasonality replaces the periodic profiles of the rows. Profiles that were saved
+// with a different period or number of buckets are ignored and the profiles start over.
+// This must be called before the first call to ShiftObservations.
+func (w *TimeseriesWindow) RestoreSeasonality(state *SeasonalState) {
+	if w.seasonality == nil || state == nil {
+		return
+	}
+	if !w.seasonality.restore(state) {
+		log.Printf("not restoring seasonal profiles for period %d with %d buckets\n", state.Period, state.Buckets)
+		return
+	}
+	log.Printf("restored seasonal profiles for %d rows\n", len(state.Rows))
+}
@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"github.com/kpaschen/corrjoin/lib/comparisons"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func checkpointTestSettings() settings.CorrjoinSettings {
+	return settings.CorrjoinSettings{
+		Algorithm:      settings.ALGO_NONE,
+		WindowSize:     6,
+		StrideLength:   3,
+		SampleInterval: 5,
+	}
+}
+
+func makeTestCheckpoint(t *testing.T, config settings.CorrjoinSettings) *Checkpoint {
+	now := time.Now()
+	replies := make(chan *ObservationResult, 1)
+	acc := NewTimeseriesAccumulator(config.StrideLength, now, config.SampleInterval, 0, 0, replies)
+	acc.AddObservation(&Observation{
+		MetricFingerprint: uint64(1),
+		MetricName:        "ts1",
+		Value:             0.1,
+		Timestamp:         now.Add(time.Second * 1),
+	})
+	acc.AddObservation(&Observation{
+		MetricFingerprint: uint64(2),
+		MetricName:        "ts2",
+		Value:             0.2,
+		Timestamp:         now.Add(time.Second * 6),
+	})
+	comparer := &comparisons.InProcessComparer{}
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	comparer.Initialize(config, results)
+	window := NewTimeseriesWindow(config, comparer)
+	err, _ := window.ShiftBuffer([][]float64{
+		[]float64{1.0, 2.0, 3.0},
+		[]float64{4.0, 5.0, 6.0},
+	})
+	if err != nil {
+		t.Fatalf("unexpected: %v", err)
+	}
+	strideCounter, buffers, maskedUntil := window.Snapshot()
+	return &Checkpoint{
+		CreatedAt:        time.Now().UTC(),
+		WindowSize:       config.WindowSize,
+		StrideLength:     config.StrideLength,
+		SampleInterval:   config.SampleInterval,
+		StrideCounter:    strideCounter,
+		WindowBuffers:    buffers,
+		MaskedUntil:      maskedUntil,
+		StrideStartTimes: map[int]time.Time{1: now},
+		Accumulator:      acc.Snapshot(),
+		Rates:            map[uint64]CounterSample{3: {Value: 10.0, Timestamp: now}},
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	tempdir, err := os.MkdirTemp("", "corrjoinTest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	config := checkpointTestSettings()
+
+	c := makeTestCheckpoint(t, config)
+	if err = WriteCheckpoint(tempdir, c); err != nil {
+		t.Fatalf("failed to write checkpoint: %v", err)
+	}
+
+	restored, err := LoadLatestCheckpoint(tempdir, config)
+	if err != nil {
+		t.Fatalf("failed to load checkpoint: %v", err)
+	}
+	if restored == nil {
+		t.Fatalf("expected to find a checkpoint")
+	}
+	if !matrixEqual(restored.WindowBuffers, c.WindowBuffers, 0.0) {
+		t.Errorf("expected window buffers %v but got %v", c.WindowBuffers, restored.WindowBuffers)
+	}
+	if restored.StrideCounter != 1 {
+		t.Errorf("expected stride counter 1 but got %d", restored.StrideCounter)
+	}
+	if sample, ok := restored.Rates[uint64(3)]; !ok || sample.Value != 10.0 ||
+		!sample.Timestamp.Equal(c.Rates[uint64(3)].Timestamp) {
+		t.Errorf("expected counter samples %v but got %v", c.Rates, restored.Rates)
+	}
+
+	replies := make(chan *ObservationResult, 1)
+	acc := NewTimeseriesAccumulator(config.StrideLength, time.Now(), config.SampleInterval, 0, 0, replies)
+	if err = acc.Restore(restored.Accumulator); err != nil {
+		t.Fatalf("failed to restore accumulator: %v", err)
+	}
+	if len(acc.Tsids) != 2 || acc.rowmap[uint64(2)] != 1 {
+		t.Errorf("unexpected accumulator rows after restore: %v, %v", acc.Tsids, acc.rowmap)
+	}
+	if len(acc.buffers[1]) != 2 || acc.buffers[1][1] != 0.2 {
+		t.Errorf("unexpected buffer for ts2 after restore: %v", acc.buffers[1])
+	}
+	if !acc.currentStrideStartTs.Equal(c.Accumulator.CurrentStrideStartTs) {
+		t.Errorf("expected stride start %v but got %v", c.Accumulator.CurrentStrideStartTs, acc.currentStrideStartTs)
+	}
+
+	comparer := &comparisons.InProcessComparer{}
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	comparer.Initialize(config, results)
+	window := NewTimeseriesWindow(config, comparer)
+	if err = window.Restore(restored.StrideCounter, restored.WindowBuffers, restored.MaskedUntil); err != nil {
+		t.Fatalf("failed to restore window: %v", err)
+	}
+	if window.StrideCounter != 1 || len(window.buffers) != 2 {
+		t.Errorf("unexpected window state after restore")
+	}
+}
+
+func TestCheckpointRejectsCorruption(t *testing.T) {
+	tempdir, err := os.MkdirTemp("", "corrjoinTest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	config := checkpointTestSettings()
+
+	c := makeTestCheckpoint(t, config)
+	if err = WriteCheckpoint(tempdir, c); err != nil {
+		t.Fatalf("failed to write checkpoint: %v", err)
+	}
+	checkpoints, err := listCheckpoints(tempdir)
+	if err != nil || len(checkpoints) != 1 {
+		t.Fatalf("expected one checkpoint but got %v (%v)", checkpoints, err)
+	}
+	data, err := os.ReadFile(checkpoints[0])
+	if err != nil {
+		t.Fatalf("failed to read checkpoint: %v", err)
+	}
+
+	corrupted := make([]byte, len(data))
+	copy(corrupted, data)
+	corrupted[len(corrupted)/2] ^= 0xff
+	if err = os.WriteFile(checkpoints[0], corrupted, 0640); err != nil {
+		t.Fatalf("failed to write corrupted checkpoint: %v", err)
+	}
+	if _, err = ReadCheckpoint(checkpoints[0]); err == nil {
+		t.Errorf("expected an error for a corrupted checkpoint")
+	}
+
+	wrongVersion := make([]byte, len(data))
+	copy(wrongVersion, data)
+	wrongVersion[len(checkpointMagic)] = CHECKPOINT_VERSION + 1
+	if err = os.WriteFile(checkpoints[0], wrongVersion, 0640); err != nil {
+		t.Fatalf("failed to write checkpoint: %v", err)
+	}
+	if _, err = ReadCheckpoint(checkpoints[0]); err == nil {
+		t.Errorf("expected an error for a checkpoint with the wrong version")
+	}
+
+	restored, err := LoadLatestCheckpoint(tempdir, config)
+	if err != nil || restored != nil {
+		t.Errorf("expected no usable checkpoint but got %v (%v)", restored, err)
+	}
+}
+
+func TestCheckpointRejectsIncompatibleSettings(t *testing.T) {
+	tempdir, err := os.MkdirTemp("", "corrjoinTest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	config := checkpointTestSettings()
+
+	if err = WriteCheckpoint(tempdir, makeTestCheckpoint(t, config)); err != nil {
+		t.Fatalf("failed to write checkpoint: %v", err)
+	}
+	other := config
+	other.StrideLength = 2
+	restored, err := LoadLatestCheckpoint(tempdir, other)
+	if err != nil || restored != nil {
+		t.Errorf("expected checkpoint with a different stride length to be rejected")
+	}
+
+	old := makeTestCheckpoint(t, config)
+	old.CreatedAt = time.Now().Add(-time.Hour)
+	if err = old.validate(config); err == nil {
+		t.Errorf("expected a checkpoint older than the window to be rejected")
+	}
+}
+
+func TestCheckpointRejectsMissedStrides(t *testing.T) {
+	// The window is 300 seconds and a stride is 15 seconds.
+	config := checkpointTestSettings()
+	config.WindowSize = 60
+	c := makeTestCheckpoint(t, config)
+	c.CreatedAt = time.Now().Add(-10 * time.Second)
+	if err := c.validate(config); err != nil {
+		t.Errorf("expected a checkpoint from within the last stride to be accepted but got %v", err)
+	}
+	c.CreatedAt = time.Now().Add(-45 * time.Second)
+	if err := c.validate(config); err == nil {
+		t.Errorf("expected a checkpoint three strides old to be rejected")
+	}
+}
+
+func TestCheckpointRejectsBadState(t *testing.T) {
+	config := checkpointTestSettings()
+
+	c := makeTestCheckpoint(t, config)
+	c.WindowBuffers[1] = c.WindowBuffers[1][:1]
+	if err := c.validate(config); err == nil {
+		t.Errorf("expected a checkpoint with ragged window rows to be rejected")
+	}
+
+	c = makeTestCheckpoint(t, config)
+	c.Accumulator.Buffers[1] = []float64{1.0, 2.0, 3.0, 4.0}
+	if err := c.validate(config); err == nil {
+		t.Errorf("expected a checkpoint with an overlong accumulator buffer to be rejected")
+	}
+}
+
+func TestRemoveOldCheckpoints(t *testing.T) {
+	tempdir, err := os.MkdirTemp("", "corrjoinTest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	config := checkpointTestSettings()
+
+	c := makeTestCheckpoint(t, config)
+	for i := 0; i < 4; i++ {
+		c.CreatedAt = time.Unix(int64(1000+i), 0)
+		if err = WriteCheckpoint(tempdir, c); err != nil {
+			t.Fatalf("failed to write checkpoint: %v", err)
+		}
+	}
+	checkpoints, err := listCheckpoints(tempdir)
+	if err != nil {
+		t.Fatalf("unexpected: %v", err)
+	}
+	if len(checkpoints) != checkpointsToKeep {
+		t.Errorf("expected %d checkpoints but got %v", checkpointsToKeep, checkpoints)
+	}
+	if checkpoints[0] != filepath.Join(tempdir, "checkpoint_1003.ckpt") {
+		t.Errorf("expected newest checkpoint first but got %v", checkpoints)
+	}
+}
@@ -2,6 +2,7 @@ package comparisons
 
 import (
 	"github.com/kpaschen/corrjoin/lib/correlation"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
 	"github.com/kpaschen/corrjoin/lib/paa"
 	"github.com/kpaschen/corrjoin/lib/settings"
 	"github.com/prometheus/client_golang/prometheus"
@@ -25,16 +26,24 @@ var (
 			Help: "number of correlated pairs found",
 		},
 	)
+	insignificant_pairs = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "corrjoin_insignificant_pairs",
+			Help: "number of correlated pairs that were dropped because their p-value was too high",
+		},
+	)
 )
 
 type StrideStats struct {
-	comparisons int
-	correlated  int
+	comparisons   int
+	correlated    int
+	insignificant int
 }
 
 func init() {
 	prometheus.MustRegister(comparisons)
 	prometheus.MustRegister(correlated_pairs)
+	prometheus.MustRegister(insignificant_pairs)
 }
 
 type BaseComparer struct {
@@ -46,6 +55,9 @@ type BaseComparer struct {
 	strideCounter    int
 	paa2             map[int][]float64
 	constantPostPaa2 map[int]bool
+	// The autocorrelations of the rows, for the significance of correlated pairs.
+	// This is filled in lazily.
+	autocorrelations map[int][]float64
 
 	stats StrideStats
 }
@@ -73,8 +85,13 @@ func IsConstantRow(index int, constantRows []bool) bool {
 }
 
 func (b *BaseComparer) RecordStats() {
-	comparisons.Set(float64(b.stats.comparisons))
-	correlated_pairs.Set(float64(b.stats.correlated))
+	recordStats(b.stats)
+}
+
+func recordStats(stats StrideStats) {
+	comparisons.Set(float64(stats.comparisons))
+	correlated_pairs.Set(float64(stats.correlated))
+	insignificant_pairs.Set(float64(stats.insignificant))
 }
 
 func (b *BaseComparer) getVector(index int) []float64 {
@@ -139,6 +156,13 @@ func (b *BaseComparer) Compare(index1 int, index2 int) (float64, error) {
 	if err != nil {
 		return 0.0, err
 	}
+	if distance > b.config.Epsilon2 && b.config.NegativeCorrelations {
+		// Anti-correlated vectors are close to each other's negation.
+		distance, err = correlation.EuclideanDistance(paaVec1, correlation.Negate(paaVec2))
+		if err != nil {
+			return 0.0, err
+		}
+	}
 	if distance > b.config.Epsilon2 {
 		// Not a match
 		return 0.0, nil
@@ -152,9 +176,90 @@ func (b *BaseComparer) Compare(index1 int, index2 int) (float64, error) {
 		return 0.0, err
 	}
 
-	if pearson >= b.config.CorrelationThreshold {
+	if b.isMatch(pearson) {
 		b.stats.correlated++
 		return pearson, nil
 	}
 	return 0.0, nil
 }
+
+func (b *BaseComparer) isMatch(pearson float64) bool {
+	if pearson >= b.config.CorrelationThreshold {
+		return true
+	}
+	return b.config.NegativeCorrelations && pearson <= -b.config.CorrelationThreshold
+}
+
+// CompareLagged computes the lagged pearson correlation of the rows identified by
+// index1 and index2 for lags of up to config.MaxLag samples. It returns the best
+// coefficient and its lag if the coefficient reaches the correlation threshold
+// (or, with config.NegativeCorrelations, if it is at most -threshold).
+// The PAA filter does not apply here because it only holds for unshifted rows.
+func (b *BaseComparer) CompareLagged(index1 int, index2 int) (float64, int, error) {
+	vec1 := b.getVector(index1)
+	vec2 := b.getVector(index2)
+
+	if vec1 == nil || vec2 == nil {
+		log.Printf("did not find rows %d and %d in rows provided\n", index1, index2)
+		return 0.0, 0, nil
+	}
+	if len(vec1) != len(vec2) {
+		log.Printf("mismatched lengths %d vs. %d for vectors %d, %d", len(vec1), len(vec2), index1, index2)
+		return 0.0, 0, nil
+	}
+
+	b.stats.comparisons++
+	pearson, lag, err := correlation.LaggedPearsonCorrelation(vec1, vec2, b.config.MaxLag)
+	if err != nil {
+		return 0.0, 0, err
+	}
+	if pearson >= b.config.CorrelationThreshold {
+		b.stats.correlated++
+		return pearson, lag, nil
+	}
+	if b.config.NegativeCorrelations {
+		// The strongest negative correlation is the strongest positive correlation with -vec2.
+		pearson, lag, err = correlation.LaggedPearsonCorrelation(vec1, correlation.Negate(vec2), b.config.MaxLag)
+		if err != nil {
+			return 0.0, 0, err
+		}
+		if pearson >= b.config.CorrelationThreshold {
+			b.stats.correlated++
+			return -pearson, lag, nil
+		}
+	}
+	return 0.0, 0, nil
+}
+
+func (b *BaseComparer) getAutocorrelations(index int) []float64 {
+	if b.autocorrelations == nil {
+		b.autocorrelations = make(map[int][]float64)
+	}
+	auto, exists := b.autocorrelations[index]
+	if !exists {
+		auto = correlation.Autocorrelations(b.getVector(index))
+		b.autocorrelations[index] = auto
+	}
+	return auto
+}
+
+// Significance computes the p-value and confidence interval of the coefficient of the rows
+// identified by index1 and index2. Rows that are shifted against each other by lag
+// samples only overlap in the remaining samples.
+func (b *BaseComparer) Significance(index1 int, index2 int, coefficient float64, lag int) datatypes.Significance {
+	n := len(b.getVector(index1))
+	if lag < 0 {
+		n += lag
+	} else {
+		n -= lag
+	}
+	effectiveSamples := correlation.EffectiveSampleSize(n, b.getAutocorrelations(index1),
+		b.getAutocorrelations(index2))
+	low, high := correlation.ConfidenceInterval(coefficient, effectiveSamples)
+	return datatypes.Significance{
+		PValue:              correlation.PValue(coefficient, effectiveSamples),
+		ConfidenceLow:       low,
+		ConfidenceHigh:      high,
+		EffectiveSampleSize: effectiveSamples,
+	}
+}
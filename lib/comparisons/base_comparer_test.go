@@ -1,7 +1,9 @@
 package comparisons
 
 import (
+	"github.com/kpaschen/corrjoin/lib/paa"
 	"github.com/kpaschen/corrjoin/lib/settings"
+	"math/rand"
 	"testing"
 )
 
@@ -39,3 +41,144 @@ func TestCompare(t *testing.T) {
 		t.Errorf("expected correlation 1.0 but got %f", corr)
 	}
 }
+
+func TestCompareLagged(t *testing.T) {
+	rows := make(map[int][]float64)
+	rows[0] = []float64{1.0, 5.0, 2.0, 8.0, 3.0, 7.0, 1.0, 4.0}
+	// Row 1 is row 0 delayed by two samples.
+	rows[1] = []float64{6.0, 2.0, 1.0, 5.0, 2.0, 8.0, 3.0, 7.0}
+	bc := NewBaseComparer(
+		settings.CorrjoinSettings{CorrelationThreshold: 0.9, MaxLag: 3},
+		0,
+		rows,
+	)
+	corr, lag, err := bc.CompareLagged(0, 1)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if corr < 0.99 {
+		t.Errorf("expected correlation close to 1.0 but got %f", corr)
+	}
+	if lag != 2 {
+		t.Errorf("expected lag 2 but got %d", lag)
+	}
+
+	corr, lag, err = bc.CompareLagged(1, 0)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if corr < 0.99 || lag != -2 {
+		t.Errorf("expected correlation close to 1.0 at lag -2 but got %f at lag %d", corr, lag)
+	}
+
+	bc.config.MaxLag = 1
+	corr, _, err = bc.CompareLagged(0, 1)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if corr != 0.0 {
+		t.Errorf("expected no match with max lag 1 but got %f", corr)
+	}
+}
+
+func TestCompareNegative(t *testing.T) {
+	rows := make(map[int][]float64)
+	rows[0] = []float64{-1.0, 0.0, 1.0}
+	rows[1] = []float64{1.0, 0.0, -1.0}
+	config := settings.CorrjoinSettings{
+		EuclidDimensions:     3,
+		CorrelationThreshold: 0.9,
+		WindowSize:           3,
+	}.ComputeSettingsFields()
+	bc := NewBaseComparer(config, 0, rows)
+	corr, err := bc.Compare(0, 1)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if corr != 0.0 {
+		t.Errorf("expected no match without negative correlations but got %f", corr)
+	}
+
+	config.NegativeCorrelations = true
+	bc = NewBaseComparer(config, 0, rows)
+	corr, err = bc.Compare(0, 1)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if corr != -1.0 {
+		t.Errorf("expected correlation -1.0 but got %f", corr)
+	}
+}
+
+func TestSignificance(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	n := 1000
+	rows := make(map[int][]float64)
+	for i := 0; i < 4; i++ {
+		rows[i] = make([]float64, n)
+	}
+	// Rows 0 and 1 follow the same random walk, rows 2 and 3 share white noise.
+	walk := 0.0
+	for j := 0; j < n; j++ {
+		walk += rng.NormFloat64()
+		rows[0][j] = walk + 2.0*rng.NormFloat64()
+		rows[1][j] = walk + 2.0*rng.NormFloat64()
+		shared := rng.NormFloat64()
+		rows[2][j] = shared + 0.3*rng.NormFloat64()
+		rows[3][j] = shared + 0.3*rng.NormFloat64()
+	}
+	for _, row := range rows {
+		paa.NormalizeSlice(row)
+	}
+	config := settings.CorrjoinSettings{
+		Algorithm:            settings.ALGO_FULL_PEARSON,
+		EuclidDimensions:     10,
+		CorrelationThreshold: 0.8,
+		WindowSize:           n,
+	}.ComputeSettingsFields()
+	bc := NewBaseComparer(config, 0, rows)
+
+	walkMatch, err := bc.compareForMatch(0, 1)
+	if err != nil || walkMatch == nil {
+		t.Fatalf("expected rows 0 and 1 to match but got %v", err)
+	}
+	noiseMatch, err := bc.compareForMatch(2, 3)
+	if err != nil || noiseMatch == nil {
+		t.Fatalf("expected rows 2 and 3 to match but got %v", err)
+	}
+	walkSignificance, noiseSignificance := walkMatch.significance, noiseMatch.significance
+	if walkSignificance.EffectiveSampleSize > noiseSignificance.EffectiveSampleSize/10 {
+		t.Errorf("expected far fewer effective samples for the random walks but got %f vs. %f",
+			walkSignificance.EffectiveSampleSize, noiseSignificance.EffectiveSampleSize)
+	}
+	if noiseSignificance.EffectiveSampleSize < 0.8*float64(n) {
+		t.Errorf("expected close to %d effective samples for white noise but got %f", n,
+			noiseSignificance.EffectiveSampleSize)
+	}
+	if walkSignificance.PValue <= noiseSignificance.PValue {
+		t.Errorf("expected the random walks to be less significant but got p-values %g and %g",
+			walkSignificance.PValue, noiseSignificance.PValue)
+	}
+	for _, m := range []*match{walkMatch, noiseMatch} {
+		if m.significance.ConfidenceLow > m.pearson || m.significance.ConfidenceHigh < m.pearson {
+			t.Errorf("expected the confidence interval %+v to contain %f", m.significance, m.pearson)
+		}
+	}
+	if walkSignificance.ConfidenceHigh-walkSignificance.ConfidenceLow <=
+		noiseSignificance.ConfidenceHigh-noiseSignificance.ConfidenceLow {
+		t.Errorf("expected a wider confidence interval for the random walks")
+	}
+
+	// A p-value limit between the two only keeps the white noise pair.
+	config.MaxPValue = walkSignificance.PValue / 2
+	bc = NewBaseComparer(config, 0, rows)
+	if m, _ := bc.compareForMatch(0, 1); m != nil {
+		t.Errorf("expected the random walks to be dropped with max p-value %g", config.MaxPValue)
+	}
+	if m, _ := bc.compareForMatch(2, 3); m == nil {
+		t.Errorf("expected the white noise pair to be kept with max p-value %g", config.MaxPValue)
+	}
+	if bc.stats.insignificant != 1 {
+		t.Errorf("expected one insignificant pair but got %d", bc.stats.insignificant)
+	}
+}
@@ -0,0 +1,178 @@
+package comparisons
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	WORKER_START_PATH   = "/stride/start"
+	WORKER_COMPARE_PATH = "/stride/compare"
+	WORKER_STOP_PATH    = "/stride/stop"
+
+	// How many strides a worker keeps in memory.
+	workerStridesToKeep = 2
+)
+
+// strideData is what a DistributedComparer sends to its workers at the start of a stride.
+// It is gob-encoded because the matrix can be large.
+type strideData struct {
+	StrideCounter int
+	Config        settings.CorrjoinSettings
+	Matrix        [][]float64
+	ConstantRows  []bool
+
+	// The comparers that are not handling a request right now. They are kept for the
+	// whole stride so their caches are reused.
+	idleComparers []*BaseComparer
+}
+
+type compareRequest struct {
+	StrideCounter int      `json:"strideCounter"`
+	Pairs         [][2]int `json:"pairs"`
+}
+
+type compareResponse struct {
+	Result      *datatypes.CorrjoinResult `json:"result"`
+	Comparisons int                       `json:"comparisons"`
+	Correlated  int                       `json:"correlated"`
+	// The number of correlated pairs that were dropped for their p-value.
+	Insignificant int `json:"insignificant"`
+}
+
+type stopRequest struct {
+	StrideCounter int `json:"strideCounter"`
+}
+
+// A ComparisonWorker runs comparisons on behalf of a DistributedComparer in another process.
+type ComparisonWorker struct {
+	lock    sync.Mutex
+	strides map[int]*strideData
+}
+
+func NewComparisonWorker() *ComparisonWorker {
+	return &ComparisonWorker{
+		strides: make(map[int]*strideData),
+	}
+}
+
+// Handler returns the http handler for the worker api.
+func (w *ComparisonWorker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+WORKER_START_PATH, w.StartStride)
+	mux.HandleFunc("POST "+WORKER_COMPARE_PATH, w.Compare)
+	mux.HandleFunc("POST "+WORKER_STOP_PATH, w.StopStride)
+	return mux
+}
+
+func (w *ComparisonWorker) stride(strideCounter int) *strideData {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.strides[strideCounter]
+}
+
+// takeComparer returns an idle comparer for the stride, or a new one if they are all busy.
+func (w *ComparisonWorker) takeComparer(data *strideData) *BaseComparer {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var comparer *BaseComparer
+	if n := len(data.idleComparers); n > 0 {
+		comparer = data.idleComparers[n-1]
+		data.idleComparers = data.idleComparers[:n-1]
+	} else {
+		comparer = &BaseComparer{
+			config:           data.Config,
+			normalizedMatrix: data.Matrix,
+			strideCounter:    data.StrideCounter,
+			paa2:             make(map[int][]float64),
+			constantPostPaa2: make(map[int]bool),
+		}
+	}
+	// The stats are reported per request.
+	comparer.stats = StrideStats{}
+	return comparer
+}
+
+func (w *ComparisonWorker) releaseComparer(data *strideData, comparer *BaseComparer) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	data.idleComparers = append(data.idleComparers, comparer)
+}
+
+func (w *ComparisonWorker) StartStride(resp http.ResponseWriter, r *http.Request) {
+	data := &strideData{}
+	if err := gob.NewDecoder(r.Body).Decode(data); err != nil {
+		http.Error(resp, fmt.Sprintf("failed to decode stride data: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.lock.Lock()
+	w.strides[data.StrideCounter] = data
+	for strideCounter := range w.strides {
+		if strideCounter <= data.StrideCounter-workerStridesToKeep {
+			delete(w.strides, strideCounter)
+		}
+	}
+	w.lock.Unlock()
+	log.Printf("comparison worker got %d rows for stride %d\n", len(data.Matrix), data.StrideCounter)
+	resp.WriteHeader(http.StatusOK)
+}
+
+func (w *ComparisonWorker) Compare(resp http.ResponseWriter, r *http.Request) {
+	var req compareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(resp, fmt.Sprintf("failed to decode compare request: %v", err), http.StatusBadRequest)
+		return
+	}
+	data := w.stride(req.StrideCounter)
+	if data == nil {
+		http.Error(resp, fmt.Sprintf("unknown stride %d", req.StrideCounter), http.StatusNotFound)
+		return
+	}
+	// Requests can be handled concurrently, so a comparer is used by one request at a time.
+	comparer := w.takeComparer(data)
+	defer w.releaseComparer(data, comparer)
+	results := newResultBatch(data.Config)
+	for _, p := range req.Pairs {
+		if p[0] < 0 || p[1] < 0 || p[0] >= len(data.Matrix) || p[1] >= len(data.Matrix) {
+			http.Error(resp, fmt.Sprintf("row pair %v out of range", p), http.StatusBadRequest)
+			return
+		}
+		if IsConstantRow(p[0], data.ConstantRows) || IsConstantRow(p[1], data.ConstantRows) {
+			continue
+		}
+		m, err := comparer.compareForMatch(p[0], p[1])
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if m != nil {
+			results.add(m)
+		}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	json.NewEncoder(resp).Encode(compareResponse{
+		Result:        results.result(req.StrideCounter),
+		Comparisons:   comparer.stats.comparisons,
+		Correlated:    comparer.stats.correlated,
+		Insignificant: comparer.stats.insignificant,
+	})
+}
+
+func (w *ComparisonWorker) StopStride(resp http.ResponseWriter, r *http.Request) {
+	var req stopRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(resp, fmt.Sprintf("failed to decode stop request: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.lock.Lock()
+	delete(w.strides, req.StrideCounter)
+	w.lock.Unlock()
+	resp.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,22 @@
+package comparisons
+
+// A CountingEngine counts the comparisons of non-constant rows that it passes on to
+// its engine. The count starts over with every stride.
+type CountingEngine struct {
+	Engine
+	constantRows []bool
+	Compared     int
+}
+
+func (c *CountingEngine) StartStride(normalizedMatrix [][]float64, constantRows []bool, strideCounter int) error {
+	c.constantRows = constantRows
+	c.Compared = 0
+	return c.Engine.StartStride(normalizedMatrix, constantRows, strideCounter)
+}
+
+func (c *CountingEngine) Compare(index1 int, index2 int) error {
+	if !IsConstantRow(index1, c.constantRows) && !IsConstantRow(index2, c.constantRows) {
+		c.Compared++
+	}
+	return c.Engine.Compare(index1, index2)
+}
@@ -0,0 +1,397 @@
+package comparisons
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// The number of row pairs sent to a worker in one request.
+	REMOTE_PAIR_BATCH_SIZE = 4 * PAIR_BATCH_SIZE
+
+	workerRequestTimeout = 2 * time.Minute
+)
+
+var (
+	failedWorkers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_comparison_worker_failures_total",
+			Help: "Total number of times a comparison worker failed during a stride.",
+		},
+	)
+	locallyComparedBatches = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_locally_compared_batches_total",
+			Help: "Total number of pair batches compared locally because no worker was available.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(failedWorkers)
+	prometheus.MustRegister(locallyComparedBatches)
+}
+
+type remoteWorker struct {
+	url string
+	// alive is reset at the start of every stride.
+	alive bool
+}
+
+// A DistributedComparer implements Engine. It sends the normalized matrix to
+// comparison workers in other processes (see ComparisonWorker) and hands them
+// batches of row pairs over HTTP.
+// Every worker pulls batches from a shared queue, so faster workers get more pairs.
+// When a worker fails, it is not used again for the rest of the stride and its
+// batch goes to another worker. When there are no workers left, the comparisons
+// happen locally.
+type DistributedComparer struct {
+	// These are set in Initialize. The config can change between strides through Reconfigure.
+	config        settings.CorrjoinSettings
+	resultChannel chan<- *datatypes.CorrjoinResult
+	client        *http.Client
+
+	workersLock sync.Mutex
+	workers     []*remoteWorker
+
+	strideCounter int
+	matrix        [][]float64
+	constantRows  []bool
+	pairBatch     [][2]int
+	pairs         chan [][2]int
+	matches       chan []*match
+	senders       sync.WaitGroup
+	collector     sync.WaitGroup
+	// Every sender has its own BaseComparer for the batches it compares locally.
+	comparers []*BaseComparer
+
+	statsLock sync.Mutex
+	stats     StrideStats
+	err       error
+}
+
+func (s *DistributedComparer) Initialize(config settings.CorrjoinSettings, results chan<- *datatypes.CorrjoinResult) {
+	s.config = config
+	s.resultChannel = results
+	s.strideCounter = -1
+	s.client = &http.Client{Timeout: workerRequestTimeout}
+	s.workers = make([]*remoteWorker, len(config.ComparerWorkerURLs))
+	for i, url := range config.ComparerWorkerURLs {
+		s.workers[i] = &remoteWorker{url: url}
+	}
+}
+
+func (s *DistributedComparer) post(worker *remoteWorker, path string, contentType string, body []byte) ([]byte, error) {
+	resp, err := s.client.Post(worker.url+path, contentType, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("worker %s returned %s: %s", worker.url, resp.Status, string(respBody))
+	}
+	return respBody, nil
+}
+
+func (s *DistributedComparer) markFailed(worker *remoteWorker, err error) {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+	if worker.alive {
+		log.Printf("comparison worker %s failed during stride %d: %v\n", worker.url, s.strideCounter, err)
+		failedWorkers.Inc()
+	}
+	worker.alive = false
+}
+
+// liveWorkers returns the workers that have not failed during the current stride.
+func (s *DistributedComparer) liveWorkers() []*remoteWorker {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+	ret := make([]*remoteWorker, 0, len(s.workers))
+	for _, w := range s.workers {
+		if w.alive {
+			ret = append(ret, w)
+		}
+	}
+	return ret
+}
+
+func (s *DistributedComparer) Reconfigure(config settings.CorrjoinSettings) {
+	s.config = config
+}
+
+func (s *DistributedComparer) StartStride(normalizedMatrix [][]float64, constantRows []bool, strideCounter int) error {
+	if strideCounter < s.strideCounter {
+		return fmt.Errorf("got new stride %d but current stride %d is larger", strideCounter, s.strideCounter)
+	}
+	if strideCounter == s.strideCounter {
+		return fmt.Errorf("repeated StartStride call for stride %d", strideCounter)
+	}
+	if s.pairs != nil {
+		log.Printf("stride %d was not stopped before stride %d started\n", s.strideCounter, strideCounter)
+		s.drain()
+	}
+	s.strideCounter = strideCounter
+	s.matrix = normalizedMatrix
+	s.constantRows = constantRows
+	s.stats = StrideStats{}
+	s.err = nil
+
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(&strideData{
+		StrideCounter: strideCounter,
+		Config:        s.config,
+		Matrix:        normalizedMatrix,
+		ConstantRows:  constantRows,
+	})
+	if err != nil {
+		return err
+	}
+	s.workersLock.Lock()
+	for _, w := range s.workers {
+		w.alive = true
+	}
+	s.workersLock.Unlock()
+	var wg sync.WaitGroup
+	for _, w := range s.workers {
+		wg.Add(1)
+		go func(w *remoteWorker) {
+			defer wg.Done()
+			if _, err := s.post(w, WORKER_START_PATH, "application/x-gob", buffer.Bytes()); err != nil {
+				s.markFailed(w, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	live := s.liveWorkers()
+	log.Printf("sent %d rows for stride %d to %d of %d workers\n", len(normalizedMatrix), strideCounter,
+		len(live), len(s.workers))
+
+	s.pairBatch = make([][2]int, 0, REMOTE_PAIR_BATCH_SIZE)
+	s.pairs = make(chan [][2]int, 2*max(len(s.workers), 1))
+	s.matches = make(chan []*match, max(len(s.workers), 1))
+	// There is at least one sender so the pairs get compared locally if there are no workers.
+	s.comparers = make([]*BaseComparer, max(len(live), 1))
+	for i := range s.comparers {
+		var w *remoteWorker
+		if i < len(live) {
+			w = live[i]
+		}
+		s.comparers[i] = &BaseComparer{
+			config:           s.config,
+			normalizedMatrix: normalizedMatrix,
+			strideCounter:    strideCounter,
+			paa2:             make(map[int][]float64),
+			constantPostPaa2: make(map[int]bool),
+			stats:            StrideStats{},
+		}
+		s.senders.Add(1)
+		go s.send(w, s.comparers[i])
+	}
+	s.collector.Add(1)
+	go s.collect(strideCounter)
+	return nil
+}
+
+// send hands batches of pairs to a worker until the worker fails. After that,
+// it passes its batches on to other workers.
+func (s *DistributedComparer) send(worker *remoteWorker, comparer *BaseComparer) {
+	defer s.senders.Done()
+	for batch := range s.pairs {
+		if worker != nil {
+			err := s.compareRemotely(worker, batch)
+			if err == nil {
+				continue
+			}
+			s.markFailed(worker, err)
+			worker = nil
+		}
+		s.compareElsewhere(batch, comparer)
+	}
+}
+
+// compareElsewhere tries the remaining live workers one by one, and compares the
+// batch locally if there are none.
+func (s *DistributedComparer) compareElsewhere(batch [][2]int, comparer *BaseComparer) {
+	for _, w := range s.liveWorkers() {
+		err := s.compareRemotely(w, batch)
+		if err == nil {
+			return
+		}
+		s.markFailed(w, err)
+	}
+	locallyComparedBatches.Inc()
+	s.compareLocally(batch, comparer)
+}
+
+func (s *DistributedComparer) compareRemotely(worker *remoteWorker, batch [][2]int) error {
+	body, err := json.Marshal(compareRequest{StrideCounter: s.strideCounter, Pairs: batch})
+	if err != nil {
+		return err
+	}
+	respBody, err := s.post(worker, WORKER_COMPARE_PATH, "application/json", body)
+	if err != nil {
+		return err
+	}
+	var resp compareResponse
+	if err = json.Unmarshal(respBody, &resp); err != nil {
+		return err
+	}
+	if resp.Result == nil || resp.Result.StrideCounter != s.strideCounter {
+		return fmt.Errorf("worker %s sent a result for the wrong stride", worker.url)
+	}
+	found := make([]*match, 0, len(resp.Result.CorrelatedPairs))
+	for pair, pearson := range resp.Result.CorrelatedPairs {
+		found = append(found, &match{pair: pair, pearson: pearson, lag: resp.Result.Lags[pair],
+			significance: resp.Result.Significance[pair]})
+	}
+	s.addStats(StrideStats{comparisons: resp.Comparisons, correlated: resp.Correlated,
+		insignificant: resp.Insignificant})
+	if len(found) > 0 {
+		s.matches <- found
+	}
+	return nil
+}
+
+func (s *DistributedComparer) compareLocally(batch [][2]int, comparer *BaseComparer) {
+	var found []*match
+	for _, p := range batch {
+		m, err := comparer.compareForMatch(p[0], p[1])
+		if err != nil {
+			s.statsLock.Lock()
+			if s.err == nil {
+				s.err = err
+			}
+			s.statsLock.Unlock()
+			continue
+		}
+		if m != nil {
+			found = append(found, m)
+		}
+	}
+	if len(found) > 0 {
+		s.matches <- found
+	}
+}
+
+func (s *DistributedComparer) addStats(stats StrideStats) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	s.stats.comparisons += stats.comparisons
+	s.stats.correlated += stats.correlated
+	s.stats.insignificant += stats.insignificant
+}
+
+// collect merges the matches from all workers into result batches.
+func (s *DistributedComparer) collect(strideCounter int) {
+	defer s.collector.Done()
+	results := newResultBatch(s.config)
+	for found := range s.matches {
+		for _, m := range found {
+			results.add(m)
+			if results.full() {
+				s.resultChannel <- results.result(strideCounter)
+				results = newResultBatch(s.config)
+			}
+		}
+	}
+	if !results.empty() {
+		s.resultChannel <- results.result(strideCounter)
+	}
+}
+
+// Compare asks for a comparison of the rows identified by index1 and index2 in the
+// normalized matrix. The comparison happens asynchronously.
+func (s *DistributedComparer) Compare(index1 int, index2 int) error {
+	if s.strideCounter < 0 || s.pairs == nil {
+		return fmt.Errorf("asked for comparison but there is no current stride")
+	}
+	if IsConstantRow(index1, s.constantRows) || IsConstantRow(index2, s.constantRows) {
+		return nil
+	}
+	s.pairBatch = append(s.pairBatch, [2]int{index1, index2})
+	if len(s.pairBatch) >= REMOTE_PAIR_BATCH_SIZE {
+		s.pairs <- s.pairBatch
+		s.pairBatch = make([][2]int, 0, REMOTE_PAIR_BATCH_SIZE)
+	}
+	return nil
+}
+
+// drain waits until all pairs of the current stride have been compared and all
+// matches have been sent to the results channel.
+func (s *DistributedComparer) drain() {
+	if len(s.pairBatch) > 0 {
+		s.pairs <- s.pairBatch
+		s.pairBatch = nil
+	}
+	close(s.pairs)
+	s.senders.Wait()
+	close(s.matches)
+	s.collector.Wait()
+	s.pairs = nil
+	s.matches = nil
+}
+
+func (s *DistributedComparer) StopStride(strideCounter int) error {
+	if strideCounter != s.strideCounter || s.pairs == nil {
+		return fmt.Errorf("trying to stop stride %d but i am processing stride %d",
+			strideCounter, s.strideCounter)
+	}
+	s.drain()
+
+	// All results for this stride have been sent, so this is the last message for it.
+	s.resultChannel <- &datatypes.CorrjoinResult{
+		CorrelatedPairs: map[datatypes.RowPair]float64{},
+		StrideCounter:   s.strideCounter,
+	}
+
+	body, _ := json.Marshal(stopRequest{StrideCounter: strideCounter})
+	for _, w := range s.liveWorkers() {
+		if _, err := s.post(w, WORKER_STOP_PATH, "application/json", body); err != nil {
+			log.Printf("failed to stop stride %d on worker %s: %v\n", strideCounter, w.url, err)
+		}
+	}
+	s.matrix = nil
+	for _, c := range s.comparers {
+		s.addStats(c.stats)
+	}
+	s.comparers = nil
+
+	recordStats(s.stats)
+	log.Printf("stride %d complete on %d live workers, stats: %+v\n", strideCounter,
+		len(s.liveWorkers()), s.stats)
+
+	return s.err
+}
+
+// Shutdown gives the engine a chance to cancel running computations when it is deleted.
+func (s *DistributedComparer) Shutdown() error {
+
+	log.Println("distributed comparer shutting down")
+
+	if s.pairs != nil {
+		s.drain()
+	}
+
+	// Send stride end to results channel
+	s.resultChannel <- &datatypes.CorrjoinResult{
+		CorrelatedPairs: map[datatypes.RowPair]float64{},
+		StrideCounter:   s.strideCounter,
+	}
+
+	return nil
+}
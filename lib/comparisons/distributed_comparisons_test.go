@@ -0,0 +1,187 @@
+package comparisons
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+const workerEnvVariable = "CORRJOIN_TEST_COMPARISON_WORKER"
+
+// When the test binary is started with workerEnvVariable set, it runs a comparison
+// worker instead of the tests. That way the tests can use real worker processes.
+func TestMain(m *testing.M) {
+	if os.Getenv(workerEnvVariable) != "" {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to listen: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("listening on %s\n", listener.Addr().String())
+		http.Serve(listener, NewComparisonWorker().Handler())
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// startWorker starts a comparison worker process and returns its url.
+func startWorker(t *testing.T) (string, *exec.Cmd) {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), workerEnvVariable+"=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("failed to get worker stdout: %v", err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatalf("failed to start worker: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read worker address: %v", err)
+	}
+	address := strings.TrimPrefix(strings.TrimSpace(line), "listening on ")
+	return "http://" + address, cmd
+}
+
+func TestDistributedComparer(t *testing.T) {
+	matrix := correlatedMatrix(300, 60)
+	config := settings.CorrjoinSettings{
+		EuclidDimensions:     6,
+		CorrelationThreshold: 0.9,
+		WindowSize:           60,
+	}.ComputeSettingsFields()
+
+	inProcessResults := make(chan *datatypes.CorrjoinResult, 1)
+	inProcess := &InProcessComparer{}
+	inProcess.Initialize(config, inProcessResults)
+	expected, _ := runStride(t, inProcess, matrix, 0, inProcessResults)
+
+	workers := make([]*exec.Cmd, 3)
+	for i := range workers {
+		url, cmd := startWorker(t)
+		config.ComparerWorkerURLs = append(config.ComparerWorkerURLs, url)
+		workers[i] = cmd
+	}
+	config.Comparer = settings.COMPARER_DISTRIBUTED
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	engine, err := NewEngine(config, results)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	distributed := engine.(*DistributedComparer)
+
+	check := func(stride int, actual map[datatypes.RowPair]float64, terminal int) {
+		if terminal != 1 {
+			t.Errorf("expected one terminal result for stride %d but got %d", stride, terminal)
+		}
+		if len(actual) != len(expected) {
+			t.Errorf("expected %d pairs but got %d in stride %d", len(expected), len(actual), stride)
+		}
+		for pair, pearson := range expected {
+			if actual[pair] != pearson {
+				t.Errorf("expected %f for %v but got %f in stride %d", pearson, pair, actual[pair], stride)
+			}
+		}
+	}
+
+	// The workers send the significance of the pairs along with their coefficients.
+	actual := make(map[datatypes.RowPair]float64)
+	significance := make(map[datatypes.RowPair]datatypes.Significance)
+	terminal := runStrideObserving(t, distributed, matrix, 0, results, func() {},
+		func(result *datatypes.CorrjoinResult) {
+			for pair, pearson := range result.CorrelatedPairs {
+				actual[pair] = pearson
+				significance[pair] = result.Significance[pair]
+			}
+		})
+	check(0, actual, terminal)
+	for pair, s := range significance {
+		if s.PValue <= 0 || s.EffectiveSampleSize <= 0 {
+			t.Errorf("expected the significance of %v from the workers but got %+v", pair, s)
+			break
+		}
+	}
+	if len(distributed.liveWorkers()) != 3 {
+		t.Errorf("expected all workers to be alive")
+	}
+
+	// Kill a worker in the middle of a stride.
+	actual, terminal = runStrideWithHook(t, distributed, matrix, 1, results, func() {
+		workers[0].Process.Kill()
+		workers[0].Wait()
+	})
+	check(1, actual, terminal)
+	if len(distributed.liveWorkers()) != 2 {
+		t.Errorf("expected two live workers but got %d", len(distributed.liveWorkers()))
+	}
+
+	// Without any workers, the comparisons happen locally.
+	actual, terminal = runStrideWithHook(t, distributed, matrix, 2, results, func() {
+		workers[1].Process.Kill()
+		workers[2].Process.Kill()
+	})
+	check(2, actual, terminal)
+}
+
+func TestComparisonWorkerReusesComparers(t *testing.T) {
+	// Rows 0, 5 and 10 are copies of the same base row, so both pairs get compared.
+	matrix := correlatedMatrix(15, 60)
+	config := settings.CorrjoinSettings{
+		EuclidDimensions:     6,
+		CorrelationThreshold: 0.9,
+		WindowSize:           60,
+	}.ComputeSettingsFields()
+	worker := NewComparisonWorker()
+	server := httptest.NewServer(worker.Handler())
+	defer server.Close()
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(&strideData{StrideCounter: 1, Config: config, Matrix: matrix}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+WORKER_START_PATH, "application/x-gob", &buffer)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to start stride: %v", err)
+	}
+	resp.Body.Close()
+
+	for i := 1; i < 3; i++ {
+		body, _ := json.Marshal(compareRequest{StrideCounter: 1, Pairs: [][2]int{{0, 5 * i}}})
+		resp, err = http.Post(server.URL+WORKER_COMPARE_PATH, "application/json", bytes.NewReader(body))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to compare: %v", err)
+		}
+		var compared compareResponse
+		err = json.NewDecoder(resp.Body).Decode(&compared)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if compared.Comparisons != 1 {
+			t.Errorf("expected the stats of one comparison in request %d but got %d", i, compared.Comparisons)
+		}
+	}
+
+	data := worker.stride(1)
+	if len(data.idleComparers) != 1 {
+		t.Fatalf("expected the requests to share one comparer but there are %d", len(data.idleComparers))
+	}
+	if len(data.idleComparers[0].paa2) != 3 {
+		t.Errorf("expected the comparer to cache the paa of 3 rows but it has %d", len(data.idleComparers[0].paa2))
+	}
+}
@@ -3,6 +3,7 @@
 package comparisons
 
 import (
+	"fmt"
 	"github.com/kpaschen/corrjoin/lib/datatypes"
 	"github.com/kpaschen/corrjoin/lib/settings"
 )
@@ -13,6 +14,9 @@ type Engine interface {
 	// Initialize provides the engine with settings and a channel for results.
 	Initialize(config settings.CorrjoinSettings, results chan<- *datatypes.CorrjoinResult)
 
+	// Reconfigure replaces the settings, starting with the next stride.
+	Reconfigure(config settings.CorrjoinSettings)
+
 	// StartStride tells the engine that subsequent comparisons are for the new stride.
 	StartStride(normalizedMatrix [][]float64, constantRows []bool, strideCounter int) error
 
@@ -28,3 +32,23 @@ type Engine interface {
 	// Shutdown gives the engine a chance to cancel running computations when it is deleted.
 	Shutdown() error
 }
+
+// NewEngine returns an initialized engine of the type selected in config.
+func NewEngine(config settings.CorrjoinSettings, results chan<- *datatypes.CorrjoinResult) (Engine, error) {
+	var engine Engine
+	switch config.Comparer {
+	case settings.COMPARER_INPROCESS, "":
+		engine = &InProcessComparer{}
+	case settings.COMPARER_PARALLEL:
+		engine = &ParallelComparer{}
+	case settings.COMPARER_DISTRIBUTED:
+		if len(config.ComparerWorkerURLs) == 0 {
+			return nil, fmt.Errorf("the distributed comparer needs at least one worker url")
+		}
+		engine = &DistributedComparer{}
+	default:
+		return nil, fmt.Errorf("unsupported comparer %s", config.Comparer)
+	}
+	engine.Initialize(config, results)
+	return engine, nil
+}
@@ -15,14 +15,18 @@ const (
 
 // An InProcessComparer implements Engine.
 type InProcessComparer struct {
-	// These settings remain for the lifetime of an engine.
+	// These are set in Initialize. The config can change between strides through Reconfigure.
 	config        settings.CorrjoinSettings
 	constantRows  []bool
 	resultChannel chan<- *datatypes.CorrjoinResult
 
 	baseComparer  *BaseComparer
 	strideCounter int
-	resultsBuffer map[datatypes.RowPair]float64
+	results       *resultBatch
+
+	// Trial is set for comparers that try out settings while auto-tuning. They do not
+	// update the comparison metrics.
+	Trial bool
 }
 
 func (s *InProcessComparer) Initialize(config settings.CorrjoinSettings, results chan<- *datatypes.CorrjoinResult) {
@@ -31,6 +35,10 @@ func (s *InProcessComparer) Initialize(config settings.CorrjoinSettings, results
 	s.strideCounter = -1
 }
 
+func (s *InProcessComparer) Reconfigure(config settings.CorrjoinSettings) {
+	s.config = config
+}
+
 func (s *InProcessComparer) StartStride(normalizedMatrix [][]float64, constantRows []bool, strideCounter int) error {
 	if strideCounter < s.strideCounter {
 		return fmt.Errorf("got new stride %d but current stride %d is larger", strideCounter, s.strideCounter)
@@ -40,11 +48,14 @@ func (s *InProcessComparer) StartStride(normalizedMatrix [][]float64, constantRo
 	}
 	if s.baseComparer == nil {
 		s.baseComparer = &BaseComparer{
-			paa2:             make(map[int][]float64),
-			constantPostPaa2: make(map[int]bool),
-			stats:            StrideStats{},
+			stats: StrideStats{},
 		}
 	}
+	// The PAA and autocorrelation caches are keyed by row id. The data for a row changes
+	// from one stride to the next, and row ids change when rows are compacted, so start over.
+	s.baseComparer.paa2 = make(map[int][]float64)
+	s.baseComparer.constantPostPaa2 = make(map[int]bool)
+	s.baseComparer.autocorrelations = nil
 	s.strideCounter = strideCounter
 	s.constantRows = constantRows
 	s.baseComparer.normalizedMatrix = normalizedMatrix
@@ -54,7 +65,7 @@ func (s *InProcessComparer) StartStride(normalizedMatrix [][]float64, constantRo
 		comparisons: 0,
 		correlated:  0,
 	}
-	s.resultsBuffer = make(map[datatypes.RowPair]float64)
+	s.results = newResultBatch(s.config)
 
 	return nil
 }
@@ -68,26 +79,16 @@ func (s *InProcessComparer) Compare(index1 int, index2 int) error {
 	if IsConstantRow(index1, s.constantRows) || IsConstantRow(index2, s.constantRows) {
 		return nil
 	}
-	pearson, err := s.baseComparer.Compare(index1, index2)
+	m, err := s.baseComparer.compareForMatch(index1, index2)
 	if err != nil {
 		return err
 	}
-	if pearson > 0.0 {
+	if m != nil {
 		// This is a match, put it into our buffer.
-		var pair datatypes.RowPair
-		if index1 > index2 {
-			pair = *datatypes.NewRowPair(index2, index1)
-		} else {
-			pair = *datatypes.NewRowPair(index1, index2)
-		}
-		s.resultsBuffer[pair] = pearson
-
-		if len(s.resultsBuffer) >= BUFFER_SIZE {
-			s.resultChannel <- &datatypes.CorrjoinResult{
-				CorrelatedPairs: s.resultsBuffer,
-				StrideCounter:   s.strideCounter,
-			}
-			s.resultsBuffer = make(map[datatypes.RowPair]float64)
+		s.results.add(m)
+		if s.results.full() {
+			s.resultChannel <- s.results.result(s.strideCounter)
+			s.results = newResultBatch(s.config)
 		}
 	}
 	return nil
@@ -99,11 +100,8 @@ func (s *InProcessComparer) StopStride(strideCounter int) error {
 			strideCounter, s.strideCounter)
 	}
 	// If we have anything left in the buffer, send it now.
-	if len(s.resultsBuffer) > 0 {
-		s.resultChannel <- &datatypes.CorrjoinResult{
-			CorrelatedPairs: s.resultsBuffer,
-			StrideCounter:   s.strideCounter,
-		}
+	if !s.results.empty() {
+		s.resultChannel <- s.results.result(s.strideCounter)
 	}
 	// Send stride end to results channel
 	s.resultChannel <- &datatypes.CorrjoinResult{
@@ -111,7 +109,9 @@ func (s *InProcessComparer) StopStride(strideCounter int) error {
 		StrideCounter:   s.strideCounter,
 	}
 
-	s.baseComparer.RecordStats()
+	if !s.Trial {
+		s.baseComparer.RecordStats()
+	}
 	log.Printf("stride %d complete, stats: %+v\n", strideCounter, s.baseComparer.stats)
 
 	return nil
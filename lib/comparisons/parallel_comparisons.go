@@ -0,0 +1,211 @@
+package comparisons
+
+import (
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"log"
+	"runtime"
+	"sync"
+)
+
+const (
+	// The number of row pairs handed to a worker at a time.
+	PAIR_BATCH_SIZE = 256
+)
+
+// A ParallelComparer implements Engine. It hands the comparisons out to a pool
+// of worker goroutines. Every worker has its own BaseComparer, so the PAA cache
+// is per worker.
+type ParallelComparer struct {
+	// These are set in Initialize. The config can change between strides through Reconfigure.
+	config        settings.CorrjoinSettings
+	workerCount   int
+	resultChannel chan<- *datatypes.CorrjoinResult
+
+	strideCounter int
+	constantRows  []bool
+	// Pairs are collected into batches before they are handed to the workers.
+	pairBatch [][2]int
+	pairs     chan [][2]int
+	matches   chan []*match
+	workers   sync.WaitGroup
+	collector sync.WaitGroup
+	comparers []*BaseComparer
+	// The first error a worker ran into during the current stride.
+	errLock sync.Mutex
+	err     error
+}
+
+func (s *ParallelComparer) Initialize(config settings.CorrjoinSettings, results chan<- *datatypes.CorrjoinResult) {
+	s.config = config
+	s.resultChannel = results
+	s.strideCounter = -1
+	s.workerCount = config.ComparerWorkers
+	if s.workerCount <= 0 {
+		s.workerCount = runtime.NumCPU()
+	}
+}
+
+func (s *ParallelComparer) Reconfigure(config settings.CorrjoinSettings) {
+	s.config = config
+}
+
+func (s *ParallelComparer) StartStride(normalizedMatrix [][]float64, constantRows []bool, strideCounter int) error {
+	if strideCounter < s.strideCounter {
+		return fmt.Errorf("got new stride %d but current stride %d is larger", strideCounter, s.strideCounter)
+	}
+	if strideCounter == s.strideCounter {
+		return fmt.Errorf("repeated StartStride call for stride %d", strideCounter)
+	}
+	if s.pairs != nil {
+		// The previous stride was never stopped. Stop the workers, but do not
+		// send a stride end for it.
+		log.Printf("stride %d was not stopped before stride %d started\n", s.strideCounter, strideCounter)
+		s.drain()
+	}
+	s.strideCounter = strideCounter
+	s.constantRows = constantRows
+	s.err = nil
+	s.pairBatch = make([][2]int, 0, PAIR_BATCH_SIZE)
+	s.pairs = make(chan [][2]int, 2*s.workerCount)
+	s.matches = make(chan []*match, s.workerCount)
+	s.comparers = make([]*BaseComparer, s.workerCount)
+	for i := range s.comparers {
+		s.comparers[i] = &BaseComparer{
+			config:           s.config,
+			normalizedMatrix: normalizedMatrix,
+			strideCounter:    strideCounter,
+			paa2:             make(map[int][]float64),
+			constantPostPaa2: make(map[int]bool),
+			stats:            StrideStats{},
+		}
+		s.workers.Add(1)
+		go s.work(s.comparers[i])
+	}
+	s.collector.Add(1)
+	go s.collect(strideCounter)
+	return nil
+}
+
+func (s *ParallelComparer) work(comparer *BaseComparer) {
+	defer s.workers.Done()
+	for batch := range s.pairs {
+		var found []*match
+		for _, p := range batch {
+			m, err := comparer.compareForMatch(p[0], p[1])
+			if err != nil {
+				s.setError(err)
+				continue
+			}
+			if m != nil {
+				found = append(found, m)
+			}
+		}
+		if len(found) > 0 {
+			s.matches <- found
+		}
+	}
+}
+
+// collect merges the matches from all workers into result batches.
+func (s *ParallelComparer) collect(strideCounter int) {
+	defer s.collector.Done()
+	results := newResultBatch(s.config)
+	for found := range s.matches {
+		for _, m := range found {
+			results.add(m)
+			if results.full() {
+				s.resultChannel <- results.result(strideCounter)
+				results = newResultBatch(s.config)
+			}
+		}
+	}
+	if !results.empty() {
+		s.resultChannel <- results.result(strideCounter)
+	}
+}
+
+func (s *ParallelComparer) setError(err error) {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Compare asks for a comparison of the rows identified by index1 and index2 in the
+// normalized matrix. The comparison happens asynchronously, errors are reported by StopStride.
+func (s *ParallelComparer) Compare(index1 int, index2 int) error {
+	if s.strideCounter < 0 || s.pairs == nil {
+		return fmt.Errorf("asked for comparison but there is no current stride")
+	}
+	if IsConstantRow(index1, s.constantRows) || IsConstantRow(index2, s.constantRows) {
+		return nil
+	}
+	s.pairBatch = append(s.pairBatch, [2]int{index1, index2})
+	if len(s.pairBatch) >= PAIR_BATCH_SIZE {
+		s.pairs <- s.pairBatch
+		s.pairBatch = make([][2]int, 0, PAIR_BATCH_SIZE)
+	}
+	return nil
+}
+
+// drain waits until all pairs of the current stride have been compared and all
+// matches have been sent to the results channel.
+func (s *ParallelComparer) drain() {
+	if len(s.pairBatch) > 0 {
+		s.pairs <- s.pairBatch
+		s.pairBatch = nil
+	}
+	close(s.pairs)
+	s.workers.Wait()
+	close(s.matches)
+	s.collector.Wait()
+	s.pairs = nil
+	s.matches = nil
+}
+
+func (s *ParallelComparer) StopStride(strideCounter int) error {
+	if strideCounter != s.strideCounter || s.pairs == nil {
+		return fmt.Errorf("trying to stop stride %d but i am processing stride %d",
+			strideCounter, s.strideCounter)
+	}
+	s.drain()
+
+	// All results for this stride have been sent, so this is the last message for it.
+	s.resultChannel <- &datatypes.CorrjoinResult{
+		CorrelatedPairs: map[datatypes.RowPair]float64{},
+		StrideCounter:   s.strideCounter,
+	}
+
+	stats := StrideStats{}
+	for _, c := range s.comparers {
+		stats.comparisons += c.stats.comparisons
+		stats.correlated += c.stats.correlated
+		stats.insignificant += c.stats.insignificant
+	}
+	recordStats(stats)
+	log.Printf("stride %d complete on %d workers, stats: %+v\n", strideCounter, s.workerCount, stats)
+	s.comparers = nil
+
+	return s.err
+}
+
+// Shutdown gives the engine a chance to cancel running computations when it is deleted.
+func (s *ParallelComparer) Shutdown() error {
+
+	log.Println("parallel comparer shutting down")
+
+	if s.pairs != nil {
+		s.drain()
+	}
+
+	// Send stride end to results channel
+	s.resultChannel <- &datatypes.CorrjoinResult{
+		CorrelatedPairs: map[datatypes.RowPair]float64{},
+		StrideCounter:   s.strideCounter,
+	}
+
+	return nil
+}
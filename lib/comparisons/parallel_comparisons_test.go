@@ -0,0 +1,140 @@
+package comparisons
+
+import (
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/paa"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"math/rand"
+	"testing"
+)
+
+// runStride compares all pairs of rows in matrix and returns the merged results
+// and the number of terminal (empty) results.
+func runStride(t *testing.T, engine Engine, matrix [][]float64, strideCounter int,
+	results chan *datatypes.CorrjoinResult) (map[datatypes.RowPair]float64, int) {
+	return runStrideWithHook(t, engine, matrix, strideCounter, results, func() {})
+}
+
+// runStrideWithHook is like runStride, but calls hook halfway through the comparisons.
+func runStrideWithHook(t *testing.T, engine Engine, matrix [][]float64, strideCounter int,
+	results chan *datatypes.CorrjoinResult, hook func()) (map[datatypes.RowPair]float64, int) {
+	merged := make(map[datatypes.RowPair]float64)
+	terminal := runStrideObserving(t, engine, matrix, strideCounter, results, hook,
+		func(result *datatypes.CorrjoinResult) {
+			for pair, pearson := range result.CorrelatedPairs {
+				merged[pair] = pearson
+			}
+		})
+	return merged, terminal
+}
+
+// runStrideObserving compares all pairs of rows in matrix, calls hook halfway through the
+// comparisons and observe with every non-empty result. It returns the number of empty results.
+func runStrideObserving(t *testing.T, engine Engine, matrix [][]float64, strideCounter int,
+	results chan *datatypes.CorrjoinResult, hook func(), observe func(*datatypes.CorrjoinResult)) int {
+	done := make(chan bool)
+	terminal := 0
+	go func() {
+		for result := range results {
+			if result.StrideCounter != strideCounter {
+				t.Errorf("expected results for stride %d but got %d", strideCounter, result.StrideCounter)
+			}
+			if len(result.CorrelatedPairs) == 0 {
+				terminal++
+				break
+			}
+			observe(result)
+		}
+		done <- true
+	}()
+	if err := engine.StartStride(matrix, []bool{}, strideCounter); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < len(matrix); i++ {
+		if i == len(matrix)/2 {
+			hook()
+		}
+		for j := i + 1; j < len(matrix); j++ {
+			if err := engine.Compare(i, j); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+	if err := engine.StopStride(strideCounter); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-done
+	return terminal
+}
+
+// correlatedMatrix returns a normalized matrix whose rows are noisy copies of a few
+// base rows, so there are lots of matches.
+func correlatedMatrix(rowCount int, columnCount int) [][]float64 {
+	base := make([][]float64, 5)
+	for i := range base {
+		base[i] = make([]float64, columnCount)
+		for j := range base[i] {
+			base[i][j] = rand.Float64()
+		}
+	}
+	matrix := make([][]float64, rowCount)
+	for i := range matrix {
+		matrix[i] = make([]float64, columnCount)
+		for j := range matrix[i] {
+			matrix[i][j] = base[i%len(base)][j] + 0.05*rand.Float64()
+		}
+		paa.NormalizeSlice(matrix[i])
+	}
+	return matrix
+}
+
+func TestParallelComparer(t *testing.T) {
+	matrix := correlatedMatrix(300, 60)
+	config := settings.CorrjoinSettings{
+		EuclidDimensions:     6,
+		CorrelationThreshold: 0.9,
+		WindowSize:           60,
+		ComparerWorkers:      4,
+	}.ComputeSettingsFields()
+
+	inProcessResults := make(chan *datatypes.CorrjoinResult, 1)
+	inProcess := &InProcessComparer{}
+	inProcess.Initialize(config, inProcessResults)
+	expected, _ := runStride(t, inProcess, matrix, 0, inProcessResults)
+	if len(expected) < BUFFER_SIZE {
+		t.Fatalf("expected more than one batch of results but got %d", len(expected))
+	}
+
+	parallelResults := make(chan *datatypes.CorrjoinResult, 1)
+	parallel := &ParallelComparer{}
+	parallel.Initialize(config, parallelResults)
+	for stride := 0; stride < 2; stride++ {
+		actual, terminal := runStride(t, parallel, matrix, stride, parallelResults)
+		if terminal != 1 {
+			t.Errorf("expected one terminal result for stride %d but got %d", stride, terminal)
+		}
+		if len(actual) != len(expected) {
+			t.Errorf("expected %d pairs but got %d in stride %d", len(expected), len(actual), stride)
+		}
+		for pair, pearson := range expected {
+			if actual[pair] != pearson {
+				t.Errorf("expected %f for %v but got %f", pearson, pair, actual[pair])
+			}
+		}
+	}
+}
+
+func TestNewEngine(t *testing.T) {
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	engine, err := NewEngine(settings.CorrjoinSettings{Comparer: settings.COMPARER_PARALLEL}, results)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := engine.(*ParallelComparer); !ok {
+		t.Errorf("expected a parallel comparer but got %T", engine)
+	}
+	_, err = NewEngine(settings.CorrjoinSettings{Comparer: "nonsense"}, results)
+	if err == nil {
+		t.Errorf("expected an error for an unknown comparer")
+	}
+}
@@ -0,0 +1,90 @@
+package comparisons
+
+import (
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/settings"
+)
+
+// A match is a pair of rows that passed a comparison.
+type match struct {
+	pair         datatypes.RowPair
+	pearson      float64
+	lag          int
+	significance datatypes.Significance
+}
+
+// compareForMatch compares two rows with the comparison that fits the configured
+// algorithm. It returns nil if the rows are not correlated.
+func (b *BaseComparer) compareForMatch(index1 int, index2 int) (*match, error) {
+	var pearson float64
+	var lag int
+	var err error
+	if b.config.Algorithm == settings.ALGO_LAGGED_PEARSON {
+		pearson, lag, err = b.CompareLagged(index1, index2)
+	} else {
+		pearson, err = b.Compare(index1, index2)
+	}
+	if err != nil || pearson == 0.0 {
+		return nil, err
+	}
+	significance := b.Significance(index1, index2, pearson, lag)
+	if b.config.MaxPValue > 0.0 && significance.PValue > b.config.MaxPValue {
+		b.stats.insignificant++
+		return nil, nil
+	}
+	if index1 > index2 {
+		// The lag is relative to index1, so flip it for the pair.
+		return &match{pair: *datatypes.NewRowPair(index2, index1), pearson: pearson, lag: -lag,
+			significance: significance}, nil
+	}
+	return &match{pair: *datatypes.NewRowPair(index1, index2), pearson: pearson, lag: lag,
+		significance: significance}, nil
+}
+
+// A resultBatch collects matches until there are enough of them to send a CorrjoinResult.
+type resultBatch struct {
+	pairs map[datatypes.RowPair]float64
+	// Lags are only recorded for the lagged algorithm.
+	lags         map[datatypes.RowPair]int
+	significance map[datatypes.RowPair]datatypes.Significance
+	// The correlation measure the pairs were compared with.
+	measure string
+}
+
+func newResultBatch(config settings.CorrjoinSettings) *resultBatch {
+	batch := &resultBatch{
+		pairs:        make(map[datatypes.RowPair]float64),
+		significance: make(map[datatypes.RowPair]datatypes.Significance),
+		measure:      config.CorrelationMeasure,
+	}
+	if config.Algorithm == settings.ALGO_LAGGED_PEARSON {
+		batch.lags = make(map[datatypes.RowPair]int)
+	}
+	return batch
+}
+
+func (r *resultBatch) add(m *match) {
+	r.pairs[m.pair] = m.pearson
+	r.significance[m.pair] = m.significance
+	if r.lags != nil {
+		r.lags[m.pair] = m.lag
+	}
+}
+
+func (r *resultBatch) full() bool {
+	return len(r.pairs) >= BUFFER_SIZE
+}
+
+func (r *resultBatch) empty() bool {
+	return len(r.pairs) == 0
+}
+
+func (r *resultBatch) result(strideCounter int) *datatypes.CorrjoinResult {
+	return &datatypes.CorrjoinResult{
+		CorrelatedPairs: r.pairs,
+		Lags:            r.lags,
+		Significance:    r.significance,
+		StrideCounter:   strideCounter,
+		Measure:         r.measure,
+	}
+}
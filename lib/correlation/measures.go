@@ -0,0 +1,59 @@
+package correlation
+
+import (
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"sort"
+)
+
+// A RowTransform maps a row to the values that the pearson correlation is computed on.
+// The transform happens before the rows are normalized, so the PAA and SVD filters
+// bound the pearson correlation of the transformed rows.
+type RowTransform func(row []float64) []float64
+
+// NewRowTransform returns the transform for one of the settings.MEASURE_ constants.
+// It returns nil for the plain pearson correlation.
+func NewRowTransform(measure string) (RowTransform, error) {
+	switch measure {
+	case settings.MEASURE_PEARSON, "":
+		return nil, nil
+	case settings.MEASURE_SPEARMAN:
+		return Ranks, nil
+	default:
+		return nil, fmt.Errorf("unsupported correlation measure %s", measure)
+	}
+}
+
+// Ranks returns the rank of every value in x, starting at 1.
+// Tied values all get the average of their ranks.
+func Ranks(x []float64) []float64 {
+	order := make([]int, len(x))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return x[order[i]] < x[order[j]] })
+
+	ret := make([]float64, len(x))
+	for start := 0; start < len(order); {
+		end := start + 1
+		for end < len(order) && x[order[end]] == x[order[start]] {
+			end++
+		}
+		// The ranks start..end-1 (zero-based) are shared by the tied values.
+		rank := float64(start+end+1) / 2.0
+		for _, i := range order[start:end] {
+			ret[i] = rank
+		}
+		start = end
+	}
+	return ret
+}
+
+// SpearmanCorrelation computes the Spearman rank correlation of x and y, which is
+// the pearson correlation of their ranks.
+func SpearmanCorrelation(x []float64, y []float64) (float64, error) {
+	if len(x) != len(y) {
+		return 0.0, fmt.Errorf("correlation needs arguments of the same length")
+	}
+	return PearsonCorrelation(Ranks(x), Ranks(y))
+}
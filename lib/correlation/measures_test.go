@@ -0,0 +1,65 @@
+package correlation
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRanks(t *testing.T) {
+	ranks := Ranks([]float64{3.0, 1.0, 4.0, 1.0, 5.0})
+	expected := []float64{3.0, 1.5, 4.0, 1.5, 5.0}
+	for i, r := range expected {
+		if ranks[i] != r {
+			t.Errorf("expected rank %f at %d but got %f", r, i, ranks[i])
+		}
+	}
+	if len(Ranks([]float64{})) != 0 {
+		t.Errorf("expected no ranks for an empty slice")
+	}
+}
+
+func TestSpearmanCorrelation(t *testing.T) {
+	// y is a monotonic but not linear function of x.
+	x := []float64{0.1, 0.5, 1.0, 2.0, 3.0, 4.0}
+	y := make([]float64, len(x))
+	for i, xi := range x {
+		y[i] = math.Exp(3 * xi)
+	}
+	spearman, err := SpearmanCorrelation(x, y)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if math.Abs(spearman-1.0) > 1e-9 {
+		t.Errorf("expected spearman correlation 1 but got %f", spearman)
+	}
+	pearson, _ := PearsonCorrelation(x, y)
+	if pearson > 0.9 {
+		t.Errorf("expected a weaker pearson correlation but got %f", pearson)
+	}
+
+	// The textbook example with d^2 = 4: 1 - 6 * 4 / (5 * 24) = 0.8
+	spearman, _ = SpearmanCorrelation([]float64{1, 2, 3, 4, 5}, []float64{2, 1, 4, 3, 5})
+	if math.Abs(spearman-0.8) > 1e-9 {
+		t.Errorf("expected spearman correlation 0.8 but got %f", spearman)
+	}
+
+	if _, err = SpearmanCorrelation([]float64{1, 2}, []float64{1, 2, 3}); err == nil {
+		t.Errorf("expected an error for vectors of unequal length")
+	}
+}
+
+func TestNewRowTransform(t *testing.T) {
+	for _, measure := range []string{"", "pearson"} {
+		transform, err := NewRowTransform(measure)
+		if err != nil || transform != nil {
+			t.Errorf("expected no transform for %q but got %v", measure, err)
+		}
+	}
+	transform, err := NewRowTransform("spearman")
+	if err != nil || transform == nil {
+		t.Fatalf("expected a transform for spearman but got %v", err)
+	}
+	if _, err = NewRowTransform("kendall"); err == nil {
+		t.Errorf("expected an error for an unsupported measure")
+	}
+}
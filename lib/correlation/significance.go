@@ -0,0 +1,94 @@
+package correlation
+
+import (
+	"gonum.org/v1/gonum/mathext"
+	"math"
+)
+
+const (
+	// Autocorrelations are computed for at most this many lags, and at most
+	// for a quarter of the row length.
+	MaxAutocorrelationLag = 50
+
+	// The z value for a two-sided 95% confidence interval.
+	confidenceZ = 1.959964
+)
+
+// Autocorrelations returns the autocorrelations of row at lags 1 to
+// min(MaxAutocorrelationLag, len(row)/4). The result is nil for constant rows.
+func Autocorrelations(row []float64) []float64 {
+	n := len(row)
+	maxLag := min(MaxAutocorrelationLag, n/4)
+	mean := 0.0
+	for _, v := range row {
+		mean += v
+	}
+	mean /= float64(n)
+	variance := 0.0
+	for _, v := range row {
+		variance += (v - mean) * (v - mean)
+	}
+	if variance == 0.0 {
+		return nil
+	}
+	ret := make([]float64, maxLag)
+	for k := 1; k <= maxLag; k++ {
+		sum := 0.0
+		for t := 0; t+k < n; t++ {
+			sum += (row[t] - mean) * (row[t+k] - mean)
+		}
+		ret[k-1] = sum / variance
+	}
+	return ret
+}
+
+// EffectiveSampleSize returns the number of independent samples that n samples of two
+// timeseries with the given autocorrelations are worth when computing their
+// correlation (Bartlett 1935, Bayley and Hammersley 1946):
+//
+//	n / (1 + 2 sum_k (1 - k/n) a1[k] a2[k])
+//
+// The sum stops at the first lag where one of the autocorrelations is no longer positive,
+// since the estimates after that point are mostly noise.
+// The result is between 2 and n.
+func EffectiveSampleSize(n int, auto1 []float64, auto2 []float64) float64 {
+	sum := 0.0
+	for k := 0; k < len(auto1) && k < len(auto2); k++ {
+		if auto1[k] <= 0.0 || auto2[k] <= 0.0 {
+			break
+		}
+		sum += (1.0 - float64(k+1)/float64(n)) * auto1[k] * auto2[k]
+	}
+	return max(2.0, min(float64(n), float64(n)/(1.0+2.0*sum)))
+}
+
+// PValue returns the two-sided p-value of the correlation coefficient r for the
+// null hypothesis that the timeseries are uncorrelated, using a t-test with
+// effectiveSamples - 2 degrees of freedom.
+func PValue(r float64, effectiveSamples float64) float64 {
+	df := effectiveSamples - 2.0
+	if df <= 0.0 || math.IsNaN(r) {
+		return 1.0
+	}
+	r2 := r * r
+	if r2 >= 1.0 {
+		return 0.0
+	}
+	// With t^2 = df r^2 / (1 - r^2), the two-sided tail of the t distribution is
+	// I(df / (df + t^2); df/2, 1/2) = I(1 - r^2; df/2, 1/2).
+	return mathext.RegIncBeta(df/2.0, 0.5, 1.0-r2)
+}
+
+// ConfidenceInterval returns the 95% confidence interval of the correlation coefficient r
+// from the Fisher transformation.
+func ConfidenceInterval(r float64, effectiveSamples float64) (float64, float64) {
+	if effectiveSamples <= 3.0 || math.IsNaN(r) {
+		return -1.0, 1.0
+	}
+	z := math.Atanh(max(-1.0, min(1.0, r)))
+	if math.IsInf(z, 0) {
+		return r, r
+	}
+	delta := confidenceZ / math.Sqrt(effectiveSamples-3.0)
+	return math.Tanh(z - delta), math.Tanh(z + delta)
+}
@@ -0,0 +1,79 @@
+package correlation
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestAutocorrelations(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	noise := make([]float64, 400)
+	walk := make([]float64, 400)
+	value := 0.0
+	for i := range noise {
+		noise[i] = rng.NormFloat64()
+		value += rng.NormFloat64()
+		walk[i] = value
+	}
+	noiseAuto := Autocorrelations(noise)
+	walkAuto := Autocorrelations(walk)
+	if len(noiseAuto) != MaxAutocorrelationLag || len(walkAuto) != MaxAutocorrelationLag {
+		t.Fatalf("expected %d autocorrelations but got %d and %d", MaxAutocorrelationLag,
+			len(noiseAuto), len(walkAuto))
+	}
+	if math.Abs(noiseAuto[0]) > 0.15 {
+		t.Errorf("expected a small autocorrelation for white noise but got %f", noiseAuto[0])
+	}
+	if walkAuto[0] < 0.9 {
+		t.Errorf("expected a large autocorrelation for a random walk but got %f", walkAuto[0])
+	}
+	if len(Autocorrelations(make([]float64, 20))) != 0 {
+		t.Errorf("expected no autocorrelations for a constant row")
+	}
+	if len(Autocorrelations(noise[:20])) != 5 {
+		t.Errorf("expected autocorrelations for a quarter of a short row")
+	}
+
+	if n := EffectiveSampleSize(400, noiseAuto, walkAuto); n < 300 {
+		t.Errorf("expected most samples to count when one row is white noise but got %f", n)
+	}
+	if n := EffectiveSampleSize(400, walkAuto, walkAuto); n > 40 {
+		t.Errorf("expected few effective samples for random walks but got %f", n)
+	}
+	if n := EffectiveSampleSize(400, nil, walkAuto); n != 400 {
+		t.Errorf("expected all samples to count without autocorrelations but got %f", n)
+	}
+}
+
+func TestPValue(t *testing.T) {
+	// t = 0.5 * sqrt(10 / 0.75) = 1.826 with 10 degrees of freedom.
+	if p := PValue(0.5, 12); math.Abs(p-0.0980) > 0.0005 {
+		t.Errorf("expected p-value 0.098 but got %f", p)
+	}
+	if p := PValue(-0.5, 12); math.Abs(p-0.0980) > 0.0005 {
+		t.Errorf("expected p-value 0.098 for a negative coefficient but got %f", p)
+	}
+	if p := PValue(0.9, 2); p != 1.0 {
+		t.Errorf("expected p-value 1 without degrees of freedom but got %f", p)
+	}
+	if p := PValue(1.0, 100); p != 0.0 {
+		t.Errorf("expected p-value 0 for a perfect correlation but got %f", p)
+	}
+}
+
+func TestConfidenceInterval(t *testing.T) {
+	// atanh(0.5) = 0.5493 and the standard error is 1/5.
+	low, high := ConfidenceInterval(0.5, 28)
+	if math.Abs(low-0.1560) > 0.001 || math.Abs(high-0.7358) > 0.001 {
+		t.Errorf("expected the interval (0.156, 0.736) but got (%f, %f)", low, high)
+	}
+	low, high = ConfidenceInterval(-0.5, 28)
+	if math.Abs(low+0.7358) > 0.001 || math.Abs(high+0.1560) > 0.001 {
+		t.Errorf("expected the interval (-0.736, -0.156) but got (%f, %f)", low, high)
+	}
+	low, high = ConfidenceInterval(0.9, 3)
+	if low != -1.0 || high != 1.0 {
+		t.Errorf("expected the whole range for too few samples but got (%f, %f)", low, high)
+	}
+}
@@ -34,3 +34,57 @@ func PearsonCorrelation(x []float64, y []float64) (float64, error) {
 
 	return (n*s5 - (s1 * s3)) / math.Sqrt((n*s2-s1*s1)*(n*s4-s3*s3)), nil
 }
+
+// LaggedPearsonCorrelation computes the Pearson correlation of x and y shifted
+// against each other by -maxLag to maxLag samples, and returns the highest
+// coefficient together with its lag.
+// A positive lag means that x leads y: x[t] is compared to y[t+lag].
+// Only the overlapping parts of x and y are compared, so large lags reduce the
+// number of samples that go into the coefficient.
+func LaggedPearsonCorrelation(x []float64, y []float64, maxLag int) (float64, int, error) {
+	if len(x) != len(y) {
+		return 0.0, 0, fmt.Errorf("correlation needs arguments of the same length")
+	}
+	if maxLag >= len(x)-1 {
+		return 0.0, 0, fmt.Errorf("lag %d is too large for vectors of length %d", maxLag, len(x))
+	}
+	bestPearson := math.Inf(-1)
+	bestLag := 0
+	for lag := -maxLag; lag <= maxLag; lag++ {
+		var pearson float64
+		if lag >= 0 {
+			pearson, _ = PearsonCorrelation(x[:len(x)-lag], y[lag:])
+		} else {
+			pearson, _ = PearsonCorrelation(x[-lag:], y[:len(y)+lag])
+		}
+		if math.IsNaN(pearson) {
+			continue
+		}
+		// Prefer the smaller lag when two lags give the same coefficient.
+		if pearson > bestPearson || (pearson == bestPearson && abs(lag) < abs(bestLag)) {
+			bestPearson = pearson
+			bestLag = lag
+		}
+	}
+	if math.IsInf(bestPearson, -1) {
+		return math.NaN(), 0, nil
+	}
+	return bestPearson, bestLag, nil
+}
+
+// Negate returns a copy of vec with every value negated. The pearson correlation of x
+// and Negate(y) is the negated pearson correlation of x and y.
+func Negate(vec []float64) []float64 {
+	ret := make([]float64, len(vec))
+	for i, v := range vec {
+		ret[i] = -v
+	}
+	return ret
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
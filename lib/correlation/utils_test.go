@@ -75,3 +75,41 @@ func TestPearsonCorrelation(t *testing.T) {
 		}
 	}
 }
+
+func TestLaggedPearsonCorrelation(t *testing.T) {
+	x := []float64{0.0, 1.0, 0.0, 3.0, 1.0, 2.0, 0.0, 5.0, 1.0, 0.0}
+	// y is x delayed by two samples.
+	y := []float64{4.0, 2.0, 0.0, 1.0, 0.0, 3.0, 1.0, 2.0, 0.0, 5.0}
+
+	pearson, lag, err := LaggedPearsonCorrelation(x, y, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lag != 2 {
+		t.Errorf("expected x to lead y by 2 but got lag %d", lag)
+	}
+	if math.Abs(pearson-1.0) > 0.0001 {
+		t.Errorf("expected correlation close to 1 but got %f", pearson)
+	}
+
+	pearson, lag, err = LaggedPearsonCorrelation(y, x, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lag != -2 {
+		t.Errorf("expected y to lag x by 2 but got lag %d", lag)
+	}
+
+	pearson, lag, err = LaggedPearsonCorrelation(x, x, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lag != 0 || math.Abs(pearson-1.0) > 0.0001 {
+		t.Errorf("expected lag 0 and correlation 1 for identical vectors but got %d and %f", lag, pearson)
+	}
+
+	_, _, err = LaggedPearsonCorrelation(x, y, 9)
+	if err == nil {
+		t.Errorf("expected an error for a lag that is too large")
+	}
+}
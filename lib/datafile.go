@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReadStrides reads space-separated floats from input and calls process once for every
+// stride columns of data. The input is in column-major order, so the nth line is the
+// data at time n and has an entry for every timeseries. All the processing uses the
+// transpose of that matrix, so process gets one row per timeseries and one column per
+// point in time. A partial stride at the end of the input is not processed.
+func ReadStrides(input io.Reader, stride int, process func([][]float64) error) error {
+	reader := bufio.NewReader(input)
+	var data [][]float64
+	rowCount := 0
+	columnCount := 0
+	lineNumber := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		} // err is usually io.EOF
+		lineNumber++
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) == 0 {
+			break
+		}
+		parts := strings.Split(line, " ")
+		if rowCount == 0 {
+			// This is the number of columns in the input, and it ends up being the number
+			// of rows in the result matrix.
+			rowCount = len(parts)
+		} else if rowCount != len(parts) {
+			return fmt.Errorf("inconsistent number of values in line %d: expected %d but got %d",
+				lineNumber, rowCount, len(parts))
+		}
+		if data == nil {
+			data = make([][]float64, rowCount)
+			for i := range data {
+				data[i] = make([]float64, stride)
+			}
+		}
+		for i, p := range parts {
+			data[i][columnCount], err = strconv.ParseFloat(p, 64)
+			if err != nil {
+				return fmt.Errorf("on line %d, failed to parse %s into a float: %v", lineNumber, p, err)
+			}
+		}
+		columnCount++
+		if columnCount >= stride {
+			if err = process(data); err != nil {
+				return err
+			}
+			columnCount = 0
+			data = nil
+		}
+	}
+	return nil
+}
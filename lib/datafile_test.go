@@ -0,0 +1,27 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadStrides(t *testing.T) {
+	var strides [][][]float64
+	process := func(data [][]float64) error {
+		strides = append(strides, data)
+		return nil
+	}
+	// Five points in time for two timeseries; the last one is not a full stride.
+	if err := ReadStrides(strings.NewReader("1 2\n3 4\n5 6\n7 8\n9 10\n"), 2, process); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(strides) != 2 || strides[1][0][1] != 7 || strides[1][1][0] != 6 {
+		t.Errorf("expected two transposed strides but got %v", strides)
+	}
+
+	for _, input := range []string{"1 2\n3\n", "1 2\nx 4\n"} {
+		if err := ReadStrides(strings.NewReader(input), 2, process); err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
@@ -12,9 +12,28 @@ type RowPair struct {
 	R2 int
 }
 
+// Significance says how likely a correlation coefficient is to come from uncorrelated
+// timeseries, taking the autocorrelation of the timeseries into account.
+type Significance struct {
+	PValue float64 `json:"pValue"`
+	// The 95% confidence interval of the coefficient.
+	ConfidenceLow  float64 `json:"confidenceLow"`
+	ConfidenceHigh float64 `json:"confidenceHigh"`
+	// The number of independent samples the window is worth for this pair.
+	EffectiveSampleSize float64 `json:"effectiveSampleSize"`
+}
+
 type CorrjoinResult struct {
 	CorrelatedPairs map[RowPair]float64
-	StrideCounter   int
+	// Lags is only set by algorithms that look for lagged correlations.
+	// A positive lag means that the first row in the pair leads the second one
+	// by that many samples.
+	Lags map[RowPair]int
+	// The significance of the coefficients in CorrelatedPairs.
+	Significance  map[RowPair]Significance
+	StrideCounter int
+	// The correlation measure that produced the coefficients, one of the settings.MEASURE_ constants.
+	Measure string
 }
 
 func (r RowPair) RowIds() [2]int {
@@ -67,25 +86,87 @@ func retranslateMap(pairs map[string]float64) map[RowPair]float64 {
 	return ret
 }
 
+func translateLags(lags map[RowPair]int) map[string]int {
+	if lags == nil {
+		return nil
+	}
+	ret := make(map[string]int)
+	for key, val := range lags {
+		k, _ := (&key).MarshalJSON()
+		ret[string(k[:])] = val
+	}
+	return ret
+}
+
+func retranslateLags(lags map[string]int) map[RowPair]int {
+	if lags == nil {
+		return nil
+	}
+	ret := make(map[RowPair]int)
+	var rp RowPair
+	for key, val := range lags {
+		(&rp).UnmarshalJSON([]byte(key))
+		ret[rp] = val
+	}
+	return ret
+}
+
+func translateSignificance(significance map[RowPair]Significance) map[string]Significance {
+	if significance == nil {
+		return nil
+	}
+	ret := make(map[string]Significance)
+	for key, val := range significance {
+		k, _ := (&key).MarshalJSON()
+		ret[string(k[:])] = val
+	}
+	return ret
+}
+
+func retranslateSignificance(significance map[string]Significance) map[RowPair]Significance {
+	if significance == nil {
+		return nil
+	}
+	ret := make(map[RowPair]Significance)
+	var rp RowPair
+	for key, val := range significance {
+		(&rp).UnmarshalJSON([]byte(key))
+		ret[rp] = val
+	}
+	return ret
+}
+
 func (c *CorrjoinResult) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
-		CorrelatedPairs map[string]float64 `json:"correlatedPairs"`
-		StrideCounter   int                `json:"strideCounter"`
+		CorrelatedPairs map[string]float64      `json:"correlatedPairs"`
+		Lags            map[string]int          `json:"lags,omitempty"`
+		Significance    map[string]Significance `json:"significance,omitempty"`
+		StrideCounter   int                     `json:"strideCounter"`
+		Measure         string                  `json:"measure,omitempty"`
 	}{
 		CorrelatedPairs: translateMap(c.CorrelatedPairs),
+		Lags:            translateLags(c.Lags),
+		Significance:    translateSignificance(c.Significance),
 		StrideCounter:   c.StrideCounter,
+		Measure:         c.Measure,
 	})
 }
 
 func (c *CorrjoinResult) UnmarshalJSON(data []byte) error {
 	cr := &struct {
-		CorrelatedPairs map[string]float64 `json:"correlatedPairs"`
-		StrideCounter   int                `json:"strideCounter"`
+		CorrelatedPairs map[string]float64      `json:"correlatedPairs"`
+		Lags            map[string]int          `json:"lags,omitempty"`
+		Significance    map[string]Significance `json:"significance,omitempty"`
+		StrideCounter   int                     `json:"strideCounter"`
+		Measure         string                  `json:"measure,omitempty"`
 	}{}
 	if err := json.Unmarshal(data, &cr); err != nil {
 		return err
 	}
 	c.StrideCounter = cr.StrideCounter
 	c.CorrelatedPairs = retranslateMap(cr.CorrelatedPairs)
+	c.Lags = retranslateLags(cr.Lags)
+	c.Significance = retranslateSignificance(cr.Significance)
+	c.Measure = cr.Measure
 	return nil
 }
@@ -59,3 +59,44 @@ func TestMarshallCorrjoinResult(t *testing.T) {
 		}
 	}
 }
+
+func TestMarshallCorrjoinResultWithLags(t *testing.T) {
+	cr := &CorrjoinResult{
+		CorrelatedPairs: map[RowPair]float64{
+			RowPair{R1: 0, R2: 1}: 0.91,
+			RowPair{R1: 1, R2: 3}: 0.92,
+		},
+		Lags: map[RowPair]int{
+			RowPair{R1: 0, R2: 1}: -2,
+			RowPair{R1: 1, R2: 3}: 0,
+		},
+		Significance: map[RowPair]Significance{
+			RowPair{R1: 0, R2: 1}: Significance{PValue: 0.01, ConfidenceLow: 0.8, ConfidenceHigh: 0.95,
+				EffectiveSampleSize: 40},
+		},
+		StrideCounter: 2,
+		Measure:       "spearman",
+	}
+	b, err := cr.MarshalJSON()
+	if err != nil {
+		t.Fatalf("unexpected: %v", err)
+	}
+	var reconstructed CorrjoinResult
+	if err = (&reconstructed).UnmarshalJSON(b); err != nil {
+		t.Fatalf("unexpected: %v", err)
+	}
+	if len(reconstructed.Lags) != len(cr.Lags) {
+		t.Fatalf("expected %d lags but got %v", len(cr.Lags), reconstructed.Lags)
+	}
+	for rp, lag := range cr.Lags {
+		if reconstructed.Lags[rp] != lag {
+			t.Errorf("expected lag %d for %v but got %d", lag, rp, reconstructed.Lags[rp])
+		}
+	}
+	if reconstructed.Significance[RowPair{R1: 0, R2: 1}] != cr.Significance[RowPair{R1: 0, R2: 1}] {
+		t.Errorf("expected significance %+v but got %+v", cr.Significance, reconstructed.Significance)
+	}
+	if reconstructed.Measure != cr.Measure {
+		t.Errorf("expected measure %s but got %s", cr.Measure, reconstructed.Measure)
+	}
+}
@@ -10,6 +10,7 @@ type Metric struct {
 	LabelSet           model.LabelSet
 	PrometheusGraphURL string // computed on demand
 	Constant           bool
+	Rate               bool // the timeseries is a counter that was converted to a rate
 }
 
 type SubgraphMemberships struct {
@@ -24,4 +25,13 @@ type Edge struct {
 	Source  uint64
 	Target  uint64
 	Pearson float32
+	// A positive Lag means Source leads Target by that many samples.
+	Lag int32
+	// The correlation measure that produced Pearson. Empty means pearson.
+	Measure string
+	// The significance of Pearson. EffectiveSampleSize is 0 when it is unknown.
+	PValue              float32
+	ConfidenceLow       float32
+	ConfidenceHigh      float32
+	EffectiveSampleSize float32
 }
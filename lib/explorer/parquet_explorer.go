@@ -90,6 +90,14 @@ func (p *ParquetExplorer) Initialize(filename string) error {
 	return nil
 }
 
+// Metadata returns the value for key in the file metadata.
+func (p *ParquetExplorer) Metadata(key string) (string, bool) {
+	if p.file == nil {
+		return "", false
+	}
+	return p.file.Lookup(key)
+}
+
 func (p *ParquetExplorer) Delete() error {
 	var err error
 	if p.pqfile != nil {
@@ -106,6 +114,7 @@ type metricRow struct {
 	MetricFingerprint uint64            `parquet:"metricFingerprint,optional"`
 	Labels            map[string]string `parquet:"labels,optional"`
 	Constant          bool              `parquet:"constant,optional"`
+	Rate              bool              `parquet:"rate,optional"`
 }
 
 func (p *ParquetExplorer) GetMetrics(cache *map[uint64]*Metric) error {
@@ -141,6 +150,7 @@ func (p *ParquetExplorer) GetMetrics(cache *map[uint64]*Metric) error {
 					m.Fingerprint = result.MetricFingerprint
 				}
 				m.LabelSet["__name__"] = (model.LabelValue)(result.Metric)
+				m.Rate = result.Rate
 				// TODO: these are currently always on the same row as the metric name, not sure
 				// if that will stay that way.
 				if result.Labels != nil {
@@ -257,7 +267,7 @@ func (p *ParquetExplorer) GetSubgraphs() (*SubgraphMemberships, error) {
 			if result.Constant {
 				continue
 			}
-			if !(result.Pearson > 0.0) {
+			if result.Pearson == 0.0 {
 				continue
 			}
 			subgraphs.addPair(result.MetricFingerprint, result.Correlated)
@@ -291,7 +301,7 @@ func (p *ParquetExplorer) GetEdges(edgeChan chan<- []*Edge) error {
 			if result.Constant {
 				continue
 			}
-			if !(result.Pearson > 0.0) {
+			if result.Pearson == 0.0 {
 				continue
 			}
 			if result.MetricFingerprint >= result.Correlated {
@@ -301,6 +311,13 @@ func (p *ParquetExplorer) GetEdges(edgeChan chan<- []*Edge) error {
 				Source:  result.MetricFingerprint,
 				Target:  result.Correlated,
 				Pearson: result.Pearson,
+				Lag:     result.Lag,
+				Measure: result.Measure,
+
+				PValue:              result.PValue,
+				ConfidenceLow:       result.ConfidenceLow,
+				ConfidenceHigh:      result.ConfidenceHigh,
+				EffectiveSampleSize: result.EffectiveSampleSize,
 			})
 		}
 		edgeChan <- edgeBuf
@@ -0,0 +1,216 @@
+// Package lsh generates correlation candidates with random-hyperplane locality-sensitive
+// hashing (SimHash) over the normalized rows.
+package lsh
+
+import (
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib/comparisons"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"log"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+)
+
+// The hyperplanes are the same for every stride.
+const hyperplaneSeed = 17
+
+// An LshScheme hashes every row into LshTables hash tables. The hash in every table
+// consists of LshBits bits, one per random hyperplane, that say which side
+// of the hyperplane the row is on.
+// Two normalized rows with pearson correlation p are on the same side of a random
+// hyperplane with probability 1 - arccos(p)/pi, so correlated rows tend to get the same
+// hash. More bits make collisions of uncorrelated rows less likely, more tables make
+// it more likely that correlated rows collide in at least one table.
+// The negation of a row has the complement of its hash, so anti-correlated rows
+// are found by looking up the complement.
+type LshScheme struct {
+	// The normalized rows.
+	originalMatrix [][]float64
+
+	// Optional; rows for which this is true are left out.
+	constantRows []bool
+
+	settings settings.CorrjoinSettings
+
+	// hashes[row][table] is the hash of row in table.
+	hashes [][]uint64
+
+	// tables[table] maps hashes to the rows with that hash.
+	tables []map[uint64][]int
+
+	strideCounter int
+
+	comparer comparisons.Engine
+}
+
+func NewLshScheme(originalMatrix [][]float64, constantRows []bool,
+	settings settings.CorrjoinSettings, strideCounter int,
+	comparer comparisons.Engine) *LshScheme {
+	return &LshScheme{
+		originalMatrix: originalMatrix,
+		constantRows:   constantRows,
+		settings:       settings,
+		strideCounter:  strideCounter,
+		comparer:       comparer,
+	}
+}
+
+// ExpectedRecall returns the probability that a pair of rows with the given
+// correlation collides in at least one of the tables.
+func ExpectedRecall(correlation float64, bits int, tables int) float64 {
+	bitCollision := 1.0 - math.Acos(math.Max(-1.0, math.Min(1.0, correlation)))/math.Pi
+	tableCollision := math.Pow(bitCollision, float64(bits))
+	return 1.0 - math.Pow(1.0-tableCollision, float64(tables))
+}
+
+func (s *LshScheme) skip(row int) bool {
+	return row < len(s.constantRows) && s.constantRows[row]
+}
+
+func (s *LshScheme) mask() uint64 {
+	if s.settings.LshBits == 64 {
+		return math.MaxUint64
+	}
+	return (uint64(1) << s.settings.LshBits) - 1
+}
+
+// hyperplanes returns the normal vectors of the random hyperplanes for all tables.
+func (s *LshScheme) hyperplanes(columnCount int) [][]float64 {
+	rng := rand.New(rand.NewSource(hyperplaneSeed))
+	ret := make([][]float64, s.settings.LshTables*s.settings.LshBits)
+	for i := range ret {
+		ret[i] = make([]float64, columnCount)
+		for j := range ret[i] {
+			ret[i][j] = rng.NormFloat64()
+		}
+	}
+	return ret
+}
+
+func (s *LshScheme) hash(row []float64, planes [][]float64) []uint64 {
+	ret := make([]uint64, s.settings.LshTables)
+	for t := range ret {
+		var h uint64
+		for b, plane := range planes[t*s.settings.LshBits : (t+1)*s.settings.LshBits] {
+			dot := 0.0
+			for j, v := range row {
+				dot += v * plane[j]
+			}
+			if dot >= 0.0 {
+				h |= uint64(1) << b
+			}
+		}
+		ret[t] = h
+	}
+	return ret
+}
+
+// Initialize hashes all rows into the tables.
+func (s *LshScheme) Initialize() error {
+	if s.settings.LshTables <= 0 {
+		return fmt.Errorf("lsh needs at least one hash table but got %d", s.settings.LshTables)
+	}
+	if s.settings.LshBits <= 0 || s.settings.LshBits > 64 {
+		return fmt.Errorf("lsh needs between 1 and 64 bits per hash but got %d", s.settings.LshBits)
+	}
+	rowCount := len(s.originalMatrix)
+	if rowCount == 0 {
+		return fmt.Errorf("no data to hash")
+	}
+	planes := s.hyperplanes(len(s.originalMatrix[0]))
+
+	// Hashing is the expensive part, so the rows are divided between goroutines.
+	s.hashes = make([][]uint64, rowCount)
+	workerCount := runtime.NumCPU()
+	var wg sync.WaitGroup
+	for w := 0; w < workerCount; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < rowCount; i += workerCount {
+				if !s.skip(i) {
+					s.hashes[i] = s.hash(s.originalMatrix[i], planes)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	s.tables = make([]map[uint64][]int, s.settings.LshTables)
+	for t := range s.tables {
+		s.tables[t] = make(map[uint64][]int)
+	}
+	for i, hashes := range s.hashes {
+		if hashes == nil {
+			continue
+		}
+		for t, h := range hashes {
+			s.tables[t][h] = append(s.tables[t][h], i)
+		}
+	}
+	log.Printf("hashed %d rows into %d tables with %d bits. Expected recall at correlation %f is %f\n",
+		rowCount, s.settings.LshTables, s.settings.LshBits, s.settings.CorrelationThreshold,
+		ExpectedRecall(s.settings.CorrelationThreshold, s.settings.LshBits, s.settings.LshTables))
+	return nil
+}
+
+// collidedBefore returns true if rows r1 and r2 collide in a table before table.
+// Every pair is only compared for the first table it collides in.
+func (s *LshScheme) collidedBefore(r1 int, r2 int, table int) bool {
+	mask := s.mask()
+	for t := 0; t < table; t++ {
+		h1, h2 := s.hashes[r1][t], s.hashes[r2][t]
+		if h1 == h2 {
+			return true
+		}
+		if s.settings.NegativeCorrelations && h1 == ^h2&mask {
+			return true
+		}
+	}
+	return false
+}
+
+// CorrelationCandidates asks the comparer to compare all pairs of rows that have the same
+// hash, or complementary hashes when looking for negative correlations, in at least one table.
+func (s *LshScheme) CorrelationCandidates() error {
+	candidates := 0
+	compare := func(r1 int, r2 int, table int) error {
+		if s.collidedBefore(r1, r2, table) {
+			return nil
+		}
+		candidates++
+		return s.comparer.Compare(r1, r2)
+	}
+	mask := s.mask()
+	for t, table := range s.tables {
+		for h, members := range table {
+			for i := 0; i < len(members); i++ {
+				for j := i + 1; j < len(members); j++ {
+					if err := compare(members[i], members[j], t); err != nil {
+						return err
+					}
+				}
+			}
+			if !s.settings.NegativeCorrelations {
+				continue
+			}
+			complement := ^h & mask
+			// Every pair of complementary buckets is visited once.
+			if h > complement {
+				continue
+			}
+			for _, r1 := range members {
+				for _, r2 := range table[complement] {
+					if err := compare(r1, r2, t); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	log.Printf("lsh found %d candidate pairs\n", candidates)
+	// Let the comparer know there will be no further requests for this stride.
+	return s.comparer.StopStride(s.strideCounter)
+}
@@ -0,0 +1,159 @@
+package lsh
+
+import (
+	"github.com/kpaschen/corrjoin/lib/correlation"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/paa"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// recordingComparer is an Engine that only records the pairs it is asked to compare.
+type recordingComparer struct {
+	pairs   map[[2]int]int
+	stopped bool
+}
+
+func (r *recordingComparer) Initialize(config settings.CorrjoinSettings, results chan<- *datatypes.CorrjoinResult) {
+}
+
+func (r *recordingComparer) Reconfigure(config settings.CorrjoinSettings) {
+}
+
+func (r *recordingComparer) StartStride(normalizedMatrix [][]float64, constantRows []bool, strideCounter int) error {
+	r.pairs = make(map[[2]int]int)
+	return nil
+}
+
+func (r *recordingComparer) Compare(index1 int, index2 int) error {
+	r.pairs[[2]int{min(index1, index2), max(index1, index2)}]++
+	return nil
+}
+
+func (r *recordingComparer) StopStride(strideCounter int) error {
+	r.stopped = true
+	return nil
+}
+
+func (r *recordingComparer) Shutdown() error {
+	return nil
+}
+
+// testMatrix returns normalized random walks. Some rows have a correlated partner
+// and, when negative is set, some have an anti-correlated partner.
+func testMatrix(rowCount int, columnCount int, negative bool) [][]float64 {
+	rng := rand.New(rand.NewSource(5))
+	ret := make([][]float64, 0, rowCount)
+	for len(ret) < rowCount {
+		row := make([]float64, columnCount)
+		value := 0.0
+		for j := range row {
+			value += rng.NormFloat64()
+			row[j] = value
+		}
+		ret = append(ret, row)
+		if len(ret)%4 == 1 {
+			partner := make([]float64, columnCount)
+			sign := 1.0
+			if negative && len(ret)%8 == 1 {
+				sign = -1.0
+			}
+			for j := range partner {
+				partner[j] = sign*row[j] + 0.3*rng.NormFloat64()
+			}
+			ret = append(ret, partner)
+		}
+	}
+	for _, row := range ret {
+		paa.NormalizeSlice(row)
+	}
+	return ret
+}
+
+func TestExpectedRecall(t *testing.T) {
+	if ExpectedRecall(0.9, 10, 16) <= ExpectedRecall(0.9, 10, 8) {
+		t.Errorf("more tables should increase the recall")
+	}
+	if ExpectedRecall(0.9, 12, 16) >= ExpectedRecall(0.9, 10, 16) {
+		t.Errorf("more bits should decrease the recall")
+	}
+	if math.Abs(ExpectedRecall(1.0, 10, 1)-1.0) > 0.000001 {
+		t.Errorf("identical rows should always collide")
+	}
+}
+
+func TestCorrelationCandidates(t *testing.T) {
+	for _, negative := range []bool{false, true} {
+		matrix := testMatrix(200, 100, negative)
+		config := settings.CorrjoinSettings{
+			CorrelationThreshold: 0.95,
+			NegativeCorrelations: negative,
+			LshTables:            16,
+			LshBits:              10,
+		}
+		comparer := &recordingComparer{}
+		comparer.StartStride(matrix, nil, 1)
+		scheme := NewLshScheme(matrix, nil, config, 1, comparer)
+		if err := scheme.Initialize(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := scheme.CorrelationCandidates(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !comparer.stopped {
+			t.Errorf("expected the stride to be stopped")
+		}
+
+		expected := 0
+		for i := 0; i < len(matrix); i++ {
+			for j := i + 1; j < len(matrix); j++ {
+				pearson, err := correlation.PearsonCorrelation(matrix[i], matrix[j])
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if pearson < config.CorrelationThreshold && (!negative || pearson > -config.CorrelationThreshold) {
+					continue
+				}
+				expected++
+				if comparer.pairs[[2]int{i, j}] == 0 {
+					t.Errorf("negative %t: rows %d and %d have correlation %f but were not compared", negative, i, j, pearson)
+				}
+			}
+		}
+		if expected == 0 {
+			t.Fatalf("test data should have correlated rows")
+		}
+		for pair, count := range comparer.pairs {
+			if count > 1 {
+				t.Errorf("pair %v was compared %d times", pair, count)
+			}
+		}
+		allPairs := len(matrix) * (len(matrix) - 1) / 2
+		if len(comparer.pairs) >= allPairs/2 {
+			t.Errorf("expected lsh to compare far fewer than %d pairs but it compared %d", allPairs, len(comparer.pairs))
+		}
+	}
+}
+
+func TestConstantRowsAreSkipped(t *testing.T) {
+	matrix := testMatrix(20, 50, false)
+	constantRows := make([]bool, len(matrix))
+	constantRows[0] = true
+	config := settings.CorrjoinSettings{LshTables: 4, LshBits: 2}
+	comparer := &recordingComparer{}
+	comparer.StartStride(matrix, constantRows, 1)
+	scheme := NewLshScheme(matrix, constantRows, config, 1, comparer)
+	if err := scheme.Initialize(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := scheme.CorrelationCandidates(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for pair := range comparer.pairs {
+		if pair[0] == 0 {
+			t.Errorf("constant row 0 should not be compared but got %v", pair)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+// Package notifier sends alerts about changes in the correlations of watched timeseries
+// to an Alertmanager-compatible endpoint.
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/reporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	sentAlerts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_notifier_sent_alerts_total",
+			Help: "Total number of alerts that were delivered.",
+		},
+	)
+	failedAlerts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_notifier_failed_alerts_total",
+			Help: "Total number of alerts that could not be delivered.",
+		},
+	)
+	deduplicatedAlerts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_notifier_deduplicated_alerts_total",
+			Help: "Total number of alerts that were not sent because they had been sent recently.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sentAlerts)
+	prometheus.MustRegister(failedAlerts)
+	prometheus.MustRegister(deduplicatedAlerts)
+}
+
+// Alert is an alert in the format of the Alertmanager /api/v2/alerts endpoint.
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// Notifier matches the correlation changes of every stride against its rules and
+// posts an alert for every match. Alerts are sent from a separate goroutine so a slow
+// endpoint does not hold up the results.
+type Notifier struct {
+	url    string
+	rules  []Rule
+	client *http.Client
+
+	// How often to retry a batch of alerts, and how long to wait before the first retry.
+	// The wait doubles with every retry.
+	retries int
+	backoff time.Duration
+	// Alerts with the same labels are sent at most once per dedupInterval.
+	dedupInterval time.Duration
+	// How long alerts stay active unless they are sent again. This should be longer
+	// than a stride.
+	eventDuration time.Duration
+
+	// The correlated rows of the strides that have not been flushed yet.
+	strideSubgraphs map[int]*subgraphs
+	// The watched timeseries whose subgraph was too big in the previous stride,
+	// keyed by alert fingerprint.
+	oversized map[model.Fingerprint]Alert
+	// lock guards lastSent, pending and closed, which the sending goroutine updates.
+	lock sync.Mutex
+	// When alerts were last delivered, keyed by alert fingerprint.
+	lastSent map[model.Fingerprint]time.Time
+	// The alerts that are queued but not delivered yet, keyed by alert fingerprint.
+	pending map[model.Fingerprint]bool
+	// Whether Close has been called. Flush drops alerts after that.
+	closed bool
+
+	queue chan alertBatch
+	done  sync.WaitGroup
+}
+
+// An alertBatch is posted in one request. The deduplicated alerts in it are recorded
+// in lastSent once they are delivered.
+type alertBatch struct {
+	alerts       []Alert
+	deduplicated []model.Fingerprint
+}
+
+// NewNotifier returns a notifier that posts the alerts for rules to url.
+func NewNotifier(url string, rules []Rule) (*Notifier, error) {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	n := &Notifier{
+		url:             url,
+		rules:           rules,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		retries:         5,
+		backoff:         time.Second,
+		dedupInterval:   time.Hour,
+		eventDuration:   time.Hour,
+		strideSubgraphs: make(map[int]*subgraphs),
+		oversized:       make(map[model.Fingerprint]Alert),
+		lastSent:        make(map[model.Fingerprint]time.Time),
+		pending:         make(map[model.Fingerprint]bool),
+		queue:           make(chan alertBatch, 100),
+	}
+	n.done.Add(1)
+	go n.send()
+	return n, nil
+}
+
+// NeedsChanges returns true if some rule needs the new and lost correlations of the
+// change reporter.
+func (n *Notifier) NeedsChanges() bool {
+	for _, r := range n.rules {
+		if r.Condition == CONDITION_NEW_CORRELATE || r.Condition == CONDITION_LOST_CORRELATE {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notifier) needsSubgraphs() bool {
+	for _, r := range n.rules {
+		if r.Condition == CONDITION_SUBGRAPH_SIZE {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notifier) AddCorrelatedPairs(result datatypes.CorrjoinResult) {
+	if !n.needsSubgraphs() {
+		return
+	}
+	s, exists := n.strideSubgraphs[result.StrideCounter]
+	if !exists {
+		s = newSubgraphs()
+		n.strideSubgraphs[result.StrideCounter] = s
+	}
+	for pair := range result.CorrelatedPairs {
+		rowids := pair.RowIds()
+		s.union(rowids[0], rowids[1])
+	}
+}
+
+// Flush matches events, the correlation changes of strideCounter, and the subgraphs of
+// strideCounter against the rules and queues the resulting alerts.
+func (n *Notifier) Flush(strideCounter int, tsids []lib.TsId, events []reporter.ChangeEvent) {
+	s := n.strideSubgraphs[strideCounter]
+	for stride := range n.strideSubgraphs {
+		if stride <= strideCounter {
+			delete(n.strideSubgraphs, stride)
+		}
+	}
+
+	now := time.Now().UTC()
+	metrics := newMetricCache(tsids)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for fp, t := range n.lastSent {
+		if now.Sub(t) > n.dedupInterval {
+			delete(n.lastSent, fp)
+		}
+	}
+	alerts := n.changeAlerts(events, metrics, now)
+	batch := alertBatch{alerts: make([]Alert, 0, len(alerts))}
+	for _, a := range alerts {
+		fp := model.Fingerprint(model.LabelsToSignature(a.Labels))
+		if _, sent := n.lastSent[fp]; sent || n.pending[fp] {
+			deduplicatedAlerts.Inc()
+			continue
+		}
+		n.pending[fp] = true
+		batch.deduplicated = append(batch.deduplicated, fp)
+		batch.alerts = append(batch.alerts, a)
+	}
+	if n.needsSubgraphs() {
+		batch.alerts = append(batch.alerts, n.subgraphAlerts(s, metrics, now)...)
+	}
+	if len(batch.alerts) == 0 {
+		return
+	}
+	if n.closed {
+		log.Printf("notifier is closed, dropping %d alerts\n", len(batch.alerts))
+		n.dropped(batch)
+		return
+	}
+	select {
+	case n.queue <- batch:
+	default:
+		log.Printf("notifier queue is full, dropping %d alerts\n", len(batch.alerts))
+		n.dropped(batch)
+	}
+}
+
+// dropped counts the alerts of batch as failed and forgets that they are pending, so
+// they are sent again if they come up in a later stride. The caller holds the lock.
+func (n *Notifier) dropped(batch alertBatch) {
+	failedAlerts.Add(float64(len(batch.alerts)))
+	for _, fp := range batch.deduplicated {
+		delete(n.pending, fp)
+	}
+}
+
+func (n *Notifier) changeAlerts(events []reporter.ChangeEvent, metrics *metricCache, now time.Time) []Alert {
+	alerts := make([]Alert, 0)
+	for _, r := range n.rules {
+		var kind string
+		switch r.Condition {
+		case CONDITION_NEW_CORRELATE:
+			kind = reporter.CHANGE_NEW
+		case CONDITION_LOST_CORRELATE:
+			kind = reporter.CHANGE_LOST
+		default:
+			continue
+		}
+		for _, e := range events {
+			if e.Kind != kind {
+				continue
+			}
+			pairs := [][2]uint64{{e.Timeseries1, e.Timeseries2}, {e.Timeseries2, e.Timeseries1}}
+			for _, p := range pairs {
+				watched := metrics.get(p[0])
+				if watched == nil || !r.matches(watched) {
+					continue
+				}
+				a := newAlert(r, watched, now, now.Add(n.eventDuration))
+				a.Labels["correlate"] = fmt.Sprintf("fp-%d", p[1])
+				correlateName := a.Labels["correlate"]
+				if correlate := metrics.get(p[1]); correlate != nil {
+					correlateName = correlate.String()
+					a.Annotations["correlate"] = correlateName
+				}
+				a.Annotations["previous"] = strconv.FormatFloat(float64(e.Previous), 'f', 3, 32)
+				a.Annotations["current"] = strconv.FormatFloat(float64(e.Current), 'f', 3, 32)
+				if kind == reporter.CHANGE_NEW {
+					a.Annotations["summary"] = fmt.Sprintf("%s is now correlated with %s", watched.String(), correlateName)
+				} else {
+					a.Annotations["summary"] = fmt.Sprintf("%s is no longer correlated with %s", watched.String(), correlateName)
+				}
+				alerts = append(alerts, a)
+			}
+		}
+	}
+	return alerts
+}
+
+// subgraphAlerts returns a firing alert for every watched timeseries whose subgraph
+// is bigger than the size in a rule, and a resolved alert for every one whose subgraph
+// shrank again. Firing alerts are sent again with every stride so they do not expire,
+// but they keep the time at which the subgraph first grew too big.
+func (n *Notifier) subgraphAlerts(s *subgraphs, metrics *metricCache, now time.Time) []Alert {
+	alerts := make([]Alert, 0)
+	oversized := make(map[model.Fingerprint]Alert)
+	present := make(map[model.Fingerprint]bool)
+	for rowid, tsid := range metrics.tsids {
+		size := s.size(rowid)
+		for _, r := range n.rules {
+			if r.Condition != CONDITION_SUBGRAPH_SIZE {
+				continue
+			}
+			watched := metrics.get(tsid.MetricFingerprint)
+			if watched == nil || !r.matches(watched) {
+				continue
+			}
+			a := newAlert(r, watched, now, time.Time{})
+			fp := model.Fingerprint(model.LabelsToSignature(a.Labels))
+			present[fp] = true
+			if size <= r.SubgraphSize {
+				continue
+			}
+			if previous, exists := n.oversized[fp]; exists {
+				a.StartsAt = previous.StartsAt
+			}
+			a.Annotations["subgraphSize"] = strconv.Itoa(size)
+			a.Annotations["summary"] = fmt.Sprintf("%s is correlated with %d timeseries", watched.String(), size-1)
+			a.EndsAt = now.Add(n.eventDuration)
+			oversized[fp] = a
+			alerts = append(alerts, a)
+		}
+	}
+	for fp, a := range n.oversized {
+		if _, exists := oversized[fp]; exists || !present[fp] {
+			continue
+		}
+		a.EndsAt = now
+		alerts = append(alerts, a)
+	}
+	n.oversized = oversized
+	return alerts
+}
+
+func newAlert(r Rule, watched model.Metric, startsAt time.Time, endsAt time.Time) Alert {
+	a := Alert{
+		Labels:      make(map[string]string, len(watched)+2),
+		Annotations: make(map[string]string),
+		StartsAt:    startsAt,
+		EndsAt:      endsAt,
+	}
+	for name, value := range watched {
+		a.Labels[string(name)] = string(value)
+	}
+	a.Labels[model.AlertNameLabel] = r.Name
+	a.Labels["condition"] = r.Condition
+	return a
+}
+
+func (n *Notifier) send() {
+	defer n.done.Done()
+	for batch := range n.queue {
+		err := n.post(batch.alerts)
+		n.lock.Lock()
+		if err != nil {
+			log.Printf("failed to send %d alerts: %v\n", len(batch.alerts), err)
+			n.dropped(batch)
+		} else {
+			sentAlerts.Add(float64(len(batch.alerts)))
+			now := time.Now().UTC()
+			for _, fp := range batch.deduplicated {
+				delete(n.pending, fp)
+				n.lastSent[fp] = now
+			}
+		}
+		n.lock.Unlock()
+	}
+}
+
+func (n *Notifier) post(alerts []Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	backoff := n.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return nil
+			}
+			err = fmt.Errorf("%s returned %s", n.url, resp.Status)
+			// Only server errors and rate limits are worth retrying.
+			if resp.StatusCode/100 != 5 && resp.StatusCode != http.StatusTooManyRequests {
+				return err
+			}
+		}
+		if attempt >= n.retries {
+			return err
+		}
+		log.Printf("retrying alerts in %v: %v\n", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Close waits for the queued alerts to be sent. Alerts flushed after Close are dropped.
+func (n *Notifier) Close() {
+	n.lock.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.lock.Unlock()
+	n.done.Wait()
+}
+
+// metricCache parses the metrics of a stride on demand.
+type metricCache struct {
+	tsids   []lib.TsId
+	rows    map[uint64]int
+	metrics map[uint64]model.Metric
+}
+
+func newMetricCache(tsids []lib.TsId) *metricCache {
+	c := &metricCache{
+		tsids:   tsids,
+		rows:    make(map[uint64]int, len(tsids)),
+		metrics: make(map[uint64]model.Metric),
+	}
+	for i, tsid := range tsids {
+		c.rows[tsid.MetricFingerprint] = i
+	}
+	return c
+}
+
+func (c *metricCache) get(fingerprint uint64) model.Metric {
+	if m, exists := c.metrics[fingerprint]; exists {
+		return m
+	}
+	row, exists := c.rows[fingerprint]
+	if !exists {
+		return nil
+	}
+	var m model.Metric
+	if err := json.Unmarshal([]byte(c.tsids[row].MetricName), &m); err != nil {
+		log.Printf("failed to unmarshal tsid %s: %v\n", c.tsids[row].MetricName, err)
+	}
+	c.metrics[fingerprint] = m
+	return m
+}
+
+// subgraphs is a union-find over the correlated rows of a stride.
+type subgraphs struct {
+	parents map[int]int
+	sizes   map[int]int
+}
+
+func newSubgraphs() *subgraphs {
+	return &subgraphs{
+		parents: make(map[int]int),
+		sizes:   make(map[int]int),
+	}
+}
+
+func (s *subgraphs) find(row int) int {
+	parent, exists := s.parents[row]
+	if !exists {
+		return row
+	}
+	if parent == row {
+		return row
+	}
+	root := s.find(parent)
+	s.parents[row] = root
+	return root
+}
+
+func (s *subgraphs) union(row1 int, row2 int) {
+	root1 := s.find(row1)
+	root2 := s.find(row2)
+	if root1 == root2 {
+		return
+	}
+	size1 := s.size(root1)
+	size2 := s.size(root2)
+	if size1 < size2 {
+		root1, root2 = root2, root1
+	}
+	s.parents[root2] = root1
+	s.parents[root1] = root1
+	s.sizes[root1] = size1 + size2
+	delete(s.sizes, root2)
+}
+
+// size returns the number of rows in the subgraph of row, which is 1 if row is
+// not correlated with anything.
+func (s *subgraphs) size(row int) int {
+	if s == nil {
+		return 1
+	}
+	if size, exists := s.sizes[s.find(row)]; exists {
+		return size
+	}
+	return 1
+}
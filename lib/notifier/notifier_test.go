@@ -0,0 +1,268 @@
+package notifier
+
+import (
+	"encoding/json"
+	"github.com/kpaschen/corrjoin/lib"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/reporter"
+	"github.com/prometheus/common/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type alertmanager struct {
+	server *httptest.Server
+	lock   sync.Mutex
+	// The number of requests to fail before accepting alerts.
+	failures int
+	requests int
+	alerts   []Alert
+}
+
+func newAlertmanager(failures int) *alertmanager {
+	a := &alertmanager{failures: failures}
+	a.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		a.requests++
+		if r.URL.Path != "/api/v2/alerts" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if a.failures > 0 {
+			a.failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var alerts []Alert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.alerts = append(a.alerts, alerts...)
+		w.WriteHeader(http.StatusOK)
+	}))
+	return a
+}
+
+func testTsids(t *testing.T, metrics ...model.Metric) []lib.TsId {
+	tsids := make([]lib.TsId, len(metrics))
+	for i, m := range metrics {
+		name, err := json.Marshal(m)
+		if err != nil {
+			t.Fatalf("failed to marshal metric: %v", err)
+		}
+		tsids[i] = lib.TsId{MetricName: string(name), MetricFingerprint: uint64(m.Fingerprint())}
+	}
+	return tsids
+}
+
+func newTestNotifier(t *testing.T, url string, rules []Rule) *Notifier {
+	n, err := NewNotifier(url+"/api/v2/alerts", rules)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	n.backoff = time.Millisecond
+	return n
+}
+
+func TestChangeAlerts(t *testing.T) {
+	am := newAlertmanager(2)
+	defer am.server.Close()
+	n := newTestNotifier(t, am.server.URL, []Rule{
+		{Name: "ApiDecoupled", Selector: `{job="api"}`, Condition: CONDITION_LOST_CORRELATE},
+		{Name: "ApiCorrelated", Selector: `{job=~"api|db", instance!="a"}`, Condition: CONDITION_NEW_CORRELATE},
+	})
+	tsids := testTsids(t,
+		model.Metric{"__name__": "latency", "job": "api", "instance": "a"},
+		model.Metric{"__name__": "queries", "job": "db", "instance": "b"},
+		model.Metric{"__name__": "cpu", "job": "node", "instance": "c"})
+	fp := func(row int) uint64 { return tsids[row].MetricFingerprint }
+	events := []reporter.ChangeEvent{
+		{Kind: reporter.CHANGE_LOST, Timeseries1: fp(0), Timeseries2: fp(2), Previous: 0.95},
+		{Kind: reporter.CHANGE_NEW, Timeseries1: fp(0), Timeseries2: fp(1), Current: 0.9},
+		{Kind: reporter.CHANGE_STRENGTH, Timeseries1: fp(1), Timeseries2: fp(2), Previous: 0.99, Current: 0.8},
+	}
+	n.Flush(5, tsids, events)
+	// The same events again are not sent twice.
+	n.Flush(6, tsids, events)
+	n.Close()
+
+	if am.requests != 3 {
+		t.Errorf("expected two failed requests and one delivery but got %d requests", am.requests)
+	}
+	if len(am.alerts) != 2 {
+		t.Fatalf("expected two alerts but got %+v", am.alerts)
+	}
+	lost := am.alerts[0]
+	if lost.Labels["alertname"] != "ApiDecoupled" || lost.Labels["instance"] != "a" ||
+		lost.Labels["condition"] != CONDITION_LOST_CORRELATE || lost.Annotations["previous"] != "0.950" {
+		t.Errorf("unexpected alert for the lost correlate %+v", lost)
+	}
+	if !lost.EndsAt.After(lost.StartsAt) {
+		t.Errorf("expected the alert to be firing but it ends at %v", lost.EndsAt)
+	}
+	// Only the db timeseries is watched by the second rule.
+	correlated := am.alerts[1]
+	if correlated.Labels["alertname"] != "ApiCorrelated" || correlated.Labels["job"] != "db" ||
+		correlated.Labels["correlate"] == "" || correlated.Annotations["correlate"] != tsidString(t, tsids[0]) {
+		t.Errorf("unexpected alert for the new correlate %+v", correlated)
+	}
+}
+
+func tsidString(t *testing.T, tsid lib.TsId) string {
+	var m model.Metric
+	if err := json.Unmarshal([]byte(tsid.MetricName), &m); err != nil {
+		t.Fatalf("failed to unmarshal metric: %v", err)
+	}
+	return m.String()
+}
+
+func TestSubgraphAlerts(t *testing.T) {
+	am := newAlertmanager(0)
+	defer am.server.Close()
+	n := newTestNotifier(t, am.server.URL, []Rule{
+		{Name: "BigSubgraph", Selector: `{job="api"}`, Condition: CONDITION_SUBGRAPH_SIZE, SubgraphSize: 2},
+	})
+	tsids := testTsids(t,
+		model.Metric{"__name__": "latency", "job": "api"},
+		model.Metric{"__name__": "queries", "job": "db"},
+		model.Metric{"__name__": "cpu", "job": "node"},
+		model.Metric{"__name__": "memory", "job": "node"})
+
+	stride := func(counter int, pairs ...[2]int) {
+		result := datatypes.CorrjoinResult{
+			CorrelatedPairs: make(map[datatypes.RowPair]float64),
+			StrideCounter:   counter,
+		}
+		for _, p := range pairs {
+			result.CorrelatedPairs[*datatypes.NewRowPair(p[0], p[1])] = 0.9
+		}
+		n.AddCorrelatedPairs(result)
+		n.Flush(counter, tsids, nil)
+	}
+	stride(1, [2]int{0, 1})
+	// The api timeseries is connected to three others through the db timeseries.
+	stride(2, [2]int{0, 1}, [2]int{1, 2}, [2]int{2, 3})
+	stride(3, [2]int{0, 1}, [2]int{1, 3}, [2]int{2, 3})
+	stride(4, [2]int{2, 3})
+	n.Close()
+
+	if len(am.alerts) != 3 {
+		t.Fatalf("expected two firing alerts and a resolved one but got %+v", am.alerts)
+	}
+	if am.alerts[0].Annotations["subgraphSize"] != "4" || am.alerts[0].Labels["job"] != "api" {
+		t.Errorf("unexpected alert %+v", am.alerts[0])
+	}
+	if !am.alerts[1].StartsAt.Equal(am.alerts[0].StartsAt) {
+		t.Errorf("expected the alert to be sent again with the same start time")
+	}
+	if am.alerts[2].EndsAt.After(am.alerts[1].EndsAt) || am.alerts[2].EndsAt.After(time.Now()) {
+		t.Errorf("expected the alert to be resolved but it ends at %v", am.alerts[2].EndsAt)
+	}
+}
+
+func TestGiveUpOnClientErrors(t *testing.T) {
+	am := newAlertmanager(0)
+	defer am.server.Close()
+	// The alertmanager only accepts requests on /api/v2/alerts.
+	n, err := NewNotifier(am.server.URL+"/alerts", []Rule{
+		{Name: "Lost", Selector: `{job="api"}`, Condition: CONDITION_LOST_CORRELATE},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tsids := testTsids(t, model.Metric{"job": "api"}, model.Metric{"job": "db"})
+	n.Flush(1, tsids, []reporter.ChangeEvent{{Kind: reporter.CHANGE_LOST,
+		Timeseries1: tsids[0].MetricFingerprint, Timeseries2: tsids[1].MetricFingerprint}})
+	n.Close()
+	if am.requests != 1 {
+		t.Errorf("expected no retries for a bad request but got %d requests", am.requests)
+	}
+}
+
+func TestResendUndeliveredAlerts(t *testing.T) {
+	am := newAlertmanager(1)
+	defer am.server.Close()
+	n := newTestNotifier(t, am.server.URL, []Rule{
+		{Name: "Lost", Selector: `{job="api"}`, Condition: CONDITION_LOST_CORRELATE},
+	})
+	n.retries = 0
+	tsids := testTsids(t, model.Metric{"job": "api"}, model.Metric{"job": "db"})
+	events := []reporter.ChangeEvent{{Kind: reporter.CHANGE_LOST,
+		Timeseries1: tsids[0].MetricFingerprint, Timeseries2: tsids[1].MetricFingerprint}}
+	n.Flush(1, tsids, events)
+	// Wait for the first delivery to fail.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		n.lock.Lock()
+		pending := len(n.pending)
+		n.lock.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the alert was not sent")
+		}
+	}
+	// The alert was not delivered, so it is not deduplicated.
+	n.Flush(2, tsids, events)
+	n.Close()
+	if am.requests != 2 || len(am.alerts) != 1 {
+		t.Errorf("expected the alert to be delivered with the second request but got %d requests and %+v",
+			am.requests, am.alerts)
+	}
+
+	// Flushing after Close drops the alerts.
+	n.Flush(3, tsids, []reporter.ChangeEvent{{Kind: reporter.CHANGE_LOST,
+		Timeseries1: tsids[0].MetricFingerprint, Timeseries2: 42}})
+	n.Close()
+	if am.requests != 2 {
+		t.Errorf("did not expect requests after Close but got %d", am.requests)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	tempdir, err := os.MkdirTemp("", "corrjoinTest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	path := filepath.Join(tempdir, "rules.json")
+	err = os.WriteFile(path, []byte(`[
+		{"name": "Lost", "selector": "{job=\"api\"}", "condition": "lost_correlate"},
+		{"name": "Big", "selector": "latency", "condition": "subgraph_size", "subgraphSize": 10}
+	]`), 0640)
+	if err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+	rules, err := LoadRules(path)
+	if err != nil || len(rules) != 2 {
+		t.Fatalf("expected two rules but got %v, %v", rules, err)
+	}
+	n, err := NewNotifier("http://localhost:9093/api/v2/alerts", rules)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer n.Close()
+	if !rules[1].matches(model.Metric{"__name__": "latency", "job": "api"}) {
+		t.Errorf("expected a selector with a metric name to match the metric")
+	}
+	if !n.NeedsChanges() {
+		t.Errorf("expected a rule for lost correlates to need changes")
+	}
+
+	for _, r := range []Rule{
+		{Name: "Size", Selector: `{job="api"}`, Condition: CONDITION_SUBGRAPH_SIZE},
+		{Name: "Selector", Selector: `{job=}`, Condition: CONDITION_NEW_CORRELATE},
+		{Name: "Condition", Selector: `{job="api"}`, Condition: "flapping"},
+	} {
+		if _, err = NewNotifier("http://localhost:9093/api/v2/alerts", []Rule{r}); err == nil {
+			t.Errorf("expected an error for rule %s", r.Name)
+		}
+	}
+}
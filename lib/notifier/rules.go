@@ -0,0 +1,80 @@
+package notifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"os"
+)
+
+const (
+	// A timeseries that was not correlated with a watched timeseries now is.
+	CONDITION_NEW_CORRELATE = "new_correlate"
+	// A timeseries that was correlated with a watched timeseries is not anymore.
+	CONDITION_LOST_CORRELATE = "lost_correlate"
+	// The subgraph of correlated timeseries that a watched timeseries belongs to
+	// grew beyond SubgraphSize timeseries.
+	CONDITION_SUBGRAPH_SIZE = "subgraph_size"
+)
+
+// Rule selects the timeseries to watch and the condition to notify about.
+type Rule struct {
+	// The alertname of the alerts for this rule.
+	Name string `json:"name"`
+	// Label matchers for the watched timeseries, for example {job="api", instance=~"web-.*"}.
+	Selector  string `json:"selector"`
+	Condition string `json:"condition"`
+	// Only used by CONDITION_SUBGRAPH_SIZE.
+	SubgraphSize int `json:"subgraphSize,omitempty"`
+
+	matchers []*labels.Matcher
+}
+
+// LoadRules reads a json list of rules from path, for example
+//
+//	[{"name": "ApiDecoupled", "selector": "{job=\"api\"}", "condition": "lost_correlate"},
+//	 {"name": "ApiSubgraph", "selector": "{job=\"api\"}", "condition": "subgraph_size", "subgraphSize": 20}]
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse notification rules in %s: %v", path, err)
+	}
+	return rules, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("notification rule without a name")
+	}
+	switch r.Condition {
+	case CONDITION_NEW_CORRELATE, CONDITION_LOST_CORRELATE:
+	case CONDITION_SUBGRAPH_SIZE:
+		if r.SubgraphSize < 2 {
+			return fmt.Errorf("rule %s needs a subgraph size of at least 2 but has %d", r.Name, r.SubgraphSize)
+		}
+	default:
+		return fmt.Errorf("rule %s has unsupported condition %s", r.Name, r.Condition)
+	}
+	matchers, err := parser.ParseMetricSelector(r.Selector)
+	if err != nil {
+		return fmt.Errorf("rule %s has an invalid selector %s: %v", r.Name, r.Selector, err)
+	}
+	r.matchers = matchers
+	return nil
+}
+
+// matches returns true if metric is watched by r.
+func (r *Rule) matches(metric model.Metric) bool {
+	for _, m := range r.matchers {
+		if !m.Matches(string(metric[model.LabelName(m.Name)])) {
+			return false
+		}
+	}
+	return true
+}
@@ -54,21 +54,34 @@ func NormalizeSlice(slice []float64) bool {
 		diff := slice[i] - avg
 		sumOfSquares += diff * diff
 	}
+	return NormalizeSliceInto(slice, slice, avg, sumOfSquares)
+}
+
+// NormalizeSliceInto is like NormalizeSlice, but it writes the result to target and
+// takes the mean of slice and the sum of the squared differences from the mean as
+// arguments. target may be the same as slice.
+func NormalizeSliceInto(slice []float64, target []float64, avg float64, sumOfSquares float64) bool {
+	length := len(slice)
 	normalizingFactor := math.Sqrt(sumOfSquares)
 	if normalizingFactor == 0.0 {
 		for i := 0; i < length; i++ {
-			slice[i] = 0.0
+			target[i] = 0.0
 		}
 		return true
 	} else {
 		for i := 0; i < length; i++ {
 			diff := slice[i] - avg
-			slice[i] = diff / normalizingFactor
+			target[i] = diff / normalizingFactor
 		}
-		return isSliceConstant(slice, 0.0001)
+		return isSliceConstant(target, 0.0001)
 	}
 }
 
+// IsConstant returns true if slice is constant to within 0.0001.
+func IsConstant(slice []float64) bool {
+	return isSliceConstant(slice, 0.0001)
+}
+
 // Reduce slice to targetColumnCount columns by dividing it into
 // equi-length segments and using mean values.
 func PAA(slice []float64, targetColumnCount int) ([]float64, bool) {
@@ -82,6 +95,6 @@ func PAA(slice []float64, targetColumnCount int) ([]float64, bool) {
 	for i := 0; i < targetColumnCount; i++ {
 		ret[i] = mean(slice[(i * windowSize):((i + 1) * windowSize)])
 	}
-	constant := isSliceConstant(ret, 0.0001)
+	constant := IsConstant(ret)
 	return ret, constant
 }
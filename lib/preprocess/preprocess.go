@@ -0,0 +1,108 @@
+// Package preprocess contains transformations that are applied to the rows of the
+// window before they are normalized, to keep trends from showing up as correlations.
+package preprocess
+
+import (
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib/correlation"
+	"github.com/kpaschen/corrjoin/lib/settings"
+)
+
+// NewRowTransform returns the transform for config.Preprocessing, or nil if the
+// rows should be used as they are.
+func NewRowTransform(config settings.CorrjoinSettings) (correlation.RowTransform, error) {
+	switch config.Preprocessing {
+	case settings.PREPROCESS_NONE, "":
+		return nil, nil
+	case settings.PREPROCESS_DIFFERENCE:
+		return Difference, nil
+	case settings.PREPROCESS_DETREND:
+		return Detrend, nil
+	case settings.PREPROCESS_MOVING_AVERAGE:
+		if config.MovingAverageWindow < 2 {
+			return nil, fmt.Errorf("moving average window must be at least 2 but is %d",
+				config.MovingAverageWindow)
+		}
+		return func(row []float64) []float64 {
+			return RemoveMovingAverage(row, config.MovingAverageWindow)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported preprocessing %s", config.Preprocessing)
+	}
+}
+
+// Describe returns a description of the preprocessing for the result file metadata.
+// This includes the removal of seasonality, which happens before the preprocessing.
+func Describe(config settings.CorrjoinSettings) string {
+	var description string
+	switch config.Preprocessing {
+	case "":
+		description = settings.PREPROCESS_NONE
+	case settings.PREPROCESS_MOVING_AVERAGE:
+		description = fmt.Sprintf("%s(%d)", config.Preprocessing, config.MovingAverageWindow)
+	default:
+		description = config.Preprocessing
+	}
+	if config.SeasonalPeriod > 0 {
+		description = fmt.Sprintf("seasonal(%d),%s", config.SeasonalPeriod, description)
+	}
+	return description
+}
+
+// Difference returns the first differences of row. The result has the same length
+// as row, so the first difference is repeated at the start.
+func Difference(row []float64) []float64 {
+	ret := make([]float64, len(row))
+	for i := 1; i < len(row); i++ {
+		ret[i] = row[i] - row[i-1]
+	}
+	if len(row) > 1 {
+		ret[0] = ret[1]
+	}
+	return ret
+}
+
+// Detrend returns row minus its least-squares line.
+func Detrend(row []float64) []float64 {
+	n := float64(len(row))
+	// The sample indices are centered around 0 so the slope and the intercept are independent.
+	center := (n - 1.0) / 2.0
+	var sum, sumXY, sumXX float64
+	for i, v := range row {
+		x := float64(i) - center
+		sum += v
+		sumXY += x * v
+		sumXX += x * x
+	}
+	ret := make([]float64, len(row))
+	if len(row) == 0 {
+		return ret
+	}
+	slope := 0.0
+	if sumXX > 0.0 {
+		slope = sumXY / sumXX
+	}
+	intercept := sum / n
+	for i, v := range row {
+		ret[i] = v - intercept - slope*(float64(i)-center)
+	}
+	return ret
+}
+
+// RemoveMovingAverage returns row minus its centered moving average over window samples.
+// Close to the ends of the row, the average is over the samples that exist.
+func RemoveMovingAverage(row []float64, window int) []float64 {
+	prefix := make([]float64, len(row)+1)
+	for i, v := range row {
+		prefix[i+1] = prefix[i] + v
+	}
+	before := window / 2
+	after := window - before - 1
+	ret := make([]float64, len(row))
+	for i, v := range row {
+		start := max(0, i-before)
+		end := min(len(row), i+after+1)
+		ret[i] = v - (prefix[end]-prefix[start])/float64(end-start)
+	}
+	return ret
+}
@@ -0,0 +1,91 @@
+package preprocess
+
+import (
+	"github.com/kpaschen/corrjoin/lib/correlation"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func checkValues(t *testing.T, name string, expected []float64, actual []float64) {
+	if len(expected) != len(actual) {
+		t.Fatalf("%s: expected %d values but got %d", name, len(expected), len(actual))
+	}
+	for i, v := range expected {
+		if math.Abs(actual[i]-v) > 1e-9 {
+			t.Errorf("%s: expected %v but got %v", name, expected, actual)
+			return
+		}
+	}
+}
+
+func TestDifference(t *testing.T) {
+	checkValues(t, "difference", []float64{1.0, 1.0, 3.0, -2.0}, Difference([]float64{1.0, 2.0, 5.0, 3.0}))
+	checkValues(t, "single value", []float64{0.0}, Difference([]float64{4.0}))
+}
+
+func TestDetrend(t *testing.T) {
+	checkValues(t, "line", []float64{0.0, 0.0, 0.0, 0.0}, Detrend([]float64{1.0, 3.0, 5.0, 7.0}))
+	// The trend through 0, 2, 0, 2 has slope 0.4 and goes through 1 at the center.
+	checkValues(t, "zigzag", []float64{-0.4, 1.2, -1.2, 0.4}, Detrend([]float64{0.0, 2.0, 0.0, 2.0}))
+}
+
+func TestRemoveMovingAverage(t *testing.T) {
+	checkValues(t, "constant", []float64{0.0, 0.0, 0.0}, RemoveMovingAverage([]float64{2.0, 2.0, 2.0}, 3))
+	// The averages are over {1, 2}, {1, 2, 6}, {2, 6, 3} and {6, 3}.
+	checkValues(t, "window 3", []float64{-0.5, -1.0, 7.0 / 3.0, -1.5},
+		RemoveMovingAverage([]float64{1.0, 2.0, 6.0, 3.0}, 3))
+}
+
+// Two independent timeseries on the same trend correlate until the trend is removed.
+func TestTrendRemoval(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	x := make([]float64, 500)
+	y := make([]float64, 500)
+	for i := range x {
+		x[i] = 0.05*float64(i) + rng.NormFloat64()
+		y[i] = 0.05*float64(i) + rng.NormFloat64()
+	}
+	raw, _ := correlation.PearsonCorrelation(x, y)
+	if raw < 0.9 {
+		t.Fatalf("expected the trend to make the rows correlate but got %f", raw)
+	}
+	for _, preprocessing := range []string{settings.PREPROCESS_DIFFERENCE, settings.PREPROCESS_DETREND,
+		settings.PREPROCESS_MOVING_AVERAGE} {
+		transform, err := NewRowTransform(settings.CorrjoinSettings{
+			Preprocessing:       preprocessing,
+			MovingAverageWindow: 20,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		pearson, _ := correlation.PearsonCorrelation(transform(x), transform(y))
+		if math.Abs(pearson) > 0.2 {
+			t.Errorf("expected no correlation after %s but got %f", preprocessing, pearson)
+		}
+	}
+}
+
+func TestNewRowTransform(t *testing.T) {
+	transform, err := NewRowTransform(settings.CorrjoinSettings{Preprocessing: settings.PREPROCESS_NONE})
+	if err != nil || transform != nil {
+		t.Errorf("expected no transform without preprocessing but got %v", err)
+	}
+	if _, err = NewRowTransform(settings.CorrjoinSettings{Preprocessing: "smooth"}); err == nil {
+		t.Errorf("expected an error for unsupported preprocessing")
+	}
+	if _, err = NewRowTransform(settings.CorrjoinSettings{Preprocessing: settings.PREPROCESS_MOVING_AVERAGE,
+		MovingAverageWindow: 1}); err == nil {
+		t.Errorf("expected an error for a moving average over one sample")
+	}
+	description := Describe(settings.CorrjoinSettings{Preprocessing: settings.PREPROCESS_MOVING_AVERAGE,
+		MovingAverageWindow: 12})
+	if description != "moving_average(12)" {
+		t.Errorf("unexpected description %s", description)
+	}
+	description = Describe(settings.CorrjoinSettings{SeasonalPeriod: 4320})
+	if description != "seasonal(4320),none" {
+		t.Errorf("unexpected description %s", description)
+	}
+}
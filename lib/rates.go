@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"github.com/prometheus/prometheus/model/value"
+	"time"
+)
+
+// A CounterSample is the latest raw sample of a counter.
+type CounterSample struct {
+	Value     float64
+	Timestamp time.Time
+}
+
+// A RateConverter turns the raw values of counters into per-second rates.
+// Two growing counters always look strongly correlated, their rates do not.
+// A RateConverter is not safe for concurrent use.
+type RateConverter struct {
+	last map[uint64]CounterSample
+
+	// The number of counter resets seen so far.
+	Resets int
+}
+
+func NewRateConverter() *RateConverter {
+	return &RateConverter{
+		last: make(map[uint64]CounterSample),
+	}
+}
+
+// Convert replaces the value of a counter observation with the rate since the
+// previous sample of the same counter. Observations that are not counters are
+// returned unchanged. It returns nil when there is no rate yet, which is the case
+// for the first sample of a counter.
+// A value that is lower than the previous one is treated as a counter reset, the
+// same way Prometheus' rate() does.
+func (r *RateConverter) Convert(observation *Observation) *Observation {
+	if !observation.Counter {
+		return observation
+	}
+	if value.IsStaleNaN(observation.Value) {
+		delete(r.last, observation.MetricFingerprint)
+		return observation
+	}
+	previous, ok := r.last[observation.MetricFingerprint]
+	if ok && !observation.Timestamp.After(previous.Timestamp) {
+		// Out of order or duplicate sample.
+		return nil
+	}
+	r.last[observation.MetricFingerprint] = CounterSample{
+		Value:     observation.Value,
+		Timestamp: observation.Timestamp,
+	}
+	if !ok {
+		return nil
+	}
+	delta := observation.Value - previous.Value
+	if delta < 0 {
+		r.Resets++
+		delta = observation.Value
+	}
+	converted := *observation
+	converted.Value = delta / observation.Timestamp.Sub(previous.Timestamp).Seconds()
+	return &converted
+}
+
+// Expire forgets the counters that have not had a sample since before cutoff.
+func (r *RateConverter) Expire(cutoff time.Time) int {
+	expired := 0
+	for fp, sample := range r.last {
+		if sample.Timestamp.Before(cutoff) {
+			delete(r.last, fp)
+			expired++
+		}
+	}
+	return expired
+}
+
+// Snapshot returns the latest sample of every counter, keyed by fingerprint. The result
+// shares memory with the converter, so it must not be used after the next call to Convert.
+func (r *RateConverter) Snapshot() map[uint64]CounterSample {
+	return r.last
+}
+
+// Restore replaces the latest samples of the counters, so the first sample of a counter
+// after a restart already has a rate.
+func (r *RateConverter) Restore(last map[uint64]CounterSample) {
+	if last == nil {
+		last = make(map[uint64]CounterSample)
+	}
+	r.last = last
+}
@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"github.com/prometheus/prometheus/model/value"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateConverter(t *testing.T) {
+	now := time.Now()
+	converter := NewRateConverter()
+	counter := func(v float64, seconds int) *Observation {
+		return &Observation{
+			MetricFingerprint: uint64(1),
+			MetricName:        "requests_total",
+			Value:             v,
+			Timestamp:         now.Add(time.Duration(seconds) * time.Second),
+			Counter:           true,
+		}
+	}
+
+	if o := converter.Convert(counter(100, 0)); o != nil {
+		t.Errorf("expected no rate for the first sample but got %v", o)
+	}
+	o := converter.Convert(counter(120, 10))
+	if o == nil || o.Value != 2.0 {
+		t.Errorf("expected rate 2.0 but got %v", o)
+	}
+	if o := converter.Convert(counter(130, 10)); o != nil {
+		t.Errorf("expected duplicate sample to be dropped but got %v", o)
+	}
+	// A counter reset: the counter restarted from 0 and is at 5 now.
+	o = converter.Convert(counter(5, 20))
+	if o == nil || o.Value != 0.5 {
+		t.Errorf("expected rate 0.5 after reset but got %v", o)
+	}
+	if converter.Resets != 1 {
+		t.Errorf("expected one reset but got %d", converter.Resets)
+	}
+
+	gauge := &Observation{MetricFingerprint: uint64(2), Value: 7, Timestamp: now}
+	if o := converter.Convert(gauge); o != gauge {
+		t.Errorf("expected gauge to be passed through unchanged")
+	}
+
+	stale := counter(math.Float64frombits(value.StaleNaN), 30)
+	if o := converter.Convert(stale); o != stale {
+		t.Errorf("expected stale marker to be passed through unchanged")
+	}
+	if o := converter.Convert(counter(10, 40)); o != nil {
+		t.Errorf("expected no rate for the first sample after a stale marker but got %v", o)
+	}
+
+	if expired := converter.Expire(now.Add(time.Minute)); expired != 1 {
+		t.Errorf("expected one counter to expire but got %d", expired)
+	}
+}
@@ -0,0 +1,223 @@
+package reporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// The pair is correlated in this stride but was not in the previous one.
+	CHANGE_NEW = "new"
+	// The pair was correlated in the previous stride but is not anymore, even
+	// though both timeseries are still there.
+	CHANGE_LOST = "lost"
+	// The pair is correlated in both strides, but the coefficient moved by more
+	// than the change threshold.
+	CHANGE_STRENGTH = "strength_changed"
+)
+
+// ChangeEvent describes how the correlation of two timeseries changed between two strides.
+// The timeseries are identified by their metric fingerprints, with Timeseries1 < Timeseries2.
+type ChangeEvent struct {
+	Kind        string `json:"kind"`
+	Timeseries1 uint64 `json:"timeseries1"`
+	Timeseries2 uint64 `json:"timeseries2"`
+	// The coefficients in the previous and in the current stride, 0 if the pair
+	// was not correlated.
+	Previous float32 `json:"previous"`
+	Current  float32 `json:"current"`
+}
+
+// ChangeReport is the content of a change file.
+type ChangeReport struct {
+	Stride         int           `json:"stride"`
+	PreviousStride int           `json:"previousStride"`
+	StartTime      time.Time     `json:"startTime"`
+	EndTime        time.Time     `json:"endTime"`
+	Events         []ChangeEvent `json:"events"`
+}
+
+type fingerprintPair [2]uint64
+
+func newFingerprintPair(fp1 uint64, fp2 uint64) fingerprintPair {
+	if fp1 > fp2 {
+		return fingerprintPair{fp2, fp1}
+	}
+	return fingerprintPair{fp1, fp2}
+}
+
+// ChangeReporter compares the correlated pairs of consecutive strides and writes
+// the differences to a json file per stride. Row ids change between strides, so
+// pairs are tracked by metric fingerprint.
+type ChangeReporter struct {
+	filenameBase string
+	threshold    float64
+
+	// Strides are initialized and flushed from different goroutines.
+	lock sync.Mutex
+
+	strideStartTimes map[int]time.Time
+	strideEndTimes   map[int]time.Time
+	stridePairs      map[int]map[fingerprintPair]float32
+
+	// The pairs of the last stride that was flushed.
+	previousStride int
+	previousPairs  map[fingerprintPair]float32
+}
+
+// NewChangeReporter returns a reporter that writes change files to filenameBase. A change
+// in the coefficient of a pair that stays correlated is reported when it is more than threshold.
+func NewChangeReporter(filenameBase string, threshold float64) *ChangeReporter {
+	return &ChangeReporter{
+		filenameBase:     filenameBase,
+		threshold:        threshold,
+		strideStartTimes: make(map[int]time.Time),
+		strideEndTimes:   make(map[int]time.Time),
+		stridePairs:      make(map[int]map[fingerprintPair]float32),
+		previousStride:   -1,
+	}
+}
+
+// ChangeFilename returns the name of the change file for a stride. It matches the
+// name of the correlations file for the same stride.
+func ChangeFilename(strideCounter int, startTime time.Time, endTime time.Time) string {
+	return fmt.Sprintf("changes_%d_%s-%s.json", strideCounter,
+		startTime.UTC().Format("20060102150405"), endTime.UTC().Format("20060102150405"))
+}
+
+func (r *ChangeReporter) InitializeStride(strideCounter int, strideStart time.Time, strideEnd time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.stridePairs[strideCounter]; exists {
+		return
+	}
+	r.strideStartTimes[strideCounter] = strideStart
+	r.strideEndTimes[strideCounter] = strideEnd
+	r.stridePairs[strideCounter] = make(map[fingerprintPair]float32)
+}
+
+func (r *ChangeReporter) AddCorrelatedPairs(result datatypes.CorrjoinResult, tsids []lib.TsId) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	pairs, exists := r.stridePairs[result.StrideCounter]
+	if !exists {
+		return fmt.Errorf("stride %d has not been initialized", result.StrideCounter)
+	}
+	for pair, pearson := range result.CorrelatedPairs {
+		rowids := pair.RowIds()
+		if rowids[0] >= len(tsids) || rowids[1] >= len(tsids) {
+			return fmt.Errorf("pair %v is outside the %d timeseries of stride %d", rowids,
+				len(tsids), result.StrideCounter)
+		}
+		pairs[newFingerprintPair(tsids[rowids[0]].MetricFingerprint,
+			tsids[rowids[1]].MetricFingerprint)] = float32(pearson)
+	}
+	return nil
+}
+
+// diff returns the change events between the previous pairs and current. Lost
+// correlations are only reported if both timeseries are in present. Otherwise, the
+// correlation ended because one of the timeseries did.
+func (r *ChangeReporter) diff(current map[fingerprintPair]float32, present map[uint64]bool) []ChangeEvent {
+	events := make([]ChangeEvent, 0)
+	for pair, pearson := range current {
+		previous, exists := r.previousPairs[pair]
+		if !exists {
+			events = append(events, ChangeEvent{Kind: CHANGE_NEW, Timeseries1: pair[0],
+				Timeseries2: pair[1], Current: pearson})
+			continue
+		}
+		if math.Abs(float64(pearson-previous)) > r.threshold {
+			events = append(events, ChangeEvent{Kind: CHANGE_STRENGTH, Timeseries1: pair[0],
+				Timeseries2: pair[1], Previous: previous, Current: pearson})
+		}
+	}
+	for pair, previous := range r.previousPairs {
+		if _, exists := current[pair]; exists {
+			continue
+		}
+		if !present[pair[0]] || !present[pair[1]] {
+			continue
+		}
+		events = append(events, ChangeEvent{Kind: CHANGE_LOST, Timeseries1: pair[0],
+			Timeseries2: pair[1], Previous: previous})
+	}
+	// The largest changes first.
+	sort.Slice(events, func(i, j int) bool {
+		di := math.Abs(float64(events[i].Current - events[i].Previous))
+		dj := math.Abs(float64(events[j].Current - events[j].Previous))
+		if di != dj {
+			return di > dj
+		}
+		if events[i].Timeseries1 != events[j].Timeseries1 {
+			return events[i].Timeseries1 < events[j].Timeseries1
+		}
+		return events[i].Timeseries2 < events[j].Timeseries2
+	})
+	return events
+}
+
+// Flush compares the pairs of strideCounter with those of the previously flushed stride
+// and writes the change file. tsids are the timeseries of strideCounter. Nothing is
+// written for the first stride after a start, since there is nothing to compare it to.
+func (r *ChangeReporter) Flush(strideCounter int, tsids []lib.TsId) ([]ChangeEvent, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	current, exists := r.stridePairs[strideCounter]
+	if !exists {
+		return nil, nil
+	}
+	startTime := r.strideStartTimes[strideCounter]
+	endTime := r.strideEndTimes[strideCounter]
+	// Also forget about earlier strides whose computation never finished.
+	for stride := range r.stridePairs {
+		if stride <= strideCounter {
+			delete(r.stridePairs, stride)
+			delete(r.strideStartTimes, stride)
+			delete(r.strideEndTimes, stride)
+		}
+	}
+
+	defer func() {
+		r.previousStride = strideCounter
+		r.previousPairs = current
+	}()
+	if r.previousPairs == nil {
+		log.Printf("no previous stride to compare the correlations of stride %d to\n", strideCounter)
+		return nil, nil
+	}
+
+	present := make(map[uint64]bool, len(tsids))
+	for _, tsid := range tsids {
+		present[tsid.MetricFingerprint] = true
+	}
+	report := ChangeReport{
+		Stride:         strideCounter,
+		PreviousStride: r.previousStride,
+		StartTime:      startTime.UTC(),
+		EndTime:        endTime.UTC(),
+		Events:         r.diff(current, present),
+	}
+
+	path := filepath.Join(r.filenameBase, ChangeFilename(strideCounter, startTime, endTime))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return report.Events, fmt.Errorf("failed to open change file: %v", err)
+	}
+	defer file.Close()
+	if err = json.NewEncoder(file).Encode(report); err != nil {
+		return report.Events, fmt.Errorf("failed to write change file: %v", err)
+	}
+	log.Printf("recorded %d correlation changes between strides %d and %d\n", len(report.Events),
+		r.previousStride, strideCounter)
+	return report.Events, nil
+}
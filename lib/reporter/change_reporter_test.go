@@ -0,0 +1,88 @@
+package reporter
+
+import (
+	"encoding/json"
+	"github.com/kpaschen/corrjoin/lib"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func correlatedPairs(stride int, pairs map[[2]int]float64) datatypes.CorrjoinResult {
+	result := datatypes.CorrjoinResult{
+		CorrelatedPairs: make(map[datatypes.RowPair]float64),
+		StrideCounter:   stride,
+	}
+	for ids, pearson := range pairs {
+		result.CorrelatedPairs[*datatypes.NewRowPair(ids[0], ids[1])] = pearson
+	}
+	return result
+}
+
+func TestChangeReporter(t *testing.T) {
+	tempdir, err := os.MkdirTemp("", "corrjoinTest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	rep := NewChangeReporter(tempdir, 0.1)
+	start := time.Date(2025, 3, 28, 10, 0, 0, 0, time.UTC)
+
+	tsids := []lib.TsId{{MetricFingerprint: 10}, {MetricFingerprint: 20}, {MetricFingerprint: 30},
+		{MetricFingerprint: 40}, {MetricFingerprint: 50}}
+	rep.InitializeStride(1, start, start.Add(time.Hour))
+	if err = rep.AddCorrelatedPairs(correlatedPairs(1, map[[2]int]float64{
+		{0, 1}: 0.95, {1, 2}: 0.9, {2, 3}: 0.92, {3, 4}: 0.91}), tsids); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	events, err := rep.Flush(1, tsids)
+	if err != nil || events != nil {
+		t.Errorf("expected no changes for the first stride but got %v, %v", events, err)
+	}
+
+	// The rows are compacted in stride 2: fingerprint 50 is gone and 40 moves to row 3.
+	tsids = []lib.TsId{{MetricFingerprint: 20}, {MetricFingerprint: 10}, {MetricFingerprint: 30},
+		{MetricFingerprint: 40}}
+	rep.InitializeStride(2, start.Add(10*time.Minute), start.Add(70*time.Minute))
+	if err = rep.AddCorrelatedPairs(correlatedPairs(2, map[[2]int]float64{
+		{0, 1}: 0.93, {0, 2}: 0.7, {1, 3}: 0.9}), tsids); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err = rep.AddCorrelatedPairs(correlatedPairs(3, map[[2]int]float64{{0, 1}: 0.9}), tsids); err == nil {
+		t.Errorf("expected an error for a stride that was not initialized")
+	}
+	events, err = rep.Flush(2, tsids)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// 10-20 is unchanged, 20-30 weakened, 10-40 is new, 30-40 is lost and 40-50 ended with 50.
+	expected := []ChangeEvent{
+		{Kind: CHANGE_LOST, Timeseries1: 30, Timeseries2: 40, Previous: 0.92},
+		{Kind: CHANGE_NEW, Timeseries1: 10, Timeseries2: 40, Current: 0.9},
+		{Kind: CHANGE_STRENGTH, Timeseries1: 20, Timeseries2: 30, Previous: 0.9, Current: 0.7},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d changes but got %+v", len(expected), events)
+	}
+	for i, e := range expected {
+		if events[i] != e {
+			t.Errorf("expected change %+v but got %+v", e, events[i])
+		}
+	}
+
+	file, err := os.Open(filepath.Join(tempdir,
+		ChangeFilename(2, start.Add(10*time.Minute), start.Add(70*time.Minute))))
+	if err != nil {
+		t.Fatalf("failed to open change file: %v", err)
+	}
+	defer file.Close()
+	var report ChangeReport
+	if err = json.NewDecoder(file).Decode(&report); err != nil {
+		t.Fatalf("failed to read change file: %v", err)
+	}
+	if report.Stride != 2 || report.PreviousStride != 1 || len(report.Events) != 3 {
+		t.Errorf("unexpected change report %+v", report)
+	}
+}
@@ -13,6 +13,11 @@ import (
 	"time"
 )
 
+const (
+	// The key in the file metadata for the preprocessing that was applied to the timeseries.
+	METADATA_PREPROCESSING = "corrjoin.preprocessing"
+)
+
 type Timeseries struct {
 	ID                int               `parquet:"id"`
 	Metric            string            `parquet:"metric,optional,zstd"`
@@ -26,6 +31,20 @@ type Timeseries struct {
 	// There is no float16 datatype in go, but maybe a fixed-precision representation would be best.
 	Pearson  float32 `parquet:"pearson,optional"`
 	Constant bool    `parquet:"constant,optional"`
+	// Set on the metadata row of a counter that was converted to a rate.
+	Rate bool `parquet:"rate,optional"`
+	// Only set by the lagged_pearson algorithm. A positive lag means this timeseries
+	// leads the Correlated one by Lag samples.
+	Lag int32 `parquet:"lag,optional"`
+	// The correlation measure that produced Pearson. Files written before there was a
+	// choice of measure leave this empty, which means pearson.
+	Measure string `parquet:"measure,optional,dict"`
+	// The significance of Pearson given the autocorrelation of the two timeseries.
+	// EffectiveSampleSize is 0 when the significance was not computed.
+	PValue              float32 `parquet:"pValue,optional"`
+	ConfidenceLow       float32 `parquet:"confidenceLow,optional"`
+	ConfidenceHigh      float32 `parquet:"confidenceHigh,optional"`
+	EffectiveSampleSize float32 `parquet:"effectiveSampleSize,optional"`
 }
 
 type ParquetReporter struct {
@@ -36,6 +55,8 @@ type ParquetReporter struct {
 	// I tried a SortingWriter but it used too much memory.
 	strideWriters      map[int](*parquet.GenericWriter[Timeseries])
 	maxRowsPerRowGroup int64
+	// Key-value metadata for every file.
+	fileMetadata map[string]string
 }
 
 func NewParquetReporter(filenameBase string, maxRows int64) *ParquetReporter {
@@ -45,9 +66,16 @@ func NewParquetReporter(filenameBase string, maxRows int64) *ParquetReporter {
 		strideEndTimes:     make(map[int]string),
 		strideWriters:      make(map[int]*parquet.GenericWriter[Timeseries]),
 		maxRowsPerRowGroup: maxRows,
+		fileMetadata:       make(map[string]string),
 	}
 }
 
+// SetFileMetadata adds key and value to the metadata of the files for strides that
+// have not been initialized yet.
+func (r *ParquetReporter) SetFileMetadata(key string, value string) {
+	r.fileMetadata[key] = value
+}
+
 func (r *ParquetReporter) InitializeStride(strideCounter int,
 	strideStart time.Time, strideEnd time.Time) {
 
@@ -74,7 +102,11 @@ func (r *ParquetReporter) InitializeStride(strideCounter int,
 	}
 
 	// max rows per row group 10k is good for memory use but the files are about 3.5G per stride.
-	r.strideWriters[strideCounter] = parquet.NewGenericWriter[Timeseries](file, parquet.MaxRowsPerRowGroup(r.maxRowsPerRowGroup))
+	options := []parquet.WriterOption{parquet.MaxRowsPerRowGroup(r.maxRowsPerRowGroup)}
+	for key, value := range r.fileMetadata {
+		options = append(options, parquet.KeyValueMetadata(key, value))
+	}
+	r.strideWriters[strideCounter] = parquet.NewGenericWriter[Timeseries](file, options...)
 }
 
 func extractRowsFromResult(result datatypes.CorrjoinResult, tsids []lib.TsId) []Timeseries {
@@ -84,12 +116,17 @@ func extractRowsFromResult(result datatypes.CorrjoinResult, tsids []lib.TsId) []
 	ctr := 0
 	for pair, pearson := range result.CorrelatedPairs {
 		rowids := pair.RowIds()
+		lag := int32(result.Lags[pair])
+		significance := result.Significance[pair]
 		ts1 := Timeseries{
 			MetricFingerprint: tsids[rowids[0]].MetricFingerprint,
 			ID:                rowids[0],
 			Correlated:        tsids[rowids[1]].MetricFingerprint,
 			Pearson:           float32(pearson),
+			Lag:               lag,
+			Measure:           result.Measure,
 		}
+		setSignificance(&ts1, significance)
 		ret[ctr] = ts1
 		ctr++
 		ts2 := Timeseries{
@@ -97,13 +134,23 @@ func extractRowsFromResult(result datatypes.CorrjoinResult, tsids []lib.TsId) []
 			ID:                rowids[1],
 			Correlated:        tsids[rowids[0]].MetricFingerprint,
 			Pearson:           float32(pearson),
+			Lag:               -lag,
+			Measure:           result.Measure,
 		}
+		setSignificance(&ts2, significance)
 		ret[ctr] = ts2
 		ctr++
 	}
 	return ret
 }
 
+func setSignificance(ts *Timeseries, significance datatypes.Significance) {
+	ts.PValue = float32(significance.PValue)
+	ts.ConfidenceLow = float32(significance.ConfidenceLow)
+	ts.ConfidenceHigh = float32(significance.ConfidenceHigh)
+	ts.EffectiveSampleSize = float32(significance.EffectiveSampleSize)
+}
+
 func (r *ParquetReporter) RecordTimeseriesIds(strideCounter int, tsids []lib.TsId) error {
 	writer, exists := r.strideWriters[strideCounter]
 	if !exists || writer == nil {
@@ -130,6 +177,7 @@ func (r *ParquetReporter) RecordTimeseriesIds(strideCounter int, tsids []lib.TsI
 			Metric:            string(metricModel["__name__"]),
 			Labels:            make(map[string]string),
 			MetricFingerprint: tsid.MetricFingerprint,
+			Rate:              tsid.Rate,
 		}
 		for key, value := range metricModel {
 			if key == "__name__" {
@@ -7,6 +7,7 @@ import (
 	"github.com/parquet-go/parquet-go"
 	"github.com/prometheus/common/model"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -118,3 +119,82 @@ func TestAddCorrelatedPairs(t *testing.T) {
 		t.Errorf("did not find id column in parquet schema")
 	}
 }
+
+func TestExtractRowsFromResultWithLag(t *testing.T) {
+	tsids := []lib.TsId{
+		lib.TsId{MetricFingerprint: uint64(10)},
+		lib.TsId{MetricFingerprint: uint64(20)},
+	}
+	rp := datatypes.NewRowPair(0, 1)
+	result := datatypes.CorrjoinResult{
+		CorrelatedPairs: map[datatypes.RowPair]float64{*rp: 0.95},
+		Lags:            map[datatypes.RowPair]int{*rp: 3},
+		StrideCounter:   1,
+	}
+	rows := extractRowsFromResult(result, tsids)
+	if len(rows) != 2 {
+		t.Fatalf("expected two rows but got %d", len(rows))
+	}
+	for _, row := range rows {
+		expected := int32(3)
+		if row.MetricFingerprint == uint64(20) {
+			expected = -3
+		}
+		if row.Lag != expected {
+			t.Errorf("expected lag %d for %d but got %d", expected, row.MetricFingerprint, row.Lag)
+		}
+	}
+}
+
+func TestExtractRowsFromResultWithMeasure(t *testing.T) {
+	tsids := []lib.TsId{
+		lib.TsId{MetricFingerprint: uint64(10)},
+		lib.TsId{MetricFingerprint: uint64(20)},
+	}
+	result := datatypes.CorrjoinResult{
+		CorrelatedPairs: map[datatypes.RowPair]float64{*datatypes.NewRowPair(0, 1): 0.95},
+		StrideCounter:   1,
+		Measure:         "spearman",
+	}
+	for _, row := range extractRowsFromResult(result, tsids) {
+		if row.Measure != "spearman" {
+			t.Errorf("expected measure spearman for %d but got %q", row.MetricFingerprint, row.Measure)
+		}
+	}
+}
+
+func TestFileMetadata(t *testing.T) {
+	tempdir, err := os.MkdirTemp("", "corrjoinTest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	rep := NewParquetReporter(tempdir, 1000)
+	rep.SetFileMetadata(METADATA_PREPROCESSING, "detrend")
+	rep.InitializeStride(1, time.Now(), time.Now())
+	if err = rep.RecordTimeseriesIds(1, []lib.TsId{}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err = rep.Flush(1); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(tempdir, "correlations_1_*.pq"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one result file but got %v (%v)", files, err)
+	}
+	file, err := os.Open(files[0])
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer file.Close()
+	stat, _ := file.Stat()
+	pqfile, err := parquet.OpenFile(file, stat.Size())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	value, ok := pqfile.Lookup(METADATA_PREPROCESSING)
+	if !ok || value != "detrend" {
+		t.Errorf("expected preprocessing detrend in the file metadata but got %q", value)
+	}
+}
@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"math"
+)
+
+// SeasonalRow is the periodic profile of one row. The period is divided into
+// buckets, and every bucket holds the mean of the samples that fell into it.
+type SeasonalRow struct {
+	Means   []float32
+	Weights []float32
+	// The number of samples the profile has seen. The profile is only used once
+	// it has seen a whole period.
+	Observed int
+}
+
+// SeasonalState is the part of the seasonal profiles that is saved in a checkpoint.
+type SeasonalState struct {
+	Period  int
+	Buckets int
+	// The sample number (unix time divided by the sample interval) of the
+	// last column in the window.
+	LastSample int64
+	Rows       []SeasonalRow
+}
+
+// seasonalProfiles keeps a periodic profile for every row of the window over a much
+// longer history than the window, so the profile can be subtracted from the rows before
+// they are correlated. The memory per row is bounded by the number of buckets.
+type seasonalProfiles struct {
+	SeasonalState
+	// The maximum weight of a bucket mean. This makes the means forget samples
+	// that are more than SeasonalHistory periods old.
+	maxWeight float32
+}
+
+// newSeasonalProfiles returns nil if config does not ask for deseasonalization.
+func newSeasonalProfiles(config settings.CorrjoinSettings) *seasonalProfiles {
+	if config.SeasonalPeriod <= 0 || config.SeasonalBuckets <= 0 {
+		return nil
+	}
+	buckets := min(config.SeasonalBuckets, config.SeasonalPeriod)
+	samplesPerBucket := float64(config.SeasonalPeriod) / float64(buckets)
+	return &seasonalProfiles{
+		SeasonalState: SeasonalState{
+			Period:  config.SeasonalPeriod,
+			Buckets: buckets,
+		},
+		maxWeight: float32(math.Max(1.0, float64(max(config.SeasonalHistory, 1))*samplesPerBucket)),
+	}
+}
+
+func (s *seasonalProfiles) bucket(sample int64) int {
+	phase := sample % int64(s.Period)
+	if phase < 0 {
+		phase += int64(s.Period)
+	}
+	return int(phase * int64(s.Buckets) / int64(s.Period))
+}
+
+// observe adds the columns of buffer to the profiles. firstSample is the sample number
+// of the first column, or 0 if it is not known, in which case the columns are assumed
+// to follow the previous ones.
+func (s *seasonalProfiles) observe(buffer [][]float64, firstSample int64) {
+	if s == nil || len(buffer) == 0 {
+		return
+	}
+	if firstSample == 0 {
+		firstSample = s.LastSample + 1
+	}
+	for len(s.Rows) < len(buffer) {
+		s.Rows = append(s.Rows, SeasonalRow{
+			Means:   make([]float32, s.Buckets),
+			Weights: make([]float32, s.Buckets),
+		})
+	}
+	for i, values := range buffer {
+		r := &s.Rows[i]
+		for j, v := range values {
+			if math.IsNaN(v) {
+				continue
+			}
+			b := s.bucket(firstSample + int64(j))
+			r.Weights[b] = min(r.Weights[b]+1, s.maxWeight)
+			r.Means[b] += (float32(v) - r.Means[b]) / r.Weights[b]
+			r.Observed++
+		}
+	}
+	s.LastSample = firstSample + int64(len(buffer[0])) - 1
+}
+
+// deseasonalize returns row i of the window minus its profile. The row is returned
+// unchanged if its profile has not seen a whole period yet.
+func (s *seasonalProfiles) deseasonalize(i int, row []float64) []float64 {
+	if s == nil || i >= len(s.Rows) || s.Rows[i].Observed < s.Period {
+		return row
+	}
+	r := &s.Rows[i]
+	firstSample := s.LastSample - int64(len(row)) + 1
+	ret := make([]float64, len(row))
+	for j, v := range row {
+		b := s.bucket(firstSample + int64(j))
+		if r.Weights[b] == 0 {
+			ret[j] = v
+			continue
+		}
+		ret[j] = v - float64(r.Means[b])
+	}
+	return ret
+}
+
+// remap renumbers the profiles after rows have been compacted. mapping[old] is the
+// new row id, or -1 if the row has been dropped.
+func (s *seasonalProfiles) remap(mapping []int) {
+	if s == nil {
+		return
+	}
+	rows := make([]SeasonalRow, 0, len(s.Rows))
+	for oldRow, newRow := range mapping {
+		if newRow >= 0 && oldRow < len(s.Rows) {
+			rows = append(rows, s.Rows[oldRow])
+		}
+	}
+	s.Rows = rows
+}
+
+// restore replaces the profiles with state if state was saved with the same period
+// and number of buckets.
+func (s *seasonalProfiles) restore(state *SeasonalState) bool {
+	if s == nil || state == nil || state.Period != s.Period || state.Buckets != s.Buckets {
+		return false
+	}
+	for _, r := range state.Rows {
+		if len(r.Means) != s.Buckets || len(r.Weights) != s.Buckets {
+			return false
+		}
+	}
+	s.SeasonalState = *state
+	return true
+}
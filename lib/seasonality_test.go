@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"github.com/kpaschen/corrjoin/lib/comparisons"
+	"github.com/kpaschen/corrjoin/lib/correlation"
+	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestDeseasonalize(t *testing.T) {
+	config := settings.CorrjoinSettings{
+		Algorithm:       settings.ALGO_NONE,
+		WindowSize:      120,
+		StrideLength:    40,
+		SvdDimensions:   4,
+		SampleInterval:  20,
+		SeasonalPeriod:  240,
+		SeasonalBuckets: 24,
+		SeasonalHistory: 3,
+	}.ComputeSettingsFields()
+	comparer := &comparisons.InProcessComparer{}
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	defer close(results)
+	comparer.Initialize(config, results)
+	tswindow := NewTimeseriesWindow(config, comparer)
+	if tswindow.seasonality == nil || tswindow.stats != nil {
+		t.Fatalf("expected seasonal profiles and no incremental stats")
+	}
+
+	// Two rows with the same daily cycle and independent noise.
+	rng := rand.New(rand.NewSource(8))
+	sample := int64(1000 * config.SeasonalPeriod)
+	for stride := 0; stride < 30; stride++ {
+		buffer := make([][]float64, 2)
+		for i := range buffer {
+			buffer[i] = make([]float64, config.StrideLength)
+			for j := range buffer[i] {
+				phase := float64((sample+int64(j))%int64(config.SeasonalPeriod)) / float64(config.SeasonalPeriod)
+				buffer[i][j] = 10.0*math.Sin(2*math.Pi*phase) + rng.NormFloat64()
+			}
+		}
+		if _, err := tswindow.shiftBufferIntoWindow(buffer); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		tswindow.seasonality.observe(buffer, sample)
+		sample += int64(config.StrideLength)
+	}
+
+	raw, _ := correlation.PearsonCorrelation(tswindow.buffers[0], tswindow.buffers[1])
+	if raw < 0.8 {
+		t.Fatalf("expected the daily cycle to make the rows correlate but got %f", raw)
+	}
+	tswindow.normalizeWindow()
+	pearson, _ := correlation.PearsonCorrelation(tswindow.normalized[0], tswindow.normalized[1])
+	if math.Abs(pearson) > 0.3 {
+		t.Errorf("expected no correlation after removing the daily cycle but got %f", pearson)
+	}
+
+	for _, r := range tswindow.seasonality.Rows {
+		if len(r.Means) != 24 || len(r.Weights) != 24 {
+			t.Errorf("expected 24 buckets per row but got %d", len(r.Means))
+		}
+		for _, w := range r.Weights {
+			if w > 30.0 {
+				t.Errorf("expected bucket weights of at most 3 periods of 10 samples but got %f", w)
+			}
+		}
+	}
+
+	// Dropping row 0 keeps the profile of row 1.
+	profile := tswindow.seasonality.Rows[1]
+	tswindow.pendingRowMappings = [][]int{{-1, 0}}
+	tswindow.applyRowMappings()
+	if len(tswindow.seasonality.Rows) != 1 || &tswindow.seasonality.Rows[0].Means[0] != &profile.Means[0] {
+		t.Errorf("expected the profile of row 1 to become row 0")
+	}
+}
+
+func TestSeasonalProfilesWaitForAPeriod(t *testing.T) {
+	profiles := newSeasonalProfiles(settings.CorrjoinSettings{SeasonalPeriod: 10, SeasonalBuckets: 20})
+	if profiles.Buckets != 10 {
+		t.Errorf("expected at most one bucket per sample but got %d", profiles.Buckets)
+	}
+	row := []float64{1, 2, 3, 4, 5}
+	profiles.observe([][]float64{row}, 7)
+	if got := profiles.deseasonalize(0, row); &got[0] != &row[0] {
+		t.Errorf("expected the row to be unchanged before the profile has seen a whole period")
+	}
+	profiles.observe([][]float64{row}, 0)
+	if profiles.LastSample != 16 {
+		t.Errorf("expected the columns to follow the previous ones but the last sample is %d", profiles.LastSample)
+	}
+	for _, v := range profiles.deseasonalize(0, row) {
+		if v != 0.0 {
+			t.Errorf("expected the profile to match the row it was learned from but got %f", v)
+		}
+	}
+
+	if profiles.restore(&SeasonalState{Period: 12, Buckets: 10}) {
+		t.Errorf("did not expect profiles with a different period to be restored")
+	}
+	if newSeasonalProfiles(settings.CorrjoinSettings{}) != nil {
+		t.Errorf("did not expect profiles without a period")
+	}
+}
+
+func TestSeasonalCheckpoint(t *testing.T) {
+	tempdir, err := os.MkdirTemp("", "corrjoinTest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir")
+	}
+	defer os.RemoveAll(tempdir)
+	config := checkpointTestSettings()
+	config.SeasonalPeriod = 12
+	config.SeasonalBuckets = 4
+	c := makeTestCheckpoint(t, config)
+
+	window := NewTimeseriesWindow(config, &comparisons.InProcessComparer{})
+	window.seasonality.observe([][]float64{{1, 2, 3, 4, 5, 6}}, 100)
+	c.Seasonality = window.SeasonalSnapshot()
+	if err = WriteCheckpoint(tempdir, c); err != nil {
+		t.Fatalf("failed to write checkpoint: %v", err)
+	}
+	restored, err := LoadLatestCheckpoint(tempdir, config)
+	if err != nil || restored == nil {
+		t.Fatalf("failed to load checkpoint: %v", err)
+	}
+
+	fresh := NewTimeseriesWindow(config, &comparisons.InProcessComparer{})
+	fresh.RestoreSeasonality(restored.Seasonality)
+	if fresh.seasonality.LastSample != 105 || len(fresh.seasonality.Rows) != 1 ||
+		fresh.seasonality.Rows[0].Observed != 6 {
+		t.Errorf("unexpected restored profiles %+v", fresh.seasonality.SeasonalState)
+	}
+}
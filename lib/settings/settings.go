@@ -9,7 +9,42 @@ const (
 	ALGO_FULL_PEARSON = "full_pearson"
 	ALGO_PAA_ONLY     = "paa_only"
 	ALGO_PAA_SVD      = "paa_svd"
-	ALGO_NONE         = "none" // for tests
+	// Like ALGO_FULL_PEARSON, but also tries shifting the rows against each other
+	// by up to MaxLag samples.
+	ALGO_LAGGED_PEARSON = "lagged_pearson"
+	// Candidates from locality-sensitive hashing of the normalized rows, see LshTables and LshBits.
+	ALGO_LSH  = "lsh"
+	ALGO_NONE = "none" // for tests
+
+	COMPARER_INPROCESS = "inprocess"
+	COMPARER_PARALLEL  = "parallel"
+	// Comparisons run in worker processes, see ComparerWorkerURLs.
+	COMPARER_DISTRIBUTED = "distributed"
+
+	// Full SVD on a sample of at most MaxRowsForSvd rows.
+	SVD_FULL = "full"
+	// Randomized truncated SVD on all rows.
+	SVD_RANDOMIZED = "randomized"
+	// Like SVD_RANDOMIZED, but starting from the singular vectors of the previous stride.
+	SVD_INCREMENTAL = "incremental"
+
+	PREPROCESS_NONE = "none"
+	// Replace every value with its difference from the previous value.
+	PREPROCESS_DIFFERENCE = "difference"
+	// Subtract the least-squares line through the window.
+	PREPROCESS_DETREND = "detrend"
+	// Subtract the centered moving average over MovingAverageWindow samples.
+	PREPROCESS_MOVING_AVERAGE = "moving_average"
+
+	// Series that can be derived from histograms, see HistogramSeries.
+	HISTOGRAM_MEAN  = "mean"
+	HISTOGRAM_COUNT = "count"
+	HISTOGRAM_SUM   = "sum"
+
+	MEASURE_PEARSON = "pearson"
+	// The pearson correlation of the ranks of the values in each row. This is less
+	// sensitive to outliers and also finds monotonic relationships that are not linear.
+	MEASURE_SPEARMAN = "spearman"
 )
 
 type CorrjoinSettings struct {
@@ -44,6 +79,21 @@ type CorrjoinSettings struct {
 	// matrices.
 	MaxRowsForSvd int
 
+	// How to compute the SVD, one of the SVD_ constants.
+	SvdStrategy string
+
+	// Whether to choose SvdDimensions, EuclidDimensions and SvdOutputDimensions
+	// automatically for ALGO_PAA_SVD. The choice is made on the first full window
+	// and then every AutoTuneInterval strides (0 means never again).
+	AutoTune         bool
+	AutoTuneInterval int
+	// The fraction of the correlated pairs that the chosen settings should find.
+	AutoTuneTargetRecall float64
+	// The number of rows to sample for tuning.
+	AutoTuneSampleRows int
+	// How long tuning may take, in seconds.
+	AutoTuneBudget int
+
 	// How often we expect new samples, in seconds.
 	SampleInterval int
 
@@ -57,12 +107,101 @@ type CorrjoinSettings struct {
 	// This is mainly for debugging. You can limit the number of timeseries in the system,
 	// but the selection will be random. The system will process the first /MaxRows/ timeseries
 	// it sees and drop all others. If you want more control over the time series selection, use
-	// the label expression in the remote write config.
+	// the label expression in the remote write config or RelabelConfigFile.
 	MaxRows int
 
+	// A yaml file with Prometheus relabel configs that the receiver applies to every
+	// timeseries before it is observed. Timeseries that the configs drop are not observed.
+	RelabelConfigFile string
+	// The receiver observes at most this many timeseries per value of the job label,
+	// the first ones it sees after relabeling. 0 means no limit.
+	MaxSeriesPerJob int
+
 	ResultsDirectory string
 
 	Algorithm string
+
+	// The comparison engine, one of the COMPARER_ constants.
+	Comparer string
+	// The number of worker goroutines for COMPARER_PARALLEL. 0 means one per CPU.
+	ComparerWorkers int
+	// The base URLs of the comparison worker processes for COMPARER_DISTRIBUTED.
+	ComparerWorkerURLs []string
+
+	// How to transform the rows of the window before they are correlated, one of the
+	// PREPROCESS_ constants. This removes trends that make unrelated timeseries correlate.
+	Preprocessing string
+	// The number of samples in the moving average for PREPROCESS_MOVING_AVERAGE.
+	MovingAverageWindow int
+
+	// The length of the daily or weekly cycle, in samples. When this is set, every row
+	// gets a periodic profile estimated over the last SeasonalHistory periods, and the
+	// profile is subtracted from the row before it is correlated. 0 disables this.
+	SeasonalPeriod int
+	// The number of values in the profile of a row. This bounds the memory per row.
+	SeasonalBuckets int
+	// The number of periods the profile averages over.
+	SeasonalHistory int
+
+	// The correlation measure, one of the MEASURE_ constants. Measures other than pearson
+	// are computed as the pearson correlation of transformed rows, so the PAA and SVD
+	// filters apply to them unchanged. With ALGO_LAGGED_PEARSON, the rows are transformed
+	// before they are shifted against each other.
+	CorrelationMeasure string
+
+	// The maximum lag, in samples, for ALGO_LAGGED_PEARSON.
+	MaxLag int
+
+	// The number of hash tables and the number of bits per hash for ALGO_LSH.
+	// More tables find more of the correlated pairs, more bits produce fewer
+	// uncorrelated candidates.
+	LshTables int
+	LshBits   int
+
+	// Whether to convert counters to per-second rates before correlating them.
+	// Counters are recognized by their metadata or by their name.
+	RateCounters bool
+
+	// The series that the receiver derives from every classic or native histogram in place
+	// of its buckets: quantile estimates written as p followed by the percentile (p50, p99.9),
+	// and the HISTOGRAM_ constants. Quantiles and the mean are computed over the observations
+	// between consecutive samples. The count and sum are counters. Empty passes histogram
+	// buckets through as separate timeseries.
+	HistogramSeries []string
+
+	// Whether to also look for pairs with a pearson correlation of at most
+	// -CorrelationThreshold. These are reported with a negative coefficient.
+	NegativeCorrelations bool
+
+	// Correlated pairs whose p-value is above MaxPValue are not reported. The p-value
+	// takes the autocorrelation of the timeseries into account. 0 reports all pairs.
+	MaxPValue float64
+
+	// Whether the receiver compares the correlated pairs of consecutive strides and writes
+	// the new, lost and changed correlations to a change file per stride. This keeps the
+	// correlated pairs of the previous stride in memory.
+	DetectChanges bool
+	// How much the coefficient of a pair has to move between strides to be reported.
+	// 0 reports every change.
+	ChangeThreshold float64
+
+	// The URL that the receiver posts alerts for the rules in NotifierRulesFile to, in the
+	// format of the Alertmanager /api/v2/alerts endpoint. Empty disables alerts.
+	NotifierURL       string
+	NotifierRulesFile string
+
+	// The base URL of a Prometheus compatible query API that the receiver reads the last
+	// window of samples from when it starts without a checkpoint, so the first results do
+	// not have to wait for a whole window. Empty disables the backfill.
+	BackfillURL string
+	// Series selectors for the timeseries to backfill, for example {job="api"}.
+	BackfillMatchers []string
+	// The number of timeseries per query_range request.
+	BackfillSeriesPerQuery int
+
+	// How often the receiver writes a checkpoint of its state to the results directory,
+	// in seconds. 0 disables checkpoints.
+	CheckpointInterval int
 }
 
 func (s CorrjoinSettings) ComputeSettingsFields() CorrjoinSettings {
@@ -71,6 +210,52 @@ func (s CorrjoinSettings) ComputeSettingsFields() CorrjoinSettings {
 	if s.Algorithm == "" {
 		s.Algorithm = ALGO_NONE
 	}
+	if s.Comparer == "" {
+		s.Comparer = COMPARER_INPROCESS
+	}
+	if s.LshTables == 0 {
+		s.LshTables = 16
+	}
+	if s.LshBits == 0 {
+		s.LshBits = 10
+	}
+	if s.AutoTuneTargetRecall == 0 {
+		s.AutoTuneTargetRecall = 0.95
+	}
+	if s.AutoTuneSampleRows == 0 {
+		s.AutoTuneSampleRows = 2000
+	}
+	if s.AutoTuneBudget == 0 {
+		s.AutoTuneBudget = 60
+	}
+	if s.Preprocessing == "" {
+		s.Preprocessing = PREPROCESS_NONE
+	}
+	if s.MovingAverageWindow == 0 {
+		s.MovingAverageWindow = 30
+	}
+	if s.SeasonalPeriod > 0 {
+		if s.SeasonalBuckets == 0 {
+			s.SeasonalBuckets = min(s.SeasonalPeriod, 144)
+		}
+		if s.SeasonalHistory == 0 {
+			s.SeasonalHistory = 7
+		}
+	}
+	if s.BackfillURL != "" {
+		if len(s.BackfillMatchers) == 0 {
+			s.BackfillMatchers = []string{`{__name__=~".+"}`}
+		}
+		if s.BackfillSeriesPerQuery == 0 {
+			s.BackfillSeriesPerQuery = 100
+		}
+	}
+	if s.CorrelationMeasure == "" {
+		s.CorrelationMeasure = MEASURE_PEARSON
+	}
+	if s.SvdStrategy == "" {
+		s.SvdStrategy = SVD_FULL
+	}
 	if s.MaxRowsForSvd == 0 {
 		s.MaxRowsForSvd = 10000
 	}
@@ -0,0 +1,133 @@
+package svd
+
+import (
+	"fmt"
+	"gonum.org/v1/gonum/mat"
+	"math/rand"
+)
+
+const (
+	defaultOversampling    = 5
+	defaultPowerIterations = 2
+)
+
+// RandomizedSVD computes a truncated SVD with randomized subspace iteration
+// (Halko, Martinsson, Tropp: Finding structure with randomness, 2011).
+// The iteration works on the Gram matrix A^T A without forming it, so the cost is
+// linear in the number of rows and there is no need to sample the rows.
+// When Incremental is set, the iteration starts from the singular vectors of the previous
+// call. The window only moves by one stride between calls, so a single
+// iteration is usually enough.
+type RandomizedSVD struct {
+	// Components are the top K right singular vectors, one per column.
+	Components *mat.Dense
+
+	// The number of dimensions to truncate to.
+	K int
+
+	// The number of extra dimensions to iterate on. Defaults to 5.
+	Oversampling int
+
+	// The number of subspace iterations. Defaults to 2, or 1 when
+	// starting from the previous components.
+	PowerIterations int
+
+	Incremental bool
+
+	// The source for the random start vectors. Defaults to a fixed seed
+	// so results are reproducible.
+	Rand *rand.Rand
+
+	retainedVariance float64
+}
+
+func (r *RandomizedSVD) RetainedVariance() float64 {
+	return r.retainedVariance
+}
+
+// startMatrix returns c x l orthonormal start vectors. When possible, these
+// are the previous components filled up with random vectors.
+func (r *RandomizedSVD) startMatrix(c int, l int) (*mat.Dense, int) {
+	if r.Rand == nil {
+		r.Rand = rand.New(rand.NewSource(1))
+	}
+	start := mat.NewDense(c, l, nil)
+	reused := 0
+	if r.Incremental && r.Components != nil {
+		pr, pc := r.Components.Dims()
+		if pr == c {
+			reused = min(pc, l)
+			start.Slice(0, c, 0, reused).(*mat.Dense).Copy(r.Components.Slice(0, c, 0, reused))
+		}
+	}
+	for i := 0; i < c; i++ {
+		for j := reused; j < l; j++ {
+			start.Set(i, j, r.Rand.NormFloat64())
+		}
+	}
+	return orthonormalize(start), reused
+}
+
+// orthonormalize returns an orthonormal basis for the columns of m, which must
+// have at least as many rows as columns.
+func orthonormalize(m *mat.Dense) *mat.Dense {
+	rows, cols := m.Dims()
+	var qr mat.QR
+	qr.Factorize(m)
+	var q mat.Dense
+	qr.QTo(&q)
+	return mat.DenseCopyOf(q.Slice(0, rows, 0, cols))
+}
+
+func (r *RandomizedSVD) FitTransform(svdMatrix mat.Matrix, dataMatrix mat.Matrix) (*mat.Dense, error) {
+	m, c := svdMatrix.Dims()
+	k := min(r.K, min(m, c))
+	if k <= 0 {
+		return nil, fmt.Errorf("cannot compute svd with %d dimensions on a %d x %d matrix", r.K, m, c)
+	}
+	oversampling := r.Oversampling
+	if oversampling <= 0 {
+		oversampling = defaultOversampling
+	}
+	l := min(k+oversampling, c)
+
+	q, reused := r.startMatrix(c, l)
+	iterations := r.PowerIterations
+	if iterations <= 0 {
+		iterations = defaultPowerIterations
+		if reused >= k {
+			iterations = 1
+		}
+	}
+	var y, z mat.Dense
+	for i := 0; i < iterations; i++ {
+		y.Mul(svdMatrix, q)
+		z.Mul(svdMatrix.T(), &y)
+		q = orthonormalize(&z)
+	}
+
+	// Rayleigh-Ritz: the eigenvectors of Q^T A^T A Q rotate Q onto the singular vectors.
+	y.Mul(svdMatrix, q)
+	var gram mat.Dense
+	gram.Mul(y.T(), &y)
+	var eig mat.EigenSym
+	if ok := eig.Factorize(mat.NewSymDense(l, gram.RawMatrix().Data), true); !ok {
+		return nil, fmt.Errorf("Failed to find SVD")
+	}
+	var vectors mat.Dense
+	eig.VectorsTo(&vectors)
+	// The eigenvalues are in ascending order.
+	top := mat.NewDense(l, k, nil)
+	for j := 0; j < k; j++ {
+		top.Slice(0, l, j, j+1).(*mat.Dense).Copy(vectors.Slice(0, l, l-1-j, l-j))
+	}
+	var components mat.Dense
+	components.Mul(q, top)
+	r.Components = &components
+
+	var product mat.Dense
+	product.Mul(dataMatrix, r.Components)
+	r.retainedVariance = retainedVariance(dataMatrix, &product)
+
+	return &product, nil
+}
@@ -0,0 +1,111 @@
+package svd
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// lowRankMatrix returns a rows x cols matrix whose singular values drop off quickly.
+func lowRankMatrix(rng *rand.Rand, rows int, cols int) *mat.Dense {
+	ret := mat.NewDense(rows, cols, nil)
+	for k := 0; k < cols; k++ {
+		weight := math.Pow(0.5, float64(k))
+		direction := make([]float64, cols)
+		for j := range direction {
+			direction[j] = rng.NormFloat64()
+		}
+		for i := 0; i < rows; i++ {
+			coefficient := weight * rng.NormFloat64()
+			for j := 0; j < cols; j++ {
+				ret.Set(i, j, ret.At(i, j)+coefficient*direction[j])
+			}
+		}
+	}
+	return ret
+}
+
+// checkSameSubspace checks that the columns of got match the columns of want up to their sign.
+func checkSameSubspace(t *testing.T, want *mat.Dense, got *mat.Dense, epsilon float64) {
+	_, k := want.Dims()
+	for j := 0; j < k; j++ {
+		dot := mat.Dot(want.ColView(j), got.ColView(j))
+		if math.Abs(math.Abs(dot)-1.0) > epsilon {
+			t.Errorf("component %d differs from full svd: dot product is %f", j, dot)
+		}
+	}
+}
+
+func TestRandomizedSVD(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	data := lowRankMatrix(rng, 500, 15)
+
+	full := &TruncatedSVD{K: 3}
+	expected, err := full.FitTransform(data, data)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if full.RetainedVariance() <= 0.0 || full.RetainedVariance() > 1.0 {
+		t.Errorf("unexpected retained variance %f", full.RetainedVariance())
+	}
+
+	for _, strategy := range []string{"randomized", "incremental"} {
+		transformer, err := NewTransformer(strategy, 3)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		ret, err := transformer.FitTransform(data, data)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		rows, cols := ret.Dims()
+		if rows != 500 || cols != 3 {
+			t.Errorf("expected a 500 x 3 result but got %d x %d", rows, cols)
+		}
+		if math.Abs(transformer.RetainedVariance()-full.RetainedVariance()) > 1e-6 {
+			t.Errorf("%s svd retained %f of the variance but full svd retained %f", strategy,
+				transformer.RetainedVariance(), full.RetainedVariance())
+		}
+		checkSameSubspace(t, full.Components, transformer.(*RandomizedSVD).Components, 1e-6)
+		for i := 0; i < rows; i++ {
+			for j := 0; j < cols; j++ {
+				if math.Abs(math.Abs(ret.At(i, j))-math.Abs(expected.At(i, j))) > 1e-6 {
+					t.Fatalf("%s svd result differs from full svd at %d, %d", strategy, i, j)
+				}
+			}
+		}
+	}
+
+	if _, err := NewTransformer("nonsense", 3); err == nil {
+		t.Errorf("expected an error for an unknown strategy")
+	}
+}
+
+func TestIncrementalSVD(t *testing.T) {
+	rng := rand.New(rand.NewSource(11))
+	data := lowRankMatrix(rng, 400, 12)
+	incremental := &RandomizedSVD{K: 2, Incremental: true}
+	if _, err := incremental.FitTransform(data, data); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// A small change to the data, like one stride moving through the window.
+	for i := 0; i < 400; i++ {
+		for j := 0; j < 12; j++ {
+			data.Set(i, j, data.At(i, j)+0.01*rng.NormFloat64())
+		}
+	}
+	if _, err := incremental.FitTransform(data, data); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	full := &TruncatedSVD{K: 2}
+	if _, err := full.FitTransform(data, data); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	checkSameSubspace(t, full.Components, incremental.Components, 1e-4)
+	if math.Abs(incremental.RetainedVariance()-full.RetainedVariance()) > 1e-6 {
+		t.Errorf("incremental svd retained %f of the variance but full svd retained %f",
+			incremental.RetainedVariance(), full.RetainedVariance())
+	}
+}
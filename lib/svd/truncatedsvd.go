@@ -2,9 +2,46 @@ package svd
 
 import (
 	"fmt"
+	"github.com/kpaschen/corrjoin/lib/settings"
 	"gonum.org/v1/gonum/mat"
 )
 
+// A Transformer reduces the columns of a matrix to its top K right singular vectors.
+type Transformer interface {
+	// FitTransform computes the singular vectors of svdMatrix and returns dataMatrix
+	// multiplied by the top K of them.
+	FitTransform(svdMatrix mat.Matrix, dataMatrix mat.Matrix) (*mat.Dense, error)
+
+	// RetainedVariance returns the fraction of the squared Frobenius norm of
+	// the last dataMatrix that is kept by the projection onto the top K singular vectors.
+	RetainedVariance() float64
+}
+
+// NewTransformer returns a Transformer for one of the settings.SVD_ strategies.
+func NewTransformer(strategy string, k int) (Transformer, error) {
+	switch strategy {
+	case settings.SVD_FULL, "":
+		return &TruncatedSVD{K: k}, nil
+	case settings.SVD_RANDOMIZED:
+		return &RandomizedSVD{K: k}, nil
+	case settings.SVD_INCREMENTAL:
+		return &RandomizedSVD{K: k, Incremental: true}, nil
+	default:
+		return nil, fmt.Errorf("unsupported svd strategy %s", strategy)
+	}
+}
+
+// retainedVariance returns the fraction of the squared Frobenius norm of data
+// that is left in the projection.
+func retainedVariance(data mat.Matrix, projection mat.Matrix) float64 {
+	total := mat.Norm(data, 2)
+	if total == 0.0 {
+		return 1.0
+	}
+	retained := mat.Norm(projection, 2)
+	return (retained * retained) / (total * total)
+}
+
 // TruncatedSVD, inspired by sklearn's class of the same
 // name, as well as github.com/james-bowman/nlp.
 // SVD factors a matrix A as USV^T where S is a diagonal
@@ -20,6 +57,8 @@ type TruncatedSVD struct {
 
 	// The number of dimensions to truncate to.
 	K int
+
+	retainedVariance float64
 }
 
 // This is based on the code in james-bowman/nlp but it returns
@@ -46,6 +85,11 @@ func (t *TruncatedSVD) FitTransform(svdMatrix mat.Matrix, dataMatrix mat.Matrix)
 
 	var product mat.Dense
 	product.Mul(dataMatrix, t.Components)
+	t.retainedVariance = retainedVariance(dataMatrix, &product)
 
 	return &product, nil
 }
+
+func (t *TruncatedSVD) RetainedVariance() float64 {
+	return t.retainedVariance
+}
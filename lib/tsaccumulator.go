@@ -2,6 +2,7 @@ package lib
 
 import (
 	"fmt"
+	"github.com/prometheus/prometheus/model/value"
 	"log"
 	"math"
 	"time"
@@ -12,15 +13,29 @@ type Observation struct {
 	MetricName        string
 	Value             float64
 	Timestamp         time.Time
+	// Counter is set for monotonically increasing counters whose values
+	// should be converted to rates.
+	Counter bool
 }
 
 type TsId struct {
 	MetricFingerprint uint64
 	MetricName        string
+	// Rate is true if the row holds the rate of a counter instead of its raw values.
+	Rate bool
 }
 
 type ObservationResult struct {
-	Buffers              [][]float64
+	Buffers [][]float64
+	// MaskedRows marks the rows that should be left out of comparisons
+	// because their timeseries ended (Prometheus sent a stale marker).
+	MaskedRows []bool
+	// RowMapping is set when rows have been compacted at the end of this stride.
+	// RowMapping[old] is the new row id for the old row id, or -1 if the row
+	// has been dropped. Buffers and MaskedRows already use the new row ids.
+	RowMapping []int
+	// Tsids are the ids of the timeseries in Buffers, in row order.
+	Tsids                []TsId
 	Err                  error
 	CurrentStrideStartTs time.Time
 	CurrentStrideMaxTs   time.Time
@@ -56,6 +71,24 @@ type TimeseriesAccumulator struct {
 	strideDuration       time.Duration
 	maxRows              int
 
+	// sampledRows records which rows received at least one real sample
+	// during the current stride.
+	sampledRows map[int]bool
+	// endedRows are rows whose timeseries was marked stale and has not
+	// received a real sample since.
+	endedRows map[int]bool
+	// idleStrides counts the consecutive strides without real samples per row.
+	idleStrides map[int]int
+	// retiredRows are rows that have been idle for retireAfter strides.
+	// Their fingerprint no longer maps to them in rowmap, and they are
+	// dropped when the rows are compacted.
+	retiredRows map[int]bool
+	// The number of idle strides after which a row is retired. 0 means never.
+	retireAfter int
+
+	// The number of strides that have been sent to bufferChannel.
+	PublishedStrides int
+
 	bufferChannel chan<- *ObservationResult
 }
 
@@ -66,8 +99,11 @@ func maxTime(startTime time.Time, strideDuration time.Duration) time.Time {
 	return t1.Add(-1 * time.Second)
 }
 
+// NewTimeseriesAccumulator creates an accumulator for strides of /stride/ samples.
+// Rows that receive no real samples for /retireAfter/ consecutive strides are
+// retired; pass 0 to keep rows forever.
 func NewTimeseriesAccumulator(stride int, startTime time.Time, sampleInterval int,
-	maxRows int,
+	maxRows int, retireAfter int,
 	bc chan<- *ObservationResult) *TimeseriesAccumulator {
 	strideDuration, _ := time.ParseDuration(fmt.Sprintf("%ds", stride*sampleInterval))
 	acc := &TimeseriesAccumulator{
@@ -82,6 +118,11 @@ func NewTimeseriesAccumulator(stride int, startTime time.Time, sampleInterval in
 		strideDuration:       strideDuration,
 		bufferChannel:        bc,
 		maxRows:              maxRows,
+		sampledRows:          make(map[int]bool),
+		endedRows:            make(map[int]bool),
+		idleStrides:          make(map[int]int),
+		retiredRows:          make(map[int]bool),
+		retireAfter:          retireAfter,
 	}
 	log.Printf("created accumulator with start time %v and end time %v\n",
 		acc.currentStrideStartTs.UTC().Format("20060102150405"),
@@ -108,12 +149,93 @@ func (a *TimeseriesAccumulator) extractMatrixData() *ObservationResult {
 	}
 	return &ObservationResult{
 		Buffers:              ret,
+		MaskedRows:           a.maskedRows(),
+		Tsids:                a.Tsids,
 		Err:                  nil,
 		CurrentStrideStartTs: a.currentStrideStartTs,
 		CurrentStrideMaxTs:   a.currentStrideMaxTs,
 	}
 }
 
+// updateRowStates is called at the end of a stride. It updates the idle
+// counters and retires rows that have not had real samples for too long.
+func (a *TimeseriesAccumulator) updateRowStates() {
+	for rowid := range a.buffers {
+		if a.sampledRows[rowid] {
+			a.idleStrides[rowid] = 0
+			continue
+		}
+		a.idleStrides[rowid]++
+		if a.retireAfter > 0 && a.idleStrides[rowid] >= a.retireAfter && !a.retiredRows[rowid] {
+			a.retireRow(rowid)
+		}
+	}
+	a.sampledRows = make(map[int]bool)
+}
+
+// retireRow removes the fingerprint for rowid from the rowmap, so a timeseries
+// that comes back after a long absence starts over in a new row.
+func (a *TimeseriesAccumulator) retireRow(rowid int) {
+	fp := a.Tsids[rowid].MetricFingerprint
+	if r, ok := a.rowmap[fp]; ok && r == rowid {
+		delete(a.rowmap, fp)
+	}
+	a.retiredRows[rowid] = true
+	delete(a.endedRows, rowid)
+	log.Printf("retired row %d after %d idle strides\n", rowid, a.idleStrides[rowid])
+}
+
+// compact drops the retired rows and renumbers the remaining rows so there are
+// no gaps. It returns the mapping from old to new row ids, or nil if there was
+// nothing to do.
+// Tsids is replaced rather than modified in place, so earlier copies of it stay
+// valid for the strides they were handed out with.
+func (a *TimeseriesAccumulator) compact() []int {
+	if len(a.retiredRows) == 0 {
+		return nil
+	}
+	mapping := make([]int, a.maxRow)
+	tsids := make([]TsId, 0, max(cap(a.Tsids), a.maxRow-len(a.retiredRows)))
+	buffers := make(map[int][]float64)
+	endedRows := make(map[int]bool)
+	idleStrides := make(map[int]int)
+	newRow := 0
+	for oldRow := 0; oldRow < a.maxRow; oldRow++ {
+		if a.retiredRows[oldRow] {
+			mapping[oldRow] = -1
+			continue
+		}
+		mapping[oldRow] = newRow
+		tsid := a.Tsids[oldRow]
+		tsids = append(tsids, tsid)
+		if r, ok := a.rowmap[tsid.MetricFingerprint]; ok && r == oldRow {
+			a.rowmap[tsid.MetricFingerprint] = newRow
+		}
+		buffers[newRow] = a.buffers[oldRow]
+		if a.endedRows[oldRow] {
+			endedRows[newRow] = true
+		}
+		idleStrides[newRow] = a.idleStrides[oldRow]
+		newRow++
+	}
+	log.Printf("compacted accumulator from %d to %d rows\n", a.maxRow, newRow)
+	a.Tsids = tsids
+	a.buffers = buffers
+	a.endedRows = endedRows
+	a.idleStrides = idleStrides
+	a.retiredRows = make(map[int]bool)
+	a.maxRow = newRow
+	return mapping
+}
+
+func (a *TimeseriesAccumulator) maskedRows() []bool {
+	ret := make([]bool, a.maxRow)
+	for rowid := range a.endedRows {
+		ret[rowid] = true
+	}
+	return ret
+}
+
 func (a *TimeseriesAccumulator) completeRows() {
 	for j, b := range a.buffers {
 		if len(b) > cap(b) {
@@ -132,6 +254,20 @@ func (a *TimeseriesAccumulator) completeRows() {
 	}
 }
 
+// Reanchor discards the samples of the current stride without publishing it and starts
+// the stride at startTime instead. The rows are kept.
+func (a *TimeseriesAccumulator) Reanchor(startTime time.Time) {
+	for rowid := range a.buffers {
+		a.buffers[rowid] = a.buffers[rowid][:0]
+	}
+	a.sampledRows = make(map[int]bool)
+	a.currentStrideStartTs = startTime
+	a.currentStrideMaxTs = maxTime(startTime, a.strideDuration)
+	log.Printf("moved accumulator to start time %v and end time %v\n",
+		a.currentStrideStartTs.UTC().Format("20060102150405"),
+		a.currentStrideMaxTs.UTC().Format("20060102150405"))
+}
+
 func (a *TimeseriesAccumulator) AddObservation(observation *Observation) {
 	colcount := a.stride
 	slot, err := a.computeSlotIndex(observation.Timestamp)
@@ -144,9 +280,14 @@ func (a *TimeseriesAccumulator) AddObservation(observation *Observation) {
 		// data for the current stride for processing and start collecting data
 		// for the next stride.
 		a.completeRows()
+		a.updateRowStates()
+		mapping := a.compact()
 
 		log.Printf("publish %d rows to channel\n", len(a.buffers))
-		a.bufferChannel <- a.extractMatrixData()
+		result := a.extractMatrixData()
+		result.RowMapping = mapping
+		a.bufferChannel <- result
+		a.PublishedStrides++
 
 		// Now prepare for the next stride.
 		a.currentStrideStartTs = observation.Timestamp
@@ -164,13 +305,23 @@ func (a *TimeseriesAccumulator) AddObservation(observation *Observation) {
 		}
 	}
 
+	stale := value.IsStaleNaN(observation.Value)
 	rowid, ok := a.rowmap[observation.MetricFingerprint]
-	if !ok && (a.maxRows <= 0 || a.maxRow < a.maxRows) {
+	if !ok {
+		if stale {
+			// A stale marker for a timeseries we are not tracking.
+			return
+		}
+		if a.maxRows > 0 && a.maxRow >= a.maxRows {
+			// Not tracking this timeseries.
+			return
+		}
 		rowid = a.maxRow
 		a.rowmap[observation.MetricFingerprint] = rowid
 		a.buffers[rowid] = make([]float64, 0, colcount)
 		a.Tsids = append(a.Tsids,
-			TsId{MetricName: observation.MetricName, MetricFingerprint: observation.MetricFingerprint})
+			TsId{MetricName: observation.MetricName, MetricFingerprint: observation.MetricFingerprint,
+				Rate: observation.Counter})
 		if a.Tsids[rowid].MetricFingerprint != observation.MetricFingerprint {
 			log.Printf("tsid for %d is %d but should be %d\n", rowid, a.Tsids[rowid].MetricFingerprint, observation.MetricFingerprint)
 			panic("code bug")
@@ -178,6 +329,14 @@ func (a *TimeseriesAccumulator) AddObservation(observation *Observation) {
 		a.maxRow += 1
 	}
 
+	if stale {
+		// The timeseries has ended. Do not record a value for it; completeRows
+		// holds the last real value, and the row is masked until it has moved
+		// out of the window.
+		a.endedRows[rowid] = true
+		return
+	}
+
 	if math.IsNaN(observation.Value) {
 		observation.Value = float64(0)
 	}
@@ -190,10 +349,15 @@ func (a *TimeseriesAccumulator) AddObservation(observation *Observation) {
 
 	lastSlot := len(a.buffers[rowid]) - 1
 	// If we have skipped a timeslot, fill the gap with an interpolated value.
+	// Gaps after a stale marker are not interpolated but hold the last value.
 	if lastSlot < slot-1 {
 		interpolatedValue := float64(0)
 		if len(a.buffers[rowid]) > 0 {
-			interpolatedValue = (a.buffers[rowid][lastSlot] + observation.Value) / float64(2)
+			if a.endedRows[rowid] {
+				interpolatedValue = a.buffers[rowid][lastSlot]
+			} else {
+				interpolatedValue = (a.buffers[rowid][lastSlot] + observation.Value) / float64(2)
+			}
 		}
 		for i := lastSlot + 1; i < slot; i++ {
 			a.buffers[rowid] = append(a.buffers[rowid], interpolatedValue)
@@ -204,6 +368,8 @@ func (a *TimeseriesAccumulator) AddObservation(observation *Observation) {
 		}
 	}
 	a.buffers[rowid] = append(a.buffers[rowid], observation.Value)
+	a.sampledRows[rowid] = true
+	delete(a.endedRows, rowid)
 	if len(a.buffers[rowid]) != slot+1 {
 		log.Printf("wrong length for buffer %d: %d when it should be %d", rowid, len(a.buffers[rowid]), slot+1)
 		panic("bug")
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"fmt"
+	"github.com/prometheus/prometheus/model/value"
 	"math"
 	"testing"
 	"time"
@@ -11,7 +12,7 @@ func TestComputeSlotIndex(t *testing.T) {
 	now := time.Now()
 	replies := make(chan *ObservationResult, 1)
 	defer close(replies)
-	acc := NewTimeseriesAccumulator(6, now, 5, 100, replies)
+	acc := NewTimeseriesAccumulator(6, now, 5, 100, 0, replies)
 
 	s0, err := acc.computeSlotIndex(now)
 	if err != nil {
@@ -37,7 +38,7 @@ func TestAddObservation(t *testing.T) {
 	now := time.Now()
 	replies := make(chan *ObservationResult, 1)
 	defer close(replies)
-	acc := NewTimeseriesAccumulator(6, now, 5, 100, replies)
+	acc := NewTimeseriesAccumulator(6, now, 5, 100, 0, replies)
 	acc.AddObservation(&Observation{
 		MetricFingerprint: uint64(1),
 		MetricName:        "ts1",
@@ -79,7 +80,7 @@ func TestAddObservation_newStride(t *testing.T) {
 	now := time.Now()
 	replies := make(chan *ObservationResult, 1)
 	defer close(replies)
-	acc := NewTimeseriesAccumulator(2, now, 5, 100, replies)
+	acc := NewTimeseriesAccumulator(2, now, 5, 100, 0, replies)
 	acc.AddObservation(&Observation{
 		MetricFingerprint: uint64(1),
 		MetricName:        "ts1",
@@ -120,11 +121,32 @@ func TestAddObservation_newStride(t *testing.T) {
 	}
 }
 
+func TestReanchor(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	replies := make(chan *ObservationResult, 1)
+	defer close(replies)
+	acc := NewTimeseriesAccumulator(2, start, 5, 100, 0, replies)
+	acc.AddObservation(&Observation{MetricFingerprint: 1, MetricName: "ts1", Value: 0.1, Timestamp: start})
+
+	now := time.Now()
+	acc.Reanchor(now)
+	acc.AddObservation(&Observation{MetricFingerprint: 1, MetricName: "ts1", Value: 0.2, Timestamp: now})
+	// A sample from before the new start is ignored.
+	acc.AddObservation(&Observation{MetricFingerprint: 1, MetricName: "ts1", Value: 0.3, Timestamp: start.Add(5 * time.Second)})
+	if len(replies) != 0 || acc.PublishedStrides != 0 {
+		t.Errorf("did not expect the stride before the new start to be published")
+	}
+	row := acc.buffers[acc.rowmap[1]]
+	if len(row) != 1 || row[0] != 0.2 {
+		t.Errorf("expected only the sample after the new start in the buffer but got %v", row)
+	}
+}
+
 func TestAddObservation_interpolate(t *testing.T) {
 	now := time.Now()
 	replies := make(chan *ObservationResult, 1)
 	defer close(replies)
-	acc := NewTimeseriesAccumulator(6, now, 2, 100, replies)
+	acc := NewTimeseriesAccumulator(6, now, 2, 100, 0, replies)
 	acc.AddObservation(&Observation{
 		MetricFingerprint: uint64(1),
 		MetricName:        "ts1",
@@ -168,3 +190,117 @@ func TestAddObservation_interpolate(t *testing.T) {
 		t.Errorf("failed to get new stride channel message")
 	}
 }
+
+func TestAddObservation_staleMarker(t *testing.T) {
+	now := time.Now()
+	replies := make(chan *ObservationResult, 1)
+	defer close(replies)
+	acc := NewTimeseriesAccumulator(4, now, 5, 100, 0, replies)
+	acc.AddObservation(&Observation{
+		MetricFingerprint: uint64(1),
+		MetricName:        "ts1",
+		Value:             0.5,
+		Timestamp:         now.Add(time.Second * 1),
+	})
+	acc.AddObservation(&Observation{
+		MetricFingerprint: uint64(2),
+		MetricName:        "ts2",
+		Value:             0.3,
+		Timestamp:         now.Add(time.Second * 1),
+	})
+	acc.AddObservation(&Observation{
+		MetricFingerprint: uint64(1),
+		MetricName:        "ts1",
+		Value:             math.Float64frombits(value.StaleNaN),
+		Timestamp:         now.Add(time.Second * 6),
+	})
+	// A stale marker for a timeseries we do not know should not create a row.
+	acc.AddObservation(&Observation{
+		MetricFingerprint: uint64(3),
+		MetricName:        "ts3",
+		Value:             math.Float64frombits(value.StaleNaN),
+		Timestamp:         now.Add(time.Second * 6),
+	})
+	acc.AddObservation(&Observation{
+		MetricFingerprint: uint64(2),
+		MetricName:        "ts2",
+		Value:             0.4,
+		Timestamp:         now.Add(time.Second * 21),
+	})
+	select {
+	case buffers := <-replies:
+		if len(buffers.Buffers) != 2 {
+			t.Fatalf("expected two rows but got %d", len(buffers.Buffers))
+		}
+		for i, v := range buffers.Buffers[0] {
+			if v != 0.5 {
+				t.Errorf("expected ended row to hold 0.5 but got %f in slot %d", v, i)
+			}
+		}
+		if !buffers.MaskedRows[0] {
+			t.Errorf("expected row 0 to be masked")
+		}
+		if buffers.MaskedRows[1] {
+			t.Errorf("did not expect row 1 to be masked")
+		}
+	default:
+		t.Errorf("failed to get new stride channel message")
+	}
+}
+
+func TestAddObservation_retireRow(t *testing.T) {
+	now := time.Now()
+	replies := make(chan *ObservationResult, 1)
+	defer close(replies)
+	acc := NewTimeseriesAccumulator(2, now, 5, 100, 2, replies)
+	acc.AddObservation(&Observation{
+		MetricFingerprint: uint64(1),
+		MetricName:        "ts1",
+		Value:             0.1,
+		Timestamp:         now.Add(time.Second * 1),
+	})
+	for i := 1; i <= 3; i++ {
+		acc.AddObservation(&Observation{
+			MetricFingerprint: uint64(2),
+			MetricName:        "ts2",
+			Value:             float64(i),
+			Timestamp:         now.Add(time.Second * time.Duration(10*i+1)),
+		})
+		result := <-replies
+		if i < 3 {
+			if result.RowMapping != nil {
+				t.Errorf("did not expect compaction in stride %d", i)
+			}
+			continue
+		}
+		// After two idle strides, row 0 gets dropped and ts2 moves to row 0.
+		if len(result.RowMapping) != 2 || result.RowMapping[0] != -1 || result.RowMapping[1] != 0 {
+			t.Errorf("expected row mapping [-1 0] but got %v", result.RowMapping)
+		}
+		if len(result.Buffers) != 1 || result.Buffers[0][0] != 2.0 {
+			t.Errorf("expected one row for ts2 but got %v", result.Buffers)
+		}
+		if len(result.Tsids) != 1 || result.Tsids[0].MetricFingerprint != uint64(2) {
+			t.Errorf("expected tsids to contain just ts2 but got %v", result.Tsids)
+		}
+	}
+	if _, ok := acc.rowmap[uint64(1)]; ok {
+		t.Errorf("expected fingerprint 1 to be removed from the rowmap")
+	}
+	if acc.rowmap[uint64(2)] != 0 {
+		t.Errorf("expected ts2 to map to row 0 but got %d", acc.rowmap[uint64(2)])
+	}
+	// When the timeseries comes back, it gets a new row.
+	acc.AddObservation(&Observation{
+		MetricFingerprint: uint64(1),
+		MetricName:        "ts1",
+		Value:             0.2,
+		Timestamp:         now.Add(time.Second * 32),
+	})
+	if acc.rowmap[uint64(1)] != 1 {
+		t.Errorf("expected returning timeseries to get row 1 but got %d", acc.rowmap[uint64(1)])
+	}
+	if len(acc.Tsids) != 2 || acc.Tsids[1].MetricFingerprint != uint64(1) {
+		t.Errorf("unexpected tsids after compaction: %v", acc.Tsids)
+	}
+}
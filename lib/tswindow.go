@@ -5,41 +5,86 @@ import (
 	"github.com/kpaschen/corrjoin/lib/buckets"
 	"github.com/kpaschen/corrjoin/lib/comparisons"
 	"github.com/kpaschen/corrjoin/lib/correlation"
+	"github.com/kpaschen/corrjoin/lib/lsh"
 	"github.com/kpaschen/corrjoin/lib/paa"
+	"github.com/kpaschen/corrjoin/lib/preprocess"
 	"github.com/kpaschen/corrjoin/lib/settings"
 	"github.com/kpaschen/corrjoin/lib/svd"
 	"github.com/kpaschen/corrjoin/lib/utils"
+	"github.com/prometheus/client_golang/prometheus"
 	"gonum.org/v1/gonum/mat"
 	"log"
 	"slices"
 )
 
+var (
+	svdRetainedVariance = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "corrjoin_svd_retained_variance",
+			Help: "The fraction of the variance of the PAA output that is kept by the svd step in the last stride.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(svdRetainedVariance)
+}
+
 // A TimeseriesWindow is a sliding window over a list of timeseries.
 type TimeseriesWindow struct {
 
 	// This is the raw data.
 	// Every row corresponds to a timeseries.
-	// Rows can be empty if they correspond to a timeseries that we haven't
-	// received data for in a while.
-	// TODO: compact these rows from time to time.
+	// Rows that have not received data for a whole window are dropped when the
+	// accumulator compacts its rows, see applyRowMappings.
 	buffers [][]float64
 
-	// TODO: maintain the buffers normalized by keeping track of the
-	// normalization factor and the avg of the previous stride
 	normalized [][]float64
 
+	// Running sums over the buffers, used to compute normalized and postPAA
+	// without going over the whole window. This is nil if the window size,
+	// stride length and PAA dimensions do not allow incremental updates.
+	stats *windowStats
+
+	// The periodic profiles of the rows. This is nil unless the settings ask for
+	// deseasonalization.
+	seasonality *seasonalProfiles
+
 	ConstantRows []bool
 
+	// maskedUntil holds, per row, the last stride for which the row is masked.
+	// A row gets masked when its timeseries ended during a stride, and it stays
+	// masked until that stride has moved out of the window.
+	maskedUntil []int
+
+	// skipRows are the rows that are left out of comparisons for the current
+	// stride: constant rows and masked rows.
+	skipRows []bool
+
+	// Row mappings from the accumulator that have not been applied yet.
+	pendingRowMappings [][]int
+
 	postPAA [][]float64
 
 	postSVD [][]float64
 
+	// This is kept across strides because the incremental strategy starts
+	// from the previous result.
+	svd svd.Transformer
+
 	settings settings.CorrjoinSettings
 	comparer comparisons.Engine
 
 	// This is the number of strides that have been shifted into this window.
 	StrideCounter int
 
+	// The stride during which the settings were last auto-tuned.
+	lastTuned int
+
+	// A trial window is used to try out settings while auto-tuning and does not
+	// update the metrics.
+	trial bool
+
 	windowLocked chan struct{}
 }
 
@@ -54,6 +99,8 @@ func NewTimeseriesWindow(settings settings.CorrjoinSettings, comparer comparison
 		settings:      settings,
 		StrideCounter: 0,
 		comparer:      comparer,
+		stats:         newWindowStats(settings),
+		seasonality:   newSeasonalProfiles(settings),
 		windowLocked:  make(chan struct{}, 1),
 	}
 }
@@ -102,6 +149,7 @@ func (w *TimeseriesWindow) shiftBufferIntoWindow(buffer [][]float64) (bool, erro
 		newColumnCount, sliceLengthToDelete)
 
 	// Append new data.
+	w.stats.shift(w.buffers, buffer, sliceLengthToDelete)
 	for i, buf := range w.buffers {
 		// This would leak memory if w.buffers[i] held anything other than a basic data type.
 		w.buffers[i] = append(buf[sliceLengthToDelete:], buffer[i]...)
@@ -130,6 +178,20 @@ func (w *TimeseriesWindow) shiftBufferIntoWindow(buffer [][]float64) (bool, erro
 // of w.
 // Returns true if computation was performed, false if there was nothing to do.
 func (w *TimeseriesWindow) ShiftBuffer(buffer [][]float64) (error, bool) {
+	return w.ShiftObservations(&ObservationResult{Buffers: buffer})
+}
+
+// ShiftObservations is like ShiftBuffer, but it also applies the row mapping and
+// the masked rows from the observation result.
+// Masked rows are left out of comparisons until the current stride has moved out
+// of the window.
+func (w *TimeseriesWindow) ShiftObservations(result *ObservationResult) (error, bool) {
+
+	// Row mappings have to be applied even if the window is busy, otherwise
+	// the rows in the window no longer match the rows in the next buffer.
+	if result.RowMapping != nil {
+		w.pendingRowMappings = append(w.pendingRowMappings, result.RowMapping)
+	}
 
 	// If the window is currently unlocked, lock it before starting computation.
 	// If the window is currently locked, reject the request.
@@ -142,11 +204,21 @@ func (w *TimeseriesWindow) ShiftBuffer(buffer [][]float64) (error, bool) {
 	}
 
 	w.StrideCounter++
+	w.applyRowMappings()
+	buffer := result.Buffers
 	startComputation, err := w.shiftBufferIntoWindow(buffer)
 	if err != nil {
 		w.unlockWindow()
 		return err, false
 	}
+	if len(buffer) > 0 {
+		w.updateMask(result.MaskedRows, len(buffer[0]))
+	}
+	var firstSample int64
+	if !result.CurrentStrideStartTs.IsZero() && w.settings.SampleInterval > 0 {
+		firstSample = result.CurrentStrideStartTs.Unix() / int64(w.settings.SampleInterval)
+	}
+	w.seasonality.observe(buffer, firstSample)
 	if !startComputation {
 		w.unlockWindow()
 		return nil, false
@@ -157,6 +229,85 @@ func (w *TimeseriesWindow) ShiftBuffer(buffer [][]float64) (error, bool) {
 	return nil, true
 }
 
+// applyRowMappings renumbers the rows in the window after the accumulator
+// has dropped rows. This must only be called while the window is locked.
+func (w *TimeseriesWindow) applyRowMappings() {
+	for _, mapping := range w.pendingRowMappings {
+		kept := 0
+		for _, m := range mapping {
+			if m >= 0 {
+				kept++
+			}
+		}
+		buffers := make([][]float64, 0, min(kept, len(w.buffers)))
+		maskedUntil := make([]int, 0, min(kept, len(w.maskedUntil)))
+		constantRows := make([]bool, 0, min(kept, len(w.ConstantRows)))
+		for oldRow, newRow := range mapping {
+			if newRow < 0 {
+				continue
+			}
+			if oldRow < len(w.buffers) {
+				buffers = append(buffers, w.buffers[oldRow])
+			}
+			if oldRow < len(w.maskedUntil) {
+				maskedUntil = append(maskedUntil, w.maskedUntil[oldRow])
+			}
+			if oldRow < len(w.ConstantRows) {
+				constantRows = append(constantRows, w.ConstantRows[oldRow])
+			}
+		}
+		log.Printf("compacted window from %d to %d rows\n", len(w.buffers), len(buffers))
+		w.buffers = buffers
+		w.maskedUntil = maskedUntil
+		// These are recomputed on every stride. ConstantRows is replaced rather than
+		// modified so the reporter can keep using the old one for the previous stride.
+		w.ConstantRows = constantRows
+		w.normalized = nil
+		w.skipRows = nil
+		w.postPAA = nil
+		w.postSVD = nil
+		w.stats.invalidate()
+		w.seasonality.remap(mapping)
+	}
+	w.pendingRowMappings = nil
+}
+
+func (w *TimeseriesWindow) updateMask(masked []bool, strideLength int) {
+	if len(w.maskedUntil) < len(w.buffers) {
+		w.maskedUntil = append(w.maskedUntil, make([]int, len(w.buffers)-len(w.maskedUntil))...)
+	}
+	if strideLength <= 0 {
+		return
+	}
+	stridesPerWindow := (w.settings.WindowSize + strideLength - 1) / strideLength
+	for i, m := range masked {
+		if m && i < len(w.maskedUntil) {
+			w.maskedUntil[i] = w.StrideCounter + stridesPerWindow - 1
+		}
+	}
+}
+
+// IsMasked returns true if row is currently masked.
+func (w *TimeseriesWindow) IsMasked(row int) bool {
+	return row < len(w.maskedUntil) && w.maskedUntil[row] >= w.StrideCounter
+}
+
+// computeSkipRows combines the constant rows and the masked rows.
+func (w *TimeseriesWindow) computeSkipRows() int {
+	if len(w.skipRows) < len(w.ConstantRows) {
+		w.skipRows = append(w.skipRows, make([]bool, len(w.ConstantRows)-len(w.skipRows))...)
+	}
+	maskedCounter := 0
+	for i, constant := range w.ConstantRows {
+		masked := w.IsMasked(i)
+		if masked {
+			maskedCounter++
+		}
+		w.skipRows[i] = constant || masked
+	}
+	return maskedCounter
+}
+
 func (w *TimeseriesWindow) unlockWindow() {
 	log.Println("unlocking window")
 	<-w.windowLocked
@@ -167,19 +318,27 @@ func (w *TimeseriesWindow) runAlgorithm() {
 	defer w.unlockWindow()
 
 	w.normalizeWindow()
-	log.Printf("starting a run of %v on %d rows\n", w.settings.Algorithm, len(w.normalized))
-	err = w.comparer.StartStride(w.normalized, w.ConstantRows, w.StrideCounter)
+	masked := w.computeSkipRows()
+	if w.tuningDue() {
+		if _, err = w.autoTune(); err != nil {
+			log.Printf("auto-tuning failed: %v\n", err)
+		}
+	}
+	log.Printf("starting a run of %v on %d rows (%d masked)\n", w.settings.Algorithm, len(w.normalized), masked)
+	err = w.comparer.StartStride(w.normalized, w.skipRows, w.StrideCounter)
 	if err != nil {
 		// This could get a 'repeated start stride'
 		log.Printf("failed to start stride %d: %v", w.StrideCounter, err)
 	}
 	switch w.settings.Algorithm {
-	case settings.ALGO_FULL_PEARSON:
+	case settings.ALGO_FULL_PEARSON, settings.ALGO_LAGGED_PEARSON:
 		err = w.fullPearson()
 	case settings.ALGO_PAA_ONLY:
 		err = w.pAAOnly()
 	case settings.ALGO_PAA_SVD:
 		err = w.processBuffer()
+	case settings.ALGO_LSH:
+		err = w.lshCandidates()
 	case settings.ALGO_NONE: // No-op
 	default:
 		err = fmt.Errorf("unsupported algorithm choice %s", w.settings.Algorithm)
@@ -189,7 +348,10 @@ func (w *TimeseriesWindow) runAlgorithm() {
 	}
 }
 
-// This could be computed incrementally.
+// normalizeWindow uses the running sums in w.stats when possible, so only the
+// normalized values themselves need a pass over the window.
+// Rows are deseasonalized, preprocessed and transformed for the configured correlation
+// measure before they are normalized.
 func (w *TimeseriesWindow) normalizeWindow() *TimeseriesWindow {
 	log.Printf("start normalizing window\n")
 	if len(w.normalized) < len(w.buffers) {
@@ -198,17 +360,33 @@ func (w *TimeseriesWindow) normalizeWindow() *TimeseriesWindow {
 	if len(w.ConstantRows) < len(w.buffers) {
 		w.ConstantRows = slices.Grow(w.ConstantRows, len(w.buffers)-len(w.ConstantRows))
 	}
+	transform := w.rowTransform()
+	incremental := w.stats.sync(w.buffers)
 	constantRowCounter := 0
 	for i, b := range w.buffers {
+		var normalized []float64
+		var constant bool
+		if incremental {
+			normalized = make([]float64, len(b))
+			constant = w.stats.normalizeRow(i, b, normalized)
+		} else {
+			row := w.seasonality.deseasonalize(i, b)
+			if transform != nil {
+				normalized = transform(row)
+			} else {
+				normalized = slices.Clone(row)
+			}
+			constant = paa.NormalizeSlice(normalized)
+		}
 		if i >= len(w.normalized) {
-			w.normalized = append(w.normalized, slices.Clone(b))
+			w.normalized = append(w.normalized, normalized)
 		} else {
-			w.normalized[i] = slices.Clone(b)
+			w.normalized[i] = normalized
 		}
 		if i >= len(w.ConstantRows) {
-			w.ConstantRows = append(w.ConstantRows, paa.NormalizeSlice(w.normalized[i]))
+			w.ConstantRows = append(w.ConstantRows, constant)
 		} else {
-			w.ConstantRows[i] = paa.NormalizeSlice(w.normalized[i])
+			w.ConstantRows[i] = constant
 		}
 		if w.ConstantRows[i] {
 			constantRowCounter++
@@ -218,7 +396,31 @@ func (w *TimeseriesWindow) normalizeWindow() *TimeseriesWindow {
 	return w
 }
 
-// This could be computed incrementally after shiftBuffer.
+// rowTransform returns the transform for the rows of the window: the preprocessing
+// followed by the transform for the correlation measure. It returns nil if the rows
+// are used as they are.
+func (w *TimeseriesWindow) rowTransform() correlation.RowTransform {
+	preprocessing, err := preprocess.NewRowTransform(w.settings)
+	if err != nil {
+		log.Printf("%v, not preprocessing\n", err)
+	}
+	measure, err := correlation.NewRowTransform(w.settings.CorrelationMeasure)
+	if err != nil {
+		log.Printf("%v, using pearson instead\n", err)
+	}
+	if preprocessing == nil {
+		return measure
+	}
+	if measure == nil {
+		return preprocessing
+	}
+	return func(row []float64) []float64 {
+		return measure(preprocessing(row))
+	}
+}
+
+// pAA computes the PAA segments from the block sums in w.stats when they are
+// aligned to the segments. This must only be called after normalizeWindow.
 func (w *TimeseriesWindow) pAA() *TimeseriesWindow {
 	log.Printf("start paa\n")
 	if len(w.postPAA) < len(w.normalized) {
@@ -227,7 +429,10 @@ func (w *TimeseriesWindow) pAA() *TimeseriesWindow {
 	constantCounter := 0
 	for i, b := range w.normalized {
 		// TODO: skip constantRows during PAA?
-		paaResults, constant := paa.PAA(b, w.settings.SvdDimensions)
+		paaResults, constant, ok := w.stats.pAA(i, len(b), w.settings.SvdDimensions)
+		if !ok {
+			paaResults, constant = paa.PAA(b, w.settings.SvdDimensions)
+		}
 		if constant && !w.ConstantRows[i] {
 			constantCounter++
 		}
@@ -247,7 +452,7 @@ func (w *TimeseriesWindow) correlationPairs() error {
 		return fmt.Errorf("you must run SVD before you can get correlation pairs")
 	}
 
-	scheme := buckets.NewBucketingScheme(w.normalized, w.postSVD, w.ConstantRows,
+	scheme := buckets.NewBucketingScheme(w.normalized, w.postSVD, w.skipRows,
 		w.settings, w.StrideCounter, w.comparer)
 	utils.ReportMemory("created scheme")
 	err := scheme.Initialize()
@@ -264,6 +469,19 @@ func (w *TimeseriesWindow) correlationPairs() error {
 	return nil
 }
 
+func (w *TimeseriesWindow) lshCandidates() error {
+	if len(w.normalized) == 0 {
+		return fmt.Errorf("no data to run lsh on")
+	}
+	scheme := lsh.NewLshScheme(w.normalized, w.skipRows, w.settings, w.StrideCounter, w.comparer)
+	err := scheme.Initialize()
+	utils.ReportMemory("initialized lsh tables")
+	if err != nil {
+		return err
+	}
+	return scheme.CorrelationCandidates()
+}
+
 func (w *TimeseriesWindow) sVD() (*TimeseriesWindow, error) {
 	log.Println("start svd")
 	rowCount := len(w.postPAA)
@@ -272,26 +490,38 @@ func (w *TimeseriesWindow) sVD() (*TimeseriesWindow, error) {
 	}
 	columnCount := len(w.postPAA[0])
 
-	svd := &svd.TruncatedSVD{K: w.settings.SvdOutputDimensions}
+	if w.svd == nil {
+		transformer, err := svd.NewTransformer(w.settings.SvdStrategy, w.settings.SvdOutputDimensions)
+		if err != nil {
+			return nil, err
+		}
+		w.svd = transformer
+	}
 
 	fullData := make([]float64, 0, rowCount*columnCount)
-	svdData := make([]float64, 0, w.settings.MaxRowsForSvd*columnCount)
 	// I ran into failures (with no error messages) for svd on large
 	// inputs (over 40k rows with 600 columns). It looks like some implementations
 	// struggle at that size.
 	// The following samples the data so we stay below maxRowsForSvd rows.
+	// The randomized strategies do not need this.
 	svdRowCount := 0
+	maxRowsForSvd := w.settings.MaxRowsForSvd
 	var modulus int
-	if w.settings.MaxRowsForSvd == 0 || w.settings.MaxRowsForSvd >= rowCount {
+	if w.settings.SvdStrategy != settings.SVD_FULL && w.settings.SvdStrategy != "" {
+		log.Printf("will compute %s svd on all %d rows", w.settings.SvdStrategy, rowCount)
+		maxRowsForSvd = rowCount
+		modulus = 1
+	} else if w.settings.MaxRowsForSvd == 0 || w.settings.MaxRowsForSvd >= rowCount {
 		log.Printf("will attempt to compute svd on full %d rows", rowCount)
 		modulus = 1
 	} else {
 		log.Printf("reducing matrix from %d to %d rows for svd", rowCount, w.settings.MaxRowsForSvd)
 		modulus = rowCount / w.settings.MaxRowsForSvd
 	}
+	svdData := make([]float64, 0, maxRowsForSvd*columnCount)
 	for i, r := range w.postPAA {
 		fullData = append(fullData, r...)
-		if svdRowCount < w.settings.MaxRowsForSvd && (len(w.ConstantRows) <= i || !w.ConstantRows[i]) {
+		if svdRowCount < maxRowsForSvd && (len(w.skipRows) <= i || !w.skipRows[i]) {
 			// TODO: check if r is constant
 			if i%modulus == 0 {
 				svdData = append(svdData, r...)
@@ -305,10 +535,16 @@ func (w *TimeseriesWindow) sVD() (*TimeseriesWindow, error) {
 
 	log.Printf("computing svd using a matrix with %d columns and %d rows\n", columnCount, svdRowCount)
 
-	ret, err := svd.FitTransform(svdMatrix, fullMatrix)
+	ret, err := w.svd.FitTransform(svdMatrix, fullMatrix)
 	if err != nil {
 		return nil, err
 	}
+	retained := w.svd.RetainedVariance()
+	if !w.trial {
+		svdRetainedVariance.Set(retained)
+	}
+	log.Printf("svd with %d output dimensions retained %.4f of the variance\n",
+		w.settings.SvdOutputDimensions, retained)
 	if len(w.postSVD) < rowCount {
 		w.postSVD = slices.Grow(w.postSVD, rowCount-len(w.postSVD))
 	}
@@ -358,6 +594,12 @@ func (w *TimeseriesWindow) pAAOnly() error {
 			if err != nil {
 				return err
 			}
+			if distance > w.settings.Epsilon1 && w.settings.NegativeCorrelations {
+				distance, err = correlation.EuclideanDistance(r1, correlation.Negate(r2))
+				if err != nil {
+					return err
+				}
+			}
 			if distance > w.settings.Epsilon1 {
 				continue
 			}
@@ -3,9 +3,14 @@ package lib
 import (
 	"fmt"
 	"github.com/kpaschen/corrjoin/lib/comparisons"
+	"github.com/kpaschen/corrjoin/lib/correlation"
 	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/paa"
+	"github.com/kpaschen/corrjoin/lib/preprocess"
 	"github.com/kpaschen/corrjoin/lib/settings"
 	"math"
+	"math/rand"
+	"slices"
 	"testing"
 )
 
@@ -346,3 +351,300 @@ func TestCorrelationPairs(t *testing.T) {
 		fmt.Printf("expected to find a correlated pair\n")
 	}
 }
+
+func TestShiftObservationsMask(t *testing.T) {
+	config := settings.CorrjoinSettings{
+		Algorithm:  settings.ALGO_NONE,
+		WindowSize: 4,
+	}
+	comparer := &comparisons.InProcessComparer{}
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	defer close(results)
+	comparer.Initialize(config, results)
+	tswindow := NewTimeseriesWindow(config, comparer)
+
+	strides := [][][]float64{
+		[][]float64{
+			[]float64{0.1, 0.2},
+			[]float64{1.1, 1.3},
+		},
+		[][]float64{
+			[]float64{0.3, 0.4},
+			[]float64{1.2, 1.4},
+		},
+		[][]float64{
+			[]float64{0.5, 0.6},
+			[]float64{1.5, 1.1},
+		},
+		[][]float64{
+			[]float64{0.7, 0.8},
+			[]float64{1.6, 1.7},
+		},
+	}
+	masks := [][]bool{
+		[]bool{false, true},
+		nil,
+		nil,
+		nil,
+	}
+	// Row 1 ended during the first stride, so it should stay masked until the first
+	// stride has moved out of the window.
+	expectMasked := []bool{true, true, false, false}
+	// Shift the strides in directly so no computation gets started.
+	for i, stride := range strides {
+		tswindow.StrideCounter++
+		_, err := tswindow.shiftBufferIntoWindow(stride)
+		if err != nil {
+			t.Fatalf("unexpected error shifting stride %d: %v", i, err)
+		}
+		tswindow.updateMask(masks[i], len(stride[0]))
+		if tswindow.IsMasked(0) {
+			t.Errorf("row 0 should never be masked")
+		}
+		if tswindow.IsMasked(1) != expectMasked[i] {
+			t.Errorf("expected masked state %t for row 1 after stride %d", expectMasked[i], i)
+		}
+		if i == 1 {
+			tswindow.normalizeWindow()
+			tswindow.computeSkipRows()
+			if !tswindow.skipRows[1] || tswindow.skipRows[0] {
+				t.Errorf("expected only row 1 to be skipped but got %v", tswindow.skipRows)
+			}
+			if tswindow.ConstantRows[1] {
+				t.Errorf("a masked row should not be reported as constant")
+			}
+		}
+	}
+}
+
+func TestShiftObservationsWithRowMapping(t *testing.T) {
+	config := settings.CorrjoinSettings{
+		Algorithm:  settings.ALGO_NONE,
+		WindowSize: 9,
+	}
+	comparer := &comparisons.InProcessComparer{}
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	defer close(results)
+	comparer.Initialize(config, results)
+	tswindow := NewTimeseriesWindow(config, comparer)
+	bufferWindow := [][]float64{
+		[]float64{0.1, 0.2, 0.3},
+		[]float64{1.1, 1.2, 1.3},
+		[]float64{2.1, 2.2, 2.3},
+	}
+	err, _ := tswindow.ShiftBuffer(bufferWindow)
+	if err != nil {
+		t.Errorf("unexpected: %v", err)
+	}
+
+	// The accumulator dropped row 1 and added a new row.
+	err, _ = tswindow.ShiftObservations(&ObservationResult{
+		Buffers: [][]float64{
+			[]float64{0.4, 0.5, 0.6},
+			[]float64{2.4, 2.5, 2.6},
+			[]float64{3.4, 3.5, 3.6},
+		},
+		RowMapping: []int{0, -1, 1},
+	})
+	if err != nil {
+		t.Errorf("unexpected: %v", err)
+	}
+	expected := [][]float64{
+		[]float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6},
+		[]float64{2.1, 2.2, 2.3, 2.4, 2.5, 2.6},
+		[]float64{0.0, 0.0, 0.0, 3.4, 3.5, 3.6},
+	}
+	if !matrixEqual(expected, tswindow.buffers, 0.001) {
+		t.Errorf("after compaction: expected %v but got %v", expected, tswindow.buffers)
+	}
+	if len(tswindow.pendingRowMappings) != 0 {
+		t.Errorf("expected row mappings to have been applied")
+	}
+}
+
+func TestIncrementalNormalization(t *testing.T) {
+	config := settings.CorrjoinSettings{
+		Algorithm:     settings.ALGO_NONE,
+		WindowSize:    60,
+		StrideLength:  10,
+		SvdDimensions: 4,
+	}
+	comparer := &comparisons.InProcessComparer{}
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	defer close(results)
+	comparer.Initialize(config, results)
+	tswindow := NewTimeseriesWindow(config, comparer)
+	if tswindow.stats == nil || tswindow.stats.blockSize != 5 {
+		t.Fatalf("expected incremental stats with block size 5 but got %+v", tswindow.stats)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	rowCount := 4
+	last := []float64{0.0, 1e6, 5.0, 0.0}
+	for stride := 0; stride < 25; stride++ {
+		// Add a row partway through, and drop one later.
+		if stride == 10 {
+			rowCount++
+			last = append(last, -3e5)
+		}
+		if stride == 17 {
+			tswindow.pendingRowMappings = [][]int{{0, -1, 1, 2, 3}}
+			tswindow.applyRowMappings()
+			rowCount--
+			last = append(last[:1], last[2:]...)
+		}
+		buffer := make([][]float64, rowCount)
+		for i := range buffer {
+			buffer[i] = make([]float64, config.StrideLength)
+			for j := range buffer[i] {
+				// One row stays constant.
+				if i != 2 {
+					last[i] += rng.NormFloat64()
+				}
+				buffer[i][j] = last[i]
+			}
+		}
+		startComputation, err := tswindow.shiftBufferIntoWindow(buffer)
+		if err != nil {
+			t.Fatalf("unexpected error in stride %d: %v", stride, err)
+		}
+		if !startComputation {
+			continue
+		}
+		tswindow.normalizeWindow()
+		tswindow.pAA()
+		if !tswindow.stats.valid {
+			t.Errorf("expected incremental stats to be used in stride %d", stride)
+		}
+
+		expectedNormalized := make([][]float64, len(tswindow.buffers))
+		expectedPAA := make([][]float64, len(tswindow.buffers))
+		for i, b := range tswindow.buffers {
+			expectedNormalized[i] = slices.Clone(b)
+			constant := paa.NormalizeSlice(expectedNormalized[i])
+			if constant != tswindow.ConstantRows[i] {
+				t.Errorf("stride %d row %d: expected constant to be %t", stride, i, constant)
+			}
+			expectedPAA[i], _ = paa.PAA(expectedNormalized[i], config.SvdDimensions)
+			// The values of constant rows depend on rounding and are not used.
+			if constant {
+				expectedNormalized[i] = tswindow.normalized[i]
+				expectedPAA[i] = tswindow.postPAA[i]
+			}
+		}
+		if !matrixEqual(tswindow.normalized, expectedNormalized, 1e-9) {
+			t.Errorf("stride %d: incremental normalization %v differs from %v", stride,
+				tswindow.normalized, expectedNormalized)
+		}
+		if !matrixEqual(tswindow.postPAA, expectedPAA, 1e-9) {
+			t.Errorf("stride %d: incremental paa %v differs from %v", stride, tswindow.postPAA, expectedPAA)
+		}
+	}
+}
+
+func TestSpearmanMeasure(t *testing.T) {
+	config := settings.CorrjoinSettings{
+		Algorithm:            settings.ALGO_FULL_PEARSON,
+		WindowSize:           100,
+		StrideLength:         20,
+		SvdDimensions:        5,
+		EuclidDimensions:     10,
+		CorrelationThreshold: 0.95,
+		CorrelationMeasure:   settings.MEASURE_SPEARMAN,
+	}.ComputeSettingsFields()
+	comparer := &comparisons.InProcessComparer{}
+	results := make(chan *datatypes.CorrjoinResult, 10)
+	comparer.Initialize(config, results)
+	tswindow := NewTimeseriesWindow(config, comparer)
+	if tswindow.stats != nil {
+		t.Errorf("did not expect incremental stats for the spearman measure")
+	}
+
+	// Row 1 is a monotonic but very much not linear function of row 0.
+	rng := rand.New(rand.NewSource(3))
+	rows := make([][]float64, 6)
+	for i := range rows {
+		rows[i] = make([]float64, config.WindowSize)
+	}
+	value := 0.0
+	for j := 0; j < config.WindowSize; j++ {
+		value += rng.NormFloat64()
+		rows[0][j] = value
+		rows[1][j] = math.Exp(2 * value)
+		for i := 2; i < len(rows); i++ {
+			rows[i][j] = rng.NormFloat64()
+		}
+	}
+	tswindow.buffers = rows
+	tswindow.normalizeWindow()
+
+	expected := correlation.Ranks(rows[1])
+	paa.NormalizeSlice(expected)
+	for j, v := range expected {
+		if math.Abs(tswindow.normalized[1][j]-v) > 1e-9 {
+			t.Fatalf("expected the normalized ranks in row 1 but got %v", tswindow.normalized[1])
+		}
+	}
+
+	if err := comparer.StartStride(tswindow.normalized, tswindow.ConstantRows, tswindow.StrideCounter); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := tswindow.fullPearson(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	found := false
+	for result := range results {
+		if len(result.CorrelatedPairs) == 0 {
+			break
+		}
+		for pair, coefficient := range result.CorrelatedPairs {
+			if pair == *datatypes.NewRowPair(0, 1) {
+				found = true
+				if math.Abs(coefficient-1.0) > 1e-9 {
+					t.Errorf("expected a rank correlation of 1 but got %f", coefficient)
+				}
+			}
+			if result.Measure != settings.MEASURE_SPEARMAN {
+				t.Errorf("expected the result to record the spearman measure but got %q", result.Measure)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected rows 0 and 1 to be correlated")
+	}
+}
+
+func TestPreprocessing(t *testing.T) {
+	config := settings.CorrjoinSettings{
+		Algorithm:          settings.ALGO_NONE,
+		WindowSize:         40,
+		StrideLength:       10,
+		SvdDimensions:      4,
+		Preprocessing:      settings.PREPROCESS_DETREND,
+		CorrelationMeasure: settings.MEASURE_SPEARMAN,
+	}.ComputeSettingsFields()
+	comparer := &comparisons.InProcessComparer{}
+	results := make(chan *datatypes.CorrjoinResult, 1)
+	defer close(results)
+	comparer.Initialize(config, results)
+	tswindow := NewTimeseriesWindow(config, comparer)
+	if tswindow.stats != nil {
+		t.Errorf("did not expect incremental stats with preprocessing")
+	}
+	rng := rand.New(rand.NewSource(4))
+	row := make([]float64, config.WindowSize)
+	for j := range row {
+		row[j] = float64(j) + rng.NormFloat64()
+	}
+	tswindow.buffers = [][]float64{row}
+	tswindow.normalizeWindow()
+
+	// The rows are detrended first, then ranked.
+	expected := correlation.Ranks(preprocess.Detrend(row))
+	paa.NormalizeSlice(expected)
+	for j, v := range expected {
+		if math.Abs(tswindow.normalized[0][j]-v) > 1e-9 {
+			t.Fatalf("expected the normalized ranks of the detrended row but got %v", tswindow.normalized[0])
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"math/rand"
+)
+
+// RandomWalks returns groups of rows that are noisy copies of a random walk of the given
+// length. The rows within a group are strongly correlated. Tests use this as input with
+// a known set of correlated pairs.
+func RandomWalks(rng *rand.Rand, groups int, copies int, length int) [][]float64 {
+	rows := make([][]float64, 0, groups*copies)
+	for group := 0; group < groups; group++ {
+		base := make([]float64, length)
+		value := 0.0
+		for j := range base {
+			value += rng.NormFloat64()
+			base[j] = value
+		}
+		for c := 0; c < copies; c++ {
+			row := make([]float64, length)
+			for j := range row {
+				row[j] = base[j] + 0.2*rng.NormFloat64()
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
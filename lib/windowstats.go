@@ -0,0 +1,213 @@
+package lib
+
+import (
+	"github.com/kpaschen/corrjoin/lib/paa"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"math"
+)
+
+const (
+	// When the sum of squared differences from the mean is this much smaller than
+	// the running sum of squares, the subtraction has lost too much precision and
+	// the row statistics are recomputed.
+	cancellationLimit = 1e-6
+)
+
+// rowStats holds running sums for one row of the window. The sums are taken over
+// the differences from offset so they stay small for timeseries with a large mean.
+type rowStats struct {
+	offset       float64
+	sum          float64
+	sumOfSquares float64
+	// The sums of the differences from offset over consecutive blocks of the row.
+	blockSums []float64
+}
+
+// windowStats maintains running sums and sums of squares for the rows of a
+// TimeseriesWindow so that normalization and PAA do not have to look at
+// the whole window on every stride.
+// The rows are divided into blocks whose size divides both the stride length and
+// the PAA segment length, so the PAA segments are sums of whole blocks and a shift
+// adds and removes whole blocks.
+type windowStats struct {
+	blockSize int
+	// The sums are recomputed from scratch after this many shifts to keep
+	// rounding errors from piling up.
+	rebuildInterval    int
+	shiftsSinceRebuild int
+
+	valid bool
+	rows  []rowStats
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// newWindowStats returns nil if the settings do not allow incremental updates.
+func newWindowStats(config settings.CorrjoinSettings) *windowStats {
+	if config.StrideLength <= 0 || config.WindowSize <= 0 {
+		return nil
+	}
+	// Transformed rows, such as ranks, detrended or deseasonalized rows, change everywhere
+	// when the window shifts.
+	if config.CorrelationMeasure != "" && config.CorrelationMeasure != settings.MEASURE_PEARSON {
+		return nil
+	}
+	if config.Preprocessing != "" && config.Preprocessing != settings.PREPROCESS_NONE {
+		return nil
+	}
+	if config.SeasonalPeriod > 0 {
+		return nil
+	}
+	blockSize := config.StrideLength
+	if config.SvdDimensions > 0 && config.WindowSize >= config.SvdDimensions {
+		blockSize = gcd(blockSize, config.WindowSize/config.SvdDimensions)
+	}
+	if config.WindowSize%blockSize != 0 {
+		return nil
+	}
+	return &windowStats{
+		blockSize:       blockSize,
+		rebuildInterval: max(config.WindowSize/config.StrideLength, 1),
+	}
+}
+
+func (s *windowStats) invalidate() {
+	if s == nil {
+		return
+	}
+	s.valid = false
+	s.rows = nil
+}
+
+func (s *windowStats) computeRow(row []float64) rowStats {
+	ret := rowStats{
+		blockSums: make([]float64, 0, len(row)/s.blockSize),
+	}
+	for _, v := range row {
+		ret.offset += v
+	}
+	ret.offset /= float64(len(row))
+	ret.blockSums = s.appendBlocks(&ret, ret.blockSums, row)
+	return ret
+}
+
+// appendBlocks adds the values to the sums in r and appends their block sums to blockSums.
+func (s *windowStats) appendBlocks(r *rowStats, blockSums []float64, values []float64) []float64 {
+	for start := 0; start < len(values); start += s.blockSize {
+		blockSum := 0.0
+		for _, v := range values[start : start+s.blockSize] {
+			d := v - r.offset
+			blockSum += d
+			r.sumOfSquares += d * d
+		}
+		r.sum += blockSum
+		blockSums = append(blockSums, blockSum)
+	}
+	return blockSums
+}
+
+// shift updates the sums for the rows in buffers before the first removed columns
+// are dropped from them and the columns in buffer are appended.
+// This has to be called before the window buffers are modified.
+func (s *windowStats) shift(buffers [][]float64, buffer [][]float64, removed int) {
+	if s == nil || !s.valid {
+		return
+	}
+	if removed%s.blockSize != 0 || len(buffer[0])%s.blockSize != 0 {
+		s.invalidate()
+		return
+	}
+	for i := 0; i < len(buffers) && i < len(s.rows); i++ {
+		r := &s.rows[i]
+		for _, v := range buffers[i][:removed] {
+			d := v - r.offset
+			r.sum -= d
+			r.sumOfSquares -= d * d
+		}
+		r.blockSums = s.appendBlocks(r, r.blockSums[removed/s.blockSize:], buffer[i])
+	}
+	s.shiftsSinceRebuild++
+}
+
+// sync makes sure there are up-to-date sums for all rows in buffers. It returns
+// false if the sums cannot be used for buffers.
+func (s *windowStats) sync(buffers [][]float64) bool {
+	if s == nil {
+		return false
+	}
+	if !s.valid || s.shiftsSinceRebuild >= s.rebuildInterval {
+		s.rows = make([]rowStats, 0, len(buffers))
+		s.shiftsSinceRebuild = 0
+		s.valid = true
+	}
+	if len(s.rows) > len(buffers) {
+		s.rows = s.rows[:len(buffers)]
+	}
+	for i, b := range buffers {
+		if len(b)%s.blockSize != 0 {
+			s.invalidate()
+			return false
+		}
+		if i >= len(s.rows) {
+			s.rows = append(s.rows, s.computeRow(b))
+		} else if len(s.rows[i].blockSums)*s.blockSize != len(b) {
+			s.rows[i] = s.computeRow(b)
+		}
+	}
+	return true
+}
+
+// moments returns the mean of row i and the sum of the squared differences from the mean.
+func (s *windowStats) moments(i int, row []float64) (float64, float64) {
+	r := &s.rows[i]
+	n := float64(len(row))
+	sumOfSquares := r.sumOfSquares - r.sum*r.sum/n
+	if r.sumOfSquares > 0 && sumOfSquares < cancellationLimit*r.sumOfSquares {
+		*r = s.computeRow(row)
+		sumOfSquares = r.sumOfSquares - r.sum*r.sum/n
+	}
+	return r.offset + r.sum/n, max(sumOfSquares, 0.0)
+}
+
+// normalizeRow writes the normalized values of row i to target. It returns true
+// if the normalized row is constant.
+// This must only be called after sync.
+func (s *windowStats) normalizeRow(i int, row []float64, target []float64) bool {
+	avg, sumOfSquares := s.moments(i, row)
+	return paa.NormalizeSliceInto(row, target, avg, sumOfSquares)
+}
+
+// pAA computes the PAA of the normalized row i from the block sums. It returns
+// false if the PAA segments are not aligned to the blocks.
+// This must only be called after normalizeRow.
+func (s *windowStats) pAA(i int, rowLength int, targetColumnCount int) ([]float64, bool, bool) {
+	if s == nil || !s.valid || i >= len(s.rows) || targetColumnCount <= 0 {
+		return nil, false, false
+	}
+	r := &s.rows[i]
+	segmentLength := rowLength / targetColumnCount
+	if segmentLength < 1 || segmentLength%s.blockSize != 0 || len(r.blockSums)*s.blockSize != rowLength {
+		return nil, false, false
+	}
+	blocksPerSegment := segmentLength / s.blockSize
+	n := float64(rowLength)
+	normalizingFactor := math.Sqrt(max(r.sumOfSquares-r.sum*r.sum/n, 0.0))
+	ret := make([]float64, targetColumnCount)
+	if normalizingFactor == 0.0 {
+		return ret, true, true
+	}
+	rowMean := r.sum / n
+	for k := 0; k < targetColumnCount; k++ {
+		segmentSum := 0.0
+		for _, b := range r.blockSums[k*blocksPerSegment : (k+1)*blocksPerSegment] {
+			segmentSum += b
+		}
+		ret[k] = (segmentSum/float64(segmentLength) - rowMean) / normalizingFactor
+	}
+	return ret, paa.IsConstant(ret), true
+}
@@ -3,9 +3,7 @@
 package main
 
 import (
-	"bufio"
 	"flag"
-	"fmt"
 	"github.com/kpaschen/corrjoin/lib"
 	"github.com/kpaschen/corrjoin/lib/comparisons"
 	"github.com/kpaschen/corrjoin/lib/datatypes"
@@ -14,8 +12,6 @@ import (
 	"log"
 	"os"
 	"runtime/pprof"
-	"strconv"
-	"strings"
 )
 
 func main() {
@@ -47,10 +43,6 @@ func main() {
 		panic(err)
 	}
 	defer file.Close()
-	lineCount := 0
-	columnCount := 0
-	reader := bufio.NewReader(file)
-	var data [][]float64
 
 	config := settings.CorrjoinSettings{
 		SvdOutputDimensions:  *svdDimensions,
@@ -97,59 +89,18 @@ func main() {
 		}
 	}()
 
-	// The data in the sample files is in column-major order, so the nth line of a file
-	// is the data at time n, and each line contains an entry for each time series.
-	// All the processing uses the transpose of that matrix, so each row corresponds to
-	// a timeseries and each column to a point in time.
-	for {
-		line, err := reader.ReadString('\n')
+	err = lib.ReadStrides(file, *stride, func(data [][]float64) error {
+		// This triggers computation once the window is full.
+		// You can capture and print the results here but it'll make the system appear slow, so I don't
+		// do it by default.
+		err, _ := window.ShiftBuffer(data)
 		if err != nil {
-			break
-		} // err is usually io.EOF
-		if len(line) == 0 {
-			break
+			return err
 		}
-
-		line = strings.TrimSuffix(line, "\n")
-		// This is the current line number, and this is how we count how many columns the resulting matrix will have.
-
-		// parse floats out of line with strconv
-		parts := strings.Split(line, " ")
-		if lineCount == 0 {
-			// This is the number of columns in the input file, and it'll end up being the number
-			// of rows in the result matrix.
-			lineCount = len(parts)
-			data = make([][]float64, lineCount, lineCount)
-		} else {
-			if lineCount != len(parts) {
-				panic(fmt.Errorf("inconsistent number of values in line %d: expected %d but got %d",
-					columnCount, lineCount, len(parts)))
-			}
-		}
-		for i, p := range parts {
-			if len(data[i]) == 0 {
-				data[i] = make([]float64, *stride, *stride)
-			}
-			data[i][columnCount], err = strconv.ParseFloat(p, 64)
-			if err != nil {
-				panic(fmt.Errorf("on line %d of %s, failed to parse %s into a float: %v\n",
-					columnCount, *filename, p, err))
-			}
-		}
-		columnCount++
-		if columnCount >= *stride {
-			// This triggers computation once the window is full.
-			// You can capture and print the results here but it'll make the system appear slow, so I don't
-			// do it by default.
-			err, _ = window.ShiftBuffer(data)
-			if err != nil {
-				log.Printf("caught error: %v\n", err)
-				break
-			}
-			columnCount = 0
-			data = make([][]float64, lineCount, lineCount)
-			shiftCount++
-		}
-
+		shiftCount++
+		return nil
+	})
+	if err != nil {
+		log.Printf("caught error: %v\n", err)
 	}
 }
@@ -0,0 +1,261 @@
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	backfilledSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_backfilled_samples_total",
+			Help: "Total number of samples read from the query API at startup.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(backfilledSamples)
+}
+
+// The metric types as the Prometheus metadata API names them.
+var metadataTypes = map[model.MetricType]prompb.MetricMetadata_MetricType{
+	model.MetricTypeCounter:        prompb.MetricMetadata_COUNTER,
+	model.MetricTypeGauge:          prompb.MetricMetadata_GAUGE,
+	model.MetricTypeHistogram:      prompb.MetricMetadata_HISTOGRAM,
+	model.MetricTypeGaugeHistogram: prompb.MetricMetadata_GAUGEHISTOGRAM,
+	model.MetricTypeSummary:        prompb.MetricMetadata_SUMMARY,
+	model.MetricTypeInfo:           prompb.MetricMetadata_INFO,
+	model.MetricTypeStateset:       prompb.MetricMetadata_STATESET,
+}
+
+// A backfiller reads samples from a Prometheus compatible query API.
+type backfiller struct {
+	client *http.Client
+	// The base URL of the API, without /api/v1.
+	url            string
+	matchers       []string
+	seriesPerQuery int
+	step           time.Duration
+}
+
+func newBackfiller(baseURL string, matchers []string, seriesPerQuery int, sampleInterval int) *backfiller {
+	return &backfiller{
+		client:         &http.Client{Timeout: 2 * time.Minute},
+		url:            strings.TrimSuffix(baseURL, "/"),
+		matchers:       matchers,
+		seriesPerQuery: seriesPerQuery,
+		step:           time.Duration(sampleInterval) * time.Second,
+	}
+}
+
+type apiResponse struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	ErrorType string          `json:"errorType"`
+	Error     string          `json:"error"`
+}
+
+// post sends a form to the given API endpoint and decodes the data of the response into data.
+// POST keeps long lists of selectors out of the URL.
+func (b *backfiller) post(endpoint string, form url.Values, data interface{}) error {
+	resp, err := b.client.PostForm(b.url+endpoint, form)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(endpoint, resp, data)
+}
+
+// get is like post for the endpoints that only accept GET.
+func (b *backfiller) get(endpoint string, data interface{}) error {
+	resp, err := b.client.Get(b.url + endpoint)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(endpoint, resp, data)
+}
+
+// decodeResponse decodes the data of an API response into data.
+func decodeResponse(endpoint string, resp *http.Response, data interface{}) error {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var r apiResponse
+	if err = json.Unmarshal(body, &r); err != nil {
+		return fmt.Errorf("unexpected response from %s with status %d: %v", endpoint, resp.StatusCode, err)
+	}
+	if r.Status != "success" {
+		return fmt.Errorf("%s failed with %s: %s", endpoint, r.ErrorType, r.Error)
+	}
+	return json.Unmarshal(r.Data, data)
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64)
+}
+
+// series returns the timeseries selected by the matchers that have samples between start and end.
+func (b *backfiller) series(start, end time.Time) ([]model.Metric, error) {
+	form := url.Values{
+		"match[]": b.matchers,
+		"start":   {formatTime(start)},
+		"end":     {formatTime(end)},
+	}
+	var series []model.Metric
+	err := b.post("/api/v1/series", form, &series)
+	return series, err
+}
+
+// metadata returns the types of the metric families. The query API does not return them
+// with the samples.
+func (b *backfiller) metadata() ([]prompb.MetricMetadata, error) {
+	var families map[string][]struct {
+		Type model.MetricType `json:"type"`
+	}
+	if err := b.get("/api/v1/metadata", &families); err != nil {
+		return nil, err
+	}
+	ret := make([]prompb.MetricMetadata, 0, len(families))
+	for name, m := range families {
+		if len(m) == 0 {
+			continue
+		}
+		if t, ok := metadataTypes[m[0].Type]; ok {
+			ret = append(ret, prompb.MetricMetadata{MetricFamilyName: name, Type: t})
+		}
+	}
+	return ret, nil
+}
+
+// selector returns a PromQL selector for exactly the timeseries metric.
+func selector(metric model.Metric) string {
+	names := make([]string, 0, len(metric))
+	for name := range metric {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	matchers := make([]string, len(names))
+	for i, name := range names {
+		matchers[i] = name + "=" + strconv.Quote(string(metric[model.LabelName(name)]))
+	}
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+// queryRange returns the samples of the given timeseries between start and end, one per step.
+func (b *backfiller) queryRange(series []model.Metric, start, end time.Time) (model.Matrix, error) {
+	selectors := make([]string, len(series))
+	for i, s := range series {
+		selectors[i] = selector(s)
+	}
+	form := url.Values{
+		"query": {strings.Join(selectors, " or ")},
+		"start": {formatTime(start)},
+		"end":   {formatTime(end)},
+		"step":  {strconv.FormatFloat(b.step.Seconds(), 'f', -1, 64)},
+	}
+	var result struct {
+		ResultType string       `json:"resultType"`
+		Result     model.Matrix `json:"result"`
+	}
+	if err := b.post("/api/v1/query_range", form, &result); err != nil {
+		return nil, err
+	}
+	if result.ResultType != "matrix" {
+		return nil, fmt.Errorf("unexpected result type %s", result.ResultType)
+	}
+	return result.Result, nil
+}
+
+// backfill reads the samples between start and end from the query API and observes them in
+// timestamp order, as if they had been sent with remote write. It reads pageLength at a
+// time, so the samples of one page for all timeseries have to fit into memory.
+func (t *tsProcessor) backfill(b *backfiller, start, end time.Time, pageLength time.Duration) error {
+	metadata, err := b.metadata()
+	if err != nil {
+		log.Printf("backfilling without metric metadata: %v\n", err)
+	}
+	t.counters.observeMetadata(metadata)
+	series, err := b.series(start, end)
+	if err != nil {
+		return err
+	}
+	log.Printf("backfilling %d timeseries from %v to %v\n", len(series), start, end)
+	for pageStart := start; !pageStart.After(end); pageStart = pageStart.Add(pageLength) {
+		pageEnd := pageStart.Add(pageLength - b.step)
+		if pageEnd.After(end) {
+			pageEnd = end
+		}
+		// timestamp -> one timeseries with one sample per series
+		samples := make(map[int64][]prompb.TimeSeries)
+		for first := 0; first < len(series); first += b.seriesPerQuery {
+			matrix, err := b.queryRange(series[first:min(first+b.seriesPerQuery, len(series))], pageStart, pageEnd)
+			if err != nil {
+				return err
+			}
+			for _, stream := range matrix {
+				labels := make([]prompb.Label, 0, len(stream.Metric))
+				for name, value := range stream.Metric {
+					labels = append(labels, prompb.Label{Name: string(name), Value: string(value)})
+				}
+				for _, v := range stream.Values {
+					ts := int64(v.Timestamp)
+					samples[ts] = append(samples[ts], prompb.TimeSeries{
+						Labels:  labels,
+						Samples: []prompb.Sample{{Value: float64(v.Value), Timestamp: ts}},
+					})
+				}
+			}
+		}
+		timestamps := make([]int64, 0, len(samples))
+		for ts := range samples {
+			timestamps = append(timestamps, ts)
+		}
+		sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+		for _, ts := range timestamps {
+			written, _, err := t.observeTs(&prompb.WriteRequest{Timeseries: samples[ts]})
+			if err != nil {
+				return err
+			}
+			backfilledSamples.Add(float64(written))
+		}
+	}
+	return nil
+}
+
+// runBackfill backfills the samples between start and end and then lets remote write
+// requests in. If the backfill fails, the accumulator is moved from start to now, so the
+// first stride is not a window in the past.
+func (t *tsProcessor) runBackfill(b *backfiller, start, end time.Time, pageLength time.Duration) {
+	if err := t.backfill(b, start, end, pageLength); err != nil {
+		log.Printf("failed to backfill: %v\n", err)
+		t.reanchorRequests <- time.Now().UTC()
+	} else {
+		log.Println("backfill done")
+	}
+	t.backfilling.Store(false)
+}
+
+// rejectDuringBackfill answers requests with new samples while the backfill is running,
+// since the accumulator cannot take samples from before the ones it has seen. Senders
+// retry the request later.
+func (t *tsProcessor) rejectDuringBackfill(w http.ResponseWriter) bool {
+	if !t.backfilling.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", "30")
+	http.Error(w, "backfill in progress", http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,179 @@
+package receiver
+
+import (
+	"encoding/json"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePrometheus answers series, metadata and query_range requests for a fixed set of
+// timeseries whose value at time t is t divided by the sample interval plus the row.
+type fakePrometheus struct {
+	server *httptest.Server
+	series []model.Metric
+
+	lock    sync.Mutex
+	queries int
+}
+
+func newFakePrometheus(t *testing.T, series []model.Metric) *fakePrometheus {
+	p := &fakePrometheus{series: series}
+	respond := func(w http.ResponseWriter, data interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": data})
+	}
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %v", err)
+		}
+		switch r.URL.Path {
+		case "/api/v1/series":
+			respond(w, p.series)
+		case "/api/v1/metadata":
+			// Prometheus only registers the metadata endpoint for GET.
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			respond(w, map[string][]map[string]string{"requests": {{"type": "counter"}}})
+		case "/api/v1/query_range":
+			p.lock.Lock()
+			p.queries++
+			p.lock.Unlock()
+			start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+			end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+			step, _ := strconv.ParseFloat(r.Form.Get("step"), 64)
+			expr, err := parser.ParseExpr(r.Form.Get("query"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"status": "error", "errorType": "bad_data", "error": err.Error()})
+				return
+			}
+			var matrix model.Matrix
+			parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+				vs, ok := node.(*parser.VectorSelector)
+				if !ok {
+					return nil
+				}
+				for row, s := range p.series {
+					if !matchesAll(vs.LabelMatchers, s) {
+						continue
+					}
+					stream := &model.SampleStream{Metric: s}
+					for ts := start; ts <= end; ts += step {
+						stream.Values = append(stream.Values, model.SamplePair{
+							Timestamp: model.TimeFromUnix(int64(ts)),
+							Value:     model.SampleValue(ts/step + float64(row)),
+						})
+					}
+					matrix = append(matrix, stream)
+				}
+				return nil
+			})
+			respond(w, map[string]interface{}{"resultType": "matrix", "result": matrix})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return p
+}
+
+func matchesAll(matchers []*labels.Matcher, metric model.Metric) bool {
+	for _, m := range matchers {
+		if !m.Matches(string(metric[model.LabelName(m.Name)])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBackfill(t *testing.T) {
+	series := []model.Metric{
+		{"__name__": "requests", "job": "api"},
+		{"__name__": "latency", "job": "api", "path": "/a \"b\""},
+		{"__name__": "latency", "job": "db"},
+	}
+	prometheus := newFakePrometheus(t, series)
+	defer prometheus.server.Close()
+
+	processor := newTestProcessor()
+	processor.backfilling.Store(true)
+	b := newBackfiller(prometheus.server.URL+"/", []string{`{job=~"api|db"}`}, 2, 20)
+	end := time.Unix(1700000000, 0).UTC()
+	start := end.Add(-200 * time.Second)
+	// Two pages of five samples each plus a page with the last sample.
+	if err := processor.backfill(b, start, end, 100*time.Second); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if prometheus.queries != 6 {
+		t.Errorf("expected two queries for each of three pages but got %d", prometheus.queries)
+	}
+
+	// The observations arrive in timestamp order.
+	var last time.Time
+	observations := make(map[uint64][]float64)
+	for len(processor.observationQueue) > 0 {
+		o := <-processor.observationQueue
+		if o.Timestamp.Before(last) {
+			t.Errorf("observation at %v after one at %v", o.Timestamp, last)
+		}
+		last = o.Timestamp
+		observations[o.MetricFingerprint] = append(observations[o.MetricFingerprint], o.Value)
+		if o.Counter != (o.MetricFingerprint == uint64(series[0].Fingerprint())) {
+			t.Errorf("expected only the requests timeseries to be a counter but got %v", *o)
+		}
+	}
+	if !last.Equal(end) {
+		t.Errorf("expected the last observation at %v but got %v", end, last)
+	}
+	for row, s := range series {
+		values := observations[uint64(s.Fingerprint())]
+		if len(values) != 11 || values[0] != float64(start.Unix()/20+int64(row)) {
+			t.Errorf("expected eleven values for %v but got %v", s, values)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	processor.ReceivePrometheusData(w, httptest.NewRequest("POST", "/api/v1/write", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected writes to be rejected during the backfill but got %d", w.Code)
+	}
+}
+
+func TestBackfillErrors(t *testing.T) {
+	prometheus := newFakePrometheus(t, []model.Metric{{"__name__": "up"}})
+	defer prometheus.server.Close()
+	processor := newTestProcessor()
+	end := time.Unix(1700000000, 0)
+
+	b := newBackfiller(prometheus.server.URL+"/prefix", []string{"up"}, 10, 20)
+	if err := processor.backfill(b, end.Add(-time.Minute), end, time.Minute); err == nil {
+		t.Errorf("expected an error for a wrong url")
+	}
+
+	// After a failed backfill, the accumulator starts at now instead of a window ago.
+	processor.reanchorRequests = make(chan time.Time, 1)
+	processor.backfilling.Store(true)
+	before := time.Now()
+	processor.runBackfill(b, end.Add(-time.Minute), end, time.Minute)
+	if processor.backfilling.Load() {
+		t.Errorf("expected writes to be accepted after the failed backfill")
+	}
+	select {
+	case start := <-processor.reanchorRequests:
+		if start.Before(before) || start.After(time.Now()) {
+			t.Errorf("expected the accumulator to be moved to now but got %v", start)
+		}
+	default:
+		t.Errorf("expected the accumulator to be moved after the failed backfill")
+	}
+	if selector(model.Metric{"job": "a\nb", "__name__": "up"}) != `{__name__="up",job="a\nb"}` {
+		t.Errorf("unexpected selector %s", selector(model.Metric{"job": "a\nb", "__name__": "up"}))
+	}
+}
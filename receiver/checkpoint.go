@@ -0,0 +1,91 @@
+package receiver
+
+import (
+	"fmt"
+	corrjoin "github.com/kpaschen/corrjoin/lib"
+	"log"
+	"time"
+)
+
+// strideInFlightError means a stride has been published by the accumulator but
+// not shifted into the window yet, so the state is not consistent.
+type strideInFlightError struct{}
+
+func (s strideInFlightError) Error() string {
+	return fmt.Sprintf("a stride is in flight between the accumulator and the window")
+}
+
+// checkpoint writes the state of the accumulator and the window to the results directory.
+// It must be called from the goroutine that feeds the accumulator. As long as no stride is
+// in flight, the goroutine that shifts buffers into the window is idle, so the window does
+// not change while it is written.
+func (t *tsProcessor) checkpoint() error {
+	if int64(t.accumulator.PublishedStrides) != t.consumedStrides.Load() {
+		return strideInFlightError{}
+	}
+	strideCounter, buffers, maskedUntil := t.window.Snapshot()
+	c := &corrjoin.Checkpoint{
+		CreatedAt:        time.Now().UTC(),
+		WindowSize:       t.settings.WindowSize,
+		StrideLength:     t.settings.StrideLength,
+		SampleInterval:   t.settings.SampleInterval,
+		StrideCounter:    strideCounter,
+		WindowBuffers:    buffers,
+		MaskedUntil:      maskedUntil,
+		StrideStartTimes: t.strideStartTimes,
+		Seasonality:      t.window.SeasonalSnapshot(),
+		Accumulator:      t.accumulator.Snapshot(),
+		Rates:            t.rates.Snapshot(),
+	}
+	return corrjoin.WriteCheckpoint(t.settings.ResultsDirectory, c)
+}
+
+// restoreCheckpoint loads the latest valid checkpoint from the results directory, if there is one.
+// This must be called before the processor starts its goroutines.
+func (t *tsProcessor) restoreCheckpoint() error {
+	c, err := corrjoin.LoadLatestCheckpoint(t.settings.ResultsDirectory, *t.settings)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		log.Println("no usable checkpoint found, starting with an empty window")
+		return nil
+	}
+	// LoadLatestCheckpoint has validated the window and the accumulator state, so neither
+	// restore fails after the other has replaced its state.
+	if err = t.window.Restore(c.StrideCounter, c.WindowBuffers, c.MaskedUntil); err != nil {
+		return err
+	}
+	t.window.RestoreSeasonality(c.Seasonality)
+	if err = t.accumulator.Restore(c.Accumulator); err != nil {
+		return err
+	}
+	t.rates.Restore(c.Rates)
+	if c.StrideStartTimes != nil {
+		t.strideStartTimes = c.StrideStartTimes
+	}
+	log.Printf("resuming from checkpoint written at %v\n", c.CreatedAt)
+	return nil
+}
+
+// requestCheckpoint asks the goroutine that feeds the accumulator for a checkpoint.
+// It retries for a while if a stride is in flight.
+func (t *tsProcessor) requestCheckpoint(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		reply := make(chan error, 1)
+		select {
+		case t.checkpointRequests <- reply:
+		case <-time.After(time.Until(deadline)):
+			return fmt.Errorf("timed out waiting to write checkpoint")
+		}
+		err := <-reply
+		if _, inFlight := err.(strideInFlightError); !inFlight {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
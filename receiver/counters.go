@@ -0,0 +1,89 @@
+package receiver
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"strings"
+	"sync"
+)
+
+// Series with these suffixes are counters, either on their own or as part of a
+// histogram or summary.
+var counterSuffixes = []string{"_total", "_count", "_sum"}
+
+// A counterDetector decides which metrics are counters. It uses the metric
+// metadata from remote write requests when there is any, and the metric
+// naming conventions otherwise.
+type counterDetector struct {
+	lock sync.RWMutex
+	// metric family name -> type
+	types map[string]prompb.MetricMetadata_MetricType
+}
+
+func newCounterDetector() *counterDetector {
+	return &counterDetector{
+		types: make(map[string]prompb.MetricMetadata_MetricType),
+	}
+}
+
+func (d *counterDetector) observeMetadata(metadata []prompb.MetricMetadata) {
+	if len(metadata) == 0 {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, m := range metadata {
+		if m.Type == prompb.MetricMetadata_UNKNOWN {
+			continue
+		}
+		d.types[m.MetricFamilyName] = m.Type
+	}
+}
+
+func (d *counterDetector) lookupType(name string) (prompb.MetricMetadata_MetricType, bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	t, ok := d.types[name]
+	return t, ok
+}
+
+// isInfo returns true if the metadata says that the series with the given metric name
+// belongs to an info metric.
+func (d *counterDetector) isInfo(name string) bool {
+	t, ok := d.lookupType(name)
+	return ok && t == prompb.MetricMetadata_INFO
+}
+
+// isCounter returns true if the series with the given metric name is a counter.
+func (d *counterDetector) isCounter(name string) bool {
+	// The family name of a counter may or may not include the _total suffix.
+	if t, ok := d.lookupType(name); ok {
+		return t == prompb.MetricMetadata_COUNTER
+	}
+	suffix := ""
+	for _, s := range append(counterSuffixes, "_bucket") {
+		if strings.HasSuffix(name, s) {
+			suffix = s
+			break
+		}
+	}
+	if suffix != "" {
+		if t, ok := d.lookupType(strings.TrimSuffix(name, suffix)); ok {
+			switch t {
+			case prompb.MetricMetadata_COUNTER:
+				return suffix == "_total"
+			case prompb.MetricMetadata_HISTOGRAM:
+				return suffix != "_total"
+			case prompb.MetricMetadata_SUMMARY:
+				return suffix == "_count" || suffix == "_sum"
+			default:
+				return false
+			}
+		}
+	}
+	for _, s := range counterSuffixes {
+		if suffix == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package receiver
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"testing"
+)
+
+func TestIsCounter(t *testing.T) {
+	d := newCounterDetector()
+	for name, expected := range map[string]bool{
+		"http_requests_total":             true,
+		"request_duration_seconds_sum":    true,
+		"request_duration_seconds_count":  true,
+		"node_memory_free_bytes":          false,
+		"request_duration_seconds_bucket": false,
+	} {
+		if d.isCounter(name) != expected {
+			t.Errorf("expected isCounter(%s) to be %t without metadata", name, expected)
+		}
+	}
+
+	d.observeMetadata([]prompb.MetricMetadata{
+		{MetricFamilyName: "queue_length_total", Type: prompb.MetricMetadata_GAUGE},
+		{MetricFamilyName: "bytes_sent", Type: prompb.MetricMetadata_COUNTER},
+		{MetricFamilyName: "request_duration_seconds", Type: prompb.MetricMetadata_HISTOGRAM},
+		{MetricFamilyName: "rpc_latency", Type: prompb.MetricMetadata_SUMMARY},
+	})
+	for name, expected := range map[string]bool{
+		"queue_length_total":              false,
+		"bytes_sent":                      true,
+		"bytes_sent_total":                true,
+		"request_duration_seconds_bucket": true,
+		"request_duration_seconds_count":  true,
+		"rpc_latency":                     false,
+		"rpc_latency_sum":                 true,
+	} {
+		if d.isCounter(name) != expected {
+			t.Errorf("expected isCounter(%s) to be %t with metadata", name, expected)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package receiver
+
+import (
+	"sync"
+	"time"
+)
+
+// An expiryGuard holds the lock of a cache of per-timeseries state and keeps the cache
+// from being scanned for timeseries that are gone on every request.
+type expiryGuard struct {
+	lock sync.Mutex
+	// When the cache was last scanned.
+	lastExpiry time.Time
+}
+
+// expireBefore calls forget with the lock held, unless it already did so during the minute
+// before before. forget removes the state of the timeseries not seen since before.
+func (g *expiryGuard) expireBefore(before time.Time, forget func()) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if before.Sub(g.lastExpiry) < time.Minute {
+		return
+	}
+	g.lastExpiry = before
+	forget()
+}
@@ -0,0 +1,416 @@
+package receiver
+
+import (
+	"fmt"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The label of the quantile estimates, like the one of summaries.
+	quantileLabel = "quantile"
+	// Native histograms with a lower schema use custom bucket bounds, which are not supported.
+	minExponentialSchema = -4
+)
+
+var (
+	histogramSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_histogram_samples_total",
+			Help: "Total number of classic histogram samples and native histograms that were replaced by derived series.",
+		},
+	)
+	lateHistogramSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_late_histogram_samples_total",
+			Help: "Total number of classic histogram samples dropped because a later sample of the same histogram had already arrived.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(histogramSamples)
+	prometheus.MustRegister(lateHistogramSamples)
+}
+
+// A histogramDeriver replaces classic and native histograms by a few derived series,
+// so the buckets do not end up as rows that correlate with each other. The quantile
+// estimates and the mean are computed over the observations between two consecutive
+// samples of a histogram.
+type histogramDeriver struct {
+	quantiles []float64
+	mean      bool
+	count     bool
+	sum       bool
+
+	expiryGuard
+	// Keyed by the fingerprint of histogramState.metric.
+	histograms map[model.Fingerprint]*histogramState
+}
+
+// histogramState holds the latest samples of one histogram.
+type histogramState struct {
+	// The labels of the histogram without le, with the family name as the metric name.
+	metric   model.Metric
+	lastSeen time.Time
+
+	// The bucket, count and sum series of a classic histogram can arrive in separate
+	// requests. Their samples for one timestamp are collected in current until a sample
+	// with a later timestamp arrives.
+	timestamp int64
+	current   *classicHistogram
+	previous  *classicHistogram
+
+	native *histogram.FloatHistogram
+}
+
+type classicHistogram struct {
+	// upper bound -> cumulative count
+	buckets map[float64]float64
+	// NaN until the count or sum series has a sample.
+	count float64
+	sum   float64
+}
+
+func newClassicHistogram() *classicHistogram {
+	return &classicHistogram{
+		buckets: make(map[float64]float64),
+		count:   math.NaN(),
+		sum:     math.NaN(),
+	}
+}
+
+// derivedSample is a sample of a series that the histogramDeriver derived.
+type derivedSample struct {
+	metric  model.Metric
+	sample  prompb.Sample
+	counter bool
+}
+
+// newHistogramDeriver parses the list of series to derive, see settings.HistogramSeries.
+// It returns nil if the list is empty.
+func newHistogramDeriver(series []string) (*histogramDeriver, error) {
+	if len(series) == 0 {
+		return nil, nil
+	}
+	d := &histogramDeriver{histograms: make(map[model.Fingerprint]*histogramState)}
+	for _, s := range series {
+		switch s {
+		case settings.HISTOGRAM_MEAN:
+			d.mean = true
+		case settings.HISTOGRAM_COUNT:
+			d.count = true
+		case settings.HISTOGRAM_SUM:
+			d.sum = true
+		default:
+			percentile, err := strconv.ParseFloat(strings.TrimPrefix(s, "p"), 64)
+			if err != nil || !strings.HasPrefix(s, "p") || percentile <= 0 || percentile >= 100 {
+				return nil, fmt.Errorf("unsupported histogram series %s", s)
+			}
+			d.quantiles = append(d.quantiles, percentile/100)
+		}
+	}
+	return d, nil
+}
+
+// deriveHistograms hands the samples of ts to the histogramDeriver if ts is part of a
+// classic or native histogram. It returns the derived samples and whether the samples of
+// ts should still be observed as they are.
+func (t *tsProcessor) deriveHistograms(metric model.Metric, ts prompb.TimeSeries, now time.Time) ([]derivedSample, bool) {
+	d := t.histograms
+	name := string(metric[model.MetricNameLabel])
+	if len(ts.Histograms) > 0 {
+		return d.observeNative(metric, ts.Histograms, now), false
+	}
+	var family string
+	var passThrough bool
+	_, hasLe := metric[model.BucketLabel]
+	switch {
+	case strings.HasSuffix(name, "_bucket") && hasLe:
+		family = strings.TrimSuffix(name, "_bucket")
+	case strings.HasSuffix(name, "_count"):
+		family = strings.TrimSuffix(name, "_count")
+		passThrough = d.count
+	case strings.HasSuffix(name, "_sum"):
+		family = strings.TrimSuffix(name, "_sum")
+		passThrough = d.sum
+	default:
+		return nil, true
+	}
+	histogramMetric := histogramMetric(metric, family)
+	metricType, known := t.counters.lookupType(family)
+	if known {
+		if metricType != prompb.MetricMetadata_HISTOGRAM && metricType != prompb.MetricMetadata_GAUGEHISTOGRAM {
+			return nil, true
+		}
+	} else if !hasLe && !d.tracks(histogramMetric) {
+		// Without metadata, a count or sum series only belongs to a histogram whose
+		// buckets have been seen.
+		return nil, true
+	}
+	return d.observeClassic(histogramMetric, name, string(metric[model.BucketLabel]), ts.Samples,
+		metricType == prompb.MetricMetadata_GAUGEHISTOGRAM, now), passThrough
+}
+
+// histogramMetric returns the labels that identify the histogram a series belongs to.
+func histogramMetric(metric model.Metric, family string) model.Metric {
+	ret := make(model.Metric, len(metric))
+	for k, v := range metric {
+		if k != model.BucketLabel {
+			ret[k] = v
+		}
+	}
+	ret[model.MetricNameLabel] = model.LabelValue(family)
+	return ret
+}
+
+func (d *histogramDeriver) tracks(metric model.Metric) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, ok := d.histograms[metric.Fingerprint()]
+	return ok
+}
+
+func (d *histogramDeriver) state(metric model.Metric, now time.Time) *histogramState {
+	fp := metric.Fingerprint()
+	s, ok := d.histograms[fp]
+	if !ok {
+		s = &histogramState{metric: metric}
+		d.histograms[fp] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// observeClassic adds the samples of the bucket, count or sum series name to the
+// classic histogram metric. le is the upper bound of a bucket series.
+func (d *histogramDeriver) observeClassic(metric model.Metric, name string, le string, samples []prompb.Sample,
+	gauge bool, now time.Time) []derivedSample {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s := d.state(metric, now)
+	var ret []derivedSample
+	for _, sample := range samples {
+		if value.IsStaleNaN(sample.Value) {
+			continue
+		}
+		if sample.Timestamp < s.timestamp {
+			lateHistogramSamples.Inc()
+			continue
+		}
+		if sample.Timestamp > s.timestamp {
+			if s.current != nil {
+				ret = append(ret, d.deriveClassic(s, gauge)...)
+				s.previous = s.current
+			}
+			s.current = newClassicHistogram()
+			s.timestamp = sample.Timestamp
+		}
+		histogramSamples.Inc()
+		switch {
+		case le != "":
+			bound, err := strconv.ParseFloat(le, 64)
+			if err != nil {
+				continue
+			}
+			s.current.buckets[bound] = sample.Value
+		case strings.HasSuffix(name, "_count"):
+			s.current.count = sample.Value
+		case strings.HasSuffix(name, "_sum"):
+			s.current.sum = sample.Value
+		}
+	}
+	return ret
+}
+
+// deriveClassic computes the derived samples for the current sample of the classic histogram s.
+func (d *histogramDeriver) deriveClassic(s *histogramState, gauge bool) []derivedSample {
+	h := s.current
+	if !gauge {
+		if s.previous == nil {
+			return nil
+		}
+		h = h.sub(s.previous)
+	}
+	bounds := make([]float64, 0, len(h.buckets))
+	for b := range h.buckets {
+		bounds = append(bounds, b)
+	}
+	sort.Float64s(bounds)
+	buckets := make([]histogramBucket, len(bounds))
+	previous := 0.0
+	for i, b := range bounds {
+		buckets[i] = histogramBucket{upper: b, count: math.Max(h.buckets[b]-previous, 0)}
+		previous = math.Max(h.buckets[b], previous)
+		switch {
+		case i > 0:
+			buckets[i].lower = bounds[i-1]
+		case b <= 0:
+			buckets[i].lower = math.Inf(-1)
+		}
+	}
+	count := h.count
+	if math.IsNaN(count) && len(bounds) > 0 && math.IsInf(bounds[len(bounds)-1], 1) {
+		count = h.buckets[bounds[len(bounds)-1]]
+	}
+	return d.derive(s.metric, s.timestamp, buckets, count, h.sum)
+}
+
+// sub returns the increase from previous to h, or h if there was a counter reset.
+func (h *classicHistogram) sub(previous *classicHistogram) *classicHistogram {
+	ret := newClassicHistogram()
+	for b, v := range h.buckets {
+		p, ok := previous.buckets[b]
+		if !ok {
+			p = 0
+		}
+		if v < p {
+			return h
+		}
+		ret.buckets[b] = v - p
+	}
+	if h.count < previous.count {
+		return h
+	}
+	ret.count = h.count - previous.count
+	ret.sum = h.sum - previous.sum
+	return ret
+}
+
+// observeNative replaces the native histogram samples of metric by derived samples.
+func (d *histogramDeriver) observeNative(metric model.Metric, histograms []prompb.Histogram, now time.Time) []derivedSample {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s := d.state(metric, now)
+	var ret []derivedSample
+	for _, hp := range histograms {
+		if hp.Schema < minExponentialSchema {
+			continue
+		}
+		var h *histogram.FloatHistogram
+		if hp.IsFloatHistogram() {
+			h = remote.FloatHistogramProtoToFloatHistogram(hp)
+		} else {
+			h = remote.HistogramProtoToFloatHistogram(hp)
+		}
+		if value.IsStaleNaN(h.Sum) {
+			continue
+		}
+		histogramSamples.Inc()
+		gauge := h.CounterResetHint == histogram.GaugeType
+		name := string(metric[model.MetricNameLabel])
+		if d.count {
+			ret = append(ret, derivedSample{metric: withName(metric, name+"_count"),
+				sample: prompb.Sample{Value: h.Count, Timestamp: hp.Timestamp}, counter: !gauge})
+		}
+		if d.sum {
+			ret = append(ret, derivedSample{metric: withName(metric, name+"_sum"),
+				sample: prompb.Sample{Value: h.Sum, Timestamp: hp.Timestamp}, counter: !gauge})
+		}
+		increase := h
+		if !gauge {
+			previous := s.native
+			s.native = h
+			if previous == nil {
+				continue
+			}
+			if !h.DetectReset(previous) {
+				increase = h.Copy().Sub(previous)
+			}
+		}
+		var buckets []histogramBucket
+		it := increase.AllBucketIterator()
+		for it.Next() {
+			b := it.At()
+			buckets = append(buckets, histogramBucket{lower: b.Lower, upper: b.Upper, count: math.Max(b.Count, 0)})
+		}
+		ret = append(ret, d.derive(metric, hp.Timestamp, buckets, increase.Count, increase.Sum)...)
+	}
+	return ret
+}
+
+type histogramBucket struct {
+	lower, upper, count float64
+}
+
+// derive computes the quantile estimates and the mean of a histogram with the given
+// (not cumulative) buckets. There are no derived samples for histograms without observations.
+func (d *histogramDeriver) derive(metric model.Metric, timestamp int64, buckets []histogramBucket,
+	count float64, sum float64) []derivedSample {
+	if !(count > 0) {
+		return nil
+	}
+	var ret []derivedSample
+	for _, q := range d.quantiles {
+		v := bucketQuantile(q, buckets)
+		if math.IsNaN(v) {
+			continue
+		}
+		m := metric.Clone()
+		m[quantileLabel] = model.LabelValue(strconv.FormatFloat(q, 'f', -1, 64))
+		ret = append(ret, derivedSample{metric: m, sample: prompb.Sample{Value: v, Timestamp: timestamp}})
+	}
+	if d.mean && !math.IsNaN(sum) {
+		ret = append(ret, derivedSample{
+			metric: withName(metric, string(metric[model.MetricNameLabel])+"_mean"),
+			sample: prompb.Sample{Value: sum / count, Timestamp: timestamp},
+		})
+	}
+	return ret
+}
+
+// bucketQuantile estimates the q quantile by linear interpolation within the bucket that
+// holds it, like histogram_quantile does for classic histograms. When the quantile falls
+// into a bucket with an infinite bound, the finite bound is returned.
+func bucketQuantile(q float64, buckets []histogramBucket) float64 {
+	total := 0.0
+	for _, b := range buckets {
+		total += b.count
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+	rank := q * total
+	seen := 0.0
+	for _, b := range buckets {
+		if b.count == 0 || seen+b.count < rank {
+			seen += b.count
+			continue
+		}
+		switch {
+		case math.IsInf(b.upper, 1):
+			return b.lower
+		case math.IsInf(b.lower, -1):
+			return b.upper
+		}
+		return b.lower + (b.upper-b.lower)*(rank-seen)/b.count
+	}
+	return math.NaN()
+}
+
+func withName(metric model.Metric, name string) model.Metric {
+	m := metric.Clone()
+	m[model.MetricNameLabel] = model.LabelValue(name)
+	return m
+}
+
+// expire forgets histograms that have not had samples since before.
+func (d *histogramDeriver) expire(before time.Time) {
+	d.expireBefore(before, func() {
+		for fp, s := range d.histograms {
+			if s.lastSeen.Before(before) {
+				delete(d.histograms, fp)
+			}
+		}
+	})
+}
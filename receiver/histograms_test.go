@@ -0,0 +1,163 @@
+package receiver
+
+import (
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"math"
+	"testing"
+)
+
+func seriesWithLabels(samples []prompb.Sample, labels ...string) prompb.TimeSeries {
+	ts := prompb.TimeSeries{Samples: samples}
+	for i := 0; i < len(labels); i += 2 {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	return ts
+}
+
+// classicHistogramRequest returns the series of a request_duration_seconds histogram
+// with two finite buckets.
+func classicHistogramRequest(timestamp int64, buckets [3]float64, sum float64) *prompb.WriteRequest {
+	sample := func(v float64) []prompb.Sample {
+		return []prompb.Sample{{Value: v, Timestamp: timestamp}}
+	}
+	req := &prompb.WriteRequest{}
+	for i, le := range []string{"0.1", "1", "+Inf"} {
+		req.Timeseries = append(req.Timeseries, seriesWithLabels(sample(buckets[i]),
+			"__name__", "request_duration_seconds_bucket", "job", "api", "le", le))
+	}
+	req.Timeseries = append(req.Timeseries,
+		seriesWithLabels(sample(buckets[2]), "__name__", "request_duration_seconds_count", "job", "api"),
+		seriesWithLabels(sample(sum), "__name__", "request_duration_seconds_sum", "job", "api"),
+		seriesWithLabels(sample(1), "__name__", "up", "job", "api"))
+	return req
+}
+
+func TestClassicHistograms(t *testing.T) {
+	processor := newTestProcessor()
+	var err error
+	processor.histograms, err = newHistogramDeriver([]string{"p50", "p99", "mean", "count"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for i, req := range []*prompb.WriteRequest{
+		classicHistogramRequest(1700000000000, [3]float64{5, 9, 10}, 2.5),
+		classicHistogramRequest(1700000020000, [3]float64{5, 19, 20}, 7.5),
+		// The derived samples for a histogram sample are computed when the next one arrives.
+		classicHistogramRequest(1700000040000, [3]float64{6, 19, 21}, 8),
+	} {
+		written, _, err := processor.observeTs(req)
+		if err != nil || written != 6 {
+			t.Fatalf("expected six samples to be written for request %d but got %d, %v", i, written, err)
+		}
+	}
+
+	observations := drainObservations(processor)
+	if len(observations) != 5 {
+		t.Fatalf("expected up, the count and three derived series but got %v", observations)
+	}
+	for name, o := range observations {
+		metric := metricFromName(t, name)
+		if _, ok := metric[model.BucketLabel]; ok {
+			t.Errorf("unexpected bucket series %s", name)
+		}
+		switch string(metric[model.MetricNameLabel]) + string(metric[quantileLabel]) {
+		case "request_duration_seconds0.5":
+			// The ten observations of the second sample are all in the second bucket.
+			if len(o) != 1 || math.Abs(o[0].Value-0.55) > 1e-9 || o[0].Counter {
+				t.Errorf("unexpected median %v", o)
+			}
+		case "request_duration_seconds0.99":
+			if len(o) != 1 || math.Abs(o[0].Value-0.991) > 1e-9 {
+				t.Errorf("unexpected 99th percentile %v", o)
+			}
+		case "request_duration_seconds_mean":
+			if len(o) != 1 || o[0].Value != 0.5 || o[0].Timestamp.Unix() != 1700000020 {
+				t.Errorf("unexpected mean %v", o)
+			}
+		case "request_duration_seconds_count":
+			if len(o) != 3 || !o[0].Counter {
+				t.Errorf("expected the count to be passed through as a counter but got %v", o)
+			}
+		case "up":
+		default:
+			t.Errorf("unexpected series %s", name)
+		}
+	}
+}
+
+func TestNativeHistograms(t *testing.T) {
+	processor := newTestProcessor()
+	var err error
+	processor.histograms, err = newHistogramDeriver([]string{"p50", "mean", "sum"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// With schema 0, the two buckets are (0.5, 1] and (1, 2].
+	native := func(timestamp int64, buckets []int64, count uint64, sum float64) prompb.Histogram {
+		return remote.HistogramToHistogramProto(timestamp, &histogram.Histogram{
+			Count:           count,
+			Sum:             sum,
+			PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+			PositiveBuckets: buckets,
+		})
+	}
+	ts := seriesWithLabels(nil, "__name__", "rpc_duration_seconds", "job", "api")
+	ts.Histograms = []prompb.Histogram{
+		native(1700000000000, []int64{2, 0}, 4, 5),
+		native(1700000020000, []int64{2, 4}, 8, 11),
+	}
+	_, histograms, err := processor.observeTs(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{ts}})
+	if err != nil || histograms != 2 {
+		t.Fatalf("expected two histograms to be written but got %d, %v", histograms, err)
+	}
+
+	observations := drainObservations(processor)
+	if len(observations) != 3 {
+		t.Fatalf("expected the sum, median and mean but got %v", observations)
+	}
+	for name, o := range observations {
+		metric := metricFromName(t, name)
+		switch metric[model.MetricNameLabel] {
+		case "rpc_duration_seconds":
+			// The four new observations are in the second bucket.
+			if len(o) != 1 || o[0].Value != 1.5 {
+				t.Errorf("unexpected median %v", o)
+			}
+		case "rpc_duration_seconds_mean":
+			if len(o) != 1 || o[0].Value != 1.5 {
+				t.Errorf("unexpected mean %v", o)
+			}
+		case "rpc_duration_seconds_sum":
+			if len(o) != 2 || o[1].Value != 11 || !o[1].Counter {
+				t.Errorf("unexpected sum %v", o)
+			}
+		default:
+			t.Errorf("unexpected series %s", name)
+		}
+	}
+}
+
+func TestBucketQuantile(t *testing.T) {
+	buckets := []histogramBucket{
+		{lower: 0, upper: 1, count: 2},
+		{lower: 1, upper: 2, count: 0},
+		{lower: 2, upper: math.Inf(1), count: 2},
+	}
+	for q, expected := range map[float64]float64{0.25: 0.5, 0.5: 1, 0.9: 2} {
+		if v := bucketQuantile(q, buckets); v != expected {
+			t.Errorf("expected quantile %f to be %f but got %f", q, expected, v)
+		}
+	}
+	if !math.IsNaN(bucketQuantile(0.5, buckets[1:2])) {
+		t.Errorf("expected no quantile for a histogram without observations")
+	}
+
+	for _, series := range [][]string{{"p0"}, {"p100"}, {"median"}, {"90"}} {
+		if _, err := newHistogramDeriver(series); err == nil {
+			t.Errorf("expected an error for %v", series)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package receiver
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	prometheustranslator "github.com/prometheus/prometheus/storage/remote/otlptranslator/prometheus"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The resource attributes that Prometheus maps to the job and instance labels.
+	otlpServiceName       = "service.name"
+	otlpServiceNamespace  = "service.namespace"
+	otlpServiceInstanceID = "service.instance.id"
+)
+
+var (
+	otlpDroppedPoints = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_otlp_dropped_points_total",
+			Help: "Total number of OTLP data points that could not be converted to samples.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(otlpDroppedPoints)
+}
+
+// deltaAccumulator turns delta sums and histograms into cumulative ones, so they are
+// treated like counters that were scraped by Prometheus. It is keyed by the fingerprint
+// of the labels of the converted series.
+type deltaAccumulator struct {
+	expiryGuard
+	totals map[model.Fingerprint]*deltaTotal
+}
+
+type deltaTotal struct {
+	value    float64
+	lastSeen time.Time
+}
+
+func newDeltaAccumulator() *deltaAccumulator {
+	return &deltaAccumulator{totals: make(map[model.Fingerprint]*deltaTotal)}
+}
+
+// add adds delta to the running total of the series with labels and returns the total.
+func (d *deltaAccumulator) add(labels []prompb.Label, delta float64, now time.Time) float64 {
+	metric := make(model.Metric, len(labels))
+	for _, l := range labels {
+		metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	fp := metric.Fingerprint()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	total, exists := d.totals[fp]
+	if !exists {
+		total = &deltaTotal{}
+		d.totals[fp] = total
+	}
+	total.value += delta
+	total.lastSeen = now
+	return total.value
+}
+
+// expire forgets about the series that have not been seen since before.
+func (d *deltaAccumulator) expire(before time.Time) {
+	d.expireBefore(before, func() {
+		for fp, total := range d.totals {
+			if total.lastSeen.Before(before) {
+				delete(d.totals, fp)
+			}
+		}
+	})
+}
+
+// otlpConverter converts OTLP metrics to a remote write request with the same metric
+// names and labels that Prometheus uses when it ingests OTLP, so a timeseries gets the
+// same fingerprint no matter which way it arrives.
+type otlpConverter struct {
+	deltas *deltaAccumulator
+	now    time.Time
+	series []prompb.TimeSeries
+	// metric family name -> metadata
+	metadata map[string]prompb.MetricMetadata
+	dropped  int
+}
+
+func (c *otlpConverter) convert(md pmetric.Metrics) *prompb.WriteRequest {
+	c.metadata = make(map[string]prompb.MetricMetadata)
+	resourceMetrics := md.ResourceMetrics()
+	for i := 0; i < resourceMetrics.Len(); i++ {
+		resource := resourceMetrics.At(i).Resource()
+		scopeMetrics := resourceMetrics.At(i).ScopeMetrics()
+		for j := 0; j < scopeMetrics.Len(); j++ {
+			metrics := scopeMetrics.At(j).Metrics()
+			for k := 0; k < metrics.Len(); k++ {
+				c.convertMetric(resource, metrics.At(k))
+			}
+		}
+	}
+	req := &prompb.WriteRequest{
+		Timeseries: c.series,
+		Metadata:   make([]prompb.MetricMetadata, 0, len(c.metadata)),
+	}
+	for _, m := range c.metadata {
+		req.Metadata = append(req.Metadata, m)
+	}
+	return req
+}
+
+func (c *otlpConverter) convertMetric(resource pcommon.Resource, metric pmetric.Metric) {
+	name := prometheustranslator.BuildCompliantName(metric, "", true)
+	switch metric.Type() {
+	case pmetric.MetricTypeGauge:
+		c.addMetadata(name, prompb.MetricMetadata_GAUGE)
+		points := metric.Gauge().DataPoints()
+		for i := 0; i < points.Len(); i++ {
+			p := points.At(i)
+			c.addSample(otlpLabels(resource, p.Attributes(), name), numberValue(p), p.Timestamp(), p.Flags())
+		}
+	case pmetric.MetricTypeSum:
+		sum := metric.Sum()
+		if sum.IsMonotonic() {
+			c.addMetadata(name, prompb.MetricMetadata_COUNTER)
+		} else {
+			c.addMetadata(name, prompb.MetricMetadata_GAUGE)
+		}
+		delta := sum.AggregationTemporality() == pmetric.AggregationTemporalityDelta
+		points := sum.DataPoints()
+		for i := 0; i < points.Len(); i++ {
+			p := points.At(i)
+			labels := otlpLabels(resource, p.Attributes(), name)
+			v := numberValue(p)
+			if delta && !p.Flags().NoRecordedValue() {
+				v = c.deltas.add(labels, v, c.now)
+			}
+			c.addSample(labels, v, p.Timestamp(), p.Flags())
+		}
+	case pmetric.MetricTypeHistogram:
+		// Histograms are reduced to their count and sum.
+		c.addMetadata(name, prompb.MetricMetadata_HISTOGRAM)
+		histogram := metric.Histogram()
+		delta := histogram.AggregationTemporality() == pmetric.AggregationTemporalityDelta
+		points := histogram.DataPoints()
+		for i := 0; i < points.Len(); i++ {
+			p := points.At(i)
+			c.addSummary(resource, p.Attributes(), name, float64(p.Count()), p.Sum(), p.HasSum(),
+				delta, p.Timestamp(), p.Flags())
+		}
+	case pmetric.MetricTypeExponentialHistogram:
+		c.addMetadata(name, prompb.MetricMetadata_HISTOGRAM)
+		histogram := metric.ExponentialHistogram()
+		delta := histogram.AggregationTemporality() == pmetric.AggregationTemporalityDelta
+		points := histogram.DataPoints()
+		for i := 0; i < points.Len(); i++ {
+			p := points.At(i)
+			c.addSummary(resource, p.Attributes(), name, float64(p.Count()), p.Sum(), p.HasSum(),
+				delta, p.Timestamp(), p.Flags())
+		}
+	case pmetric.MetricTypeSummary:
+		c.addMetadata(name, prompb.MetricMetadata_SUMMARY)
+		points := metric.Summary().DataPoints()
+		for i := 0; i < points.Len(); i++ {
+			p := points.At(i)
+			c.addSummary(resource, p.Attributes(), name, float64(p.Count()), p.Sum(), true,
+				false, p.Timestamp(), p.Flags())
+			quantiles := p.QuantileValues()
+			for j := 0; j < quantiles.Len(); j++ {
+				q := quantiles.At(j)
+				labels := otlpLabels(resource, p.Attributes(), name,
+					model.QuantileLabel, strconv.FormatFloat(q.Quantile(), 'f', -1, 64))
+				c.addSample(labels, q.Value(), p.Timestamp(), p.Flags())
+			}
+		}
+	default:
+		c.dropped++
+	}
+}
+
+// addSummary adds the _count and _sum series of a histogram or summary data point.
+func (c *otlpConverter) addSummary(resource pcommon.Resource, attributes pcommon.Map, name string,
+	count float64, sum float64, hasSum bool, delta bool, timestamp pcommon.Timestamp, flags pmetric.DataPointFlags) {
+	countLabels := otlpLabels(resource, attributes, name+"_count")
+	sumLabels := otlpLabels(resource, attributes, name+"_sum")
+	if delta && !flags.NoRecordedValue() {
+		count = c.deltas.add(countLabels, count, c.now)
+		if hasSum {
+			sum = c.deltas.add(sumLabels, sum, c.now)
+		}
+	}
+	c.addSample(countLabels, count, timestamp, flags)
+	if hasSum {
+		c.addSample(sumLabels, sum, timestamp, flags)
+	}
+}
+
+func (c *otlpConverter) addSample(labels []prompb.Label, v float64, timestamp pcommon.Timestamp,
+	flags pmetric.DataPointFlags) {
+	if timestamp == 0 {
+		c.dropped++
+		return
+	}
+	if flags.NoRecordedValue() {
+		v = math.Float64frombits(value.StaleNaN)
+	}
+	c.series = append(c.series, prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Value: v, Timestamp: timestamp.AsTime().UnixMilli()}},
+	})
+}
+
+func (c *otlpConverter) addMetadata(name string, metricType prompb.MetricMetadata_MetricType) {
+	c.metadata[name] = prompb.MetricMetadata{MetricFamilyName: name, Type: metricType}
+}
+
+func numberValue(p pmetric.NumberDataPoint) float64 {
+	if p.ValueType() == pmetric.NumberDataPointValueTypeInt {
+		return float64(p.IntValue())
+	}
+	return p.DoubleValue()
+}
+
+// otlpLabels returns the labels of a series the way Prometheus builds them from OTLP:
+// attribute names are sanitized, attributes whose names collide after sanitizing are
+// joined with ';', and service.name, service.namespace and service.instance.id become
+// the job and instance labels. extras are pairs of label names and values.
+func otlpLabels(resource pcommon.Resource, attributes pcommon.Map, name string, extras ...string) []prompb.Label {
+	keys := make([]string, 0, attributes.Len())
+	attributes.Range(func(key string, _ pcommon.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Strings(keys)
+	l := make(map[string]string, len(keys)+3+len(extras)/2)
+	for _, key := range keys {
+		v, _ := attributes.Get(key)
+		normalized := prometheustranslator.NormalizeLabel(key)
+		if existing, exists := l[normalized]; exists {
+			l[normalized] = existing + ";" + v.AsString()
+		} else {
+			l[normalized] = v.AsString()
+		}
+	}
+	if serviceName, ok := resource.Attributes().Get(otlpServiceName); ok {
+		job := serviceName.AsString()
+		if namespace, ok := resource.Attributes().Get(otlpServiceNamespace); ok {
+			job = fmt.Sprintf("%s/%s", namespace.AsString(), job)
+		}
+		l[model.JobLabel] = job
+	}
+	if instance, ok := resource.Attributes().Get(otlpServiceInstanceID); ok {
+		l[model.InstanceLabel] = instance.AsString()
+	}
+	for i := 0; i+1 < len(extras); i += 2 {
+		l[extras[i]] = extras[i+1]
+	}
+	l[model.MetricNameLabel] = name
+
+	labels := make([]prompb.Label, 0, len(l))
+	for k, v := range l {
+		labels = append(labels, prompb.Label{Name: k, Value: v})
+	}
+	return labels
+}
+
+// decodeOTLPRequest reads an OTLP export request in protobuf or json, depending on the content type.
+func decodeOTLPRequest(r *http.Request) (pmetricotlp.ExportRequest, int, error) {
+	req := pmetricotlp.NewExportRequest()
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return req, http.StatusUnsupportedMediaType, fmt.Errorf("invalid content type: %v", err)
+	}
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return req, http.StatusBadRequest, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return req, http.StatusBadRequest, err
+	}
+	switch contentType {
+	case "application/x-protobuf":
+		err = req.UnmarshalProto(data)
+	case "application/json":
+		err = req.UnmarshalJSON(data)
+	default:
+		return req, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %s", contentType)
+	}
+	if err != nil {
+		return req, http.StatusBadRequest, err
+	}
+	return req, http.StatusOK, nil
+}
+
+// ReceiveOTLPData accepts OTLP/HTTP metric export requests.
+func (t *tsProcessor) ReceiveOTLPData(w http.ResponseWriter, r *http.Request) {
+	if t.rejectDuringBackfill(w) {
+		return
+	}
+	req, status, err := decodeOTLPRequest(r)
+	if err != nil {
+		log.Printf("failed to decode otlp request: %v\n", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	now := time.Now()
+	converter := &otlpConverter{deltas: t.deltas, now: now}
+	writeRequest := converter.convert(req.Metrics())
+	if converter.dropped > 0 {
+		otlpDroppedPoints.Add(float64(converter.dropped))
+	}
+	if _, _, err = t.observeTs(writeRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Forget about delta series that have been gone for a whole window.
+	t.deltas.expire(now.Add(-t.windowDuration()))
+
+	resp := pmetricotlp.NewExportResponse()
+	if converter.dropped > 0 {
+		resp.PartialSuccess().SetRejectedDataPoints(int64(converter.dropped))
+	}
+	var data []byte
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		data, err = resp.MarshalJSON()
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		data, err = resp.MarshalProto()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,210 @@
+package receiver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	corrjoin "github.com/kpaschen/corrjoin/lib"
+	"github.com/kpaschen/corrjoin/lib/settings"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestProcessor() *tsProcessor {
+	return &tsProcessor{
+		settings: &settings.CorrjoinSettings{
+			WindowSize:     20,
+			SampleInterval: 20,
+			RateCounters:   true,
+		},
+		observationQueue: make(chan *corrjoin.Observation, 100),
+		counters:         newCounterDetector(),
+		deltas:           newDeltaAccumulator(),
+	}
+}
+
+// drainObservations returns the queued observations keyed by metric name.
+func drainObservations(t *tsProcessor) map[string][]*corrjoin.Observation {
+	ret := make(map[string][]*corrjoin.Observation)
+	for {
+		select {
+		case o := <-t.observationQueue:
+			ret[o.MetricName] = append(ret[o.MetricName], o)
+		default:
+			return ret
+		}
+	}
+}
+
+func testMetrics(timestamp time.Time, requests int64) pmetric.Metrics {
+	md := pmetric.NewMetrics()
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "api")
+	rm.Resource().Attributes().PutStr("service.namespace", "shop")
+	rm.Resource().Attributes().PutStr("service.instance.id", "web-1")
+	metrics := rm.ScopeMetrics().AppendEmpty().Metrics()
+	ts := pcommon.NewTimestampFromTime(timestamp)
+
+	gauge := metrics.AppendEmpty()
+	gauge.SetName("memory.usage")
+	gauge.SetUnit("By")
+	p := gauge.SetEmptyGauge().DataPoints().AppendEmpty()
+	p.SetTimestamp(ts)
+	p.SetDoubleValue(1024)
+	p.Attributes().PutStr("host.name", "a")
+
+	sum := metrics.AppendEmpty()
+	sum.SetName("http.requests")
+	sum.SetEmptySum().SetIsMonotonic(true)
+	sum.Sum().SetAggregationTemporality(pmetric.AggregationTemporalityDelta)
+	p = sum.Sum().DataPoints().AppendEmpty()
+	p.SetTimestamp(ts)
+	p.SetIntValue(requests)
+
+	histogram := metrics.AppendEmpty()
+	histogram.SetName("http.duration")
+	histogram.SetUnit("s")
+	histogram.SetEmptyHistogram().SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	h := histogram.Histogram().DataPoints().AppendEmpty()
+	h.SetTimestamp(ts)
+	h.SetCount(10)
+	h.SetSum(2.5)
+	h.ExplicitBounds().FromRaw([]float64{0.1, 1})
+	h.BucketCounts().FromRaw([]uint64{5, 4, 1})
+	return md
+}
+
+func postOTLP(t *testing.T, processor *tsProcessor, md pmetric.Metrics, asJSON bool, compress bool) *httptest.ResponseRecorder {
+	req := pmetricotlp.NewExportRequestFromMetrics(md)
+	var body []byte
+	var err error
+	contentType := "application/x-protobuf"
+	if asJSON {
+		body, err = req.MarshalJSON()
+		contentType = "application/json"
+	} else {
+		body, err = req.MarshalProto()
+	}
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+	if compress {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+		body = buf.Bytes()
+	}
+	r := httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	if compress {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+	w := httptest.NewRecorder()
+	processor.ReceiveOTLPData(w, r)
+	return w
+}
+
+func TestReceiveOTLPData(t *testing.T) {
+	processor := newTestProcessor()
+	now := time.Now().Truncate(time.Second)
+	w := postOTLP(t, processor, testMetrics(now, 3), false, true)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-protobuf" {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	w = postOTLP(t, processor, testMetrics(now.Add(20*time.Second), 4), true, false)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	observations := drainObservations(processor)
+	if len(observations) != 4 {
+		t.Fatalf("expected a gauge, a sum and the count and sum of a histogram but got %v", observations)
+	}
+	// The gauge has the labels that Prometheus gives it.
+	gauge := model.Metric{
+		"__name__":  "memory_usage_bytes",
+		"host_name": "a",
+		"job":       "shop/api",
+		"instance":  "web-1",
+	}
+	var gaugeObservations []*corrjoin.Observation
+	for _, o := range observations {
+		if o[0].MetricFingerprint == uint64(gauge.Fingerprint()) {
+			gaugeObservations = o
+		}
+	}
+	if len(gaugeObservations) != 2 || gaugeObservations[0].Value != 1024 || gaugeObservations[0].Counter {
+		t.Fatalf("expected two samples with the fingerprint of %v but got %v", gauge, gaugeObservations)
+	}
+	if !gaugeObservations[0].Timestamp.Equal(now) {
+		t.Errorf("expected the sample at %v but got %v", now, gaugeObservations[0].Timestamp)
+	}
+
+	for name, o := range observations {
+		metric := metricFromName(t, name)
+		switch metric[model.MetricNameLabel] {
+		case "http_requests_total":
+			// The deltas add up.
+			if o[0].Value != 3 || o[1].Value != 7 || !o[0].Counter {
+				t.Errorf("expected the running total of the deltas as a counter but got %v, %v", *o[0], *o[1])
+			}
+		case "http_duration_seconds_count":
+			if o[0].Value != 10 || !o[0].Counter {
+				t.Errorf("unexpected histogram count %v", *o[0])
+			}
+		case "http_duration_seconds_sum":
+			if o[0].Value != 2.5 {
+				t.Errorf("unexpected histogram sum %v", *o[0])
+			}
+		case "memory_usage_bytes":
+		default:
+			t.Errorf("unexpected series %s", name)
+		}
+	}
+}
+
+func TestReceiveOTLPDataErrors(t *testing.T) {
+	processor := newTestProcessor()
+	r := httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader([]byte("{}")))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	processor.ReceiveOTLPData(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected unsupported media type but got %d", w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader([]byte("not protobuf")))
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	w = httptest.NewRecorder()
+	processor.ReceiveOTLPData(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request but got %d", w.Code)
+	}
+
+	// A point without a recorded value becomes a stale marker.
+	md := testMetrics(time.Now(), 1)
+	md.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).Gauge().DataPoints().At(0).SetFlags(
+		pmetric.DefaultDataPointFlags.WithNoRecordedValue(true))
+	postOTLP(t, processor, md, false, false)
+	for name, o := range drainObservations(processor) {
+		if metricFromName(t, name)[model.MetricNameLabel] == "memory_usage_bytes" && !math.IsNaN(o[0].Value) {
+			t.Errorf("expected a stale marker but got %f", o[0].Value)
+		}
+	}
+}
+
+func metricFromName(t *testing.T, name string) model.Metric {
+	var metric model.Metric
+	if err := json.Unmarshal([]byte(name), &metric); err != nil {
+		t.Fatalf("failed to unmarshal %s: %v", name, err)
+	}
+	return metric
+}
@@ -2,17 +2,24 @@ package receiver
 
 import (
 	"encoding/json"
+	"fmt"
 	corrjoin "github.com/kpaschen/corrjoin/lib"
 	"github.com/kpaschen/corrjoin/lib/comparisons"
 	"github.com/kpaschen/corrjoin/lib/datatypes"
+	"github.com/kpaschen/corrjoin/lib/notifier"
+	"github.com/kpaschen/corrjoin/lib/preprocess"
 	"github.com/kpaschen/corrjoin/lib/reporter"
 	"github.com/kpaschen/corrjoin/lib/settings"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/prometheus/prometheus/storage/remote"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +30,12 @@ var (
 			Help: "Total number of received samples.",
 		},
 	)
+	skippedInfoSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_skipped_info_samples_total",
+			Help: "Total number of received samples of info metrics, which are not correlated.",
+		},
+	)
 	requestedCorrelationBatches = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "corrjoin_requested_correlation_batches_total",
@@ -41,6 +54,24 @@ var (
 			Help: "number of constant timeseries",
 		},
 	)
+	compactedTimeseries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_compacted_timeseries_total",
+			Help: "Total number of timeseries rows dropped because they had no samples for a whole window.",
+		},
+	)
+	counterResets = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "corrjoin_counter_resets_total",
+			Help: "Total number of counter resets seen while converting counters to rates.",
+		},
+	)
+	maskedTimeseries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "corrjoin_masked_timeseries",
+			Help: "number of timeseries that ended (got a stale marker) and are masked in the latest stride",
+		},
+	)
 	correlationDurationHist = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:                            "correlation_duration_milliseconds_histogram",
@@ -65,16 +96,29 @@ var (
 			Help: "Number of times a correlation stride computation has overrun",
 		},
 	)
+
+	correlationChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "corrjoin_correlation_changes_total",
+			Help: "Total number of correlations that appeared, disappeared or changed in strength between strides.",
+		},
+		[]string{"kind"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(receivedSamples)
+	prometheus.MustRegister(skippedInfoSamples)
 	prometheus.MustRegister(requestedCorrelationBatches)
 	prometheus.MustRegister(correlationDurationHist)
 	prometheus.MustRegister(correlationDuration)
 	prometheus.MustRegister(strideOverruns)
 	prometheus.MustRegister(numberOfTimeseries)
 	prometheus.MustRegister(constantTimeseries)
+	prometheus.MustRegister(maskedTimeseries)
+	prometheus.MustRegister(compactedTimeseries)
+	prometheus.MustRegister(counterResets)
+	prometheus.MustRegister(correlationChanges)
 }
 
 type tsProcessor struct {
@@ -88,62 +132,216 @@ type tsProcessor struct {
 	requestProcessingStartTimes map[int]time.Time
 	strideStartTimes            map[int]time.Time
 	reporter                    *reporter.ParquetReporter
+	// Only set if settings.DetectChanges is true.
+	changes *reporter.ChangeReporter
+	// Only set if settings.NotifierURL is set.
+	notifier *notifier.Notifier
+
+	// The timeseries ids for every stride that is being computed. Row ids
+	// change when the accumulator compacts its rows, so the reporter has to use
+	// the ids that were current when the stride was shifted into the window.
+	strideTsids     map[int][]corrjoin.TsId
+	strideTsidsLock sync.Mutex
+
+	counters *counterDetector
+	// Only used from the goroutine that feeds the accumulator.
+	rates *corrjoin.RateConverter
+	// The running totals of OTLP delta sums and histograms.
+	deltas *deltaAccumulator
+	// Only set if settings.HistogramSeries is not empty.
+	histograms *histogramDeriver
+	// Only set if there are relabel configs or a cardinality cap.
+	selector *seriesSelector
+
+	// Set while the samples of the last window are read from the query API.
+	backfilling atomic.Bool
+	// The start times to move the accumulator to after a failed backfill.
+	reanchorRequests chan time.Time
+
+	// The number of observation results that have been handed to the window.
+	consumedStrides    atomic.Int64
+	checkpointRequests chan (chan error)
+}
+
+// windowDuration returns the time that a window of samples covers.
+func (t *tsProcessor) windowDuration() time.Duration {
+	return time.Duration(t.settings.WindowSize*t.settings.SampleInterval) * time.Second
+}
+
+func (t *tsProcessor) tsidsForStride(stride int) []corrjoin.TsId {
+	t.strideTsidsLock.Lock()
+	defer t.strideTsidsLock.Unlock()
+	return t.strideTsids[stride]
 }
 
-func (t *tsProcessor) observeTs(req *prompb.WriteRequest) error {
+func (t *tsProcessor) setTsidsForStride(stride int, tsids []corrjoin.TsId) {
+	t.strideTsidsLock.Lock()
+	defer t.strideTsidsLock.Unlock()
+	if tsids == nil {
+		delete(t.strideTsids, stride)
+	} else {
+		t.strideTsids[stride] = tsids
+	}
+}
+
+// observeTs queues the samples in req as observations. It returns how many samples and
+// native histograms it took.
+func (t *tsProcessor) observeTs(req *prompb.WriteRequest) (int, int, error) {
+	t.counters.observeMetadata(req.Metadata)
+	now := time.Now()
+	written := 0
+	histograms := 0
 	for _, ts := range req.Timeseries {
 		metric := make(model.Metric, len(ts.Labels))
 		for _, l := range ts.Labels {
 			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
 		}
-		mjson, err := json.Marshal(metric)
-		if err != nil {
-			return err
+		if t.selector != nil {
+			metric = t.selector.selectSeries(metric, len(ts.Samples)+len(ts.Histograms), now)
+			if metric == nil {
+				continue
+			}
+		}
+		name := string(metric[model.MetricNameLabel])
+		// Info metrics are constant and only carry labels.
+		if t.counters.isInfo(name) {
+			skippedInfoSamples.Add(float64(len(ts.Samples)))
+			continue
 		}
-		metricName := string(mjson)
-		sampleCounter := 0
-		for _, s := range ts.Samples {
-			t.observationQueue <- &corrjoin.Observation{
-				MetricFingerprint: (uint64)(metric.Fingerprint()),
-				MetricName:        metricName,
-				Value:             s.Value,
-				Timestamp:         time.Unix(s.Timestamp/1000, 0).UTC(),
+		written += len(ts.Samples)
+		passThrough := true
+		if t.histograms != nil {
+			histograms += len(ts.Histograms)
+			var derived []derivedSample
+			derived, passThrough = t.deriveHistograms(metric, ts, now)
+			for _, d := range derived {
+				err := t.queueSamples(d.metric, []prompb.Sample{d.sample}, t.settings.RateCounters && d.counter)
+				if err != nil {
+					return written, histograms, err
+				}
+			}
+		}
+		if passThrough {
+			isCounter := t.settings.RateCounters && t.counters.isCounter(name)
+			if err := t.queueSamples(metric, ts.Samples, isCounter); err != nil {
+				return written, histograms, err
 			}
-			sampleCounter++
 		}
-		receivedSamples.Add(float64(sampleCounter))
 	}
+	// Forget about histograms and series that have been gone for a whole window.
+	if t.histograms != nil {
+		t.histograms.expire(now.Add(-t.windowDuration()))
+	}
+	if t.selector != nil {
+		t.selector.expire(now.Add(-t.windowDuration()))
+	}
+	return written, histograms, nil
+}
+
+func (t *tsProcessor) queueSamples(metric model.Metric, samples []prompb.Sample, isCounter bool) error {
+	mjson, err := json.Marshal(metric)
+	if err != nil {
+		return err
+	}
+	metricName := string(mjson)
+	fingerprint := (uint64)(metric.Fingerprint())
+	for _, s := range samples {
+		t.observationQueue <- &corrjoin.Observation{
+			MetricFingerprint: fingerprint,
+			MetricName:        metricName,
+			Value:             s.Value,
+			Timestamp:         time.Unix(s.Timestamp/1000, 0).UTC(),
+			Counter:           isCounter,
+		}
+	}
+	receivedSamples.Add(float64(len(samples)))
 	return nil
 }
 
+// addObservation converts counters to rates and hands the observation to the accumulator.
+// It must only be called from the goroutine that owns the accumulator.
+func (t *tsProcessor) addObservation(observation *corrjoin.Observation) {
+	resets := t.rates.Resets
+	observation = t.rates.Convert(observation)
+	counterResets.Add(float64(t.rates.Resets - resets))
+	if observation == nil {
+		return
+	}
+	published := t.accumulator.PublishedStrides
+	t.accumulator.AddObservation(observation)
+	if t.accumulator.PublishedStrides > published {
+		// Forget about counters that have been gone for a whole window.
+		t.rates.Expire(observation.Timestamp.Add(-t.windowDuration()))
+	}
+}
+
+// ReceivePrometheusData accepts remote write 1.0 and 2.0 requests.
 func (t *tsProcessor) ReceivePrometheusData(w http.ResponseWriter, r *http.Request) {
-	req, err := remote.DecodeWriteRequest(r.Body)
+	if t.rejectDuringBackfill(w) {
+		return
+	}
+	message, err := remoteWriteMessage(r)
 	if err != nil {
-		log.Printf("failed to decode write request: %v\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("rejecting write request: %v\n", err)
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
 		return
 	}
 
-	// TODO: either this or the accumulator need to evaluate the stale marker.
-	// That is a special NaN value 0x7ff0000000000002
+	var req *prompb.WriteRequest
+	if message == remoteWriteV2Message {
+		var v2 *writeV2Request
+		v2, err = decodeWriteV2Request(r.Body)
+		if err == nil {
+			req, err = v2.toWriteRequest()
+		}
+		if err != nil {
+			log.Printf("failed to decode write request: %v\n", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		req, err = remote.DecodeWriteRequest(r.Body)
+		if err != nil {
+			log.Printf("failed to decode write request: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
-	// For now, convert samples directly and add them as observations
-	err = t.observeTs(req)
+	// Convert samples directly and add them as observations.
+	// Stale markers are passed through as-is, the accumulator evaluates them.
+	written, histograms, err := t.observeTs(req)
+	w.Header().Set(samplesWrittenHeader, strconv.Itoa(written))
+	w.Header().Set(histogramsWrittenHeader, strconv.Itoa(histograms))
+	// Exemplars are not used.
+	w.Header().Set(exemplarsWrittenHeader, "0")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	if message == remoteWriteV2Message {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
 }
 
 func (t *tsProcessor) Shutdown() error {
+	if t.settings.CheckpointInterval > 0 {
+		if err := t.requestCheckpoint(30 * time.Second); err != nil {
+			log.Printf("failed to write checkpoint on shutdown: %v\n", err)
+		}
+	}
+	if t.notifier != nil {
+		t.notifier.Close()
+	}
 	if t.reporter != nil {
 		return t.reporter.Flush(-1) // Flush all writers
 	}
 	return nil
 }
 
-func NewTsProcessor(corrjoinConfig settings.CorrjoinSettings) *tsProcessor {
+func NewTsProcessor(corrjoinConfig settings.CorrjoinSettings) (*tsProcessor, error) {
 
 	// The observation queue is how we hand timeseries data to the accumulator.
 	observationQueue := make(chan *corrjoin.Observation, 1)
@@ -155,12 +353,27 @@ func NewTsProcessor(corrjoinConfig settings.CorrjoinSettings) *tsProcessor {
 	// The results channel is where we hear about correlated timeseries.
 	resultsChannel := make(chan *datatypes.CorrjoinResult, 1)
 
-	comparer := &comparisons.InProcessComparer{}
-	comparer.Initialize(corrjoinConfig, resultsChannel)
+	comparer, err := comparisons.NewEngine(corrjoinConfig, resultsChannel)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows that have had no samples for a whole window get retired.
+	stridesPerWindow := corrjoinConfig.WindowSize / corrjoinConfig.StrideLength
+
+	// With a backfill, the accumulator starts a window before now, so the first window is
+	// full as soon as the backfill is done.
+	strideDuration := time.Duration(corrjoinConfig.StrideLength*corrjoinConfig.SampleInterval) * time.Second
+	backfillEnd := time.Now().UTC().Truncate(time.Duration(corrjoinConfig.SampleInterval) * time.Second)
+	accumulatorStart := time.Now().UTC()
+	if corrjoinConfig.BackfillURL != "" {
+		accumulatorStart = backfillEnd.Add(-time.Duration(stridesPerWindow) * strideDuration)
+	}
 
 	processor := &tsProcessor{
 		accumulator: corrjoin.NewTimeseriesAccumulator(corrjoinConfig.StrideLength,
-			time.Now().UTC(), corrjoinConfig.SampleInterval, corrjoinConfig.MaxRows, bufferChannel),
+			accumulatorStart, corrjoinConfig.SampleInterval, corrjoinConfig.MaxRows,
+			stridesPerWindow, bufferChannel),
 		settings:                    &corrjoinConfig,
 		observationQueue:            observationQueue,
 		window:                      corrjoin.NewTimeseriesWindow(corrjoinConfig, comparer),
@@ -169,16 +382,73 @@ func NewTsProcessor(corrjoinConfig settings.CorrjoinSettings) *tsProcessor {
 		comparer:                    comparer,
 		strideStartTimes:            make(map[int]time.Time),
 		requestProcessingStartTimes: make(map[int]time.Time),
+		strideTsids:                 make(map[int][]corrjoin.TsId),
+		checkpointRequests:          make(chan chan error),
+		reanchorRequests:            make(chan time.Time),
+		counters:                    newCounterDetector(),
+		rates:                       corrjoin.NewRateConverter(),
+		deltas:                      newDeltaAccumulator(),
 		reporter: reporter.NewParquetReporter(
 			corrjoinConfig.ResultsDirectory, corrjoinConfig.MaxRowsPerRowGroup),
 	}
+	processor.histograms, err = newHistogramDeriver(corrjoinConfig.HistogramSeries)
+	if err != nil {
+		return nil, err
+	}
+	if corrjoinConfig.RelabelConfigFile != "" || corrjoinConfig.MaxSeriesPerJob > 0 {
+		var configs []*relabel.Config
+		if corrjoinConfig.RelabelConfigFile != "" {
+			configs, err = LoadRelabelConfigs(corrjoinConfig.RelabelConfigFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		processor.selector = newSeriesSelector(configs, corrjoinConfig.MaxSeriesPerJob)
+	}
+	processor.reporter.SetFileMetadata(reporter.METADATA_PREPROCESSING, preprocess.Describe(corrjoinConfig))
+	if corrjoinConfig.DetectChanges {
+		processor.changes = reporter.NewChangeReporter(corrjoinConfig.ResultsDirectory,
+			corrjoinConfig.ChangeThreshold)
+	}
+	if corrjoinConfig.NotifierURL != "" {
+		rules, err := notifier.LoadRules(corrjoinConfig.NotifierRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		processor.notifier, err = notifier.NewNotifier(corrjoinConfig.NotifierURL, rules)
+		if err != nil {
+			return nil, err
+		}
+		if processor.notifier.NeedsChanges() && processor.changes == nil {
+			processor.notifier.Close()
+			return nil, fmt.Errorf("the rules for new and lost correlates need change detection")
+		}
+	}
+
+	var checkpointTicker <-chan time.Time
+	if corrjoinConfig.CheckpointInterval > 0 {
+		err := processor.restoreCheckpoint()
+		if err != nil {
+			log.Printf("failed to restore checkpoint: %v\n", err)
+		}
+		checkpointTicker = time.NewTicker(time.Duration(corrjoinConfig.CheckpointInterval) * time.Second).C
+	}
 
 	go func() {
 		log.Println("watching observation queue")
 		for {
 			select {
 			case observation := <-observationQueue:
-				processor.accumulator.AddObservation(observation)
+				processor.addObservation(observation)
+			case <-checkpointTicker:
+				err := processor.checkpoint()
+				if err != nil {
+					log.Printf("skipping checkpoint: %v\n", err)
+				}
+			case reply := <-processor.checkpointRequests:
+				reply <- processor.checkpoint()
+			case start := <-processor.reanchorRequests:
+				processor.accumulator.Reanchor(start)
 			}
 		}
 	}()
@@ -215,9 +485,22 @@ func NewTsProcessor(corrjoinConfig settings.CorrjoinSettings) *tsProcessor {
 
 						// This creates the output file for an entire window, not just for the stride.
 						processor.reporter.InitializeStride(stride, windowStart, windowEnd)
+						if processor.changes != nil {
+							processor.changes.InitializeStride(stride, windowStart, windowEnd)
+						}
+					}
+
+					masked := 0
+					for _, m := range observationResult.MaskedRows {
+						if m {
+							masked++
+						}
 					}
+					maskedTimeseries.Set(float64(masked))
 
-					err, willRunComputation := processor.window.ShiftBuffer(observationResult.Buffers)
+					// Results for this stride can arrive as soon as the computation starts.
+					processor.setTsidsForStride(stride, observationResult.Tsids)
+					err, willRunComputation := processor.window.ShiftObservations(observationResult)
 
 					if err != nil {
 						// TODO: if window is busy, hold the observationResult
@@ -229,11 +512,24 @@ func NewTsProcessor(corrjoinConfig settings.CorrjoinSettings) *tsProcessor {
 							log.Printf("failed to process window: %v", err)
 						}
 					}
+					if observationResult.RowMapping != nil {
+						dropped := 0
+						for _, m := range observationResult.RowMapping {
+							if m < 0 {
+								dropped++
+							}
+						}
+						compactedTimeseries.Add(float64(dropped))
+					}
+					if err != nil || !willRunComputation {
+						processor.setTsidsForStride(stride, nil)
+					}
 					if err == nil && willRunComputation {
 						processor.requestProcessingStartTimes[stride] = requestStart
 						log.Printf("started processing stride %d\n", processor.window.StrideCounter)
 					}
 				}
+				processor.consumedStrides.Add(1)
 			case <-time.After(10 * time.Minute):
 				log.Printf("got no stride data for 10 minutes")
 			}
@@ -260,9 +556,10 @@ func NewTsProcessor(corrjoinConfig settings.CorrjoinSettings) *tsProcessor {
 						log.Printf("correlation batch processed in %d milliseconds\n", elapsed.Milliseconds())
 					}
 					stride := correlationResult.StrideCounter
-					processor.reporter.RecordTimeseriesIds(stride, processor.accumulator.Tsids)
-					numberOfTimeseries.Set(float64(len(processor.accumulator.Tsids)))
-					constant, err := processor.reporter.AddConstantRows(stride, processor.window.ConstantRows, processor.accumulator.Tsids)
+					tsids := processor.tsidsForStride(stride)
+					processor.reporter.RecordTimeseriesIds(stride, tsids)
+					numberOfTimeseries.Set(float64(len(tsids)))
+					constant, err := processor.reporter.AddConstantRows(stride, processor.window.ConstantRows, tsids)
 					if err != nil {
 						log.Printf("failed to record constant rows: %v\n", err)
 					} else {
@@ -272,16 +569,49 @@ func NewTsProcessor(corrjoinConfig settings.CorrjoinSettings) *tsProcessor {
 					if err != nil {
 						log.Printf("failed to flush results writer: %e\n", err)
 					}
+					var events []reporter.ChangeEvent
+					if processor.changes != nil {
+						events, err = processor.changes.Flush(stride, tsids)
+						if err != nil {
+							log.Printf("failed to record correlation changes: %v\n", err)
+						}
+						for _, e := range events {
+							correlationChanges.WithLabelValues(e.Kind).Inc()
+						}
+					}
+					if processor.notifier != nil {
+						processor.notifier.Flush(stride, tsids, events)
+					}
+					processor.setTsidsForStride(stride, nil)
 					log.Printf("finished recording data for stride %d\n", stride)
 				} else {
-					err := processor.reporter.AddCorrelatedPairs(*correlationResult, processor.accumulator.Tsids)
+					err := processor.reporter.AddCorrelatedPairs(*correlationResult,
+						processor.tsidsForStride(correlationResult.StrideCounter))
 					if err != nil {
 						log.Printf("failed to log results: %v\n", err)
 					}
+					if processor.changes != nil {
+						err = processor.changes.AddCorrelatedPairs(*correlationResult,
+							processor.tsidsForStride(correlationResult.StrideCounter))
+						if err != nil {
+							log.Printf("failed to track correlation changes: %v\n", err)
+						}
+					}
+					if processor.notifier != nil {
+						processor.notifier.AddCorrelatedPairs(*correlationResult)
+					}
 				}
 			}
 		}
 	}()
 
-	return processor
+	// A restored checkpoint already has the data of the last window.
+	if corrjoinConfig.BackfillURL != "" && processor.window.StrideCounter == 0 {
+		processor.backfilling.Store(true)
+		b := newBackfiller(corrjoinConfig.BackfillURL, corrjoinConfig.BackfillMatchers,
+			corrjoinConfig.BackfillSeriesPerQuery, corrjoinConfig.SampleInterval)
+		go processor.runBackfill(b, accumulatorStart, backfillEnd, strideDuration)
+	}
+
+	return processor, nil
 }
@@ -0,0 +1,265 @@
+package receiver
+
+import (
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	// The protobuf messages that remote write requests can carry, as named in the
+	// proto parameter of the content type.
+	remoteWriteV1Message = "prometheus.WriteRequest"
+	remoteWriteV2Message = "io.prometheus.write.v2.Request"
+
+	// The headers a remote write 2.0 receiver reports what it has written in.
+	samplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	exemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// remoteWriteMessage returns the protobuf message of a remote write request based on
+// its headers. Requests without a content type are from 1.0 senders.
+func remoteWriteMessage(r *http.Request) (string, error) {
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "snappy" {
+		return "", fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return remoteWriteV1Message, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("invalid content type: %v", err)
+	}
+	if mediaType != "application/x-protobuf" {
+		return "", fmt.Errorf("unsupported content type %s", mediaType)
+	}
+	switch params["proto"] {
+	case "", remoteWriteV1Message:
+		return remoteWriteV1Message, nil
+	case remoteWriteV2Message:
+		return remoteWriteV2Message, nil
+	default:
+		return "", fmt.Errorf("unsupported remote write message %s", params["proto"])
+	}
+}
+
+// writeV2Request holds the parts of a remote write 2.0 request that corrjoin uses.
+// Exemplars are skipped while decoding.
+type writeV2Request struct {
+	symbols    []string
+	timeseries []writeV2TimeSeries
+}
+
+type writeV2TimeSeries struct {
+	// Pairs of indices into the symbols for the label names and values.
+	labelsRefs []uint32
+	samples    []prompb.Sample
+	// The 2.0 histograms have the same fields as the 1.0 ones, plus the bounds of
+	// custom buckets which are not supported.
+	histograms []prompb.Histogram
+	// The 2.0 metric types have the same values as the 1.0 ones.
+	metricType prompb.MetricMetadata_MetricType
+}
+
+// decodeWriteV2Request reads a snappy compressed remote write 2.0 request.
+func decodeWriteV2Request(r io.Reader) (*writeV2Request, error) {
+	compressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	req := &writeV2Request{}
+	err = parseMessage(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		if typ != protowire.BytesType || (num != 4 && num != 5) {
+			return 0, nil
+		}
+		v, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return n, nil
+		}
+		if num == 4 {
+			req.symbols = append(req.symbols, string(v))
+			return n, nil
+		}
+		ts, err := parseWriteV2TimeSeries(v)
+		if err != nil {
+			return n, err
+		}
+		req.timeseries = append(req.timeseries, ts)
+		return n, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// parseMessage calls field for every field of the protobuf message in data. field returns
+// the number of bytes of the field value that it consumed, or 0 to skip the field.
+func parseMessage(data []byte, field func(num protowire.Number, typ protowire.Type, data []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		n, err := field(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func parseWriteV2TimeSeries(data []byte) (writeV2TimeSeries, error) {
+	ts := writeV2TimeSeries{}
+	err := parseMessage(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			// Packed label references.
+			v, n := protowire.ConsumeBytes(data)
+			for len(v) > 0 {
+				ref, m := protowire.ConsumeVarint(v)
+				if m < 0 {
+					return m, nil
+				}
+				ts.labelsRefs = append(ts.labelsRefs, uint32(ref))
+				v = v[m:]
+			}
+			return n, nil
+		case num == 1 && typ == protowire.VarintType:
+			ref, n := protowire.ConsumeVarint(data)
+			ts.labelsRefs = append(ts.labelsRefs, uint32(ref))
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return n, nil
+			}
+			sample, err := parseWriteV2Sample(v)
+			ts.samples = append(ts.samples, sample)
+			return n, err
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return n, nil
+			}
+			var h prompb.Histogram
+			err := h.Unmarshal(v)
+			ts.histograms = append(ts.histograms, h)
+			return n, err
+		case num == 5 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return n, nil
+			}
+			return n, parseMessage(v, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+				if num != 1 || typ != protowire.VarintType {
+					return 0, nil
+				}
+				t, n := protowire.ConsumeVarint(data)
+				ts.metricType = prompb.MetricMetadata_MetricType(t)
+				return n, nil
+			})
+		}
+		return 0, nil
+	})
+	return ts, err
+}
+
+func parseWriteV2Sample(data []byte) (prompb.Sample, error) {
+	sample := prompb.Sample{}
+	err := parseMessage(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			sample.Value = math.Float64frombits(v)
+			return n, nil
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			sample.Timestamp = int64(v)
+			return n, nil
+		}
+		return 0, nil
+	})
+	return sample, err
+}
+
+// toWriteRequest resolves the label references of r and turns the metric types of its
+// timeseries into 1.0 metadata.
+func (r *writeV2Request) toWriteRequest() (*prompb.WriteRequest, error) {
+	req := &prompb.WriteRequest{
+		Timeseries: make([]prompb.TimeSeries, 0, len(r.timeseries)),
+	}
+	families := make(map[string]bool)
+	for _, ts := range r.timeseries {
+		if len(ts.labelsRefs)%2 != 0 {
+			return nil, fmt.Errorf("odd number of label references %d", len(ts.labelsRefs))
+		}
+		labels := make([]prompb.Label, 0, len(ts.labelsRefs)/2)
+		name := ""
+		for i := 0; i < len(ts.labelsRefs); i += 2 {
+			nameRef, valueRef := ts.labelsRefs[i], ts.labelsRefs[i+1]
+			if int(nameRef) >= len(r.symbols) || int(valueRef) >= len(r.symbols) {
+				return nil, fmt.Errorf("label reference out of range for %d symbols", len(r.symbols))
+			}
+			l := prompb.Label{Name: r.symbols[nameRef], Value: r.symbols[valueRef]}
+			if l.Name == "__name__" {
+				name = l.Value
+			}
+			labels = append(labels, l)
+		}
+		if ts.metricType != prompb.MetricMetadata_UNKNOWN && name != "" {
+			family := metricFamilyName(name, ts.metricType)
+			if !families[family] {
+				families[family] = true
+				req.Metadata = append(req.Metadata, prompb.MetricMetadata{
+					MetricFamilyName: family,
+					Type:             ts.metricType,
+				})
+			}
+		}
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels:     labels,
+			Samples:    ts.samples,
+			Histograms: ts.histograms,
+		})
+	}
+	return req, nil
+}
+
+// metricFamilyName returns the name of the metric family that a series with the given
+// name and type belongs to.
+func metricFamilyName(name string, metricType prompb.MetricMetadata_MetricType) string {
+	var suffixes []string
+	switch metricType {
+	case prompb.MetricMetadata_HISTOGRAM, prompb.MetricMetadata_GAUGEHISTOGRAM:
+		suffixes = []string{"_bucket", "_count", "_sum"}
+	case prompb.MetricMetadata_SUMMARY:
+		suffixes = []string{"_count", "_sum"}
+	}
+	for _, s := range suffixes {
+		if strings.HasSuffix(name, s) {
+			return strings.TrimSuffix(name, s)
+		}
+	}
+	return name
+}
@@ -0,0 +1,175 @@
+package receiver
+
+import (
+	"bytes"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testV2Series struct {
+	labels     []string
+	metricType prompb.MetricMetadata_MetricType
+	values     []float64
+}
+
+// encodeWriteV2Request builds a snappy compressed remote write 2.0 request.
+func encodeWriteV2Request(series []testV2Series) []byte {
+	symbols := []string{""}
+	refs := map[string]uint32{"": 0}
+	symbolRef := func(s string) uint64 {
+		if ref, ok := refs[s]; ok {
+			return uint64(ref)
+		}
+		refs[s] = uint32(len(symbols))
+		symbols = append(symbols, s)
+		return uint64(refs[s])
+	}
+	var timeseries [][]byte
+	for _, s := range series {
+		var ts, packed []byte
+		for _, l := range s.labels {
+			packed = protowire.AppendVarint(packed, symbolRef(l))
+		}
+		ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, packed)
+		for i, v := range s.values {
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(v))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(1700000000000+int64(i)*20000))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sample)
+		}
+		var metadata []byte
+		metadata = protowire.AppendTag(metadata, 1, protowire.VarintType)
+		metadata = protowire.AppendVarint(metadata, uint64(s.metricType))
+		metadata = protowire.AppendTag(metadata, 3, protowire.VarintType)
+		metadata = protowire.AppendVarint(metadata, symbolRef("some help"))
+		ts = protowire.AppendTag(ts, 5, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, metadata)
+		// A created timestamp, which is skipped.
+		ts = protowire.AppendTag(ts, 6, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, 1600000000000)
+		timeseries = append(timeseries, ts)
+	}
+	var req []byte
+	for _, s := range symbols {
+		req = protowire.AppendTag(req, 4, protowire.BytesType)
+		req = protowire.AppendString(req, s)
+	}
+	for _, ts := range timeseries {
+		req = protowire.AppendTag(req, 5, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return snappy.Encode(nil, req)
+}
+
+func postRemoteWrite(processor *tsProcessor, body []byte, contentType string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("Content-Encoding", "snappy")
+	w := httptest.NewRecorder()
+	processor.ReceivePrometheusData(w, r)
+	return w
+}
+
+func TestReceiveRemoteWriteV2(t *testing.T) {
+	processor := newTestProcessor()
+	body := encodeWriteV2Request([]testV2Series{
+		{
+			labels:     []string{"__name__", "queue_length_total", "job", "api"},
+			metricType: prompb.MetricMetadata_GAUGE,
+			values:     []float64{3, 1},
+		},
+		{
+			labels:     []string{"__name__", "request_duration_seconds_count", "job", "api"},
+			metricType: prompb.MetricMetadata_HISTOGRAM,
+			values:     []float64{10},
+		},
+		{
+			labels:     []string{"__name__", "build", "job", "api", "version", "1.2"},
+			metricType: prompb.MetricMetadata_INFO,
+			values:     []float64{1, 1},
+		},
+	})
+	w := postRemoteWrite(processor, body, "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get(samplesWrittenHeader) != "3" || w.Header().Get(histogramsWrittenHeader) != "0" {
+		t.Errorf("expected three samples written but got headers %v", w.Header())
+	}
+
+	observations := drainObservations(processor)
+	if len(observations) != 2 {
+		t.Fatalf("expected the info metric to be skipped but got %v", observations)
+	}
+	gauge := model.Metric{"__name__": "queue_length_total", "job": "api"}
+	for name, o := range observations {
+		metric := metricFromName(t, name)
+		switch metric[model.MetricNameLabel] {
+		case "queue_length_total":
+			// The metadata says this is a gauge despite its name.
+			if len(o) != 2 || o[0].Value != 3 || o[0].Counter ||
+				o[0].MetricFingerprint != uint64(gauge.Fingerprint()) {
+				t.Errorf("unexpected gauge observations %v", o)
+			}
+			if o[1].Timestamp.Sub(o[0].Timestamp).Seconds() != 20 {
+				t.Errorf("unexpected timestamps %v and %v", o[0].Timestamp, o[1].Timestamp)
+			}
+		case "request_duration_seconds_count":
+			if o[0].Value != 10 || !o[0].Counter {
+				t.Errorf("unexpected histogram count %v", *o[0])
+			}
+		default:
+			t.Errorf("unexpected series %s", name)
+		}
+	}
+}
+
+func TestRemoteWriteNegotiation(t *testing.T) {
+	processor := newTestProcessor()
+	for contentType, expected := range map[string]int{
+		"application/x-protobuf;proto=io.prometheus.write.v3.Request": http.StatusUnsupportedMediaType,
+		"application/json": http.StatusUnsupportedMediaType,
+		"application/x-protobuf;proto=io.prometheus.write.v2.Request": http.StatusBadRequest,
+		"application/x-protobuf;proto=prometheus.WriteRequest":        http.StatusInternalServerError,
+	} {
+		w := postRemoteWrite(processor, []byte("not snappy"), contentType)
+		if w.Code != expected {
+			t.Errorf("expected status %d for %s but got %d", expected, contentType, w.Code)
+		}
+	}
+
+	// Label references have to point at symbols.
+	body := encodeWriteV2Request([]testV2Series{{labels: []string{"__name__", "up"}}})
+	req, err := decodeWriteV2Request(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	req.symbols = req.symbols[:2]
+	if _, err = req.toWriteRequest(); err == nil {
+		t.Errorf("expected an error for a label reference out of range")
+	}
+
+	// 1.0 requests still work.
+	v1 := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1700000000000}},
+	}}}
+	data, err := v1.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+	w := postRemoteWrite(processor, snappy.Encode(nil, data), "application/x-protobuf")
+	if w.Code != http.StatusOK || w.Header().Get(samplesWrittenHeader) != "1" {
+		t.Errorf("unexpected response %d with headers %v", w.Code, w.Header())
+	}
+}
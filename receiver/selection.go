@@ -0,0 +1,179 @@
+package receiver
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+	"os"
+	"time"
+)
+
+const (
+	// The reasons a series can be dropped for.
+	dropRelabel     = "relabel"
+	dropCardinality = "cardinality"
+)
+
+var (
+	droppedSeries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "corrjoin_dropped_series_total",
+			Help: "Total number of timeseries dropped at ingest, by the relabel rules or by the per-job cardinality cap.",
+		},
+		[]string{"reason"},
+	)
+	droppedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "corrjoin_dropped_samples_total",
+			Help: "Total number of samples of timeseries dropped at ingest.",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(droppedSeries)
+	prometheus.MustRegister(droppedSamples)
+}
+
+// LoadRelabelConfigs reads a yaml list of Prometheus relabel configs from path, in the
+// format of write_relabel_configs, for example
+//
+//   - source_labels: [__name__]
+//     regex: "go_.*|process_.*"
+//     action: drop
+//   - regex: "pod_template_hash|controller_revision_hash"
+//     action: labeldrop
+func LoadRelabelConfigs(path string) ([]*relabel.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []*relabel.Config
+	if err = yaml.UnmarshalStrict(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse relabel configs in %s: %v", path, err)
+	}
+	return configs, nil
+}
+
+// A seriesSelector decides which timeseries are observed. It relabels the timeseries
+// and keeps at most maxSeriesPerJob relabeled timeseries per job; the first ones it sees.
+// The decisions are cached by the fingerprint of the received labels.
+type seriesSelector struct {
+	configs         []*relabel.Config
+	maxSeriesPerJob int
+
+	expiryGuard
+	series map[model.Fingerprint]*selectedSeries
+	// fingerprint of a kept relabeled series -> number of received series that map to it.
+	// Only used with a cardinality cap.
+	keptSeries map[model.Fingerprint]int
+	// job -> number of kept relabeled series
+	jobSeries map[model.LabelValue]int
+}
+
+type selectedSeries struct {
+	// The relabeled metric, nil if the series is dropped.
+	metric model.Metric
+	// The fingerprint of metric.
+	fingerprint model.Fingerprint
+	dropReason  string
+	// The job of a series that was dropped by the cardinality cap.
+	job      model.LabelValue
+	lastSeen time.Time
+}
+
+func newSeriesSelector(configs []*relabel.Config, maxSeriesPerJob int) *seriesSelector {
+	return &seriesSelector{
+		configs:         configs,
+		maxSeriesPerJob: maxSeriesPerJob,
+		series:          make(map[model.Fingerprint]*selectedSeries),
+		keptSeries:      make(map[model.Fingerprint]int),
+		jobSeries:       make(map[model.LabelValue]int),
+	}
+}
+
+// selectSeries returns the relabeled metric, or nil if the series with the given samples
+// is dropped.
+func (s *seriesSelector) selectSeries(metric model.Metric, samples int, now time.Time) model.Metric {
+	fp := metric.Fingerprint()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	selected, ok := s.series[fp]
+	if !ok {
+		selected = s.decide(metric)
+		s.series[fp] = selected
+		if selected.metric == nil {
+			droppedSeries.WithLabelValues(selected.dropReason).Inc()
+		}
+	}
+	selected.lastSeen = now
+	if selected.metric == nil {
+		droppedSamples.WithLabelValues(selected.dropReason).Add(float64(samples))
+	}
+	return selected.metric
+}
+
+func (s *seriesSelector) decide(metric model.Metric) *selectedSeries {
+	relabeled := metric
+	if len(s.configs) > 0 {
+		lbls, keep := relabel.Process(labels.FromMap(modelToMap(metric)), s.configs...)
+		if !keep {
+			return &selectedSeries{dropReason: dropRelabel}
+		}
+		relabeled = make(model.Metric, lbls.Len())
+		lbls.Range(func(l labels.Label) {
+			relabeled[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		})
+	}
+	fp := relabeled.Fingerprint()
+	if s.maxSeriesPerJob > 0 {
+		// Received series that relabel to a kept series share its place in the cap.
+		if s.keptSeries[fp] == 0 {
+			job := relabeled[model.JobLabel]
+			if s.jobSeries[job] >= s.maxSeriesPerJob {
+				return &selectedSeries{dropReason: dropCardinality, job: job}
+			}
+			s.jobSeries[job]++
+		}
+		s.keptSeries[fp]++
+	}
+	return &selectedSeries{metric: relabeled, fingerprint: fp}
+}
+
+func modelToMap(metric model.Metric) map[string]string {
+	ret := make(map[string]string, len(metric))
+	for k, v := range metric {
+		ret[string(k)] = string(v)
+	}
+	return ret
+}
+
+// expire forgets the series that have not been seen since before. A relabeled series
+// frees its place in the cardinality cap of its job once all the received series that
+// map to it are forgotten. Series that were dropped by the cap are decided again once
+// their job has room.
+func (s *seriesSelector) expire(before time.Time) {
+	s.expireBefore(before, func() {
+		for fp, selected := range s.series {
+			if selected.lastSeen.Before(before) {
+				delete(s.series, fp)
+				if selected.metric != nil && s.maxSeriesPerJob > 0 {
+					s.keptSeries[selected.fingerprint]--
+					if s.keptSeries[selected.fingerprint] == 0 {
+						delete(s.keptSeries, selected.fingerprint)
+						s.jobSeries[selected.metric[model.JobLabel]]--
+					}
+				}
+			}
+		}
+		for fp, selected := range s.series {
+			if selected.dropReason == dropCardinality && s.jobSeries[selected.job] < s.maxSeriesPerJob {
+				delete(s.series, fp)
+			}
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package receiver
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeRelabelConfigs(t *testing.T, configs string) string {
+	tempdir, err := os.MkdirTemp("", "corrjoinTest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir")
+	}
+	t.Cleanup(func() { os.RemoveAll(tempdir) })
+	path := filepath.Join(tempdir, "relabel.yaml")
+	if err = os.WriteFile(path, []byte(configs), 0640); err != nil {
+		t.Fatalf("failed to write relabel configs: %v", err)
+	}
+	return path
+}
+
+func TestRelabeling(t *testing.T) {
+	path := writeRelabelConfigs(t, `
+- source_labels: [__name__]
+  regex: "go_.*"
+  action: drop
+- source_labels: [job]
+  regex: "api|db"
+  action: keep
+- regex: "pod_template_hash"
+  action: labeldrop
+- source_labels: [instance]
+  regex: "(.*):[0-9]+"
+  target_label: host
+  replacement: "$1"
+`)
+	configs, err := LoadRelabelConfigs(path)
+	if err != nil || len(configs) != 4 {
+		t.Fatalf("expected four relabel configs but got %v, %v", configs, err)
+	}
+	processor := newTestProcessor()
+	processor.selector = newSeriesSelector(configs, 0)
+	dropped := testutil.ToFloat64(droppedSeries.WithLabelValues(dropRelabel))
+
+	sample := []prompb.Sample{{Value: 1, Timestamp: 1700000000000}}
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		seriesWithLabels(sample, "__name__", "go_goroutines", "job", "api"),
+		seriesWithLabels(sample, "__name__", "up", "job", "node"),
+		seriesWithLabels(sample, "__name__", "up", "job", "api", "instance", "web-1:8080", "pod_template_hash", "5d8f"),
+	}}
+	for i := 0; i < 2; i++ {
+		written, _, err := processor.observeTs(req)
+		if err != nil || written != 1 {
+			t.Fatalf("expected one sample to be written but got %d, %v", written, err)
+		}
+	}
+	if d := testutil.ToFloat64(droppedSeries.WithLabelValues(dropRelabel)) - dropped; d != 2 {
+		t.Errorf("expected two dropped series but got %f", d)
+	}
+
+	observations := drainObservations(processor)
+	expected := model.Metric{"__name__": "up", "job": "api", "instance": "web-1:8080", "host": "web-1"}
+	if len(observations) != 1 {
+		t.Fatalf("expected one series but got %v", observations)
+	}
+	for name, o := range observations {
+		if !metricFromName(t, name).Equal(expected) || o[0].MetricFingerprint != uint64(expected.Fingerprint()) {
+			t.Errorf("expected the relabeled series %v but got %s", expected, name)
+		}
+	}
+
+	if _, err = LoadRelabelConfigs(writeRelabelConfigs(t, "- action: replace\n  regex: x\n")); err == nil {
+		t.Errorf("expected an error for a replace config without a target label")
+	}
+}
+
+func TestMaxSeriesPerJob(t *testing.T) {
+	s := newSeriesSelector(nil, 2)
+	now := time.Now()
+	metric := func(job string, instance string) model.Metric {
+		return model.Metric{"__name__": "up", "job": model.LabelValue(job), "instance": model.LabelValue(instance)}
+	}
+	for i, expected := range []bool{true, true, false} {
+		if kept := s.selectSeries(metric("api", string(rune('a'+i))), 1, now) != nil; kept != expected {
+			t.Errorf("expected series %d of the api job to be kept: %t", i, expected)
+		}
+	}
+	if s.selectSeries(metric("db", "a"), 1, now) == nil {
+		t.Errorf("expected the cap to be per job")
+	}
+	// The first series is gone for a window, so the third one gets its place.
+	later := now.Add(time.Hour)
+	s.selectSeries(metric("api", "b"), 1, later)
+	s.selectSeries(metric("api", "c"), 1, later)
+	s.expire(now.Add(time.Minute))
+	if s.selectSeries(metric("api", "c"), 1, later) == nil {
+		t.Errorf("expected the third series to be kept after the first one expired")
+	}
+	if s.selectSeries(metric("api", "a"), 1, later) != nil {
+		t.Errorf("expected the first series to be dropped after it came back")
+	}
+}
+
+func TestMaxSeriesPerJobAfterRelabeling(t *testing.T) {
+	configs, err := LoadRelabelConfigs(writeRelabelConfigs(t, "- regex: pod\n  action: labeldrop\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	s := newSeriesSelector(configs, 2)
+	now := time.Now()
+	metric := func(instance string, pod string) model.Metric {
+		return model.Metric{"__name__": "up", "job": "api", "instance": model.LabelValue(instance), "pod": model.LabelValue(pod)}
+	}
+	// The two pods of instance a are one series after relabeling, so they take one place.
+	for _, m := range []model.Metric{metric("a", "1"), metric("a", "2"), metric("b", "1")} {
+		if s.selectSeries(m, 1, now) == nil {
+			t.Errorf("expected %v to be kept", m)
+		}
+	}
+	if s.selectSeries(metric("c", "1"), 1, now) != nil {
+		t.Errorf("expected the third series of the api job to be dropped")
+	}
+
+	// Instance a keeps its place while one of its pods is still seen.
+	later := now.Add(time.Hour)
+	s.selectSeries(metric("a", "2"), 1, later)
+	s.selectSeries(metric("b", "1"), 1, later)
+	s.expire(now.Add(time.Minute))
+	if s.selectSeries(metric("c", "1"), 1, later) != nil {
+		t.Errorf("expected the third series to be dropped while both places are taken")
+	}
+	evenLater := later.Add(time.Hour)
+	s.selectSeries(metric("b", "1"), 1, evenLater)
+	s.expire(later.Add(time.Minute))
+	if s.selectSeries(metric("c", "1"), 1, evenLater) == nil {
+		t.Errorf("expected the third series to be kept once instance a expired")
+	}
+}